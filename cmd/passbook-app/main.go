@@ -3,6 +3,9 @@ package main
 import (
 	"log"
 	"os"
+	"time"
+	// the release image has no tz database, users pick the time zone of their statements
+	_ "time/tzdata"
 
 	"github.com/akashsharma99/passbook-app/internal/initializers"
 	"github.com/akashsharma99/passbook-app/internal/routes"
@@ -26,6 +29,21 @@ func main() {
 	// intialize the database connection pool
 	initializers.InitializeDBConnection()
 
+	// set up the sender of emails like password reset links
+	initializers.InitializeMailer()
+
+	// load the keys signing the tokens, rotated by the background jobs
+	initializers.InitializeTokenKeys()
+
+	// share the failed login counters between instances when configured
+	initializers.InitializeLoginLimiters()
+
+	// the identity provider users can log in with, if any
+	initializers.InitializeOIDC()
+
+	// start the periodic maintenance jobs like purging expired trash
+	routes.StartBackgroundJobs(time.Hour)
+
 	// initialize the router
 	router := routes.NewRouter()
 	router.Run(":8080")
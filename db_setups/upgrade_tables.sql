@@ -0,0 +1,230 @@
+-- brings a database created with an earlier version of create_tables.sql up to date, new databases are created with
+-- create_tables.sql instead. Every statement can be run again, so the whole script is run after each update of the
+-- app. It runs in one transaction so a failure leaves the database as it was.
+begin;
+-- transactions: trash
+alter table passbook_app.transactions add column if not exists deleted_at timestamp with time zone;
+-- transactions: transfers between two passbooks
+alter table passbook_app.transactions add column if not exists transfer_id uuid;
+create index if not exists transactions_transfer_id_idx on passbook_app.transactions (transfer_id) where transfer_id is not null;
+-- create import_profiles table holding the CSV column mappings of bank statements
+create table if not exists
+  passbook_app.import_profiles (
+    profile_id uuid primary key DEFAULT gen_random_uuid(),
+    user_id uuid references passbook_app.users(user_id) not null,
+    name VARCHAR(255) NOT NULL,
+    delimiter VARCHAR(4) NOT NULL,
+    has_header BOOLEAN NOT NULL,
+    skip_rows INTEGER NOT NULL,
+    date_column VARCHAR(255) NOT NULL,
+    date_format VARCHAR(255) NOT NULL,
+    amount_column VARCHAR(255) NOT NULL,
+    debit_column VARCHAR(255) NOT NULL,
+    credit_column VARCHAR(255) NOT NULL,
+    party_column VARCHAR(255) NOT NULL,
+    description_column VARCHAR(255) NOT NULL,
+    decimal_separator VARCHAR(1) NOT NULL,
+    tags VARCHAR(512) NOT NULL,
+    created_at timestamp with time zone not null,
+    updated_at timestamp with time zone not null,
+    constraint unique_import_profile_name unique (user_id, name)
+  );
+-- transactions: external ids of imported statements
+alter table passbook_app.transactions add column if not exists external_id VARCHAR(255);
+create unique index if not exists transactions_external_id_idx on passbook_app.transactions (passbook_id, external_id) where external_id is not null;
+-- create purged_imports table, external ids of imported transactions that were purged from trash so importing the
+-- same statement again does not bring them back
+create table if not exists
+  passbook_app.purged_imports (
+    passbook_id uuid references passbook_app.passbooks(passbook_id) not null,
+    user_id uuid references passbook_app.users(user_id) not null,
+    external_id VARCHAR(255) not null,
+    purged_at timestamp with time zone not null,
+    primary key (passbook_id, external_id)
+  );
+-- create sessions table, every login on a device is a session holding the current refresh token of that device
+create table if not exists
+  passbook_app.sessions (
+    session_id uuid primary key DEFAULT gen_random_uuid(),
+    user_id uuid references passbook_app.users(user_id) not null,
+    rtoken TEXT NOT NULL,
+    device_name VARCHAR(255) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    created_at timestamp with time zone not null,
+    last_used_at timestamp with time zone not null
+  );
+create index if not exists sessions_user_id_idx on passbook_app.sessions (user_id);
+-- refresh tokens now live in sessions, the old tokens are dropped so every user logs in once again
+drop table if exists passbook_app.tokens;
+-- sessions: refresh tokens stored hashed, sessions created before keep working as their token is hashed in place
+alter table passbook_app.sessions add column if not exists rtoken_hash VARCHAR(64);
+do $$
+begin
+  if exists (select 1 from information_schema.columns where table_schema = 'passbook_app' and table_name = 'sessions' and column_name = 'rtoken') then
+    update passbook_app.sessions set rtoken_hash = encode(sha256(convert_to(rtoken, 'UTF8')), 'hex');
+    alter table passbook_app.sessions drop column rtoken;
+  end if;
+end $$;
+alter table passbook_app.sessions alter column rtoken_hash set not null;
+-- create rotated_tokens table, hashes of the refresh tokens a session already rotated away from. A session and its
+-- rotated tokens form a rotation family, presenting one of these tokens again revokes the whole family
+create table if not exists
+  passbook_app.rotated_tokens (
+    token_hash VARCHAR(64) primary key,
+    session_id uuid references passbook_app.sessions(session_id) on delete cascade not null,
+    rotated_at timestamp with time zone not null
+  );
+create index if not exists rotated_tokens_session_id_idx on passbook_app.rotated_tokens (session_id);
+-- create security_events table, audit trail of suspicious activity on an account
+create table if not exists
+  passbook_app.security_events (
+    event_id uuid primary key DEFAULT gen_random_uuid(),
+    user_id uuid references passbook_app.users(user_id) not null,
+    event_type VARCHAR(64) NOT NULL,
+    session_id uuid,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL,
+    details TEXT NOT NULL,
+    created_at timestamp with time zone not null
+  );
+create index if not exists security_events_user_id_idx on passbook_app.security_events (user_id, created_at);
+-- create password_resets table, hashes of the single use tokens of the password reset links sent by email
+create table if not exists
+  passbook_app.password_resets (
+    token_hash VARCHAR(64) primary key,
+    user_id uuid references passbook_app.users(user_id) not null,
+    expires_at timestamp with time zone not null,
+    used_at timestamp with time zone,
+    created_at timestamp with time zone not null
+  );
+create index if not exists password_resets_user_id_idx on passbook_app.password_resets (user_id);
+-- users: verified email addresses
+alter table passbook_app.users add column if not exists email_verified_at timestamp with time zone;
+-- create email_verifications table, hashes of the tokens of the verification links sent to the email of a user
+create table if not exists
+  passbook_app.email_verifications (
+    token_hash VARCHAR(64) primary key,
+    user_id uuid references passbook_app.users(user_id) not null,
+    email VARCHAR(255) NOT NULL,
+    expires_at timestamp with time zone not null,
+    created_at timestamp with time zone not null
+  );
+create index if not exists email_verifications_user_id_idx on passbook_app.email_verifications (user_id, created_at);
+-- users: two-factor authentication
+alter table passbook_app.users add column if not exists totp_secret TEXT;
+alter table passbook_app.users add column if not exists totp_enabled_at timestamp with time zone;
+alter table passbook_app.users add column if not exists totp_last_counter BIGINT NOT NULL DEFAULT 0;
+-- create recovery_codes table, hashes of the one time codes to log in when the authenticator app is lost
+create table if not exists
+  passbook_app.recovery_codes (
+    code_hash VARCHAR(64) NOT NULL,
+    user_id uuid references passbook_app.users(user_id) not null,
+    used_at timestamp with time zone,
+    created_at timestamp with time zone not null,
+    primary key (user_id, code_hash)
+  );
+-- create login_attempts table, failed login counters per username and client IP shared by all instances of the app
+create table if not exists
+  passbook_app.login_attempts (
+    attempt_key VARCHAR(512) primary key,
+    failures INTEGER NOT NULL,
+    last_failed_at timestamp with time zone not null
+  );
+-- create signing_keys table, the private keys signing the tokens of the app as PKCS #8, rotated by the app
+create table if not exists
+  passbook_app.signing_keys (
+    kid VARCHAR(64) primary key,
+    algorithm VARCHAR(10) not null,
+    private_key BYTEA not null,
+    not_before timestamp with time zone not null,
+    created_at timestamp with time zone not null
+  );
+-- create personal_access_tokens table, long lived tokens of scripts stored as SHA-256 hashes
+create table if not exists
+  passbook_app.personal_access_tokens (
+    token_id uuid primary key DEFAULT gen_random_uuid(),
+    user_id uuid references passbook_app.users(user_id) not null,
+    name VARCHAR(100) not null,
+    token_hash VARCHAR(64) unique not null,
+    token_prefix VARCHAR(16) not null,
+    scopes TEXT[] not null,
+    -- null when the token may use all passbooks of the user
+    passbook_ids uuid[],
+    expires_at timestamp with time zone,
+    last_used_at timestamp with time zone,
+    created_at timestamp with time zone not null
+  );
+create index if not exists personal_access_tokens_user_id_idx on passbook_app.personal_access_tokens (user_id);
+-- create user_identities table, the accounts at OpenID Connect providers users log in with
+create table if not exists
+  passbook_app.user_identities (
+    identity_id uuid primary key DEFAULT gen_random_uuid(),
+    user_id uuid references passbook_app.users(user_id) not null,
+    issuer VARCHAR(255) not null,
+    subject VARCHAR(255) not null,
+    email VARCHAR(255) not null,
+    created_at timestamp with time zone not null,
+    last_login_at timestamp with time zone,
+    unique (issuer, subject)
+  );
+create index if not exists user_identities_user_id_idx on passbook_app.user_identities (user_id);
+-- create oidc_login_states table, logins started at the OpenID Connect provider by the hash of their state
+create table if not exists
+  passbook_app.oidc_login_states (
+    state_hash VARCHAR(64) primary key,
+    nonce VARCHAR(64) not null,
+    code_verifier VARCHAR(128) not null,
+    device_name VARCHAR(255) not null,
+    -- set when a logged in user links an identity instead of logging in
+    user_id uuid references passbook_app.users(user_id),
+    expires_at timestamp with time zone not null,
+    created_at timestamp with time zone not null
+  );
+-- create account_deletions table, users who asked to delete their account and when their data is purged
+create table if not exists
+  passbook_app.account_deletions (
+    user_id uuid primary key references passbook_app.users(user_id),
+    requested_at timestamp with time zone not null,
+    purge_after timestamp with time zone not null
+  );
+-- create user_preferences table, how amounts and dates are shown to a user, users without a row get the defaults of the app
+create table if not exists
+  passbook_app.user_preferences (
+    user_id uuid primary key references passbook_app.users(user_id),
+    -- ISO 4217 code
+    currency VARCHAR(3) not null,
+    -- IANA time zone like Asia/Kolkata, days of statements and date filters start at midnight in this zone
+    time_zone VARCHAR(64) not null,
+    locale VARCHAR(16) not null,
+    date_format VARCHAR(16) not null,
+    updated_at timestamp with time zone not null
+  );
+-- passbooks: currencies, existing passbooks get the preferred currency of their user or INR
+alter table passbook_app.passbooks add column if not exists currency VARCHAR(3);
+update passbook_app.passbooks p set currency = coalesce((select up.currency from passbook_app.user_preferences up where up.user_id = p.user_id), 'INR') where p.currency is null;
+alter table passbook_app.passbooks alter column currency set not null;
+-- create exchange_rates table, rates loaded by a user to convert between the currencies of their passbooks
+create table if not exists
+  passbook_app.exchange_rates (
+    rate_id uuid primary key DEFAULT gen_random_uuid(),
+    user_id uuid references passbook_app.users(user_id) not null,
+    base_currency VARCHAR(3) not null,
+    quote_currency VARCHAR(3) not null,
+    -- day the rate applies from, conversions as of a date use the latest rate on or before it
+    rate_date date not null,
+    -- units of the quote currency for one unit of the base currency
+    rate NUMERIC(18,8) not null,
+    created_at timestamp with time zone not null,
+    constraint unique_exchange_rate unique (user_id, base_currency, quote_currency, rate_date)
+  );
+-- create account_deletion_confirmations table, hashes of the tokens of the links confirming the deletion of an account without a password
+create table if not exists
+  passbook_app.account_deletion_confirmations (
+    token_hash VARCHAR(64) primary key,
+    user_id uuid references passbook_app.users(user_id) not null,
+    expires_at timestamp with time zone not null,
+    created_at timestamp with time zone not null
+  );
+create index if not exists account_deletion_confirmations_user_id_idx on passbook_app.account_deletion_confirmations (user_id);
+commit;
@@ -0,0 +1,41 @@
+package exporters
+
+import (
+	"encoding/csv"
+	"io"
+	"time"
+)
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (Writer, error) {
+	cw := &csvWriter{w: csv.NewWriter(w)}
+	if err := cw.w.Write(columns); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(row Row) error {
+	return cw.w.Write([]string{
+		row.TransactionID,
+		row.TransactionDate.Format(time.RFC3339),
+		row.PassbookID,
+		row.PassbookName,
+		row.TransactionType,
+		row.Amount.String(),
+		row.Currency,
+		row.PartyName,
+		row.Description,
+		row.Tags,
+		stringValue(row.TransferID),
+		row.RunningBalance.String(),
+	})
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
@@ -0,0 +1,90 @@
+// Package exporters streams transactions into downloadable files, rows are written one at a time so exports of any size use constant memory.
+package exporters
+
+import (
+	"errors"
+	"io"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+)
+
+// ErrUnknownFormat is returned by New for formats that are not supported
+var ErrUnknownFormat = errors.New("unknown export format")
+
+/*
+Row is a transaction with the name of its passbook and the balance of the passbook right after the transaction. The
+transaction date is written in its own time zone, callers move it into the time zone of the user.
+*/
+type Row struct {
+	types.Transaction
+	PassbookName   string      `json:"passbook_name"`
+	RunningBalance types.Money `json:"running_balance"`
+	// ISO 4217 code of the amount and the running balance
+	Currency string `json:"currency"`
+}
+
+// Writer writes rows of an export, Close has to be called after the last row to complete the file
+type Writer interface {
+	Write(row Row) error
+	Close() error
+}
+
+// columns of the tabular export formats
+var columns = []string{
+	"transaction_id",
+	"transaction_date",
+	"passbook_id",
+	"passbook_name",
+	"transaction_type",
+	"amount",
+	"currency",
+	"party_name",
+	"description",
+	"tags",
+	"transfer_id",
+	"running_balance",
+}
+
+type format struct {
+	contentType string
+	extension   string
+	open        func(w io.Writer) (Writer, error)
+}
+
+var formats = map[string]format{
+	"csv":    {contentType: "text/csv; charset=utf-8", extension: "csv", open: newCSVWriter},
+	"ndjson": {contentType: "application/x-ndjson", extension: "ndjson", open: newNDJSONWriter},
+	"xlsx":   {contentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", extension: "xlsx", open: newXLSXWriter},
+}
+
+// IsFormat reports whether the format is supported
+func IsFormat(name string) bool {
+	_, ok := formats[name]
+	return ok
+}
+
+// ContentType of the files of a format
+func ContentType(name string) string {
+	return formats[name].contentType
+}
+
+// Extension of the files of a format, without the leading dot
+func Extension(name string) string {
+	return formats[name].extension
+}
+
+// New returns a Writer writing the export in the given format to w
+func New(name string, w io.Writer) (Writer, error) {
+	f, ok := formats[name]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return f.open(w)
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,193 @@
+package exporters
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/locale"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func sampleRows() []Row {
+	transferID := "transfer-1"
+	date := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	return []Row{
+		{
+			Transaction: types.Transaction{
+				TransactionID:   "tr-1",
+				Amount:          types.Money(150000),
+				TransactionDate: date,
+				TransactionType: "CREDIT",
+				PartyName:       "ACME & Sons",
+				Description:     "Salary, April",
+				Tags:            "salary",
+				PassbookID:      "pb-1",
+			},
+			PassbookName:   "Savings",
+			RunningBalance: types.Money(250000),
+			Currency:       "INR",
+		},
+		{
+			Transaction: types.Transaction{
+				TransactionID:   "tr-2",
+				Amount:          types.Money(2050),
+				TransactionDate: date.AddDate(0, 0, 1),
+				TransactionType: "DEBIT",
+				PartyName:       "Wallet",
+				PassbookID:      "pb-1",
+				TransferID:      &transferID,
+			},
+			PassbookName:   "Savings",
+			RunningBalance: types.Money(247950),
+			Currency:       "INR",
+		},
+	}
+}
+
+func export(t *testing.T, format string) []byte {
+	var buf bytes.Buffer
+	w, err := New(format, &buf)
+	assert.NoError(t, err)
+	for _, row := range sampleRows() {
+		assert.NoError(t, w.Write(row))
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestCSVExport(t *testing.T) {
+	out := string(export(t, "csv"))
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, strings.Join(columns, ","), lines[0])
+	assert.Equal(t, `tr-1,2024-04-01T12:00:00Z,pb-1,Savings,CREDIT,1500.00,INR,ACME & Sons,"Salary, April",salary,,2500.00`, lines[1])
+	assert.Equal(t, `tr-2,2024-04-02T12:00:00Z,pb-1,Savings,DEBIT,20.50,INR,Wallet,,,transfer-1,2479.50`, lines[2])
+}
+
+func TestCSVExportKeepsTimeZone(t *testing.T) {
+	row := sampleRows()[0]
+	row.TransactionDate = row.TransactionDate.In(time.FixedZone("IST", 5*3600+1800))
+	var buf bytes.Buffer
+	w, err := New("csv", &buf)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Write(row))
+	assert.NoError(t, w.Close())
+	assert.Contains(t, buf.String(), "tr-1,2024-04-01T17:30:00+05:30,")
+}
+
+func TestNDJSONExport(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(string(export(t, "ndjson"))), "\n")
+	assert.Len(t, lines, 2)
+	var row map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &row))
+	assert.Equal(t, "tr-2", row["transaction_id"])
+	assert.Equal(t, 20.5, row["amount"])
+	assert.Equal(t, 2479.5, row["running_balance"])
+	assert.Equal(t, "Savings", row["passbook_name"])
+	assert.Equal(t, "transfer-1", row["transfer_id"])
+	assert.Equal(t, "INR", row["currency"])
+}
+
+func TestXLSXExport(t *testing.T) {
+	out := export(t, "xlsx")
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	assert.NoError(t, err)
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+	assert.Contains(t, files, "[Content_Types].xml")
+	assert.Contains(t, files, "xl/workbook.xml")
+	assert.Contains(t, files, "xl/styles.xml")
+	sheet := files["xl/worksheets/sheet1.xml"]
+	assert.Equal(t, 3, strings.Count(sheet, "<row "))
+	assert.Contains(t, sheet, `<t xml:space="preserve">ACME &amp; Sons</t>`)
+	assert.Contains(t, sheet, `<c s="2"><v>1500.00</v></c>`)
+	assert.Contains(t, sheet, `<t xml:space="preserve">INR</t>`)
+	// 2024-04-01 12:00 UTC
+	assert.Contains(t, sheet, `<c s="1"><v>45383.500000</v></c>`)
+	assert.True(t, strings.HasSuffix(sheet, "</sheetData></worksheet>"))
+}
+
+func TestUnknownFormat(t *testing.T) {
+	_, err := New("pdf", io.Discard)
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+	assert.False(t, IsFormat("pdf"))
+	assert.True(t, IsFormat("xlsx"))
+}
+
+func TestStatementTotals(t *testing.T) {
+	s := Statement{OpeningBalance: types.Money(100000), Rows: sampleRows()}
+	credit, debit, closing := s.Totals()
+	assert.Equal(t, types.Money(150000), credit)
+	assert.Equal(t, types.Money(2050), debit)
+	assert.Equal(t, types.Money(247950), closing)
+}
+
+func TestWriteStatementPDF(t *testing.T) {
+	rows := make([]Row, 0)
+	// enough rows to need a second page
+	for i := 0; i < 30; i++ {
+		rows = append(rows, sampleRows()...)
+	}
+	var buf bytes.Buffer
+	err := WriteStatementPDF(&buf, Statement{
+		PassbookName:   "Savings (main)",
+		BankName:       "Test Bank",
+		AccountNumber:  "123512",
+		Month:          time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+		OpeningBalance: types.Money(100000),
+		Rows:           rows,
+		GeneratedAt:    time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC),
+	})
+	assert.NoError(t, err)
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "%PDF-1.4"))
+	assert.True(t, strings.HasSuffix(out, "%%EOF\n"))
+	assert.Contains(t, out, "/Count 2")
+	assert.Contains(t, out, `(Savings \(main\))`)
+	assert.Contains(t, out, "(Page 2 of 2)")
+	assert.Contains(t, out, "(01 Apr 2024 - 30 Apr 2024)")
+	// closing balance after 30 salaries and 30 coffees
+	assert.Contains(t, out, "(45385.00)")
+	// the xref table points at the objects
+	xref := strings.Index(out, "\nxref\n")
+	assert.Contains(t, out[xref:], "0000000015 00000 n")
+	assert.True(t, strings.HasPrefix(out[15:], "1 0 obj"))
+}
+
+func TestWriteStatementPDFWithPreferences(t *testing.T) {
+	format, err := locale.New(types.Preferences{Currency: "EUR", TimeZone: "Europe/Berlin", Locale: "de-DE", DateFormat: "DD.MM.YYYY"})
+	assert.NoError(t, err)
+	month := time.Date(2024, 4, 1, 0, 0, 0, 0, format.Location)
+	rows := sampleRows()
+	// 22:00 in Berlin, the last day of the month
+	rows[0].TransactionDate = time.Date(2024, 4, 30, 20, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	err = WriteStatementPDF(&buf, Statement{
+		PassbookName:   "Savings",
+		Month:          month,
+		OpeningBalance: types.Money(123456789),
+		Rows:           rows[:1],
+		GeneratedAt:    time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC),
+		Format:         format,
+	})
+	assert.NoError(t, err)
+	out := buf.String()
+	assert.Contains(t, out, "(01.04.2024 - 30.04.2024)")
+	assert.Contains(t, out, "(30.04.2024)")
+	assert.Contains(t, out, "(EUR 1.234.567,89)")
+	assert.Contains(t, out, "(1.500,00)")
+	assert.Contains(t, out, "(Generated on 01.05.2024 11:00 CEST)")
+}
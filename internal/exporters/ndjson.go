@@ -0,0 +1,23 @@
+package exporters
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ndjsonWriter writes one JSON object per line
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) (Writer, error) {
+	return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+}
+
+func (nw *ndjsonWriter) Write(row Row) error {
+	return nw.enc.Encode(row)
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package exporters
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/locale"
+	"github.com/akashsharma99/passbook-app/internal/pdf"
+	"github.com/akashsharma99/passbook-app/internal/types"
+)
+
+// Statement is a monthly statement of a passbook, rows are oldest first and carry the balance after each transaction
+type Statement struct {
+	PassbookName   string
+	BankName       string
+	AccountNumber  string
+	Month          time.Time
+	OpeningBalance types.Money
+	Rows           []Row
+	GeneratedAt    time.Time
+	// how dates and amounts are shown, Month is midnight in its time zone
+	Format locale.Format
+}
+
+// Totals of the CREDIT and DEBIT transactions of the statement and the resulting closing balance
+func (s Statement) Totals() (credit types.Money, debit types.Money, closing types.Money) {
+	for _, row := range s.Rows {
+		if row.TransactionType == "CREDIT" {
+			credit += row.Amount
+		} else {
+			debit += row.Amount
+		}
+	}
+	return credit, debit, s.OpeningBalance + credit - debit
+}
+
+// layout of the statement in points
+const (
+	marginLeft   = 40.0
+	marginRight  = pdf.PageWidth - 40
+	marginTop    = pdf.PageHeight - 50
+	marginBottom = 60.0
+	rowHeight    = 15.0
+	fontSize     = 9.0
+	// right edges of the amount columns
+	debitColumn   = 395.0
+	creditColumn  = 475.0
+	balanceColumn = marginRight
+	detailsColumn = 100.0
+	detailsWidth  = 225.0
+)
+
+/*
+WriteStatementPDF writes a bank style statement with the opening balance, one line per transaction with the running
+balance, the totals of credits and debits and the closing balance. The transaction table continues on as many
+pages as needed, every page repeats the table header and is numbered.
+*/
+func WriteStatementPDF(w io.Writer, s Statement) error {
+	credit, debit, closing := s.Totals()
+	doc := &pdf.Document{}
+	page := doc.AddPage()
+	y := marginTop
+	page.Text(marginLeft, y, pdf.HelveticaBold, 18, "Statement of Account")
+	page.TextRight(marginRight, y, pdf.Helvetica, fontSize, "Generated on "+s.Format.Date(s.GeneratedAt)+" "+s.Format.In(s.GeneratedAt).Format("15:04 MST"))
+	y -= 28
+	details := [][2]string{
+		{"Passbook", s.PassbookName},
+		{"Bank", s.BankName},
+		{"Account number", s.AccountNumber},
+		{"Period", s.Format.Date(s.Month) + " - " + s.Format.Date(s.Month.AddDate(0, 1, -1))},
+	}
+	if s.Format.Currency != "" {
+		details = append(details, [2]string{"Currency", s.Format.Currency})
+	}
+	for _, d := range details {
+		page.Text(marginLeft, y, pdf.HelveticaBold, 10, d[0])
+		page.Text(marginLeft+100, y, pdf.Helvetica, 10, pdf.Truncate(pdf.Helvetica, 10, d[1], 300))
+		y -= 15
+	}
+	y -= 10
+	summary := [][2]string{
+		{"Opening balance", s.Format.Money(s.OpeningBalance)},
+		{"Total credits", s.Format.Money(credit)},
+		{"Total debits", s.Format.Money(debit)},
+		{"Closing balance", s.Format.Money(closing)},
+	}
+	page.Rect(marginLeft, y-float64(len(summary))*15+5, marginRight-marginLeft, float64(len(summary))*15+10, 0.93)
+	for _, line := range summary {
+		page.Text(marginLeft+10, y-5, pdf.HelveticaBold, 10, line[0])
+		page.TextRight(marginRight-10, y-5, pdf.Helvetica, 10, line[1])
+		y -= 15
+	}
+	y -= 25
+	y = statementTableHeader(page, y)
+	page.Text(marginLeft, y, pdf.Helvetica, fontSize, s.Format.Date(s.Month))
+	page.Text(detailsColumn, y, pdf.HelveticaBold, fontSize, "Opening balance")
+	page.TextRight(balanceColumn, y, pdf.Helvetica, fontSize, s.Format.Number(s.OpeningBalance))
+	y -= rowHeight
+	for _, row := range s.Rows {
+		if y < marginBottom {
+			page = doc.AddPage()
+			y = statementTableHeader(page, marginTop)
+		}
+		page.Text(marginLeft, y, pdf.Helvetica, fontSize, s.Format.Date(row.TransactionDate))
+		text := row.PartyName
+		if row.Description != "" {
+			text += " - " + row.Description
+		}
+		page.Text(detailsColumn, y, pdf.Helvetica, fontSize, pdf.Truncate(pdf.Helvetica, fontSize, text, detailsWidth))
+		if row.TransactionType == "CREDIT" {
+			page.TextRight(creditColumn, y, pdf.Helvetica, fontSize, s.Format.Number(row.Amount))
+		} else {
+			page.TextRight(debitColumn, y, pdf.Helvetica, fontSize, s.Format.Number(row.Amount))
+		}
+		page.TextRight(balanceColumn, y, pdf.Helvetica, fontSize, s.Format.Number(row.RunningBalance))
+		y -= rowHeight
+	}
+	if y < marginBottom+rowHeight {
+		page = doc.AddPage()
+		y = statementTableHeader(page, marginTop)
+	}
+	page.Line(marginLeft, y+rowHeight-4, marginRight, y+rowHeight-4, 0.5)
+	page.Text(detailsColumn, y, pdf.HelveticaBold, fontSize, "Totals and closing balance")
+	page.TextRight(debitColumn, y, pdf.HelveticaBold, fontSize, s.Format.Number(debit))
+	page.TextRight(creditColumn, y, pdf.HelveticaBold, fontSize, s.Format.Number(credit))
+	page.TextRight(balanceColumn, y, pdf.HelveticaBold, fontSize, s.Format.Number(closing))
+	// number the pages once the total is known
+	for i := 0; i < doc.PageCount(); i++ {
+		doc.Page(i).TextRight(marginRight, 30, pdf.Helvetica, 8, "Page "+strconv.Itoa(i+1)+" of "+strconv.Itoa(doc.PageCount()))
+		doc.Page(i).Text(marginLeft, 30, pdf.Helvetica, 8, s.PassbookName+" - "+s.Month.Format("January 2006"))
+	}
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// draw the header of the transaction table and return the y of the first row
+func statementTableHeader(page *pdf.Page, y float64) float64 {
+	page.Rect(marginLeft, y-4, marginRight-marginLeft, rowHeight, 0.85)
+	page.Text(marginLeft, y, pdf.HelveticaBold, fontSize, "Date")
+	page.Text(detailsColumn, y, pdf.HelveticaBold, fontSize, "Details")
+	page.TextRight(debitColumn, y, pdf.HelveticaBold, fontSize, "Debit")
+	page.TextRight(creditColumn, y, pdf.HelveticaBold, fontSize, "Credit")
+	page.TextRight(balanceColumn, y, pdf.HelveticaBold, fontSize, "Balance")
+	return y - rowHeight - 2
+}
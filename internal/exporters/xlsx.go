@@ -0,0 +1,120 @@
+package exporters
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// static parts of the workbook, the single worksheet is streamed after them
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/><Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Transactions" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`},
+	// cell style 1 formats dates and cell style 2 amounts with two decimals
+	{"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts><fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts><fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills><borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders><cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs><cellXfs count="3"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="4" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs></styleSheet>`},
+}
+
+const (
+	xlsxDateStyle   = 1
+	xlsxAmountStyle = 2
+)
+
+/*
+xlsxWriter writes a minimal Office Open XML workbook with a single sheet. The zip entries are compressed as they
+are written, so the sheet is streamed row by row with inline strings instead of a shared string table.
+*/
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	row   int
+}
+
+func newXLSXWriter(w io.Writer) (Writer, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+	f, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	xw := &xlsxWriter{zw: zw, sheet: bufio.NewWriter(f)}
+	xw.sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	xw.startRow()
+	for _, column := range columns {
+		xw.stringCell(column)
+	}
+	return xw, xw.endRow()
+}
+
+func (xw *xlsxWriter) Write(row Row) error {
+	xw.startRow()
+	xw.stringCell(row.TransactionID)
+	xw.dateCell(row.TransactionDate)
+	xw.stringCell(row.PassbookID)
+	xw.stringCell(row.PassbookName)
+	xw.stringCell(row.TransactionType)
+	xw.numberCell(row.Amount.String(), xlsxAmountStyle)
+	xw.stringCell(row.Currency)
+	xw.stringCell(row.PartyName)
+	xw.stringCell(row.Description)
+	xw.stringCell(row.Tags)
+	xw.stringCell(stringValue(row.TransferID))
+	xw.numberCell(row.RunningBalance.String(), xlsxAmountStyle)
+	return xw.endRow()
+}
+
+func (xw *xlsxWriter) Close() error {
+	xw.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := xw.sheet.Flush(); err != nil {
+		return err
+	}
+	return xw.zw.Close()
+}
+
+func (xw *xlsxWriter) startRow() {
+	xw.row++
+	fmt.Fprintf(xw.sheet, `<row r="%d">`, xw.row)
+}
+
+// end the current row, the buffered sheet is only flushed when it is full so the returned error is the first write error
+func (xw *xlsxWriter) endRow() error {
+	_, err := xw.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (xw *xlsxWriter) stringCell(s string) {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(s))
+	fmt.Fprintf(xw.sheet, `<c t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, escaped.String())
+}
+
+func (xw *xlsxWriter) numberCell(value string, style int) {
+	fmt.Fprintf(xw.sheet, `<c s="%d"><v>%s</v></c>`, style, value)
+}
+
+// dates are stored as days since 1899-12-30, the epoch spreadsheet applications use. Cells have no time zone so
+// the clock time of t in its own zone is stored
+func (xw *xlsxWriter) dateCell(t time.Time) {
+	_, offset := t.Zone()
+	days := float64(t.Unix()+int64(offset))/86400 + 25569
+	fmt.Fprintf(xw.sheet, `<c s="%d"><v>%.6f</v></c>`, xlsxDateStyle, days)
+}
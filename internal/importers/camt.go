@@ -0,0 +1,224 @@
+package importers
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+)
+
+// the parts of an ISO 20022 camt.053 document needed for an import, element names match any namespace version
+type camtDocument struct {
+	Statements []camtStatement `xml:"BkToCstmrStmt>Stmt"`
+}
+
+type camtStatement struct {
+	ID   string `xml:"Id"`
+	Acct struct {
+		IBAN  string `xml:"Id>IBAN"`
+		Other string `xml:"Id>Othr>Id"`
+		Ccy   string `xml:"Ccy"`
+	} `xml:"Acct"`
+	Balances []camtBalance `xml:"Bal"`
+	Entries  []camtEntry   `xml:"Ntry"`
+}
+
+type camtAmount struct {
+	Value string `xml:",chardata"`
+	Ccy   string `xml:"Ccy,attr"`
+}
+
+type camtDate struct {
+	Date     string `xml:"Dt"`
+	DateTime string `xml:"DtTm"`
+}
+
+type camtBalance struct {
+	Code      string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount    camtAmount `xml:"Amt"`
+	CdtDbtInd string     `xml:"CdtDbtInd"`
+	Date      camtDate   `xml:"Dt"`
+}
+
+type camtParty struct {
+	Name string `xml:"Nm"`
+	// camt.053.001.08 and later wrap the party in Pty
+	PartyName string `xml:"Pty>Nm"`
+}
+
+func (p camtParty) name() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return p.PartyName
+}
+
+// entry status, a plain code before camt.053.001.08 and a Cd element from then on
+type camtStatus struct {
+	Value string `xml:",chardata"`
+	Code  string `xml:"Cd"`
+}
+
+type camtEntry struct {
+	NtryRef     string     `xml:"NtryRef"`
+	Amount      camtAmount `xml:"Amt"`
+	CdtDbtInd   string     `xml:"CdtDbtInd"`
+	Status      camtStatus `xml:"Sts"`
+	BookingDate camtDate   `xml:"BookgDt"`
+	ValueDate   camtDate   `xml:"ValDt"`
+	AcctSvcrRef string     `xml:"AcctSvcrRef"`
+	AddtlInf    string     `xml:"AddtlNtryInf"`
+	Details     []struct {
+		AcctSvcrRef string    `xml:"Refs>AcctSvcrRef"`
+		Debtor      camtParty `xml:"RltdPties>Dbtr"`
+		Creditor    camtParty `xml:"RltdPties>Cdtr"`
+		Ustrd       []string  `xml:"RmtInf>Ustrd"`
+		StrdRef     []string  `xml:"RmtInf>Strd>CdtrRefInf>Ref"`
+	} `xml:"NtryDtls>TxDtls"`
+}
+
+func (d camtDate) parse() (time.Time, error) {
+	if d.DateTime != "" {
+		if t, err := time.Parse(time.RFC3339, d.DateTime); err == nil {
+			return t.UTC(), nil
+		}
+		return time.Parse("2006-01-02T15:04:05", d.DateTime)
+	}
+	return time.Parse(time.DateOnly, d.Date)
+}
+
+// signed amount of a camt balance or entry, DBIT amounts are negative
+func camtSignedAmount(amount camtAmount, cdtDbtInd string) (types.Money, error) {
+	value, err := types.ParseMoney(amount.Value)
+	if err != nil {
+		return 0, err
+	}
+	switch cdtDbtInd {
+	case "CRDT":
+		return value, nil
+	case "DBIT":
+		return -value, nil
+	}
+	return 0, fmt.Errorf("invalid credit debit indicator %q", cdtDbtInd)
+}
+
+/*
+ParseCAMT053 parses an ISO 20022 camt.053 bank to customer statement holding a single account statement.
+Only booked entries are imported. The remittance information becomes the description and the debtor (for credits)
+or creditor (for debits) becomes the party name. The opening balance plus all entries has to add up to the closing balance.
+*/
+func ParseCAMT053(r io.Reader) (*Statement, error) {
+	var doc camtDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid camt.053 document: %w", err)
+	}
+	if len(doc.Statements) == 0 {
+		return nil, errors.New("no statement found")
+	}
+	if len(doc.Statements) > 1 {
+		return nil, errors.New("only files with a single statement are supported")
+	}
+	stmt := doc.Statements[0]
+	statement := &Statement{
+		AccountID: stmt.Acct.IBAN,
+		Currency:  strings.ToUpper(stmt.Acct.Ccy),
+		Entries:   make([]Entry, 0, len(stmt.Entries)),
+		Errors:    make([]RowError, 0),
+	}
+	if statement.AccountID == "" {
+		statement.AccountID = stmt.Acct.Other
+	}
+	if statement.AccountID == "" {
+		return nil, errors.New("statement has no account id")
+	}
+	for _, bal := range stmt.Balances {
+		amount, err := camtSignedAmount(bal.Amount, bal.CdtDbtInd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s balance: %w", bal.Code, err)
+		}
+		if statement.Currency == "" {
+			statement.Currency = strings.ToUpper(bal.Amount.Ccy)
+		}
+		switch bal.Code {
+		case "OPBD", "PRCD":
+			if statement.OpeningBalance == nil {
+				statement.OpeningBalance = &amount
+			}
+		case "CLBD":
+			statement.ClosingBalance = &amount
+			if statement.ClosingDate, err = bal.Date.parse(); err != nil {
+				return nil, fmt.Errorf("invalid closing balance date: %w", err)
+			}
+		}
+	}
+	for i, ntry := range stmt.Entries {
+		// the position of the entry in the statement is used as line since XML lines are meaningless to users
+		line := i + 1
+		status := strings.TrimSpace(ntry.Status.Value)
+		if ntry.Status.Code != "" {
+			status = ntry.Status.Code
+		}
+		if status != "" && status != "BOOK" {
+			continue
+		}
+		entry, err := camtEntryToEntry(line, ntry)
+		if err != nil {
+			statement.Errors = append(statement.Errors, RowError{Line: line, Message: err.Error()})
+			continue
+		}
+		statement.Entries = append(statement.Entries, entry)
+	}
+	if err := statement.CheckBalances(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+func camtEntryToEntry(line int, ntry camtEntry) (Entry, error) {
+	entry := Entry{Line: line, ExternalID: ntry.AcctSvcrRef}
+	if entry.ExternalID == "" {
+		entry.ExternalID = ntry.NtryRef
+	}
+	amount, err := camtSignedAmount(ntry.Amount, ntry.CdtDbtInd)
+	if err != nil {
+		return entry, fmt.Errorf("invalid amount: %w", err)
+	}
+	signedEntry(&entry, amount)
+	date := ntry.BookingDate
+	if date.Date == "" && date.DateTime == "" {
+		date = ntry.ValueDate
+	}
+	if entry.Date, err = date.parse(); err != nil {
+		return entry, fmt.Errorf("invalid booking date: %w", err)
+	}
+	remittance := make([]string, 0)
+	for _, details := range ntry.Details {
+		if entry.PartyName == "" {
+			if entry.Type == "CREDIT" {
+				entry.PartyName = details.Debtor.name()
+			} else {
+				entry.PartyName = details.Creditor.name()
+			}
+		}
+		if entry.ExternalID == "" {
+			entry.ExternalID = details.AcctSvcrRef
+		}
+		remittance = append(remittance, details.Ustrd...)
+		remittance = append(remittance, details.StrdRef...)
+	}
+	entry.Description = strings.Join(strings.Fields(strings.Join(remittance, " ")), " ")
+	if entry.Description == "" {
+		entry.Description = strings.TrimSpace(ntry.AddtlInf)
+	}
+	if entry.PartyName == "" {
+		entry.PartyName = strings.TrimSpace(ntry.AddtlInf)
+	}
+	if entry.PartyName == "" {
+		entry.PartyName = entry.Description
+	}
+	return entry, nil
+}
@@ -0,0 +1,299 @@
+package importers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+)
+
+// tokens accepted in the date format of a profile and their go layout, longest tokens first
+var dateFormatTokens = []struct{ token, layout string }{
+	{"YYYY", "2006"},
+	{"MMMM", "January"},
+	{"MMM", "Jan"},
+	{"YY", "06"},
+	{"MM", "01"},
+	{"DD", "02"},
+	{"HH", "15"},
+	{"mm", "04"},
+	{"ss", "05"},
+}
+
+// DateLayout converts a date format like "DD/MM/YYYY" into a go time layout, go layouts are returned as is
+func DateLayout(format string) string {
+	if strings.Contains(format, "2006") {
+		return format
+	}
+	var layout strings.Builder
+	for i := 0; i < len(format); {
+		matched := false
+		for _, t := range dateFormatTokens {
+			if strings.HasPrefix(format[i:], t.token) {
+				layout.WriteString(t.layout)
+				i += len(t.token)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			layout.WriteByte(format[i])
+			i++
+		}
+	}
+	return layout.String()
+}
+
+// ValidateProfile checks that a profile has everything needed to map a CSV row to a transaction and fills in defaults
+func ValidateProfile(p *types.ImportProfile) error {
+	if p.Name == "" || len(p.Name) > 255 {
+		return errors.New("invalid profile name")
+	}
+	if p.Delimiter == "" {
+		p.Delimiter = ","
+	}
+	if p.Delimiter == `\t` {
+		p.Delimiter = "\t"
+	}
+	if utf8.RuneCountInString(p.Delimiter) != 1 || p.Delimiter == `"` {
+		return errors.New("delimiter should be a single character")
+	}
+	if p.DecimalSeparator == "" {
+		p.DecimalSeparator = "."
+	}
+	if p.DecimalSeparator != "." && p.DecimalSeparator != "," {
+		return errors.New("decimal separator should be . or ,")
+	}
+	if p.DecimalSeparator == p.Delimiter {
+		return errors.New("decimal separator and delimiter should be different")
+	}
+	if p.SkipRows < 0 || p.SkipRows > 100 {
+		return errors.New("skip rows should be between 0 and 100")
+	}
+	if p.DateColumn == "" || p.DateFormat == "" {
+		return errors.New("date column and date format are required")
+	}
+	if p.AmountColumn == "" && (p.DebitColumn == "" || p.CreditColumn == "") {
+		return errors.New("either amount column or both debit and credit columns are required")
+	}
+	if p.PartyColumn == "" {
+		return errors.New("party column is required")
+	}
+	if len(p.Tags) > 512 {
+		return errors.New("invalid tag length")
+	}
+	return nil
+}
+
+/*
+ParseCSV reads a CSV statement using the column mapping of the profile. Rows that cannot be mapped are reported as
+RowErrors so the caller can show all problems at once, the returned error is only set when the file itself or the
+profile is unusable.
+*/
+func ParseCSV(r io.Reader, profile types.ImportProfile) ([]Entry, []RowError, error) {
+	if err := ValidateProfile(&profile); err != nil {
+		return nil, nil, err
+	}
+	reader := csv.NewReader(r)
+	reader.Comma, _ = utf8.DecodeRuneInString(profile.Delimiter)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = false
+	for i := 0; i < profile.SkipRows; i++ {
+		if _, err := reader.Read(); err != nil {
+			return nil, nil, fmt.Errorf("failed to skip row %d: %w", i+1, err)
+		}
+	}
+	var header []string
+	if profile.HasHeader {
+		record, err := reader.Read()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		header = record
+	}
+	columns := map[string]string{
+		"date":        profile.DateColumn,
+		"amount":      profile.AmountColumn,
+		"debit":       profile.DebitColumn,
+		"credit":      profile.CreditColumn,
+		"party":       profile.PartyColumn,
+		"description": profile.DescriptionColumn,
+	}
+	indexes := make(map[string]int, len(columns))
+	for field, ref := range columns {
+		if ref == "" {
+			indexes[field] = -1
+			continue
+		}
+		idx, err := columnIndex(header, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		indexes[field] = idx
+	}
+	layout := DateLayout(profile.DateFormat)
+	entries := make([]Entry, 0)
+	rowErrors := make([]RowError, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				rowErrors = append(rowErrors, RowError{Line: parseErr.Line, Message: parseErr.Err.Error()})
+				continue
+			}
+			return nil, nil, err
+		}
+		if isBlankRecord(record) {
+			continue
+		}
+		field := func(name string) string {
+			idx := indexes[name]
+			if idx < 0 || idx >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[idx])
+		}
+		entry := Entry{Line: line, PartyName: field("party"), Description: field("description")}
+		entry.Date, err = time.Parse(layout, field("date"))
+		if err != nil {
+			rowErrors = append(rowErrors, RowError{Line: line, Message: fmt.Sprintf("invalid date %q, expected format %s", field("date"), profile.DateFormat)})
+			continue
+		}
+		amount, err := rowAmount(field, profile.DecimalSeparator)
+		if err != nil {
+			rowErrors = append(rowErrors, RowError{Line: line, Message: err.Error()})
+			continue
+		}
+		signedEntry(&entry, amount)
+		entries = append(entries, entry)
+	}
+	return entries, rowErrors, nil
+}
+
+// signed amount of a row either from the amount column or from the debit/credit column pair
+func rowAmount(field func(string) string, decimalSeparator string) (types.Money, error) {
+	if raw := field("amount"); raw != "" || (field("debit") == "" && field("credit") == "") {
+		amount, err := ParseAmount(raw, decimalSeparator)
+		if err != nil {
+			return 0, fmt.Errorf("invalid amount %q: %w", raw, err)
+		}
+		return amount, nil
+	}
+	var debit, credit types.Money
+	var err error
+	if raw := field("debit"); raw != "" {
+		if debit, err = ParseAmount(raw, decimalSeparator); err != nil {
+			return 0, fmt.Errorf("invalid debit amount %q: %w", raw, err)
+		}
+	}
+	if raw := field("credit"); raw != "" {
+		if credit, err = ParseAmount(raw, decimalSeparator); err != nil {
+			return 0, fmt.Errorf("invalid credit amount %q: %w", raw, err)
+		}
+	}
+	if debit < 0 {
+		debit = -debit
+	}
+	if credit < 0 {
+		credit = -credit
+	}
+	if debit != 0 && credit != 0 {
+		return 0, errors.New("both debit and credit amounts are set")
+	}
+	return credit - debit, nil
+}
+
+// ISO 4217 code printed before or after an amount, e.g. "USD 10.10" or "10,10 EUR"
+var amountCurrencyCodePattern = regexp.MustCompile(`^[A-Z]{3}\s*|\s*[A-Z]{3}$`)
+
+/*
+ParseAmount parses an amount the way banks print them in statements: thousands separators, currency symbols, a
+leading or trailing currency code, negative amounts in parentheses or with a trailing minus, and CR/DR suffixes are
+understood. Any other letter makes the amount invalid, so a typo like "12O.00" is never read as a different amount.
+*/
+func ParseAmount(raw string, decimalSeparator string) (types.Money, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	negative := false
+	switch {
+	case strings.HasSuffix(s, "DR"):
+		negative = true
+		s = strings.TrimSuffix(s, "DR")
+	case strings.HasSuffix(s, "CR"):
+		s = strings.TrimSuffix(s, "CR")
+	}
+	s = amountCurrencyCodePattern.ReplaceAllString(strings.TrimSpace(s), "")
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative = !negative
+		s = amountCurrencyCodePattern.ReplaceAllString(strings.TrimSpace(s[1:len(s)-1]), "")
+	}
+	if strings.HasSuffix(s, "-") {
+		negative = !negative
+		s = strings.TrimSuffix(s, "-")
+	}
+	thousandsSeparator := ","
+	if decimalSeparator == "," {
+		thousandsSeparator = "."
+	}
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r == '-', r == '+':
+			return r
+		case string(r) == decimalSeparator:
+			return '.'
+		case string(r) == thousandsSeparator, r == ' ', r == '\u00a0', r == '\'':
+			return -1
+		case strings.ContainsRune("$€£¥₹", r):
+			return -1
+		}
+		return r
+	}, s)
+	// exponents are not allowed either, banks never print amounts like 1E5
+	if strings.ContainsFunc(s, unicode.IsLetter) {
+		return 0, fmt.Errorf("%w %q", types.ErrInvalidMoney, raw)
+	}
+	amount, err := types.ParseMoney(s)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+// index of a column referenced by its header name or by its 1 based position
+func columnIndex(header []string, ref string) (int, error) {
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(ref)) {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n >= 1 {
+		return n - 1, nil
+	}
+	return -1, fmt.Errorf("column %q not found", ref)
+}
+
+func isBlankRecord(record []string) bool {
+	for _, v := range record {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
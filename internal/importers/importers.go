@@ -0,0 +1,63 @@
+// Package importers parses bank statement files into entries that can be posted as transactions to a passbook.
+package importers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+)
+
+// Entry is a single statement line, Amount is always positive and Type tells if it is a CREDIT or a DEBIT
+type Entry struct {
+	Line        int         `json:"line"`
+	ExternalID  string      `json:"external_id,omitempty"`
+	Date        time.Time   `json:"transaction_date"`
+	Amount      types.Money `json:"amount"`
+	Type        string      `json:"transaction_type"`
+	PartyName   string      `json:"party_name"`
+	Description string      `json:"description"`
+}
+
+// RowError describes why a line of a statement could not be parsed
+type RowError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// signedEntry fills Amount and Type of the entry from a signed amount, negative amounts are debits
+func signedEntry(e *Entry, amount types.Money) {
+	if amount < 0 {
+		e.Type = "DEBIT"
+		e.Amount = -amount
+	} else {
+		e.Type = "CREDIT"
+		e.Amount = amount
+	}
+}
+
+/*
+CheckBalances verifies that the opening balance plus all entries of the statement adds up to its closing balance.
+Statements without an opening or closing balance and statements with unparsable entries are not checked.
+*/
+func (s *Statement) CheckBalances() error {
+	if s.OpeningBalance == nil || s.ClosingBalance == nil || len(s.Errors) > 0 {
+		return nil
+	}
+	balance := *s.OpeningBalance
+	for _, entry := range s.Entries {
+		if entry.Type == "DEBIT" {
+			balance -= entry.Amount
+		} else {
+			balance += entry.Amount
+		}
+	}
+	if balance != *s.ClosingBalance {
+		return fmt.Errorf("balances do not add up: opening balance %s plus entries is %s but closing balance is %s", s.OpeningBalance, balance, s.ClosingBalance)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package importers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCSVWithDebitCreditColumns(t *testing.T) {
+	statement := `Account statement for 123512
+Txn Date;Narration;Withdrawal;Deposit;Balance
+01/04/2024;UPI/Aditya Gupta;;1.500,00;2.524,45
+02/04/2024;ATM WDL;200,50;;2.323,95
+03/04/2024;Bad row;abc;;2.323,95
+
+05/04/2024;NEFT/TCS;;10,00;2.333,95
+`
+	profile := types.ImportProfile{
+		Name:             "zelda bank",
+		Delimiter:        ";",
+		HasHeader:        true,
+		SkipRows:         1,
+		DateColumn:       "Txn Date",
+		DateFormat:       "DD/MM/YYYY",
+		DebitColumn:      "withdrawal",
+		CreditColumn:     "Deposit",
+		PartyColumn:      "Narration",
+		DecimalSeparator: ",",
+	}
+	entries, rowErrors, err := ParseCSV(strings.NewReader(statement), profile)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.Len(t, rowErrors, 1)
+	assert.Equal(t, 5, rowErrors[0].Line)
+
+	assert.Equal(t, types.Money(150000), entries[0].Amount)
+	assert.Equal(t, "CREDIT", entries[0].Type)
+	assert.Equal(t, "UPI/Aditya Gupta", entries[0].PartyName)
+	assert.Equal(t, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), entries[0].Date)
+	assert.Equal(t, types.Money(20050), entries[1].Amount)
+	assert.Equal(t, "DEBIT", entries[1].Type)
+	assert.Equal(t, 7, entries[2].Line)
+}
+
+func TestParseCSVWithSignedAmountColumn(t *testing.T) {
+	statement := "2024-04-01,Salary,\"1,00,000.00\"\n2024-04-02,Rent,-25000\n"
+	profile := types.ImportProfile{
+		Name:         "signed",
+		DateColumn:   "1",
+		DateFormat:   "2006-01-02",
+		AmountColumn: "3",
+		PartyColumn:  "2",
+	}
+	entries, rowErrors, err := ParseCSV(strings.NewReader(statement), profile)
+	assert.NoError(t, err)
+	assert.Empty(t, rowErrors)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, types.Money(10000000), entries[0].Amount)
+	assert.Equal(t, "DEBIT", entries[1].Type)
+	assert.Equal(t, types.Money(2500000), entries[1].Amount)
+}
+
+func TestParseCSVUnknownColumn(t *testing.T) {
+	profile := types.ImportProfile{Name: "p", HasHeader: true, DateColumn: "Date", DateFormat: "YYYY-MM-DD", AmountColumn: "Amount", PartyColumn: "Payee"}
+	_, _, err := ParseCSV(strings.NewReader("Date,Amount\n2024-01-01,10\n"), profile)
+	assert.ErrorContains(t, err, `column "Payee" not found`)
+}
+
+func TestParseAmount(t *testing.T) {
+	cases := map[string]types.Money{
+		"1,234.50":   123450,
+		"(12.00)":    -1200,
+		"12.00-":     -1200,
+		"₹ 1,000":    100000,
+		"500.25 DR":  -50025,
+		"500.25 Cr":  50025,
+		"USD 10.10":  1010,
+		"-0.29":      -29,
+		"1'000.00":   100000,
+		"+3":         300,
+		"10,10 EUR":  101000,
+		"(INR 5.00)": -500,
+		"1 000":      100000,
+	}
+	for input, expected := range cases {
+		amount, err := ParseAmount(input, ".")
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, amount, input)
+	}
+	_, err := ParseAmount("10.555", ".")
+	assert.ErrorIs(t, err, types.ErrMoneyPrecision)
+	// letters other than a currency code are never dropped silently
+	for _, input := range []string{"1E5", "1e5", "12O.00", "1O USD", "US 10", "EURO 10"} {
+		_, err := ParseAmount(input, ".")
+		assert.ErrorIs(t, err, types.ErrInvalidMoney, input)
+	}
+}
+
+func TestDateLayout(t *testing.T) {
+	assert.Equal(t, "02/01/2006", DateLayout("DD/MM/YYYY"))
+	assert.Equal(t, "02-Jan-06 15:04", DateLayout("DD-MMM-YY HH:mm"))
+	assert.Equal(t, "2006-01-02", DateLayout("2006-01-02"))
+}
+
+const ofxSGMLStatement = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+SECURITY:NONE
+ENCODING:USASCII
+
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS><DTSERVER>20240405</SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1>
+<STMTTRNRS>
+<TRNUID>1
+<STMTRS>
+<CURDEF>USD
+<BANKACCTFROM>
+<BANKID>121000248
+<ACCTID>123512
+<ACCTTYPE>CHECKING
+</BANKACCTFROM>
+<BANKTRANLIST>
+<DTSTART>20240401
+<DTEND>20240405
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20240401120000.000[-5:EST]
+<TRNAMT>1500.00
+<FITID>2024040101
+<NAME>ACME &amp; SONS
+<MEMO>Salary
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20240402
+<TRNAMT>-20.5
+<FITID>2024040201
+<PAYEE><NAME>Coffee Shop<ADDR1>Main St</PAYEE>
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>2024
+<TRNAMT>-1
+<FITID>2024040301
+<NAME>Broken
+</STMTTRN>
+</BANKTRANLIST>
+<LEDGERBAL>
+<BALAMT>2503.95
+<DTASOF>20240405
+</LEDGERBAL>
+</STMTRS>
+</STMTTRNRS>
+</BANKMSGSRSV1>
+</OFX>
+`
+
+const ofxXMLStatement = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+  <CREDITCARDMSGSRSV1>
+    <CCSTMTTRNRS>
+      <CCSTMTRS>
+        <CURDEF>EUR</CURDEF>
+        <CCACCTFROM><ACCTID>4111000011112222</ACCTID></CCACCTFROM>
+        <BANKTRANLIST>
+          <STMTTRN>
+            <TRNTYPE>DEBIT</TRNTYPE>
+            <DTPOSTED>20240310</DTPOSTED>
+            <TRNAMT>-42,10</TRNAMT>
+            <FITID>abc-1</FITID>
+            <NAME>Book Store</NAME>
+            <MEMO></MEMO>
+          </STMTTRN>
+        </BANKTRANLIST>
+        <LEDGERBAL><BALAMT>-42.10</BALAMT><DTASOF>20240331</DTASOF></LEDGERBAL>
+      </CCSTMTRS>
+    </CCSTMTTRNRS>
+  </CREDITCARDMSGSRSV1>
+</OFX>
+`
+
+func TestParseOFXSGML(t *testing.T) {
+	statement, err := ParseOFX(strings.NewReader(ofxSGMLStatement))
+	assert.NoError(t, err)
+	assert.Equal(t, "123512", statement.AccountID)
+	assert.Equal(t, "USD", statement.Currency)
+	assert.Equal(t, types.Money(250395), *statement.ClosingBalance)
+	assert.Equal(t, time.Date(2024, 4, 5, 0, 0, 0, 0, time.UTC), statement.ClosingDate)
+	assert.Len(t, statement.Entries, 2)
+	assert.Len(t, statement.Errors, 1)
+
+	salary := statement.Entries[0]
+	assert.Equal(t, "2024040101", salary.ExternalID)
+	assert.Equal(t, "CREDIT", salary.Type)
+	assert.Equal(t, types.Money(150000), salary.Amount)
+	assert.Equal(t, "ACME & SONS", salary.PartyName)
+	assert.Equal(t, "Salary", salary.Description)
+	assert.Equal(t, time.Date(2024, 4, 1, 17, 0, 0, 0, time.UTC), salary.Date)
+
+	coffee := statement.Entries[1]
+	assert.Equal(t, "DEBIT", coffee.Type)
+	assert.Equal(t, types.Money(2050), coffee.Amount)
+	assert.Equal(t, "Coffee Shop", coffee.PartyName)
+}
+
+func TestParseOFXXML(t *testing.T) {
+	statement, err := ParseOFX(strings.NewReader(ofxXMLStatement))
+	assert.NoError(t, err)
+	assert.Equal(t, "4111000011112222", statement.AccountID)
+	assert.Equal(t, "EUR", statement.Currency)
+	assert.Equal(t, types.Money(-4210), *statement.ClosingBalance)
+	assert.Len(t, statement.Errors, 0)
+	assert.Len(t, statement.Entries, 1)
+	assert.Equal(t, types.Money(4210), statement.Entries[0].Amount)
+	assert.Equal(t, "Book Store", statement.Entries[0].PartyName)
+}
+
+func TestParseOFXInvalid(t *testing.T) {
+	_, err := ParseOFX(strings.NewReader("date,amount\n"))
+	assert.Error(t, err)
+}
+
+const camt053Statement = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02">
+  <BkToCstmrStmt>
+    <GrpHdr><MsgId>MSG-1</MsgId><CreDtTm>2024-04-06T08:00:00</CreDtTm></GrpHdr>
+    <Stmt>
+      <Id>STMT-2024-04</Id>
+      <Acct><Id><IBAN>DE89370400440532013000</IBAN></Id><Ccy>EUR</Ccy></Acct>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>OPBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">1000.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Dt><Dt>2024-03-31</Dt></Dt>
+      </Bal>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>CLBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">2459.50</Amt><CdtDbtInd>CRDT</CdtDbtInd><Dt><Dt>2024-04-05</Dt></Dt>
+      </Bal>
+      <Ntry>
+        <Amt Ccy="EUR">1500.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Sts>BOOK</Sts>
+        <BookgDt><Dt>2024-04-01</Dt></BookgDt><AcctSvcrRef>REF-1</AcctSvcrRef>
+        <NtryDtls><TxDtls>
+          <RltdPties><Dbtr><Nm>ACME GmbH</Nm></Dbtr><Cdtr><Nm>Jane Doe</Nm></Cdtr></RltdPties>
+          <RmtInf><Ustrd>Salary</Ustrd><Ustrd>April 2024</Ustrd></RmtInf>
+        </TxDtls></NtryDtls>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="EUR">40.50</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts><Cd>BOOK</Cd></Sts>
+        <BookgDt><Dt>2024-04-02</Dt></BookgDt><AcctSvcrRef>REF-2</AcctSvcrRef>
+        <NtryDtls><TxDtls>
+          <RltdPties><Dbtr><Pty><Nm>Jane Doe</Nm></Pty></Dbtr><Cdtr><Pty><Nm>Book Store</Nm></Pty></Cdtr></RltdPties>
+          <RmtInf><Ustrd>Invoice 42</Ustrd></RmtInf>
+        </TxDtls></NtryDtls>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="EUR">99.00</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts>PDNG</Sts>
+        <BookgDt><Dt>2024-04-05</Dt></BookgDt><AcctSvcrRef>REF-3</AcctSvcrRef>
+      </Ntry>
+    </Stmt>
+  </BkToCstmrStmt>
+</Document>`
+
+func TestParseCAMT053(t *testing.T) {
+	statement, err := ParseCAMT053(strings.NewReader(camt053Statement))
+	assert.NoError(t, err)
+	assert.Equal(t, "DE89370400440532013000", statement.AccountID)
+	assert.Equal(t, "EUR", statement.Currency)
+	assert.Equal(t, types.Money(100000), *statement.OpeningBalance)
+	assert.Equal(t, types.Money(245950), *statement.ClosingBalance)
+	assert.Equal(t, time.Date(2024, 4, 5, 0, 0, 0, 0, time.UTC), statement.ClosingDate)
+	// the pending entry is not imported
+	assert.Len(t, statement.Entries, 2)
+	assert.Len(t, statement.Errors, 0)
+
+	salary := statement.Entries[0]
+	assert.Equal(t, "REF-1", salary.ExternalID)
+	assert.Equal(t, "CREDIT", salary.Type)
+	assert.Equal(t, types.Money(150000), salary.Amount)
+	assert.Equal(t, "ACME GmbH", salary.PartyName)
+	assert.Equal(t, "Salary April 2024", salary.Description)
+	assert.Equal(t, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), salary.Date)
+
+	book := statement.Entries[1]
+	assert.Equal(t, "DEBIT", book.Type)
+	assert.Equal(t, types.Money(4050), book.Amount)
+	assert.Equal(t, "Book Store", book.PartyName)
+	assert.Equal(t, "Invoice 42", book.Description)
+}
+
+func TestParseCAMT053BalanceMismatch(t *testing.T) {
+	_, err := ParseCAMT053(strings.NewReader(strings.Replace(camt053Statement, "2459.50", "2459.60", 1)))
+	assert.ErrorContains(t, err, "balances do not add up")
+}
+
+const mt940Statement = `{1:F01DEUTDEFFAXXX0000000000}{2:O9400000240406DEUTDEFFAXXX00000000002404060000N}{4:
+:20:STMT240405
+:25:37040044/0532013000
+:28C:00042/001
+:60F:C240331EUR1000,00
+:61:2404010401CR1500,00NTRFNONREF//BANKREF1
+:86:166?00GUTSCHRIFT?20Gehalt April?212024?32ACME?33 GmbH
+:61:240402D40,50NMSCINV42//BANKREF2
+:86:/NAME/Book Store/REMI/USTD//Invoice 42/
+:61:240403D10,00NCHGNONREF
+Account fee
+:62F:C240405EUR2449,50
+-}`
+
+func TestParseMT940(t *testing.T) {
+	statement, err := ParseMT940(strings.NewReader(mt940Statement))
+	assert.NoError(t, err)
+	assert.Equal(t, "37040044/0532013000", statement.AccountID)
+	assert.Equal(t, "EUR", statement.Currency)
+	assert.Equal(t, types.Money(100000), *statement.OpeningBalance)
+	assert.Equal(t, types.Money(244950), *statement.ClosingBalance)
+	assert.Equal(t, time.Date(2024, 4, 5, 0, 0, 0, 0, time.UTC), statement.ClosingDate)
+	assert.Len(t, statement.Errors, 0)
+	assert.Len(t, statement.Entries, 3)
+
+	salary := statement.Entries[0]
+	assert.Equal(t, "BANKREF1", salary.ExternalID)
+	assert.Equal(t, "CREDIT", salary.Type)
+	assert.Equal(t, types.Money(150000), salary.Amount)
+	assert.Equal(t, "ACME GmbH", salary.PartyName)
+	assert.Equal(t, "Gehalt April2024", salary.Description)
+	assert.Equal(t, time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), salary.Date)
+
+	book := statement.Entries[1]
+	assert.Equal(t, "BANKREF2", book.ExternalID)
+	assert.Equal(t, "DEBIT", book.Type)
+	assert.Equal(t, types.Money(4050), book.Amount)
+	assert.Equal(t, "Book Store", book.PartyName)
+	assert.Equal(t, "Invoice 42", book.Description)
+
+	fee := statement.Entries[2]
+	assert.Equal(t, "", fee.ExternalID)
+	assert.Equal(t, "Account fee", fee.PartyName)
+	assert.Equal(t, "Account fee", fee.Description)
+}
+
+func TestParseMT940BalanceMismatch(t *testing.T) {
+	_, err := ParseMT940(strings.NewReader(strings.Replace(mt940Statement, "C240405EUR2449,50", "C240405EUR2449,00", 1)))
+	assert.ErrorContains(t, err, "balances do not add up")
+}
+
+func TestParseMT940Invalid(t *testing.T) {
+	_, err := ParseMT940(strings.NewReader("<OFX></OFX>"))
+	assert.Error(t, err)
+}
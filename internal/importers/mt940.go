@@ -0,0 +1,263 @@
+package importers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+)
+
+// a field of an MT940 message, the value of a field can span several lines
+type mt940Field struct {
+	tag   string
+	value string
+	line  int
+}
+
+var (
+	mt940TagPattern = regexp.MustCompile(`^:([0-9]{2}[A-Z]?):`)
+	// :60F:/:62F: balances, D/C mark, YYMMDD date, currency and amount with a comma as decimal separator
+	mt940BalancePattern = regexp.MustCompile(`^([CD])([0-9]{6})([A-Z]{3})([0-9]+,[0-9]*)$`)
+	// :61: statement line, value date, optional MMDD entry date, D/C mark, optional funds code, amount, transaction type and references
+	mt940LinePattern = regexp.MustCompile(`^([0-9]{6})([0-9]{4})?(RC|RD|C|D)([A-Z])?([0-9]+,[0-9]*)([A-Z][A-Z0-9]{3})([^/\n]*)(?://([^\n]*))?`)
+	// structured :86: information as /CODE/value pairs
+	mt940CodePattern = regexp.MustCompile(`/([A-Z]{2,4})/`)
+)
+
+/*
+ParseMT940 parses a SWIFT MT940 customer statement. A file can hold several consecutive statements of the same account,
+the balances of every statement are checked and the opening balance of the first and the closing balance of the last
+statement are reported. Party name and description are taken from the :86: information of each statement line,
+both the German ?20-?33 sub fields and /NAME/ and /REMI/ codes are understood, anything else becomes the description.
+*/
+func ParseMT940(r io.Reader) (*Statement, error) {
+	fields, err := mt940Fields(r)
+	if err != nil {
+		return nil, err
+	}
+	statement := &Statement{
+		Entries: make([]Entry, 0),
+		Errors:  make([]RowError, 0),
+	}
+	// the statement currently being read, checked on its closing balance
+	var current *Statement
+	var last *Entry
+	for _, f := range fields {
+		switch f.tag {
+		case "25":
+			accountID := strings.TrimSpace(f.value)
+			if statement.AccountID != "" && statement.AccountID != accountID {
+				return nil, errors.New("statements of several accounts in one file are not supported")
+			}
+			statement.AccountID = accountID
+		case "60F", "60M":
+			balance, currency, _, err := parseMT940Balance(f.value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid opening balance: %w", f.line, err)
+			}
+			if statement.Currency != "" && statement.Currency != currency {
+				return nil, errors.New("statements in several currencies in one file are not supported")
+			}
+			statement.Currency = currency
+			if statement.OpeningBalance == nil {
+				statement.OpeningBalance = &balance
+			}
+			current = &Statement{OpeningBalance: &balance, Entries: make([]Entry, 0)}
+			last = nil
+		case "61":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: statement line without opening balance", f.line)
+			}
+			entry, err := parseMT940Line(f)
+			if err != nil {
+				statement.Errors = append(statement.Errors, RowError{Line: f.line, Message: err.Error()})
+				current.Errors = append(current.Errors, RowError{Line: f.line, Message: err.Error()})
+				last = nil
+				continue
+			}
+			current.Entries = append(current.Entries, entry)
+			last = &current.Entries[len(current.Entries)-1]
+		case "86":
+			if last != nil {
+				party, description := parseMT940Information(f.value)
+				last.PartyName = party
+				if description != "" {
+					last.Description = description
+				}
+				last = nil
+			}
+		case "62F", "62M":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: closing balance without opening balance", f.line)
+			}
+			balance, _, date, err := parseMT940Balance(f.value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid closing balance: %w", f.line, err)
+			}
+			current.ClosingBalance = &balance
+			if err := current.CheckBalances(); err != nil {
+				return nil, fmt.Errorf("line %d: %w", f.line, err)
+			}
+			for _, entry := range current.Entries {
+				if entry.PartyName == "" {
+					entry.PartyName = entry.Description
+				}
+				statement.Entries = append(statement.Entries, entry)
+			}
+			statement.ClosingBalance = &balance
+			statement.ClosingDate = date
+			current = nil
+			last = nil
+		}
+	}
+	if statement.AccountID == "" {
+		return nil, errors.New("statement has no account id")
+	}
+	if statement.OpeningBalance == nil || current != nil {
+		return nil, errors.New("statement has no closing balance")
+	}
+	return statement, nil
+}
+
+// split an MT940 message into its fields, SWIFT block headers and trailers around the message text are skipped
+func mt940Fields(r io.Reader) ([]mt940Field, error) {
+	scanner := bufio.NewScanner(r)
+	fields := make([]mt940Field, 0)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r ")
+		if i := strings.Index(line, "{4:"); i >= 0 {
+			line = line[i+3:]
+		}
+		if line == "" || line == "-" || strings.HasPrefix(line, "-}") || strings.HasPrefix(line, "{") {
+			continue
+		}
+		if m := mt940TagPattern.FindStringSubmatch(line); m != nil {
+			fields = append(fields, mt940Field{tag: m[1], value: line[len(m[0]):], line: lineNo})
+			continue
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: not an MT940 statement", lineNo)
+		}
+		fields[len(fields)-1].value += "\n" + line
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("not an MT940 statement")
+	}
+	return fields, nil
+}
+
+func parseMT940Balance(value string) (types.Money, string, time.Time, error) {
+	m := mt940BalancePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return 0, "", time.Time{}, fmt.Errorf("unexpected format %q", value)
+	}
+	date, err := time.Parse("060102", m[2])
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	amount, err := ParseAmount(m[4], ",")
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	if m[1] == "D" {
+		amount = -amount
+	}
+	return amount, m[3], date, nil
+}
+
+func parseMT940Line(f mt940Field) (Entry, error) {
+	entry := Entry{Line: f.line}
+	m := mt940LinePattern.FindStringSubmatch(f.value)
+	if m == nil {
+		return entry, fmt.Errorf("unexpected statement line format %q", strings.SplitN(f.value, "\n", 2)[0])
+	}
+	valueDate, err := time.Parse("060102", m[1])
+	if err != nil {
+		return entry, fmt.Errorf("invalid value date %q", m[1])
+	}
+	entry.Date = valueDate
+	if m[2] != "" {
+		// the entry date has no year, it is the one closest to the value date
+		entryDate, err := time.Parse("20060102", fmt.Sprintf("%04d%s", valueDate.Year(), m[2]))
+		if err != nil {
+			return entry, fmt.Errorf("invalid entry date %q", m[2])
+		}
+		if entryDate.Sub(valueDate) > 180*24*time.Hour {
+			entryDate = entryDate.AddDate(-1, 0, 0)
+		} else if valueDate.Sub(entryDate) > 180*24*time.Hour {
+			entryDate = entryDate.AddDate(1, 0, 0)
+		}
+		entry.Date = entryDate
+	}
+	amount, err := ParseAmount(m[5], ",")
+	if err != nil {
+		return entry, fmt.Errorf("invalid amount %q: %w", m[5], err)
+	}
+	// RC is the reversal of a credit and RD the reversal of a debit
+	if m[3] == "D" || m[3] == "RC" {
+		amount = -amount
+	}
+	signedEntry(&entry, amount)
+	customerRef := strings.TrimSpace(m[7])
+	bankRef := strings.TrimSpace(m[8])
+	switch {
+	case bankRef != "" && bankRef != "NONREF":
+		entry.ExternalID = bankRef
+	case customerRef != "" && customerRef != "NONREF":
+		entry.ExternalID = customerRef
+	}
+	// supplementary details on the next line are used when there is no :86: information
+	if _, details, ok := strings.Cut(f.value, "\n"); ok {
+		entry.Description = strings.Join(strings.Fields(details), " ")
+	}
+	return entry, nil
+}
+
+// party name and description from the :86: information to the account owner
+func parseMT940Information(value string) (string, string) {
+	value = strings.ReplaceAll(value, "\n", "")
+	if len(value) > 4 && value[3] == '?' {
+		// German structured format, a three digit transaction code followed by ?NN sub fields
+		var party, description strings.Builder
+		for _, sub := range strings.Split(value[3:], "?")[1:] {
+			if len(sub) < 2 {
+				continue
+			}
+			code, content := sub[:2], sub[2:]
+			switch {
+			case code == "32" || code == "33":
+				party.WriteString(content)
+			case code >= "20" && code <= "29", code >= "60" && code <= "63":
+				description.WriteString(content)
+			}
+		}
+		return strings.TrimSpace(party.String()), strings.Join(strings.Fields(description.String()), " ")
+	}
+	if matches := mt940CodePattern.FindAllStringSubmatchIndex(value, -1); len(matches) > 0 && matches[0][0] == 0 {
+		values := make(map[string]string, len(matches))
+		for i, m := range matches {
+			end := len(value)
+			if i+1 < len(matches) {
+				end = matches[i+1][0]
+			}
+			code := value[m[2]:m[3]]
+			if _, ok := values[code]; !ok {
+				values[code] = strings.TrimSpace(value[m[1]:end])
+			}
+		}
+		// unstructured remittance information is often written as /REMI/USTD//text
+		remittance := strings.TrimPrefix(values["REMI"], "USTD//")
+		return strings.Trim(values["NAME"], "/ "), strings.Join(strings.Fields(strings.Trim(remittance, "/")), " ")
+	}
+	return "", strings.Join(strings.Fields(value), " ")
+}
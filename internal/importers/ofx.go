@@ -0,0 +1,251 @@
+package importers
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+)
+
+// Statement is a parsed bank statement of a single account
+type Statement struct {
+	AccountID string `json:"account_id"`
+	Currency  string `json:"currency"`
+	// balance before the first entry of the statement, not all formats carry it
+	OpeningBalance *types.Money `json:"opening_balance,omitempty"`
+	// ledger balance at the end of the statement
+	ClosingBalance *types.Money `json:"closing_balance,omitempty"`
+	ClosingDate    time.Time    `json:"closing_date"`
+	Entries        []Entry      `json:"-"`
+	Errors         []RowError   `json:"-"`
+}
+
+// ofxNode is an element of an OFX document, leaf elements carry a value and aggregates carry children
+type ofxNode struct {
+	name     string
+	value    string
+	line     int
+	children []*ofxNode
+}
+
+func (n *ofxNode) find(path ...string) *ofxNode {
+	current := n
+	for _, name := range path {
+		var next *ofxNode
+		for _, child := range current.children {
+			if child.name == name {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		current = next
+	}
+	return current
+}
+
+func (n *ofxNode) text(path ...string) string {
+	if node := n.find(path...); node != nil {
+		return node.value
+	}
+	return ""
+}
+
+// walk calls fn for the node and all of its descendants
+func (n *ofxNode) walk(fn func(*ofxNode)) {
+	fn(n)
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
+
+/*
+ParseOFX parses OFX 1.x (SGML) and OFX 2.x (XML) bank or credit card statements, QFX files are OFX with extra
+Intuit specific elements which are ignored. The FITID of every transaction is used as ExternalID of the entry.
+*/
+func ParseOFX(r io.Reader) (*Statement, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseOFXTree(string(data))
+	if err != nil {
+		return nil, err
+	}
+	var stmtrs *ofxNode
+	root.walk(func(n *ofxNode) {
+		if stmtrs == nil && (n.name == "STMTRS" || n.name == "CCSTMTRS") {
+			stmtrs = n
+		}
+	})
+	if stmtrs == nil {
+		return nil, errors.New("no bank or credit card statement found")
+	}
+	statement := &Statement{
+		AccountID: stmtrs.text("BANKACCTFROM", "ACCTID"),
+		Currency:  strings.ToUpper(stmtrs.text("CURDEF")),
+		Entries:   make([]Entry, 0),
+		Errors:    make([]RowError, 0),
+	}
+	if statement.AccountID == "" {
+		statement.AccountID = stmtrs.text("CCACCTFROM", "ACCTID")
+	}
+	if statement.AccountID == "" {
+		return nil, errors.New("statement has no account id")
+	}
+	if ledger := stmtrs.find("LEDGERBAL"); ledger != nil {
+		balance, err := parseOFXAmount(ledger.text("BALAMT"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ledger balance: %w", err)
+		}
+		statement.ClosingBalance = &balance
+		if statement.ClosingDate, err = parseOFXDate(ledger.text("DTASOF")); err != nil {
+			return nil, fmt.Errorf("invalid ledger balance date: %w", err)
+		}
+	}
+	stmtrs.walk(func(n *ofxNode) {
+		if n.name != "STMTTRN" {
+			return
+		}
+		entry, err := ofxEntry(n)
+		if err != nil {
+			statement.Errors = append(statement.Errors, RowError{Line: n.line, Message: err.Error()})
+			return
+		}
+		statement.Entries = append(statement.Entries, entry)
+	})
+	return statement, nil
+}
+
+func ofxEntry(n *ofxNode) (Entry, error) {
+	entry := Entry{Line: n.line, ExternalID: n.text("FITID")}
+	if entry.ExternalID == "" {
+		return entry, errors.New("transaction has no FITID")
+	}
+	var err error
+	if entry.Date, err = parseOFXDate(n.text("DTPOSTED")); err != nil {
+		return entry, fmt.Errorf("invalid DTPOSTED: %w", err)
+	}
+	amount, err := parseOFXAmount(n.text("TRNAMT"))
+	if err != nil {
+		return entry, fmt.Errorf("invalid TRNAMT: %w", err)
+	}
+	signedEntry(&entry, amount)
+	entry.PartyName = n.text("NAME")
+	if entry.PartyName == "" {
+		entry.PartyName = n.text("PAYEE", "NAME")
+	}
+	entry.Description = n.text("MEMO")
+	if entry.PartyName == "" {
+		// some banks only fill in the memo
+		entry.PartyName = entry.Description
+	}
+	return entry, nil
+}
+
+// OFX amounts are plain signed decimals but some banks use a comma as decimal separator
+func parseOFXAmount(s string) (types.Money, error) {
+	if strings.Contains(s, ",") && !strings.Contains(s, ".") {
+		return ParseAmount(s, ",")
+	}
+	return ParseAmount(s, ".")
+}
+
+// parse OFX dates of the form YYYYMMDD[HHMMSS[.XXX]][[+-]offset[:TZ]], without an offset the date is in UTC
+func parseOFXDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	loc := time.UTC
+	if i := strings.Index(s, "["); i >= 0 {
+		tz := strings.TrimSuffix(s[i+1:], "]")
+		s = s[:i]
+		offset := tz
+		if j := strings.Index(tz, ":"); j >= 0 {
+			offset = tz[:j]
+		}
+		hours, err := strconv.ParseFloat(offset, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time zone %q", tz)
+		}
+		loc = time.FixedZone(tz, int(hours*3600))
+	}
+	if i := strings.Index(s, "."); i >= 0 {
+		s = s[:i]
+	}
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(s)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+	t, err := time.ParseInLocation(layout, s, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+/*
+Build the element tree of an OFX document. SGML leaf elements have no closing tag so an element is considered
+closed as soon as it has a value, closing tags of elements that are not open anymore are ignored. This handles both
+the SGML and the XML flavour of OFX.
+*/
+func parseOFXTree(doc string) (*ofxNode, error) {
+	start := strings.Index(strings.ToUpper(doc), "<OFX>")
+	if start < 0 {
+		return nil, errors.New("not an OFX document")
+	}
+	line := strings.Count(doc[:start], "\n") + 1
+	doc = doc[start:]
+	root := &ofxNode{name: "ROOT"}
+	stack := []*ofxNode{root}
+	for len(doc) > 0 {
+		lt := strings.Index(doc, "<")
+		if lt < 0 {
+			break
+		}
+		if value := strings.TrimSpace(doc[:lt]); value != "" {
+			top := stack[len(stack)-1]
+			top.value = html.UnescapeString(value)
+			// a value means the element is a leaf, in SGML there is no closing tag for it
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		line += strings.Count(doc[:lt], "\n")
+		gt := strings.Index(doc[lt:], ">")
+		if gt < 0 {
+			return nil, fmt.Errorf("line %d: unterminated tag", line)
+		}
+		tag := strings.TrimSpace(doc[lt+1 : lt+gt])
+		line += strings.Count(doc[lt:lt+gt], "\n")
+		doc = doc[lt+gt+1:]
+		switch {
+		case tag == "" || strings.HasPrefix(tag, "?") || strings.HasPrefix(tag, "!"):
+			continue
+		case strings.HasPrefix(tag, "/"):
+			name := strings.ToUpper(strings.TrimSpace(tag[1:]))
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].name == name {
+					stack = stack[:i]
+					break
+				}
+			}
+		default:
+			selfClosing := strings.HasSuffix(tag, "/")
+			name := strings.ToUpper(strings.Fields(strings.TrimSuffix(tag, "/"))[0])
+			node := &ofxNode{name: name, line: line}
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, node)
+			if !selfClosing {
+				stack = append(stack, node)
+			}
+		}
+	}
+	return root, nil
+}
@@ -0,0 +1,48 @@
+package initializers
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/lockout"
+)
+
+var (
+	// a user gets 5 free guesses, then waits 1s, 2s, 4s... and after 10 failures the username is locked for 15 minutes
+	usernameLoginPolicy = lockout.Policy{
+		FreeAttempts:     5,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 10,
+		LockoutDuration:  15 * time.Minute,
+		Window:           time.Hour,
+	}
+	// many users can share an IP behind a NAT, so a client gets far more attempts across all usernames
+	ipLoginPolicy = lockout.Policy{
+		FreeAttempts:     20,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 100,
+		LockoutDuration:  time.Hour,
+		Window:           time.Hour,
+	}
+)
+
+// limiters of the failed logins per username and per client IP, in memory until InitializeLoginLimiters is called
+var (
+	UsernameLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), usernameLoginPolicy)
+	IPLoginLimiter       = lockout.NewLimiter(lockout.NewMemoryStore(), ipLoginPolicy)
+)
+
+// InitializeLoginLimiters keeps the failed login counters in Postgres with LOGIN_LIMITER_STORE=postgres so several instances share them
+func InitializeLoginLimiters() {
+	if os.Getenv("LOGIN_LIMITER_STORE") != "postgres" {
+		log.Println("Failed login counters are kept in memory")
+		return
+	}
+	store := lockout.PostgresStore{DB: DB}
+	UsernameLoginLimiter = lockout.NewLimiter(store, usernameLoginPolicy)
+	IPLoginLimiter = lockout.NewLimiter(store, ipLoginPolicy)
+	log.Println("Failed login counters are kept in Postgres")
+}
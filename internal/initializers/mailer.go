@@ -0,0 +1,20 @@
+package initializers
+
+import (
+	"log"
+
+	"github.com/akashsharma99/passbook-app/internal/mailer"
+)
+
+// Mailer sends the emails of the app, replaced with a LogSender in tests
+var Mailer mailer.Sender
+
+// InitializeMailer sets up the mail sender configured by the environment
+func InitializeMailer() {
+	sender, err := mailer.FromEnv()
+	if err != nil {
+		log.Fatal("Unable to set up the mail sender ", err)
+	}
+	Mailer = sender
+	log.Printf("Mail sender %T ready", sender)
+}
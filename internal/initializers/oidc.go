@@ -0,0 +1,37 @@
+package initializers
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/akashsharma99/passbook-app/internal/oidc"
+)
+
+// OIDCProvider is the identity provider users can log in with, nil when OIDC login is not configured
+var OIDCProvider *oidc.Provider
+
+/*
+InitializeOIDC sets up the login with an OpenID Connect provider when OIDC_ISSUER is set. OIDC_CLIENT_ID and
+OIDC_REDIRECT_URL, the page of the web app the provider sends the browser back to, are needed as well. Without
+OIDC_CLIENT_SECRET the app logs in as a public client.
+*/
+func InitializeOIDC() {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		log.Println("OIDC login is not configured")
+		return
+	}
+	config := oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		log.Fatal("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are needed along with OIDC_ISSUER")
+	}
+	OIDCProvider = oidc.NewProvider(config)
+	log.Println("OIDC login with", issuer)
+}
@@ -0,0 +1,50 @@
+package initializers
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/keyring"
+)
+
+// keys are rotated every 30 days by default and published a day before they sign
+var tokenKeyPolicy = keyring.Policy{
+	Algorithm:        keyring.AlgorithmEdDSA,
+	RotationInterval: 30 * 24 * time.Hour,
+	PrePublish:       24 * time.Hour,
+	// longer than the 24 hours refresh tokens live
+	VerifyFor: 25 * time.Hour,
+}
+
+// TokenKeyring signs and verifies the tokens of the app, in memory until InitializeTokenKeys is called
+var TokenKeyring = keyring.New(keyring.NewMemoryStore(), tokenKeyPolicy)
+
+/*
+InitializeTokenKeys keeps the signing keys in Postgres so they survive restarts and all instances share them, and
+creates the first key when there is none. JWT_SIGNING_ALGORITHM picks EdDSA (default) or RS256 for new keys and
+JWT_KEY_ROTATION_DAYS the rotation interval.
+*/
+func InitializeTokenKeys() {
+	policy := tokenKeyPolicy
+	if algorithm := os.Getenv("JWT_SIGNING_ALGORITHM"); algorithm != "" {
+		if algorithm != keyring.AlgorithmEdDSA && algorithm != keyring.AlgorithmRS256 {
+			log.Fatal("JWT_SIGNING_ALGORITHM must be EdDSA or RS256")
+		}
+		policy.Algorithm = algorithm
+	}
+	if days := os.Getenv("JWT_KEY_ROTATION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		// a key has to sign for a while after it was published
+		if err != nil || n < 2 {
+			log.Fatal("JWT_KEY_ROTATION_DAYS must be a number of days of at least 2")
+		}
+		policy.RotationInterval = time.Duration(n) * 24 * time.Hour
+	}
+	TokenKeyring = keyring.New(keyring.PostgresStore{DB: DB}, policy)
+	if err := TokenKeyring.Rotate(); err != nil {
+		log.Fatal("Unable to set up the token signing keys ", err)
+	}
+	log.Println("Token signing keys ready, new keys use", policy.Algorithm)
+}
@@ -0,0 +1,134 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// algorithms the keys can sign with
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+const rsaKeyBits = 2048
+
+var ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+
+// Key is a private key signing tokens, identified by the kid header of the tokens it signed
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	// the key signs tokens from this time on until a newer key takes over, before that it is only published
+	NotBefore time.Time
+	CreatedAt time.Time
+}
+
+// GenerateKey creates a new random key of the algorithm signing from notBefore on
+func GenerateKey(algorithm string, notBefore time.Time, now time.Time) (Key, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		return Key{}, ErrUnsupportedAlgorithm
+	}
+	if err != nil {
+		return Key{}, err
+	}
+	return newKey(algorithm, private, notBefore, now)
+}
+
+// newKey completes a private key with its id, the RFC 7638 thumbprint of its public key
+func newKey(algorithm string, private crypto.Signer, notBefore time.Time, createdAt time.Time) (Key, error) {
+	key := Key{Algorithm: algorithm, Private: private, NotBefore: notBefore, CreatedAt: createdAt}
+	if key.signingMethod() == nil {
+		return Key{}, ErrUnsupportedAlgorithm
+	}
+	jwk := key.JWK()
+	// the thumbprint covers only the required members of the public key in lexicographic order
+	var members any
+	switch jwk.Kty {
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	}
+	data, err := json.Marshal(members)
+	if err != nil {
+		return Key{}, err
+	}
+	sum := sha256.Sum256(data)
+	key.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return key, nil
+}
+
+// the signing method of the algorithm, nil when the algorithm and the private key do not match
+func (k Key) signingMethod() jwt.SigningMethod {
+	switch k.Private.(type) {
+	case ed25519.PrivateKey:
+		if k.Algorithm == AlgorithmEdDSA {
+			return jwt.SigningMethodEdDSA
+		}
+	case *rsa.PrivateKey:
+		if k.Algorithm == AlgorithmRS256 {
+			return jwt.SigningMethodRS256
+		}
+	}
+	return nil
+}
+
+// JWK is the public part of a key as published in the JWKS, see RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// Ed25519 keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k Key) JWK() JWK {
+	jwk := JWK{Use: "sig", Alg: k.Algorithm, Kid: k.ID}
+	switch public := k.Private.Public().(type) {
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	}
+	return jwk
+}
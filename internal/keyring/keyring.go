@@ -0,0 +1,201 @@
+/*
+Package keyring signs the tokens of the app with asymmetric keys, so other services can verify them with the public
+keys published as a JWKS without holding any secret. Every token names its key in the kid header. Keys are rotated on
+a schedule: a new key is published a while before it takes over signing, and the old key keeps verifying the tokens it
+signed until they all expired, so a rotation never logs anybody out.
+*/
+package keyring
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrNoSigningKey = errors.New("no signing key")
+)
+
+// unknown kids reload the keys at most this often, so made up kids do not hit the store on every request
+const minReloadInterval = time.Minute
+
+// Store keeps the keys, implementations have to be safe for concurrent use
+type Store interface {
+	Keys() ([]Key, error)
+	// Add stores the key unless another key signs after the time, so rotations of several instances usually add a single key
+	Add(key Key, after time.Time) (bool, error)
+	Delete(ids []string) error
+}
+
+// Policy decides when keys are rotated
+type Policy struct {
+	// algorithm of new keys, keys of other algorithms still verify until they are retired
+	Algorithm string
+	// a new key takes over signing after this interval
+	RotationInterval time.Duration
+	// new keys are published this long before they sign, so verifiers caching the JWKS know them in time
+	PrePublish time.Duration
+	// keys verify tokens this long after a newer key took over, at least the lifetime of the longest lived token
+	VerifyFor time.Duration
+}
+
+// Keyring signs and verifies tokens with the keys kept in a store
+type Keyring struct {
+	Store  Store
+	Policy Policy
+
+	mu sync.RWMutex
+	// sorted by the time they sign from, oldest first
+	keys       []Key
+	lastReload time.Time
+	// replaced in tests
+	now func() time.Time
+}
+
+func New(store Store, policy Policy) *Keyring {
+	return &Keyring{Store: store, Policy: policy, now: time.Now}
+}
+
+// Reload replaces the keys with the ones in the store, picking up the keys other instances added
+func (r *Keyring) Reload() error {
+	keys, err := r.Store.Keys()
+	if err != nil {
+		return err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].NotBefore.Before(keys[j].NotBefore) })
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+	r.lastReload = r.now()
+	return nil
+}
+
+/*
+Rotate adds the next key when it is due and deletes the keys which cannot have signed any unexpired token anymore.
+The next key is due when the current one would sign for longer than the rotation interval once the next key is
+published long enough. Running it more often than the pre-publish time keeps the schedule.
+*/
+func (r *Keyring) Rotate() error {
+	if err := r.Reload(); err != nil {
+		return err
+	}
+	now := r.now()
+	keys := r.snapshot()
+	dueAfter := now.Add(r.Policy.PrePublish - r.Policy.RotationInterval)
+	if len(keys) == 0 || !keys[len(keys)-1].NotBefore.After(dueAfter) {
+		notBefore := now.Add(r.Policy.PrePublish)
+		if len(keys) == 0 {
+			// no token is signed yet so nobody has to know the first key in advance
+			notBefore = now
+		}
+		key, err := GenerateKey(r.Policy.Algorithm, notBefore, now)
+		if err != nil {
+			return err
+		}
+		if _, err := r.Store.Add(key, dueAfter); err != nil {
+			return err
+		}
+	}
+	var retired []string
+	for i := 0; i+1 < len(keys); i++ {
+		if keys[i+1].NotBefore.Add(r.Policy.VerifyFor).Before(now) {
+			retired = append(retired, keys[i].ID)
+		}
+	}
+	if len(retired) > 0 {
+		if err := r.Store.Delete(retired); err != nil {
+			return err
+		}
+	}
+	return r.Reload()
+}
+
+func (r *Keyring) snapshot() []Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys
+}
+
+// the newest key whose time to sign has come
+func (r *Keyring) signingKey() (Key, bool) {
+	keys := r.snapshot()
+	now := r.now()
+	for i := len(keys) - 1; i >= 0; i-- {
+		if !keys[i].NotBefore.After(now) {
+			return keys[i], true
+		}
+	}
+	return Key{}, false
+}
+
+// Sign signs the claims with the current key, the first key is created when there is none yet
+func (r *Keyring) Sign(claims jwt.Claims) (string, error) {
+	key, ok := r.signingKey()
+	if !ok {
+		if err := r.Rotate(); err != nil {
+			return "", err
+		}
+		if key, ok = r.signingKey(); !ok {
+			return "", ErrNoSigningKey
+		}
+	}
+	token := jwt.NewWithClaims(key.signingMethod(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+func (r *Keyring) key(id string) (Key, bool) {
+	for _, key := range r.snapshot() {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// whether an unknown kid may reload the keys, claims the reload so concurrent requests do not reload as well
+func (r *Keyring) claimReload() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.lastReload) < minReloadInterval {
+		return false
+	}
+	r.lastReload = now
+	return true
+}
+
+// Keyfunc returns the public key named by the kid header of the token, for jwt.Parse
+func (r *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	key, ok := r.key(id)
+	// the key may have been added by another instance since the last reload
+	if !ok && id != "" && r.claimReload() {
+		if err := r.Reload(); err != nil {
+			return nil, err
+		}
+		key, ok = r.key(id)
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	// a token must not pick a different algorithm than its key was made for
+	if token.Method.Alg() != key.signingMethod().Alg() {
+		return nil, ErrUnknownKey
+	}
+	return key.Private.Public(), nil
+}
+
+// JWKS returns the public keys of all keys, including the ones published ahead of signing
+func (r *Keyring) JWKS() JWKS {
+	keys := r.snapshot()
+	jwks := JWKS{Keys: make([]JWK, 0, len(keys))}
+	for _, key := range keys {
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+	return jwks
+}
@@ -0,0 +1,147 @@
+package keyring
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPolicy = Policy{
+	Algorithm:        AlgorithmEdDSA,
+	RotationInterval: 30 * 24 * time.Hour,
+	PrePublish:       24 * time.Hour,
+	VerifyFor:        48 * time.Hour,
+}
+
+func parse(t *testing.T, r *Keyring, token string) error {
+	t.Helper()
+	_, err := jwt.Parse(token, r.Keyfunc, jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}))
+	return err
+}
+
+func TestRotation(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	r := New(NewMemoryStore(), testPolicy)
+	r.now = func() time.Time { return now }
+
+	// the first key is created on demand and signs right away
+	first, err := r.Sign(jwt.RegisteredClaims{Subject: "jane"})
+	assert.NoError(t, err)
+	assert.NoError(t, parse(t, r, first))
+	assert.Len(t, r.JWKS().Keys, 1)
+	firstKey := r.JWKS().Keys[0]
+	assert.Equal(t, "OKP", firstKey.Kty)
+	assert.Equal(t, "Ed25519", firstKey.Crv)
+
+	// nothing is due within the interval
+	now = now.Add(28 * 24 * time.Hour)
+	assert.NoError(t, r.Rotate())
+	assert.Len(t, r.JWKS().Keys, 1)
+
+	// the next key is published a day ahead but does not sign yet
+	now = now.Add(24 * time.Hour)
+	assert.NoError(t, r.Rotate())
+	assert.Len(t, r.JWKS().Keys, 2)
+	token, _ := r.Sign(jwt.RegisteredClaims{})
+	kid, _, _ := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	assert.Equal(t, firstKey.Kid, kid.Header["kid"])
+
+	// a rotation does not add a further key while the next one is pending
+	assert.NoError(t, r.Rotate())
+	assert.Len(t, r.JWKS().Keys, 2)
+
+	// the next key takes over and the old one still verifies its tokens
+	now = now.Add(24 * time.Hour)
+	token, _ = r.Sign(jwt.RegisteredClaims{})
+	kid, _, _ = jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	assert.NotEqual(t, firstKey.Kid, kid.Header["kid"])
+	assert.NoError(t, parse(t, r, first))
+
+	// the old key is retired once all of its tokens expired
+	now = now.Add(49 * time.Hour)
+	assert.NoError(t, r.Rotate())
+	assert.Len(t, r.JWKS().Keys, 1)
+	assert.ErrorIs(t, parse(t, r, first), ErrUnknownKey)
+	assert.NoError(t, parse(t, r, token))
+}
+
+func TestKeyfunc(t *testing.T) {
+	store := NewMemoryStore()
+	r := New(store, testPolicy)
+	token, err := r.Sign(jwt.RegisteredClaims{})
+	assert.NoError(t, err)
+
+	// a key added by another instance is picked up
+	other := New(store, testPolicy)
+	assert.NoError(t, parse(t, other, token))
+
+	// tokens without a kid or with an algorithm the key was not made for are rejected
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{}).SignedString([]byte("secret"))
+	assert.Error(t, parse(t, r, unsigned))
+	key := store.keys[0]
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{})
+	forged.Header["kid"] = key.ID
+	forgedToken, _ := forged.SignedString([]byte(key.Private.Public().(ed25519.PublicKey)))
+	_, err = jwt.Parse(forgedToken, r.Keyfunc)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestRS256(t *testing.T) {
+	r := New(NewMemoryStore(), Policy{Algorithm: AlgorithmRS256, RotationInterval: time.Hour, VerifyFor: time.Hour})
+	token, err := r.Sign(jwt.RegisteredClaims{})
+	assert.NoError(t, err)
+	assert.NoError(t, parse(t, r, token))
+	jwk := r.JWKS().Keys[0]
+	assert.Equal(t, "RSA", jwk.Kty)
+	assert.Equal(t, "AQAB", jwk.E)
+	assert.Equal(t, AlgorithmRS256, jwk.Alg)
+}
+
+func TestThumbprint(t *testing.T) {
+	// Ed25519 key of RFC 8037 appendix A.1 with its thumbprint of appendix A.3
+	seed := []byte{0x9d, 0x61, 0xb1, 0x9d, 0xef, 0xfd, 0x5a, 0x60, 0xba, 0x84, 0x4a, 0xf4, 0x92, 0xec, 0x2c, 0xc4, 0x44, 0x49, 0xc5, 0x69, 0x7b, 0x32, 0x69, 0x19, 0x70, 0x3b, 0xac, 0x03, 0x1c, 0xae, 0x7f, 0x60}
+	key, err := newKey(AlgorithmEdDSA, ed25519.NewKeyFromSeed(seed), time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", key.ID)
+	assert.Equal(t, "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo", key.JWK().X)
+
+	_, err = newKey(AlgorithmRS256, ed25519.NewKeyFromSeed(seed), time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, ErrUnsupportedAlgorithm)
+}
+
+func TestPostgresStore(t *testing.T) {
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+	store := PostgresStore{DB: mockDB}
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	key, err := GenerateKey(AlgorithmEdDSA, now, now)
+	assert.NoError(t, err)
+	der, _ := x509.MarshalPKCS8PrivateKey(key.Private)
+
+	mockDB.ExpectExec(`^INSERT INTO passbook_app.signing_keys \(kid, algorithm, private_key, not_before, created_at\)\s+SELECT \$1, \$2, \$3, \$4, \$5 WHERE NOT EXISTS`).
+		WithArgs(key.ID, AlgorithmEdDSA, der, now, now, now.Add(-time.Hour)).
+		WillReturnResult(pgxmock.NewResult("INSERT", 0))
+	added, err := store.Add(key, now.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	mockDB.ExpectQuery(`^SELECT kid, algorithm, private_key, not_before, created_at FROM passbook_app.signing_keys$`).
+		WillReturnRows(pgxmock.NewRows([]string{"kid", "algorithm", "private_key", "not_before", "created_at"}).AddRow(key.ID, AlgorithmEdDSA, der, now, now))
+	keys, err := store.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []Key{key}, keys)
+
+	mockDB.ExpectExec(`^DELETE FROM passbook_app.signing_keys WHERE kid = ANY\(\$1\)$`).
+		WithArgs([]string{key.ID}).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	assert.NoError(t, store.Delete([]string{key.ID}))
+	assert.NoError(t, mockDB.ExpectationsWereMet())
+}
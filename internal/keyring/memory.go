@@ -0,0 +1,42 @@
+package keyring
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the keys in the memory of the process, a restart loses them and logs everybody out
+type MemoryStore struct {
+	mu   sync.Mutex
+	keys []Key
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Keys() ([]Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.keys), nil
+}
+
+func (s *MemoryStore) Add(key Key, after time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if k.NotBefore.After(after) {
+			return false, nil
+		}
+	}
+	s.keys = append(s.keys, key)
+	return true, nil
+}
+
+func (s *MemoryStore) Delete(ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = slices.DeleteFunc(s.keys, func(k Key) bool { return slices.Contains(ids, k.ID) })
+	return nil
+}
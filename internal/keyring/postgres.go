@@ -0,0 +1,73 @@
+package keyring
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DB is the part of a connection pool the PostgresStore uses
+type DB interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// PostgresStore keeps the keys in the passbook_app.signing_keys table so all instances of the app sign with the same keys
+type PostgresStore struct {
+	DB DB
+}
+
+func (s PostgresStore) Keys() ([]Key, error) {
+	rows, err := s.DB.Query(context.Background(), "SELECT kid, algorithm, private_key, not_before, created_at FROM passbook_app.signing_keys")
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	var key Key
+	var der []byte
+	_, err = pgx.ForEachRow(rows, []any{&key.ID, &key.Algorithm, &der, &key.NotBefore, &key.CreatedAt}, func() error {
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return err
+		}
+		private, ok := parsed.(crypto.Signer)
+		if !ok {
+			return ErrUnsupportedAlgorithm
+		}
+		key.Private = private
+		if key.signingMethod() == nil {
+			return errors.New("private key of kid " + key.ID + " does not match its algorithm " + key.Algorithm)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// instances rotating at the same moment may still both add a key, which is harmless as both are published and the newer one signs
+func (s PostgresStore) Add(key Key, after time.Time) (bool, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return false, err
+	}
+	tag, err := s.DB.Exec(context.Background(), `INSERT INTO passbook_app.signing_keys (kid, algorithm, private_key, not_before, created_at)
+		SELECT $1, $2, $3, $4, $5 WHERE NOT EXISTS (SELECT 1 FROM passbook_app.signing_keys WHERE not_before > $6)`,
+		key.ID, key.Algorithm, der, key.NotBefore, key.CreatedAt, after)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (s PostgresStore) Delete(ids []string) error {
+	_, err := s.DB.Exec(context.Background(), "DELETE FROM passbook_app.signing_keys WHERE kid = ANY($1)", ids)
+	return err
+}
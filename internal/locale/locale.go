@@ -0,0 +1,179 @@
+// Package locale formats amounts and dates by the preferences of a user: grouping and decimal separators of the locale, a date format and a time zone.
+package locale
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+)
+
+// Default are the preferences of users who did not set any, they match how the app showed amounts and dates before
+var Default = types.Preferences{
+	Currency:   "INR",
+	TimeZone:   "UTC",
+	Locale:     "en-US",
+	DateFormat: "DD MMM YYYY",
+}
+
+// separators of a locale, Indian grouping puts the separator after the thousands and then after every two digits
+type numberFormat struct {
+	group   string
+	decimal string
+	indian  bool
+}
+
+var numberFormats = map[string]numberFormat{
+	"en-US": {group: ",", decimal: "."},
+	"en-GB": {group: ",", decimal: "."},
+	"en-IN": {group: ",", decimal: ".", indian: true},
+	"hi-IN": {group: ",", decimal: ".", indian: true},
+	"ja-JP": {group: ",", decimal: "."},
+	"de-DE": {group: ".", decimal: ","},
+	"es-ES": {group: ".", decimal: ","},
+	"it-IT": {group: ".", decimal: ","},
+	"nl-NL": {group: ".", decimal: ","},
+	"pt-BR": {group: ".", decimal: ","},
+	// a no-break space so amounts are never split across lines
+	"fr-FR": {group: "\u00a0", decimal: ","},
+	"de-CH": {group: "'", decimal: "."},
+}
+
+// date formats users can pick from and their Go layouts
+var dateLayouts = map[string]string{
+	"YYYY-MM-DD":  "2006-01-02",
+	"DD/MM/YYYY":  "02/01/2006",
+	"MM/DD/YYYY":  "01/02/2006",
+	"DD.MM.YYYY":  "02.01.2006",
+	"DD-MM-YYYY":  "02-01-2006",
+	"DD MMM YYYY": "02 Jan 2006",
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+var (
+	ErrInvalidCurrency = errors.New("invalid currency, expected a 3 letter ISO 4217 code")
+	ErrUnknownTimeZone = errors.New("unknown time zone, expected an IANA name like Asia/Kolkata")
+	ErrUnknownLocale   = errors.New("unsupported locale, should be one of " + strings.Join(Locales(), ", "))
+	ErrUnknownFormat   = errors.New("unsupported date format, should be one of " + strings.Join(DateFormats(), ", "))
+)
+
+// IsCurrency reports whether code looks like an ISO 4217 currency code, e.g. "INR"
+func IsCurrency(code string) bool {
+	return currencyPattern.MatchString(code)
+}
+
+// Locales lists the supported locales
+func Locales() []string {
+	return sortedKeys(numberFormats)
+}
+
+// DateFormats lists the supported date formats
+func DateFormats() []string {
+	return sortedKeys(dateLayouts)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Format applies the preferences of a user. The zero value shows amounts without grouping and dates in UTC as
+"02 Jan 2006", which is what code formatting for no user in particular gets.
+*/
+type Format struct {
+	Currency   string
+	Location   *time.Location
+	dateLayout string
+	number     numberFormat
+}
+
+// New checks the preferences and returns the Format applying them
+func New(p types.Preferences) (Format, error) {
+	if !IsCurrency(p.Currency) {
+		return Format{}, ErrInvalidCurrency
+	}
+	// Local would be the zone of the server, not of the user
+	if p.TimeZone == "" || p.TimeZone == "Local" {
+		return Format{}, ErrUnknownTimeZone
+	}
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return Format{}, ErrUnknownTimeZone
+	}
+	number, ok := numberFormats[p.Locale]
+	if !ok {
+		return Format{}, ErrUnknownLocale
+	}
+	layout, ok := dateLayouts[p.DateFormat]
+	if !ok {
+		return Format{}, ErrUnknownFormat
+	}
+	return Format{Currency: p.Currency, Location: loc, dateLayout: layout, number: number}, nil
+}
+
+// In returns t in the time zone of the user
+func (f Format) In(t time.Time) time.Time {
+	if f.Location == nil {
+		return t.UTC()
+	}
+	return t.In(f.Location)
+}
+
+// Date formats the day of t in the time zone of the user
+func (f Format) Date(t time.Time) string {
+	layout := f.dateLayout
+	if layout == "" {
+		layout = "02 Jan 2006"
+	}
+	return f.In(t).Format(layout)
+}
+
+// Number formats an amount with the separators of the locale, like 1,23,456.78 for en-IN
+func (f Format) Number(m types.Money) string {
+	s := m.String()
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	units, cents, _ := strings.Cut(s, ".")
+	decimal := f.number.decimal
+	if decimal == "" {
+		decimal = "."
+	}
+	return sign + f.group(units) + decimal + cents
+}
+
+// Money formats an amount with the currency code in front, like INR 1,234.56
+func (f Format) Money(m types.Money) string {
+	if f.Currency == "" {
+		return f.Number(m)
+	}
+	return f.Currency + " " + f.Number(m)
+}
+
+// insert the group separator into the digits of the whole units
+func (f Format) group(digits string) string {
+	if f.number.group == "" || len(digits) <= 3 {
+		return digits
+	}
+	head, tail := digits[:len(digits)-3], digits[len(digits)-3:]
+	size := 3
+	if f.number.indian {
+		size = 2
+	}
+	groups := []string{tail}
+	for len(head) > size {
+		groups = append([]string{head[len(head)-size:]}, groups...)
+		head = head[:len(head)-size]
+	}
+	return head + f.number.group + strings.Join(groups, f.number.group)
+}
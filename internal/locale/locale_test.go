@@ -0,0 +1,70 @@
+package locale
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumber(t *testing.T) {
+	for _, tc := range []struct {
+		locale string
+		amount types.Money
+		want   string
+	}{
+		{"en-US", 123456789, "1,234,567.89"},
+		{"en-US", 99999, "999.99"},
+		{"en-US", -100000, "-1,000.00"},
+		{"en-IN", 123456789, "12,34,567.89"},
+		{"en-IN", 99999999999, "99,99,99,999.99"},
+		{"de-DE", 123456789, "1.234.567,89"},
+		{"fr-FR", 123456789, "1 234 567,89"},
+		{"de-CH", 5, "0.05"},
+	} {
+		f, err := New(types.Preferences{Currency: "EUR", TimeZone: "UTC", Locale: tc.locale, DateFormat: "YYYY-MM-DD"})
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, f.Number(tc.amount), tc.locale)
+	}
+}
+
+func TestZeroFormat(t *testing.T) {
+	var f Format
+	assert.Equal(t, "123456.78", f.Money(12345678))
+	// dates are shown in UTC
+	assert.Equal(t, "31 Mar 2024", f.Date(time.Date(2024, 4, 1, 2, 0, 0, 0, time.FixedZone("IST", 5*3600+1800))))
+}
+
+func TestDate(t *testing.T) {
+	f, err := New(types.Preferences{Currency: "INR", TimeZone: "Asia/Kolkata", Locale: "en-IN", DateFormat: "DD/MM/YYYY"})
+	assert.NoError(t, err)
+	// 20:00 UTC is already the next day in India
+	date := time.Date(2024, 3, 31, 20, 0, 0, 0, time.UTC)
+	assert.Equal(t, "01/04/2024", f.Date(date))
+	assert.Equal(t, "INR 1,00,000.00", f.Money(10000000))
+}
+
+func TestNewRejectsInvalidPreferences(t *testing.T) {
+	valid := Default
+	_, err := New(valid)
+	assert.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		change func(p *types.Preferences)
+		err    error
+	}{
+		"Lowercase currency": {func(p *types.Preferences) { p.Currency = "inr" }, ErrInvalidCurrency},
+		"Unknown time zone":  {func(p *types.Preferences) { p.TimeZone = "Mars/Olympus" }, ErrUnknownTimeZone},
+		"Server time zone":   {func(p *types.Preferences) { p.TimeZone = "Local" }, ErrUnknownTimeZone},
+		"Unknown locale":     {func(p *types.Preferences) { p.Locale = "xx-XX" }, ErrUnknownLocale},
+		"Unknown format":     {func(p *types.Preferences) { p.DateFormat = "YY/M/D" }, ErrUnknownFormat},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := valid
+			tc.change(&p)
+			_, err := New(p)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
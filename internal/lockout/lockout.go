@@ -0,0 +1,131 @@
+/*
+Package lockout slows down password guessing. Failed attempts are counted per key (a username, a client IP), every
+failure past the free attempts doubles the wait before the next attempt and enough failures lock the key out for a
+while. Counters live in a Store, in memory for a single instance or in Postgres when several instances share them.
+*/
+package lockout
+
+import (
+	"time"
+)
+
+// Attempts are the failed attempts of a key since its counter last started over
+type Attempts struct {
+	Failures     int
+	LastFailedAt time.Time
+}
+
+// Store keeps the failed attempts of keys, implementations have to be safe for concurrent use
+type Store interface {
+	Get(key string) (Attempts, error)
+	/*
+		Attempt counts an attempt of the key at now as a failure unless the key still has to wait by the policy, checking
+		and counting in one step so concurrent attempts cannot all pass the check before any of them is counted. The
+		counter starts over when the last failure is outside the window. Returns the attempts of the key and whether the
+		attempt was counted.
+	*/
+	Attempt(key string, now time.Time, p Policy) (Attempts, bool, error)
+	// Forgive takes back one counted failure of the key
+	Forgive(key string) error
+	Reset(key string) error
+	// Purge forgets the keys whose last failure is before the time
+	Purge(before time.Time) error
+}
+
+// Policy decides how long a key has to wait after a number of failures
+type Policy struct {
+	// failures without any wait
+	FreeAttempts int
+	// wait after the first failure past the free attempts, doubled with every further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// failures after which the key is locked out for LockoutDuration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// failures older than this are forgotten
+	Window time.Duration
+}
+
+// Delay is the wait after the last of the failures
+func (p Policy) Delay(failures int) time.Duration {
+	if failures >= p.LockoutThreshold {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// Wait is how long a key still has to wait at now after its attempts, 0 when it may try right away
+func (p Policy) Wait(a Attempts, now time.Time) time.Duration {
+	if a.Failures == 0 || now.Sub(a.LastFailedAt) > p.Window {
+		return 0
+	}
+	return max(a.LastFailedAt.Add(p.Delay(a.Failures)).Sub(now), 0)
+}
+
+// Limiter applies a policy to the attempts kept in a store
+type Limiter struct {
+	Store  Store
+	Policy Policy
+	// replaced in tests
+	now func() time.Time
+}
+
+func NewLimiter(store Store, policy Policy) *Limiter {
+	return &Limiter{Store: store, Policy: policy, now: time.Now}
+}
+
+/*
+Attempt starts an attempt of the key. When the key still has to wait nothing is counted, false is returned along with
+the remaining wait. Otherwise the attempt is counted as a failure right away, a successful attempt takes it back with
+Reset or Forgive.
+*/
+func (l *Limiter) Attempt(key string) (bool, time.Duration, error) {
+	now := l.now()
+	a, counted, err := l.Store.Attempt(key, now, l.Policy)
+	if err != nil {
+		return false, 0, err
+	}
+	if counted {
+		return true, 0, nil
+	}
+	wait := l.Policy.Wait(a, now)
+	if wait == 0 {
+		// the key was reset in the meantime, it still waits a moment so the attempt is not let through uncounted
+		wait = time.Second
+	}
+	return false, wait, nil
+}
+
+// Status returns the wait caused by the failures of the key and whether they lock it out, e.g. to report a failed attempt
+func (l *Limiter) Status(key string) (time.Duration, bool, error) {
+	a, err := l.Store.Get(key)
+	if err != nil {
+		return 0, false, err
+	}
+	if l.Policy.Wait(a, l.now()) == 0 {
+		return 0, false, nil
+	}
+	return l.Policy.Delay(a.Failures), a.Failures >= l.Policy.LockoutThreshold, nil
+}
+
+// Forgive takes back an attempt of the key counted by Attempt, e.g. the attempt of a client IP after a successful login
+func (l *Limiter) Forgive(key string) error {
+	return l.Store.Forgive(key)
+}
+
+// Reset forgets the failures of the key, e.g. after a successful login
+func (l *Limiter) Reset(key string) error {
+	return l.Store.Reset(key)
+}
+
+// Purge forgets the keys without failures in the window of the policy
+func (l *Limiter) Purge() error {
+	return l.Store.Purge(l.now().Add(-l.Policy.Window))
+}
@@ -0,0 +1,161 @@
+package lockout
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPolicy = Policy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         5 * time.Second,
+	LockoutThreshold: 8,
+	LockoutDuration:  time.Hour,
+	Window:           2 * time.Hour,
+}
+
+func TestPolicyDelay(t *testing.T) {
+	want := []time.Duration{0, 0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, time.Hour, time.Hour}
+	for failures, delay := range want {
+		assert.Equal(t, delay, testPolicy.Delay(failures), failures)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(NewMemoryStore(), testPolicy)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < testPolicy.FreeAttempts; i++ {
+		allowed, _, err := limiter.Attempt("user:jane")
+		assert.NoError(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, _, _ := limiter.Attempt("user:jane")
+	assert.True(t, allowed)
+	wait, locked, _ := limiter.Status("user:jane")
+	assert.Equal(t, time.Second, wait)
+	assert.False(t, locked)
+	// the next attempt has to wait and is not counted
+	allowed, wait, _ = limiter.Attempt("user:jane")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+	a, _ := limiter.Store.Get("user:jane")
+	assert.Equal(t, testPolicy.FreeAttempts+1, a.Failures)
+	// other keys are not affected
+	allowed, _, _ = limiter.Attempt("user:john")
+	assert.True(t, allowed)
+
+	now = now.Add(500 * time.Millisecond)
+	_, wait, _ = limiter.Attempt("user:jane")
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	for _, delay := range []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		now = now.Add(delay)
+		allowed, _, _ = limiter.Attempt("user:jane")
+		assert.True(t, allowed)
+	}
+	now = now.Add(5 * time.Second)
+	limiter.Attempt("user:jane")
+	wait, locked, _ = limiter.Status("user:jane")
+	assert.True(t, locked)
+	assert.Equal(t, time.Hour, wait)
+
+	// the lockout ends after its duration
+	now = now.Add(time.Hour)
+	allowed, _, _ = limiter.Attempt("user:jane")
+	assert.True(t, allowed)
+
+	// a success starts over
+	assert.NoError(t, limiter.Reset("user:jane"))
+	allowed, _, _ = limiter.Attempt("user:jane")
+	assert.True(t, allowed)
+	a, _ = limiter.Store.Get("user:jane")
+	assert.Equal(t, 1, a.Failures)
+
+	// a forgiven attempt is not counted anymore
+	limiter.Attempt("ip:192.0.2.1")
+	limiter.Attempt("ip:192.0.2.1")
+	assert.NoError(t, limiter.Forgive("ip:192.0.2.1"))
+	a, _ = limiter.Store.Get("ip:192.0.2.1")
+	assert.Equal(t, 1, a.Failures)
+
+	// failures outside of the window are forgotten
+	now = now.Add(3 * time.Hour)
+	assert.NoError(t, limiter.Purge())
+	a, _ = limiter.Store.Get("user:jane")
+	assert.Zero(t, a.Failures)
+}
+
+func TestMemoryStoreConcurrentAttempts(t *testing.T) {
+	limiter := NewLimiter(NewMemoryStore(), testPolicy)
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _, _ := limiter.Attempt("user:jane"); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	// only the free attempts and the one failure starting the backoff get through
+	assert.Equal(t, int32(testPolicy.FreeAttempts+1), allowed.Load())
+}
+
+func TestPostgresStore(t *testing.T) {
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+	store := PostgresStore{DB: mockDB}
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	attemptSQL := `^INSERT INTO passbook_app.login_attempts \(attempt_key, failures, last_failed_at\) VALUES \(\$1, 1, \$2\)\s+ON CONFLICT \(attempt_key\) DO UPDATE SET .+ WHERE .+ RETURNING failures$`
+	delays := []int64{0, 0, 0, 0, 1000, 2000, 4000, 5000, 3600000}
+	mockDB.ExpectQuery(attemptSQL).
+		WithArgs("ip:192.0.2.1", now, now.Add(-2*time.Hour), delays, 8).
+		WillReturnRows(pgxmock.NewRows([]string{"failures"}).AddRow(4))
+	a, counted, err := store.Attempt("ip:192.0.2.1", now, testPolicy)
+	assert.NoError(t, err)
+	assert.True(t, counted)
+	assert.Equal(t, Attempts{Failures: 4, LastFailedAt: now}, a)
+
+	// a key that still has to wait is not updated
+	mockDB.ExpectQuery(attemptSQL).
+		WithArgs("ip:192.0.2.1", now, now.Add(-2*time.Hour), delays, 8).
+		WillReturnRows(pgxmock.NewRows([]string{"failures"}))
+	mockDB.ExpectQuery(`^SELECT failures, last_failed_at FROM passbook_app.login_attempts WHERE attempt_key=\$1$`).
+		WithArgs("ip:192.0.2.1").
+		WillReturnRows(pgxmock.NewRows([]string{"failures", "last_failed_at"}).AddRow(4, now))
+	a, counted, err = store.Attempt("ip:192.0.2.1", now, testPolicy)
+	assert.NoError(t, err)
+	assert.False(t, counted)
+	assert.Equal(t, Attempts{Failures: 4, LastFailedAt: now}, a)
+
+	mockDB.ExpectExec(`^UPDATE passbook_app.login_attempts SET failures = failures - 1 WHERE attempt_key=\$1 AND failures > 0$`).
+		WithArgs("ip:192.0.2.1").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	assert.NoError(t, store.Forgive("ip:192.0.2.1"))
+
+	mockDB.ExpectQuery(`^SELECT failures, last_failed_at FROM passbook_app.login_attempts WHERE attempt_key=\$1$`).
+		WithArgs("ip:192.0.2.2").
+		WillReturnRows(pgxmock.NewRows([]string{"failures", "last_failed_at"}))
+	a, err = store.Get("ip:192.0.2.2")
+	assert.NoError(t, err)
+	assert.Zero(t, a.Failures)
+
+	mockDB.ExpectExec(`^DELETE FROM passbook_app.login_attempts WHERE attempt_key=\$1$`).
+		WithArgs("ip:192.0.2.1").
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	assert.NoError(t, store.Reset("ip:192.0.2.1"))
+	assert.NoError(t, mockDB.ExpectationsWereMet())
+}
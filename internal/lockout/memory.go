@@ -0,0 +1,73 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the attempts in the memory of the process, counters are not shared between instances
+type MemoryStore struct {
+	mu       sync.Mutex
+	attempts map[string]Attempts
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{attempts: make(map[string]Attempts)}
+}
+
+func (s *MemoryStore) Get(key string) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key], nil
+}
+
+// checked and counted under the lock of the store
+func (s *MemoryStore) Attempt(key string, now time.Time, p Policy) (Attempts, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.attempts[key]
+	if p.Wait(a, now) > 0 {
+		return a, false, nil
+	}
+	if now.Sub(a.LastFailedAt) > p.Window {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailedAt = now
+	s.attempts[key] = a
+	return a, true, nil
+}
+
+func (s *MemoryStore) Forgive(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attempts[key]
+	if !ok {
+		return nil
+	}
+	if a.Failures <= 1 {
+		delete(s.attempts, key)
+		return nil
+	}
+	a.Failures--
+	s.attempts[key] = a
+	return nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryStore) Purge(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, a := range s.attempts {
+		if a.LastFailedAt.Before(before) {
+			delete(s.attempts, key)
+		}
+	}
+	return nil
+}
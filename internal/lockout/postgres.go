@@ -0,0 +1,74 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DB is the part of a connection pool the PostgresStore uses
+type DB interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// PostgresStore keeps the attempts in the passbook_app.login_attempts table so all instances of the app share them
+type PostgresStore struct {
+	DB DB
+}
+
+func (s PostgresStore) Get(key string) (Attempts, error) {
+	var a Attempts
+	err := s.DB.QueryRow(context.Background(), "SELECT failures, last_failed_at FROM passbook_app.login_attempts WHERE attempt_key=$1", key).Scan(&a.Failures, &a.LastFailedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Attempts{}, nil
+	}
+	return a, err
+}
+
+/*
+Checked and counted in a single statement, the update only applies to a key that does not have to wait anymore so
+concurrent attempts are all counted and none of them passes while another one is waiting. The delays of the policy are
+passed in milliseconds by number of failures, up to the lockout. Nothing is returned for an attempt that was not
+counted, the attempts of the key are read again for its wait then.
+*/
+func (s PostgresStore) Attempt(key string, now time.Time, p Policy) (Attempts, bool, error) {
+	delays := make([]int64, p.LockoutThreshold+1)
+	for failures := range delays {
+		delays[failures] = p.Delay(failures).Milliseconds()
+	}
+	a := Attempts{LastFailedAt: now}
+	err := s.DB.QueryRow(context.Background(), `INSERT INTO passbook_app.login_attempts (attempt_key, failures, last_failed_at) VALUES ($1, 1, $2)
+		ON CONFLICT (attempt_key) DO UPDATE SET
+			failures = CASE WHEN passbook_app.login_attempts.last_failed_at < $3 THEN 1 ELSE passbook_app.login_attempts.failures + 1 END,
+			last_failed_at = $2
+		WHERE passbook_app.login_attempts.last_failed_at < $3
+			OR passbook_app.login_attempts.last_failed_at + ($4::bigint[])[least(passbook_app.login_attempts.failures, $5) + 1] * interval '1 millisecond' <= $2
+		RETURNING failures`, key, now, now.Add(-p.Window), delays, p.LockoutThreshold).Scan(&a.Failures)
+	if errors.Is(err, pgx.ErrNoRows) {
+		a, err = s.Get(key)
+		return a, false, err
+	}
+	if err != nil {
+		return Attempts{}, false, err
+	}
+	return a, true, nil
+}
+
+func (s PostgresStore) Forgive(key string) error {
+	_, err := s.DB.Exec(context.Background(), "UPDATE passbook_app.login_attempts SET failures = failures - 1 WHERE attempt_key=$1 AND failures > 0", key)
+	return err
+}
+
+func (s PostgresStore) Reset(key string) error {
+	_, err := s.DB.Exec(context.Background(), "DELETE FROM passbook_app.login_attempts WHERE attempt_key=$1", key)
+	return err
+}
+
+func (s PostgresStore) Purge(before time.Time) error {
+	_, err := s.DB.Exec(context.Background(), "DELETE FROM passbook_app.login_attempts WHERE last_failed_at < $1", before)
+	return err
+}
@@ -0,0 +1,129 @@
+// Package mailer sends the transactional emails of the app like password reset links through a pluggable Sender.
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages, implementations have to be safe for concurrent use
+type Sender interface {
+	Send(msg Message) error
+}
+
+// Bytes of the message in RFC 5322 format with the given sender address
+func (m Message) Bytes(from string, date time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", headerValue(m.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	// SMTP requires CRLF line endings in the body as well
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// line breaks in a header value would start new headers
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// SMTPSender delivers messages through an SMTP server, authenticating with PLAIN auth when a username is set
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send uses the bare address of From as envelope sender, the display name only goes into the From header
+func (s SMTPSender) Send(msg Message) error {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address %q: %w", s.From, err)
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, from.Address, []string{msg.To}, msg.Bytes(s.From, time.Now()))
+}
+
+/*
+LogSender does not deliver messages, it writes every message to a .eml file in Dir or, when Dir is empty, to the log.
+Meant for local development and tests where the links sent by email can be picked up from the files.
+*/
+type LogSender struct {
+	Dir  string
+	From string
+	// makes the file names unique when messages are sent within the same nanosecond
+	count atomic.Int64
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (s *LogSender) Send(msg Message) error {
+	now := time.Now()
+	content := msg.Bytes(s.From, now)
+	if s.Dir == "" {
+		log.Printf("Mail to %s\n%s", msg.To, content)
+		return nil
+	}
+	name := fmt.Sprintf("%d-%d-%s.eml", now.UnixNano(), s.count.Add(1), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	return os.WriteFile(filepath.Join(s.Dir, name), content, 0o600)
+}
+
+/*
+FromEnv returns the sender configured by the environment. MAIL_SENDER=smtp delivers through SMTP_HOST, SMTP_PORT,
+SMTP_USERNAME and SMTP_PASSWORD, anything else logs the messages or writes them to MAIL_LOG_DIR. MAIL_FROM is the
+sender address of all messages.
+*/
+func FromEnv() (Sender, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Passbook App <no-reply@localhost>"
+	}
+	if os.Getenv("MAIL_SENDER") == "smtp" {
+		if _, err := mail.ParseAddress(from); err != nil {
+			return nil, fmt.Errorf("invalid MAIL_FROM %q: %w", from, err)
+		}
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mail sender")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return SMTPSender{Host: host, Port: port, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD"), From: from}, nil
+	}
+	dir := os.Getenv("MAIL_LOG_DIR")
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &LogSender{Dir: dir, From: from}, nil
+}
@@ -0,0 +1,123 @@
+package mailer
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageBytes(t *testing.T) {
+	msg := Message{To: "jane@example.com", Subject: "Réinitialiser", Body: "Hello\nWorld"}
+	out := string(msg.Bytes("Passbook <no-reply@example.com>", time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC)))
+	assert.Contains(t, out, "From: Passbook <no-reply@example.com>\r\n")
+	assert.Contains(t, out, "To: jane@example.com\r\n")
+	assert.Contains(t, out, "Subject: =?utf-8?q?R=C3=A9initialiser?=\r\n")
+	assert.Contains(t, out, "Date: Mon, 01 Apr 2024 09:00:00 +0000\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\nHello\r\nWorld"))
+}
+
+// minimal SMTP server accepting one message, returns the commands the client sent
+func fakeSMTPServer(t *testing.T) (string, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	commands := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var received []string
+		defer func() { commands <- received }()
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost ESMTP\r\n"))
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if inData {
+				if line == "." {
+					inData = false
+					conn.Write([]byte("250 OK\r\n"))
+				}
+				continue
+			}
+			received = append(received, line)
+			switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+			case "DATA":
+				inData = true
+				conn.Write([]byte("354 Go ahead\r\n"))
+			case "QUIT":
+				conn.Write([]byte("221 Bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+	return listener.Addr().String(), commands
+}
+
+func TestSMTPSenderEnvelope(t *testing.T) {
+	addr, commands := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	sender := SMTPSender{Host: host, Port: port, From: "Passbook App <no-reply@localhost>"}
+
+	assert.NoError(t, sender.Send(Message{To: "jane@example.com", Subject: "Hi", Body: "Hello"}))
+	received := <-commands
+	assert.Contains(t, received, "MAIL FROM:<no-reply@localhost>")
+	assert.Contains(t, received, "RCPT TO:<jane@example.com>")
+
+	sender.From = "not an address"
+	assert.Error(t, sender.Send(Message{To: "jane@example.com", Subject: "Hi", Body: "Hello"}))
+}
+
+func TestLogSenderWritesFiles(t *testing.T) {
+	dir := t.TempDir()
+	sender := &LogSender{Dir: dir, From: "no-reply@example.com"}
+	assert.NoError(t, sender.Send(Message{To: "jane@example.com", Subject: "First", Body: "one"}))
+	assert.NoError(t, sender.Send(Message{To: "jane@example.com", Subject: "Second", Body: "two"}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	content, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "To: jane@example.com")
+	assert.Contains(t, files[0], "jane_example.com.eml")
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("MAIL_SENDER", "smtp")
+	t.Setenv("SMTP_HOST", "")
+	_, err := FromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	sender, err := FromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "587", sender.(SMTPSender).Port)
+
+	t.Setenv("MAIL_FROM", "Passbook App no-reply")
+	_, err = FromEnv()
+	assert.Error(t, err)
+	t.Setenv("MAIL_FROM", "")
+
+	t.Setenv("MAIL_SENDER", "log")
+	t.Setenv("MAIL_LOG_DIR", filepath.Join(t.TempDir(), "mails"))
+	sender, err = FromEnv()
+	assert.NoError(t, err)
+	assert.IsType(t, &LogSender{}, sender)
+}
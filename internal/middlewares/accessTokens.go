@@ -0,0 +1,103 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// AccessTokenPrefix tells personal access tokens apart from JWTs in the Authorization header
+const AccessTokenPrefix = "pbk_"
+
+// scopes of personal access tokens, a route accepts access tokens only when it declares the scopes it needs
+const (
+	ScopePassbooksRead     = "passbooks:read"
+	ScopePassbooksWrite    = "passbooks:write"
+	ScopeTransactionsRead  = "transactions:read"
+	ScopeTransactionsWrite = "transactions:write"
+	ScopeImportsWrite      = "imports:write"
+	ScopeExportsRead       = "exports:read"
+)
+
+// Scopes are all scopes an access token can be given
+var Scopes = []string{ScopePassbooksRead, ScopePassbooksWrite, ScopeTransactionsRead, ScopeTransactionsWrite, ScopeImportsWrite, ScopeExportsRead}
+
+// last_used_at of a token is written at most this often so busy scripts do not write on every request
+const accessTokenLastUsedInterval = time.Minute
+
+// context key of the passbooks an access token is restricted to, not set for unrestricted tokens and JWTs
+const tokenPassbookIDsKey = "tokenPassbookIds"
+
+func abortWithError(ctx *gin.Context, code int, message string) {
+	ctx.AbortWithStatusJSON(code, gin.H{
+		"status":  "error",
+		"message": message,
+	})
+}
+
+/*
+authenticate a request carrying a personal access token. The token needs all scopes of the route, and a token
+restricted to some passbooks may only use the passbook in the path of the route. Routes without a passbook in the
+path check the restriction themselves with CanAccessPassbook.
+*/
+func authenticateAccessToken(ctx *gin.Context, token string, scopes []string) {
+	if len(scopes) == 0 {
+		abortWithError(ctx, http.StatusForbidden, "Personal access tokens cannot be used for this request")
+		return
+	}
+	now := time.Now().UTC()
+	var tokenID, userID string
+	var tokenScopes, passbookIDs []string
+	err := initializers.DB.QueryRow(context.Background(), "SELECT token_id, user_id, scopes, passbook_ids FROM passbook_app.personal_access_tokens WHERE token_hash=$1 AND (expires_at IS NULL OR expires_at > $2)",
+		utils.HashToken(token), now).Scan(&tokenID, &userID, &tokenScopes, &passbookIDs)
+	if errors.Is(err, pgx.ErrNoRows) {
+		abortWithError(ctx, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to look up personal access token", err)
+		abortWithError(ctx, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(tokenScopes, scope) {
+			abortWithError(ctx, http.StatusForbidden, "Token is missing the "+scope+" scope")
+			return
+		}
+	}
+	if passbookIDs != nil {
+		if passbookID := ctx.Param("passbook_id"); passbookID != "" && !slices.Contains(passbookIDs, passbookID) {
+			abortWithError(ctx, http.StatusForbidden, "Token is not allowed to access this passbook")
+			return
+		}
+		ctx.Set(tokenPassbookIDsKey, passbookIDs)
+	}
+	_, err = initializers.DB.Exec(context.Background(), "UPDATE passbook_app.personal_access_tokens SET last_used_at=$1 WHERE token_id=$2 AND (last_used_at IS NULL OR last_used_at < $3)",
+		now, tokenID, now.Add(-accessTokenLastUsedInterval))
+	if err != nil {
+		log.Println("Failed to update last use of personal access token", tokenID, err)
+	}
+	ctx.Set("userId", userID)
+	ctx.Set("tokenId", tokenID)
+	authenticated(ctx)
+}
+
+// CanAccessPassbook reports whether the request may use the passbook, false only for access tokens restricted to other passbooks
+func CanAccessPassbook(ctx *gin.Context, passbookID string) bool {
+	ids, restricted := ctx.Get(tokenPassbookIDsKey)
+	return !restricted || slices.Contains(ids.([]string), passbookID)
+}
+
+// IsPassbookRestricted reports whether the request uses an access token restricted to some passbooks
+func IsPassbookRestricted(ctx *gin.Context) bool {
+	_, restricted := ctx.Get(tokenPassbookIDsKey)
+	return restricted
+}
@@ -1,18 +1,33 @@
 package middlewares
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"strings"
 
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/keyring"
 	"github.com/akashsharma99/passbook-app/internal/types"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 )
 
-// Auth User middleware to check if the user is authenticated
-func AuthUser() gin.HandlerFunc {
+var (
+	errLegacyToken  = errors.New("legacy HS256 tokens are not accepted anymore")
+	errTokenPurpose = errors.New("token issued for another purpose")
+	// HS256 is only accepted with a legacy secret
+	validSigningMethods = []string{keyring.AlgorithmEdDSA, keyring.AlgorithmRS256, jwt.SigningMethodHS256.Alg()}
+)
+
+/*
+Auth User middleware to check if the user is authenticated. Personal access tokens are accepted in place of an access
+token only by routes passing the scopes they need, routes without scopes are for JWTs only.
+*/
+func AuthUser(scopes ...string) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		// check for the Authorization header
 		authHeader := ctx.GetHeader("Authorization")
@@ -32,7 +47,12 @@ func AuthUser() gin.HandlerFunc {
 			return
 		}
 		jwtToken := authHeaderParts[1]
-		claims, err := ValidateToken(jwtToken, os.Getenv("ACCESS_SECRET"))
+		if strings.HasPrefix(jwtToken, AccessTokenPrefix) {
+			authenticateAccessToken(ctx, jwtToken, scopes)
+			return
+		}
+		// tokens with a purpose like an MFA challenge are signed with the same keys but are no access tokens
+		claims, err := ValidateToken(jwtToken, "", os.Getenv("ACCESS_SECRET"))
 		if err != nil {
 			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"status":  "error",
@@ -41,15 +61,92 @@ func AuthUser() gin.HandlerFunc {
 			return
 		}
 		ctx.Set("userId", claims.UserID)
+		ctx.Set("sessionId", claims.SessionID)
+		authenticated(ctx)
+	}
+}
+
+// context key marking a request to one of the routes of VerifiedEmailRoutes
+const verifiedEmailRequiredKey = "verifiedEmailRequired"
+
+/*
+VerifiedEmailRoutes marks the requests to the routes, given as method and full path, which need a verified email.
+AuthUser runs RequireVerifiedEmail on them once the user is known, so the sensitive routes are listed in one place.
+It has to be used by the engine before the routes are added.
+*/
+func VerifiedEmailRoutes(routes ...string) gin.HandlerFunc {
+	marked := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		marked[route] = true
+	}
+	return func(ctx *gin.Context) {
+		if marked[ctx.Request.Method+" "+ctx.FullPath()] {
+			ctx.Set(verifiedEmailRequiredKey, true)
+		}
 		ctx.Next()
 	}
 }
 
-func ValidateToken(jwtToken string, secret string) (*types.UserTokenClaims, error) {
+// continue with the route of an authenticated request, checking the email first on the routes of VerifiedEmailRoutes
+func authenticated(ctx *gin.Context) {
+	if ctx.GetBool(verifiedEmailRequiredKey) {
+		RequireVerifiedEmail()(ctx)
+		return
+	}
+	ctx.Next()
+}
+
+/*
+RequireVerifiedEmail blocks sensitive operations of users who have not verified their email yet, when the policy is
+enabled with REQUIRE_VERIFIED_EMAIL=true. It has to run after AuthUser, which does so on the routes of
+VerifiedEmailRoutes.
+*/
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if os.Getenv("REQUIRE_VERIFIED_EMAIL") != "true" {
+			ctx.Next()
+			return
+		}
+		userID := ctx.MustGet("userId").(string)
+		var verified bool
+		err := initializers.DB.QueryRow(context.Background(), "SELECT email_verified_at IS NOT NULL FROM passbook_app.users WHERE user_id=$1", userID).Scan(&verified)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			log.Println("Failed to check email verification of user_id:", userID, err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": "Internal server error",
+			})
+			return
+		}
+		if !verified {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"status":  "error",
+				"message": "Please verify your email address to continue",
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+/*
+ValidateToken checks the signature and expiry of a token signed by the token keyring and that it was issued for the
+purpose, "" for access tokens. Tokens signed with HS256 before the keyring existed are still accepted while their
+legacy secret is configured, their purpose is implied by the secret.
+*/
+func ValidateToken(jwtToken string, purpose string, legacySecret string) (*types.UserTokenClaims, error) {
 	claims := &types.UserTokenClaims{}
+	legacy := false
 	token, err := jwt.ParseWithClaims(jwtToken, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	}, jwt.WithExpirationRequired(), jwt.WithIssuedAt())
+		if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+			if legacySecret == "" {
+				return nil, errLegacyToken
+			}
+			legacy = true
+			return []byte(legacySecret), nil
+		}
+		return initializers.TokenKeyring.Keyfunc(token)
+	}, jwt.WithValidMethods(validSigningMethods), jwt.WithExpirationRequired(), jwt.WithIssuedAt())
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -58,5 +155,9 @@ func ValidateToken(jwtToken string, secret string) (*types.UserTokenClaims, erro
 		log.Println("Invalid token")
 		return nil, err
 	}
+	if claims.Purpose != purpose && !(legacy && claims.Purpose == "") {
+		log.Println("Token of purpose", claims.Purpose, "used as", purpose)
+		return nil, errTokenPurpose
+	}
 	return claims, nil
 }
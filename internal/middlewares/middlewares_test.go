@@ -0,0 +1,64 @@
+package middlewares
+
+import (
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func testClaims(purpose string) types.UserTokenClaims {
+	now := time.Now()
+	return types.UserTokenClaims{
+		UserID:  "test-user-id",
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	t.Run("Purpose has to match", func(t *testing.T) {
+		mfaToken, err := initializers.TokenKeyring.Sign(testClaims(types.TokenPurposeMFA))
+		assert.NoError(t, err)
+
+		claims, err := ValidateToken(mfaToken, types.TokenPurposeMFA, "")
+		assert.NoError(t, err)
+		assert.Equal(t, "test-user-id", claims.UserID)
+		_, err = ValidateToken(mfaToken, "", "")
+		assert.ErrorIs(t, err, errTokenPurpose)
+		_, err = ValidateToken(mfaToken, types.TokenPurposeRefresh, "")
+		assert.ErrorIs(t, err, errTokenPurpose)
+	})
+
+	t.Run("Legacy tokens need their secret", func(t *testing.T) {
+		legacyToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims("")).SignedString([]byte("legacy-refresh-secret"))
+
+		_, err := ValidateToken(legacyToken, types.TokenPurposeRefresh, "")
+		assert.Error(t, err)
+		_, err = ValidateToken(legacyToken, types.TokenPurposeRefresh, "another-secret")
+		assert.Error(t, err)
+		claims, err := ValidateToken(legacyToken, types.TokenPurposeRefresh, "legacy-refresh-secret")
+		assert.NoError(t, err)
+		assert.Equal(t, "test-user-id", claims.UserID)
+	})
+
+	t.Run("Legacy MFA tokens are no access tokens", func(t *testing.T) {
+		legacyToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims(types.TokenPurposeMFA)).SignedString([]byte("legacy-access-secret"))
+
+		_, err := ValidateToken(legacyToken, "", "legacy-access-secret")
+		assert.ErrorIs(t, err, errTokenPurpose)
+	})
+
+	t.Run("Unsigned tokens are rejected", func(t *testing.T) {
+		unsignedToken, _ := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims("")).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+		_, err := ValidateToken(unsignedToken, "", "legacy-access-secret")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,133 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const redirectURL = "https://passbook.example.com/oidc/callback"
+
+func TestLogin(t *testing.T) {
+	for name, secret := range map[string]string{"Confidential client": "s3cret:&+", "Public client": ""} {
+		t.Run(name, func(t *testing.T) {
+			idp := oidctest.NewServer("passbook", secret)
+			defer idp.Close()
+			provider := NewProvider(Config{Issuer: idp.Issuer(), ClientID: "passbook", ClientSecret: secret, RedirectURL: redirectURL})
+
+			verifier, err := NewCodeVerifier()
+			assert.NoError(t, err)
+			authURL, err := provider.AuthCodeURL(context.Background(), "the-state", "the-nonce", CodeChallenge(verifier))
+			assert.NoError(t, err)
+			u, _ := url.Parse(authURL)
+			assert.Equal(t, "openid email profile", u.Query().Get("scope"))
+			assert.Equal(t, redirectURL, u.Query().Get("redirect_uri"))
+
+			code, state, err := idp.Authorize(authURL)
+			assert.NoError(t, err)
+			assert.Equal(t, "the-state", state)
+
+			idToken, err := provider.Exchange(context.Background(), code, verifier)
+			assert.NoError(t, err)
+			claims, err := provider.VerifyIDToken(context.Background(), idToken, "the-nonce")
+			assert.NoError(t, err)
+			assert.Equal(t, "oidctest-subject", claims.Subject)
+			assert.Equal(t, "jane@example.com", claims.Email)
+			assert.True(t, bool(claims.EmailVerified))
+			assert.Equal(t, "jane", claims.PreferredUsername)
+
+			// the code was used up
+			_, err = provider.Exchange(context.Background(), code, verifier)
+			assert.ErrorIs(t, err, ErrExchangeFailed)
+		})
+	}
+}
+
+func TestExchangeChecksVerifier(t *testing.T) {
+	idp := oidctest.NewServer("passbook", "secret")
+	defer idp.Close()
+	provider := NewProvider(Config{Issuer: idp.Issuer(), ClientID: "passbook", ClientSecret: "secret", RedirectURL: redirectURL})
+
+	verifier, _ := NewCodeVerifier()
+	authURL, err := provider.AuthCodeURL(context.Background(), "state", "nonce", CodeChallenge(verifier))
+	assert.NoError(t, err)
+	code, _, err := idp.Authorize(authURL)
+	assert.NoError(t, err)
+
+	other, _ := NewCodeVerifier()
+	_, err = provider.Exchange(context.Background(), code, other)
+	assert.ErrorIs(t, err, ErrExchangeFailed)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := oidctest.NewServer("passbook", "secret")
+	defer idp.Close()
+	provider := NewProvider(Config{Issuer: idp.Issuer(), ClientID: "passbook", ClientSecret: "secret", RedirectURL: redirectURL})
+	now := time.Now()
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{"iss": idp.Issuer(), "sub": "subject", "aud": "passbook", "exp": now.Add(time.Minute).Unix(), "iat": now.Unix(), "nonce": "nonce"}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	_, err := provider.VerifyIDToken(context.Background(), idp.IDToken(claims(nil)), "nonce")
+	assert.NoError(t, err)
+
+	for name, token := range map[string]string{
+		"Other nonce":          idp.IDToken(claims(jwt.MapClaims{"nonce": "other"})),
+		"No nonce":             idp.IDToken(claims(jwt.MapClaims{"nonce": nil})),
+		"Other issuer":         idp.IDToken(claims(jwt.MapClaims{"iss": "https://evil.example.com"})),
+		"Other audience":       idp.IDToken(claims(jwt.MapClaims{"aud": "someone-else"})),
+		"Other azp":            idp.IDToken(claims(jwt.MapClaims{"aud": []string{"passbook", "someone-else"}, "azp": "someone-else"})),
+		"Expired":              idp.IDToken(claims(jwt.MapClaims{"exp": now.Add(-2 * time.Minute).Unix()})),
+		"No expiry":            idp.IDToken(claims(jwt.MapClaims{"exp": nil})),
+		"No subject":           idp.IDToken(claims(jwt.MapClaims{"sub": nil})),
+		"Unsigned":             unsigned(t, claims(nil)),
+		"Signed with a secret": hmacSigned(t, claims(nil)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := provider.VerifyIDToken(context.Background(), token, "nonce")
+			assert.True(t, errors.Is(err, ErrInvalidIDToken), "got %v", err)
+		})
+	}
+
+	t.Run("Several audiences naming the client as azp", func(t *testing.T) {
+		_, err := provider.VerifyIDToken(context.Background(), idp.IDToken(claims(jwt.MapClaims{"aud": []string{"passbook", "someone-else"}, "azp": "passbook"})), "nonce")
+		assert.NoError(t, err)
+	})
+}
+
+func TestDiscoveryChecksIssuer(t *testing.T) {
+	idp := oidctest.NewServer("passbook", "secret")
+	defer idp.Close()
+	// the provider names itself without the trailing slash
+	provider := NewProvider(Config{Issuer: idp.Issuer() + "/", ClientID: "passbook", RedirectURL: redirectURL})
+	_, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "challenge")
+	assert.Error(t, err)
+}
+
+func unsigned(t *testing.T, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.NoError(t, err)
+	return token
+}
+
+func hmacSigned(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = "oidctest-key"
+	signed, err := token.SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	return signed
+}
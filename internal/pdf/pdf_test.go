@@ -0,0 +1,86 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTo(t *testing.T) {
+	var doc Document
+	doc.AddPage().Text(50, 800, Helvetica, 12, `Interest (net) C:\Savings`)
+	doc.AddPage().TextRight(545, 800, HelveticaBold, 10, "1.500,00 €")
+	var buf bytes.Buffer
+	n, err := doc.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	out := buf.String()
+
+	assert.True(t, strings.HasPrefix(out, "%PDF-1.4\n"))
+	assert.True(t, strings.HasSuffix(out, "%%EOF\n"))
+	// catalog, page tree, two fonts and a content stream and page object for each page
+	assert.Contains(t, out, "trailer\n<< /Size 9 /Root 1 0 R >>\n")
+	assert.Contains(t, out, "/Kids [6 0 R 8 0 R] /Count 2")
+
+	t.Run("startxref points at the xref table", func(t *testing.T) {
+		m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindStringSubmatch(out)
+		if assert.NotNil(t, m) {
+			xref, _ := strconv.Atoi(m[1])
+			assert.True(t, strings.HasPrefix(out[xref:], "xref\n0 9\n0000000000 65535 f \n"))
+		}
+	})
+
+	t.Run("xref offsets point at their objects", func(t *testing.T) {
+		entries := regexp.MustCompile(`(\d{10}) 00000 n \n`).FindAllStringSubmatch(out, -1)
+		assert.Len(t, entries, 8)
+		for i, entry := range entries {
+			offset, _ := strconv.Atoi(entry[1])
+			assert.True(t, strings.HasPrefix(out[offset:], fmt.Sprintf("%d 0 obj\n", i+1)), "object %d", i+1)
+		}
+	})
+
+	t.Run("Stream lengths match their content", func(t *testing.T) {
+		streams := regexp.MustCompile(`(?s)<< /Length (\d+) >>\nstream\n(.*?)endstream`).FindAllStringSubmatch(out, -1)
+		assert.Len(t, streams, 2)
+		for _, stream := range streams {
+			length, _ := strconv.Atoi(stream[1])
+			assert.Equal(t, length, len(stream[2]))
+		}
+	})
+
+	t.Run("Text is escaped and encoded as WinAnsi", func(t *testing.T) {
+		assert.Contains(t, out, `(Interest \(net\) C:\\Savings) Tj`)
+		assert.Contains(t, out, "(1.500,00 \x80) Tj")
+	})
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `a\(b\)c\\d`, escape([]byte(`a(b)c\d`)))
+	assert.Equal(t, `\\\)`, escape([]byte(`\)`)))
+}
+
+func TestEncode(t *testing.T) {
+	assert.Equal(t, []byte("Caf\xe9 \x80 ? ?"), encode("Café € ₹ ✓"))
+	assert.Equal(t, []byte("a b c"), encode("a\tb\nc"))
+}
+
+func TestEmptyDocumentHasOnePage(t *testing.T) {
+	var doc Document
+	var buf bytes.Buffer
+	_, err := doc.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, doc.PageCount())
+	assert.Contains(t, buf.String(), "/Kids [6 0 R] /Count 1")
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "Short", Truncate(Helvetica, 10, "Short", 100))
+	long := Truncate(Helvetica, 10, "A rather long description of a transaction", 60)
+	assert.True(t, strings.HasSuffix(long, "..."))
+	assert.LessOrEqual(t, TextWidth(Helvetica, 10, long), 60.0)
+}
@@ -0,0 +1,187 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	securityEventAccessTokenCreated = "access_token_created"
+	securityEventAccessTokenRevoked = "access_token_revoked"
+)
+
+// characters of a token kept in the clear so users can tell their tokens apart
+const accessTokenPrefixLength = len(middlewares.AccessTokenPrefix) + 6
+
+type createAccessTokenReq struct {
+	Name        string     `json:"name"`
+	Scopes      []string   `json:"scopes"`
+	PassbookIDs []string   `json:"passbook_ids"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+/*
+Route handler for creating a personal access token of the logged in user. The token is returned only in this
+response, the db keeps its SHA-256 hash. Access tokens cannot create further tokens, the route needs a login.
+*/
+func CreateAccessToken(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req createAccessTokenReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		setErrorResponse(ctx, 400, invalidBodyMessage(err))
+		return
+	}
+	req.Name = utils.TrimAndSanitizeStrict(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		setErrorResponse(ctx, 400, "Please provide a name of at most 100 characters")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		setErrorResponse(ctx, 400, "Please provide at least one scope")
+		return
+	}
+	slices.Sort(req.Scopes)
+	req.Scopes = slices.Compact(req.Scopes)
+	for _, scope := range req.Scopes {
+		if !slices.Contains(middlewares.Scopes, scope) {
+			setErrorResponse(ctx, 400, "Unknown scope "+scope)
+			return
+		}
+	}
+	time_now := time.Now().UTC()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time_now) {
+		setErrorResponse(ctx, 400, "expires_at has to be in the future")
+		return
+	}
+	// an empty list would lock the token out of every passbook, leaving it out means all passbooks
+	if req.PassbookIDs != nil {
+		if len(req.PassbookIDs) == 0 {
+			setErrorResponse(ctx, 400, "Please provide at least one passbook_id or leave passbook_ids out")
+			return
+		}
+		slices.Sort(req.PassbookIDs)
+		req.PassbookIDs = slices.Compact(req.PassbookIDs)
+		var owned int
+		err := initializers.DB.QueryRow(context.Background(), "SELECT count(*) FROM passbook_app.passbooks WHERE user_id=$1 AND passbook_id::text = ANY($2)", loggedInUserID, req.PassbookIDs).Scan(&owned)
+		if err != nil {
+			log.Println("Failed to check passbooks of user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to create token. Try again later!")
+			return
+		}
+		if owned != len(req.PassbookIDs) {
+			setErrorResponse(ctx, 400, "Invalid passbook_ids")
+			return
+		}
+	}
+	secret, err := utils.GenerateSecureToken()
+	if err != nil {
+		log.Println("Failed to generate access token for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to create token. Try again later!")
+		return
+	}
+	token := middlewares.AccessTokenPrefix + secret
+	accessToken := types.AccessToken{
+		Name:        req.Name,
+		TokenPrefix: token[:accessTokenPrefixLength],
+		Scopes:      req.Scopes,
+		PassbookIDs: req.PassbookIDs,
+		ExpiresAt:   req.ExpiresAt,
+		CreatedAt:   time_now,
+	}
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to create token. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	err = tx.QueryRow(context.Background(), "INSERT INTO passbook_app.personal_access_tokens (user_id, name, token_hash, token_prefix, scopes, passbook_ids, expires_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING token_id",
+		loggedInUserID, accessToken.Name, utils.HashToken(token), accessToken.TokenPrefix, accessToken.Scopes, accessToken.PassbookIDs, accessToken.ExpiresAt, accessToken.CreatedAt).Scan(&accessToken.TokenID)
+	if err == nil {
+		err = recordSecurityEvent(tx, ctx, loggedInUserID, securityEventAccessTokenCreated, ctx.GetString("sessionId"), "Personal access token "+accessToken.Name+" was created")
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Println("Failed to create access token for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to create token. Try again later!")
+		return
+	}
+	ctx.JSON(201, gin.H{
+		"status":  "success",
+		"message": "Token created. Copy it now, it is shown only once",
+		"data": gin.H{
+			"token":        token,
+			"access_token": accessToken,
+		},
+	})
+}
+
+// route handler for listing the personal access tokens of the logged in user, without the tokens themselves
+func GetAccessTokens(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	rows, err := initializers.DB.Query(context.Background(), "SELECT token_id, name, token_prefix, scopes, passbook_ids, expires_at, last_used_at, created_at FROM passbook_app.personal_access_tokens WHERE user_id=$1 ORDER BY created_at DESC", loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get access tokens of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get tokens")
+		return
+	}
+	defer rows.Close()
+	tokens := make([]types.AccessToken, 0)
+	for rows.Next() {
+		var t types.AccessToken
+		if err := rows.Scan(&t.TokenID, &t.Name, &t.TokenPrefix, &t.Scopes, &t.PassbookIDs, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt); err != nil {
+			log.Println("Failed to scan access token of user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to get tokens")
+			return
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to get access tokens of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get tokens")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Tokens fetched successfully",
+		"data": map[string][]types.AccessToken{
+			"access_tokens": tokens,
+		},
+	})
+}
+
+// route handler for revoking a personal access token of the logged in user, it stops working right away
+func DeleteAccessToken(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	tokenID := ctx.Param("token_id")
+	var name string
+	err := initializers.DB.QueryRow(context.Background(), "DELETE FROM passbook_app.personal_access_tokens WHERE token_id::text=$1 AND user_id=$2 RETURNING name", tokenID, loggedInUserID).Scan(&name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		setErrorResponse(ctx, 404, "Token not found")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to revoke access token", tokenID, "of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to revoke token")
+		return
+	}
+	if err := recordSecurityEvent(initializers.DB, ctx, loggedInUserID, securityEventAccessTokenRevoked, ctx.GetString("sessionId"), "Personal access token "+name+" was revoked"); err != nil {
+		log.Println("Failed to record revocation of access token", tokenID, "of user_id:", loggedInUserID, err)
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Token revoked successfully",
+	})
+}
@@ -0,0 +1,296 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAccessToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/users/me/tokens", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+		c.Next()
+	}, CreateAccessToken)
+	create := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/users/me/tokens", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	ownedSQL := `^SELECT count\(\*\) FROM passbook_app.passbooks WHERE user_id=\$1 AND passbook_id::text = ANY\(\$2\)$`
+
+	t.Run("Token restricted to a passbook is created", func(t *testing.T) {
+		tokenHash := &captureArg{}
+		mockDB.ExpectQuery(ownedSQL).
+			WithArgs("test-user-id", []string{"passbook-1"}).
+			WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(1))
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(`^INSERT INTO passbook_app.personal_access_tokens \(user_id, name, token_hash, token_prefix, scopes, passbook_ids, expires_at, created_at\)`).
+			WithArgs("test-user-id", "import script", tokenHash, pgxmock.AnyArg(), []string{"imports:write", "transactions:read"}, []string{"passbook-1"}, (*time.Time)(nil), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"token_id"}).AddRow("test-token-id"))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", "access_token_created", (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), "Personal access token import script was created", pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := create(`{"name":"import script","scopes":["transactions:read","imports:write","transactions:read"],"passbook_ids":["passbook-1","passbook-1"]}`)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var responseBody struct {
+			Data struct {
+				Token       string `json:"token"`
+				AccessToken struct {
+					TokenID     string `json:"token_id"`
+					TokenPrefix string `json:"token_prefix"`
+				} `json:"access_token"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+		token := responseBody.Data.Token
+		assert.True(t, strings.HasPrefix(token, "pbk_"))
+		assert.Equal(t, token[:10], responseBody.Data.AccessToken.TokenPrefix)
+		assert.Equal(t, "test-token-id", responseBody.Data.AccessToken.TokenID)
+		// only the hash of the token is stored
+		assert.Equal(t, utils.HashToken(token), tokenHash.value)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid requests are rejected", func(t *testing.T) {
+		for _, body := range []string{
+			`{"name":"","scopes":["passbooks:read"]}`,
+			`{"name":"script","scopes":[]}`,
+			`{"name":"script","scopes":["users:write"]}`,
+			`{"name":"script","scopes":["passbooks:read"],"expires_at":"2020-01-01T00:00:00Z"}`,
+			`{"name":"script","scopes":["passbooks:read"],"passbook_ids":[]}`,
+		} {
+			assert.Equal(t, http.StatusBadRequest, create(body).Code, body)
+		}
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Passbooks of other users are rejected", func(t *testing.T) {
+		mockDB.ExpectQuery(ownedSQL).
+			WithArgs("test-user-id", []string{"passbook-1", "passbook-2"}).
+			WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(1))
+
+		w := create(`{"name":"script","scopes":["passbooks:read"],"passbook_ids":["passbook-2","passbook-1"]}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestAccessTokenAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.GET("/v1/passbooks", middlewares.AuthUser(middlewares.ScopePassbooksRead), GetPassbooks)
+	router.GET("/v1/passbooks/:passbook_id/transactions", middlewares.AuthUser(middlewares.ScopeTransactionsRead), func(c *gin.Context) {
+		c.JSON(200, gin.H{"userId": c.GetString("userId")})
+	})
+	router.GET("/v1/users/me/tokens", middlewares.AuthUser(), GetAccessTokens)
+	router.PATCH("/v1/passbooks/:passbook_id/transactions/:transaction_id", middlewares.AuthUser(middlewares.ScopeTransactionsWrite), UpdateTransaction)
+	router.DELETE("/v1/passbooks/:passbook_id/transactions/:transaction_id", middlewares.AuthUser(middlewares.ScopeTransactionsWrite), DeleteTransaction)
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer pbk_test-token")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	request := func(path string) *httptest.ResponseRecorder {
+		return send("GET", path, "")
+	}
+	lookupSQL := `^SELECT token_id, user_id, scopes, passbook_ids FROM passbook_app.personal_access_tokens WHERE token_hash=\$1 AND \(expires_at IS NULL OR expires_at > \$2\)$`
+	expectToken := func(scopes []string, passbookIDs []string) {
+		mockDB.ExpectQuery(lookupSQL).
+			WithArgs(utils.HashToken("pbk_test-token"), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"token_id", "user_id", "scopes", "passbook_ids"}).AddRow("test-token-id", "test-user-id", scopes, passbookIDs))
+	}
+	expectLastUsed := func() {
+		mockDB.ExpectExec(`^UPDATE passbook_app.personal_access_tokens SET last_used_at=\$1 WHERE token_id=\$2`).
+			WithArgs(pgxmock.AnyArg(), "test-token-id", pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	}
+
+	t.Run("Token with the scope of the route is accepted", func(t *testing.T) {
+		expectToken([]string{"transactions:read"}, []string{"passbook-1"})
+		expectLastUsed()
+
+		w := request("/v1/passbooks/passbook-1/transactions")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"userId":"test-user-id"}`, w.Body.String())
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Token without the scope of the route is rejected", func(t *testing.T) {
+		expectToken([]string{"passbooks:read"}, nil)
+
+		w := request("/v1/passbooks/passbook-1/transactions")
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Token restricted to other passbooks is rejected", func(t *testing.T) {
+		expectToken([]string{"transactions:read"}, []string{"passbook-1"})
+
+		w := request("/v1/passbooks/passbook-2/transactions")
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Restricted token only lists its passbooks", func(t *testing.T) {
+		expectToken([]string{"passbooks:read"}, []string{"passbook-1"})
+		expectLastUsed()
+		now := time.Now()
+		mockDB.ExpectQuery(`^SELECT passbook_id, user_id, bank_name, account_number, total_balance, nickname, currency, created_at, updated_at FROM passbook_app.passbooks WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "user_id", "bank_name", "account_number", "total_balance", "nickname", "currency", "created_at", "updated_at"}).
+				AddRow("passbook-1", "test-user-id", "Bank", "1234", int64(100), "Savings", "INR", now, now).
+				AddRow("passbook-2", "test-user-id", "Bank", "5678", int64(200), "Salary", "INR", now, now))
+
+		w := request("/v1/passbooks")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "passbook-1")
+		assert.NotContains(t, w.Body.String(), "passbook-2")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Expired or revoked token is rejected", func(t *testing.T) {
+		mockDB.ExpectQuery(lookupSQL).
+			WithArgs(utils.HashToken("pbk_test-token"), pgxmock.AnyArg()).
+			WillReturnError(pgx.ErrNoRows)
+
+		w := request("/v1/passbooks/passbook-1/transactions")
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	counterpartSQL := `^SELECT o.transfer_id, o.transaction_id, o.passbook_id FROM passbook_app.transactions t JOIN`
+	trxBody := `{"amount": 20, "transaction_date": "2024-01-01T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Test Party", "passbook_id": "passbook-2"}`
+
+	t.Run("Restricted token cannot move a transaction to other passbooks", func(t *testing.T) {
+		expectToken([]string{"transactions:write"}, []string{"passbook-1"})
+		expectLastUsed()
+
+		w := send("PATCH", "/v1/passbooks/passbook-1/transactions/trx-1", trxBody)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Restricted token cannot change the other leg of a transfer", func(t *testing.T) {
+		for _, method := range []string{"PATCH", "DELETE"} {
+			expectToken([]string{"transactions:write"}, []string{"passbook-1"})
+			expectLastUsed()
+			mockDB.ExpectBegin()
+			mockDB.ExpectQuery(counterpartSQL).
+				WithArgs("trx-1", "test-user-id").
+				WillReturnRows(pgxmock.NewRows([]string{"transfer_id", "transaction_id", "passbook_id"}).AddRow("transfer-1", "trx-2", "passbook-2"))
+			mockDB.ExpectRollback()
+
+			w := send(method, "/v1/passbooks/passbook-1/transactions/trx-1", strings.Replace(trxBody, "passbook-2", "passbook-1", 1))
+
+			assert.Equal(t, http.StatusForbidden, w.Code, method)
+			assert.Contains(t, w.Body.String(), "other leg of the transfer", method)
+			assert.NoError(t, mockDB.ExpectationsWereMet(), method)
+		}
+	})
+
+	t.Run("Routes without scopes do not accept tokens", func(t *testing.T) {
+		w := request("/v1/users/me/tokens")
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestDeleteAccessToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.DELETE("/v1/users/me/tokens/:token_id", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+		c.Next()
+	}, DeleteAccessToken)
+	deleteSQL := `^DELETE FROM passbook_app.personal_access_tokens WHERE token_id::text=\$1 AND user_id=\$2 RETURNING name$`
+
+	t.Run("Token is revoked", func(t *testing.T) {
+		mockDB.ExpectQuery(deleteSQL).
+			WithArgs("test-token-id", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow("import script"))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", "access_token_revoked", (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), "Personal access token import script was revoked", pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/users/me/tokens/test-token-id", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Token of another user is not found", func(t *testing.T) {
+		mockDB.ExpectQuery(deleteSQL).
+			WithArgs("other-token-id", "test-user-id").
+			WillReturnError(pgx.ErrNoRows)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/users/me/tokens/other-token-id", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
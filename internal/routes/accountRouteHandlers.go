@@ -0,0 +1,488 @@
+package routes
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/mailer"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	securityEventAccountDeletionRequested = "account_deletion_requested"
+	securityEventAccountDeletionCancelled = "account_deletion_cancelled"
+	securityEventDataExported             = "data_exported"
+)
+
+// tables holding data of a user, purged in this order so no row references a deleted one. Rotated tokens go along
+// with their sessions.
+var userDataTables = []string{
+	"purged_imports",
+	"transactions",
+	"passbooks",
+	"import_profiles",
+	"exchange_rates",
+	"sessions",
+	"personal_access_tokens",
+	"user_identities",
+	"oidc_login_states",
+	"recovery_codes",
+	"email_verifications",
+	"password_resets",
+	"security_events",
+	"user_preferences",
+	"account_deletions",
+	"account_deletion_confirmations",
+}
+
+const accountDeletionConfirmationLifetime = time.Hour
+
+const accountDeletionConfirmationSentMessage = "A link to confirm the deletion has been sent to your email"
+
+type deleteAccountReq struct {
+	Password string `json:"password"`
+}
+
+type confirmAccountDeletionReq struct {
+	Token string `json:"token"`
+}
+
+// how long a deleted account can still be restored before its data is purged, configured in days with ACCOUNT_DELETION_GRACE_DAYS
+func accountDeletionGracePeriod() time.Duration {
+	days := 14
+	if v := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); v != "" {
+		if d, err := strconv.Atoi(v); err == nil && d >= 0 {
+			days = d
+		} else {
+			log.Println("Invalid ACCOUNT_DELETION_GRACE_DAYS, using default of", days, "days")
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+/*
+Route handler for deleting the account of the logged in user, which needs the password. Users who only log in with
+an identity provider have no password, they are emailed a confirmation link instead. The account keeps working
+during the grace period and the deletion can be cancelled until then, afterwards the background jobs purge every row
+stored about the user. Asking again keeps the date of the first request.
+*/
+func DeleteAccount(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req deleteAccountReq
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		setErrorResponse(ctx, 400, "Invalid request body")
+		return
+	}
+	user, err := getUserByID(initializers.DB, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to delete account. Try again later!")
+		return
+	}
+	if user.PasswordHash == "" {
+		if err := sendAccountDeletionConfirmation(user); err != nil {
+			log.Println("Failed to send account deletion confirmation to user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to delete account. Try again later!")
+			return
+		}
+		ctx.JSON(200, gin.H{
+			"status":  "success",
+			"message": accountDeletionConfirmationSentMessage,
+		})
+		return
+	}
+	if req.Password == "" {
+		setErrorResponse(ctx, 400, "Please provide the password to confirm the deletion.")
+		return
+	}
+	// guesses share the counter of the password change
+	passwordKey := "password:" + loggedInUserID
+	if !checkLoginLimits(ctx, passwordKey) {
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		recordFailedLogin(ctx, passwordKey, loggedInUserID, securityEventLoginFailed)
+		setErrorResponse(ctx, 403, "Invalid password")
+		return
+	}
+	clearLoginLimits(ctx, passwordKey)
+	scheduleAccountDeletion(ctx, user, "")
+}
+
+/*
+Email a link confirming the deletion of the account to a user without a password. A new token replaces the earlier
+ones of the user, only its hash is stored.
+*/
+func sendAccountDeletionConfirmation(user types.User) error {
+	token, err := utils.GenerateSecureToken()
+	if err != nil {
+		return err
+	}
+	time_now := time.Now().UTC()
+	_, err = initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.account_deletion_confirmations WHERE user_id=$1", user.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.account_deletion_confirmations (token_hash, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4)",
+		utils.HashToken(token), user.UserID, time_now.Add(accountDeletionConfirmationLifetime), time_now)
+	if err != nil {
+		return err
+	}
+	link := strings.TrimRight(os.Getenv("APP_BASE_URL"), "/") + "/delete-account?token=" + url.QueryEscape(token)
+	return initializers.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm the deletion of your Passbook account",
+		Body: fmt.Sprintf("Hi %s,\n\nWe received a request to delete your Passbook account. "+
+			"Open the link below within %d minutes while logged in to confirm it:\n\n%s\n\n"+
+			"If you did not ask for this you can ignore this email, your account stays as it is.\n",
+			user.Username, int(accountDeletionConfirmationLifetime.Minutes()), link),
+	})
+}
+
+// route handler for confirming the deletion of the account of the logged in user with the token of an emailed link
+func ConfirmAccountDeletion(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req confirmAccountDeletionReq
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		setErrorResponse(ctx, 400, "Please provide the confirmation token.")
+		return
+	}
+	user, err := getUserByID(initializers.DB, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to delete account. Try again later!")
+		return
+	}
+	scheduleAccountDeletion(ctx, user, req.Token)
+}
+
+/*
+schedule the purge of the account after the grace period and tell the user by email. A non empty confirmation token
+is used up in the same database transaction and must belong to the user.
+*/
+func scheduleAccountDeletion(ctx *gin.Context, user types.User, confirmationToken string) {
+	time_now := time.Now().UTC()
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to delete account. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	if confirmationToken != "" {
+		ctag, err := tx.Exec(context.Background(), "DELETE FROM passbook_app.account_deletion_confirmations WHERE token_hash=$1 AND user_id=$2 AND expires_at > $3",
+			utils.HashToken(confirmationToken), user.UserID, time_now)
+		if err != nil {
+			log.Println("Failed to use account deletion confirmation of user_id:", user.UserID, err)
+			setErrorResponse(ctx, 500, "Failed to delete account. Try again later!")
+			return
+		}
+		if ctag.RowsAffected() == 0 {
+			setErrorResponse(ctx, 400, "Invalid or expired confirmation token")
+			return
+		}
+	}
+	var purgeAfter time.Time
+	err = tx.QueryRow(context.Background(), "INSERT INTO passbook_app.account_deletions (user_id, requested_at, purge_after) VALUES ($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET user_id=EXCLUDED.user_id RETURNING purge_after",
+		user.UserID, time_now, time_now.Add(accountDeletionGracePeriod())).Scan(&purgeAfter)
+	if err == nil {
+		err = recordSecurityEvent(tx, ctx, user.UserID, securityEventAccountDeletionRequested, ctx.GetString("sessionId"), "Deletion of the account was requested, the data is purged after "+purgeAfter.Format(time.RFC3339))
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Println("Failed to schedule deletion of user_id:", user.UserID, err)
+		setErrorResponse(ctx, 500, "Failed to delete account. Try again later!")
+		return
+	}
+	if err := sendAccountDeletionNotice(user, purgeAfter); err != nil {
+		log.Println("Failed to send account deletion notice to user_id:", user.UserID, err)
+	}
+	ctx.JSON(202, gin.H{
+		"status":  "success",
+		"message": "Account scheduled for deletion",
+		"data": map[string]time.Time{
+			"purge_after": purgeAfter,
+		},
+	})
+}
+
+// delete the account deletion confirmation tokens which have expired
+func purgeExpiredAccountDeletionConfirmations(conn initializers.PgxPoolIface) error {
+	_, err := conn.Exec(context.Background(), "DELETE FROM passbook_app.account_deletion_confirmations WHERE expires_at < $1", time.Now().UTC())
+	return err
+}
+
+// tell the user when the account is purged, so the owner can cancel a deletion somebody else asked for
+func sendAccountDeletionNotice(user types.User, purgeAfter time.Time) error {
+	return initializers.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Passbook account will be deleted",
+		Body: fmt.Sprintf("Hi %s,\n\nYour Passbook account and all its passbooks and transactions will be deleted for good on %s.\n\n"+
+			"Until then you can log in and cancel the deletion in the account settings. If you did not ask for this, cancel it and change your password right away.\n",
+			user.Username, purgeAfter.Format("2 January 2006 15:04 MST")),
+	})
+}
+
+// route handler for cancelling the pending deletion of the account of the logged in user
+func CancelAccountDeletion(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	ctag, err := initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.account_deletions WHERE user_id=$1", loggedInUserID)
+	if err != nil {
+		log.Println("Failed to cancel deletion of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to cancel the deletion. Try again later!")
+		return
+	}
+	if ctag.RowsAffected() == 0 {
+		setErrorResponse(ctx, 404, "The account is not scheduled for deletion")
+		return
+	}
+	if err := recordSecurityEvent(initializers.DB, ctx, loggedInUserID, securityEventAccountDeletionCancelled, ctx.GetString("sessionId"), "Deletion of the account was cancelled"); err != nil {
+		log.Println("Failed to record cancelled deletion of user_id:", loggedInUserID, err)
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Account deletion cancelled",
+	})
+}
+
+// purge every row of the users whose grace period after asking for the deletion of their account is over
+func purgeDeletedAccounts(conn initializers.PgxPoolIface) error {
+	rows, err := conn.Query(context.Background(), "SELECT user_id FROM passbook_app.account_deletions WHERE purge_after < $1", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	userIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if err := purgeUser(conn, userID); err != nil {
+			return fmt.Errorf("purging user_id %s: %w", userID, err)
+		}
+		log.Println("Purged deleted account of user_id:", userID)
+	}
+	return nil
+}
+
+func purgeUser(conn initializers.PgxPoolIface, userID string) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	for _, table := range userDataTables {
+		if _, err := tx.Exec(context.Background(), "DELETE FROM passbook_app."+table+" WHERE user_id=$1", userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(context.Background(), "DELETE FROM passbook_app.users WHERE user_id=$1", userID); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// profile of the user in the export, everything but the password hash and the TOTP secret
+type exportedUser struct {
+	UserID          string     `json:"user_id"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	HasPassword     bool       `json:"has_password"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	// set while the account is scheduled for deletion
+	DeletionPurgeAfter *time.Time `json:"deletion_purge_after"`
+}
+
+/*
+Route handler for downloading everything stored about the logged in user as a zip archive, with a JSON file per kind
+of data and CSV files of the passbooks and transactions. Secrets like hashes of passwords and tokens are left out. The
+archive is written to a temporary file first so a failure can still be answered with an error.
+*/
+func ExportAccountData(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	file, err := os.CreateTemp("", "passbook-export-*.zip")
+	if err != nil {
+		log.Println("Failed to create export file for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to export data. Try again later!")
+		return
+	}
+	defer os.Remove(file.Name())
+	err = writeAccountArchive(file, loggedInUserID)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Println("Failed to export data of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to export data. Try again later!")
+		return
+	}
+	if err := recordSecurityEvent(initializers.DB, ctx, loggedInUserID, securityEventDataExported, ctx.GetString("sessionId"), "All data of the account was exported"); err != nil {
+		log.Println("Failed to record data export of user_id:", loggedInUserID, err)
+	}
+	ctx.FileAttachment(file.Name(), "passbook-account-"+time.Now().UTC().Format("20060102")+".zip")
+}
+
+func writeAccountArchive(w io.Writer, userID string) error {
+	user, err := getUserByID(initializers.DB, userID)
+	if err != nil {
+		return err
+	}
+	profile := exportedUser{
+		UserID:          user.UserID,
+		Username:        user.Username,
+		Email:           user.Email,
+		HasPassword:     user.PasswordHash != "",
+		EmailVerifiedAt: user.EmailVerifiedAt,
+		TOTPEnabledAt:   user.TOTPEnabledAt,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+	}
+	err = initializers.DB.QueryRow(context.Background(), "SELECT purge_after FROM passbook_app.account_deletions WHERE user_id=$1", userID).Scan(&profile.DeletionPurgeAfter)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	passbooks, err := collectUserRows[types.Passbook]("SELECT passbook_id, user_id, bank_name, account_number, total_balance, nickname, currency, created_at, updated_at FROM passbook_app.passbooks WHERE user_id=$1 ORDER BY created_at", userID)
+	if err != nil {
+		return err
+	}
+	// trashed transactions are stored as well, they are exported along with their deleted_at
+	transactions, err := collectUserRows[types.Transaction]("SELECT transaction_id, amount, transaction_date, transaction_type, party_name, COALESCE(description, '') AS description, created_at, updated_at, COALESCE(tags, '') AS tags, passbook_id, user_id, transfer_id, COALESCE(external_id, '') AS external_id, deleted_at FROM passbook_app.transactions WHERE user_id=$1 ORDER BY transaction_date, created_at", userID)
+	if err != nil {
+		return err
+	}
+	importProfiles, err := collectUserRows[types.ImportProfile]("SELECT * FROM passbook_app.import_profiles WHERE user_id=$1 ORDER BY created_at", userID)
+	if err != nil {
+		return err
+	}
+	exchangeRates, err := collectUserRows[types.ExchangeRate]("SELECT rate_id, base_currency, quote_currency, rate_date, rate, created_at FROM passbook_app.exchange_rates WHERE user_id=$1 ORDER BY rate_date, base_currency, quote_currency", userID)
+	if err != nil {
+		return err
+	}
+	sessions, err := collectUserRows[types.Session]("SELECT session_id, device_name, ip, user_agent, created_at, last_used_at FROM passbook_app.sessions WHERE user_id=$1 ORDER BY created_at", userID)
+	if err != nil {
+		return err
+	}
+	accessTokens, err := collectUserRows[types.AccessToken]("SELECT token_id, name, token_prefix, scopes, passbook_ids, expires_at, last_used_at, created_at FROM passbook_app.personal_access_tokens WHERE user_id=$1 ORDER BY created_at", userID)
+	if err != nil {
+		return err
+	}
+	identities, err := collectUserRows[types.Identity]("SELECT identity_id, issuer, subject, email, created_at, last_login_at FROM passbook_app.user_identities WHERE user_id=$1 ORDER BY created_at", userID)
+	if err != nil {
+		return err
+	}
+	prefs, err := getUserPreferences(userID)
+	if err != nil {
+		return err
+	}
+	securityEvents, err := collectUserRows[types.SecurityEvent]("SELECT event_id, event_type, session_id, ip, user_agent, details, created_at FROM passbook_app.security_events WHERE user_id=$1 ORDER BY created_at", userID)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	for _, f := range []struct {
+		name string
+		data any
+	}{
+		{"user.json", profile},
+		{"preferences.json", prefs},
+		{"passbooks.json", passbooks},
+		{"transactions.json", transactions},
+		{"import_profiles.json", importProfiles},
+		{"exchange_rates.json", exchangeRates},
+		{"sessions.json", sessions},
+		{"access_tokens.json", accessTokens},
+		{"identities.json", identities},
+		{"security_events.json", securityEvents},
+	} {
+		if err := writeArchiveJSON(zw, f.name, f.data); err != nil {
+			return err
+		}
+	}
+	passbookRows := [][]string{{"passbook_id", "bank_name", "account_number", "nickname", "currency", "total_balance", "created_at", "updated_at"}}
+	for _, p := range passbooks {
+		passbookRows = append(passbookRows, []string{p.PassbookID, p.BankName, p.AccountNumber, p.Nickname, p.Currency, p.TotalBalance.String(), p.CreatedAt.UTC().Format(time.RFC3339), p.UpdatedAt.UTC().Format(time.RFC3339)})
+	}
+	if err := writeArchiveCSV(zw, "passbooks.csv", passbookRows); err != nil {
+		return err
+	}
+	transactionRows := [][]string{{"transaction_id", "transaction_date", "passbook_id", "transaction_type", "amount", "party_name", "description", "tags", "transfer_id", "external_id", "created_at", "updated_at", "deleted_at"}}
+	for _, t := range transactions {
+		transactionRows = append(transactionRows, []string{t.TransactionID, t.TransactionDate.UTC().Format(time.RFC3339), t.PassbookID, t.TransactionType, t.Amount.String(), t.PartyName, t.Description, t.Tags,
+			stringOrEmpty(t.TransferID), t.ExternalID, t.CreatedAt.UTC().Format(time.RFC3339), t.UpdatedAt.UTC().Format(time.RFC3339), timeOrEmpty(t.DeletedAt)})
+	}
+	if err := writeArchiveCSV(zw, "transactions.csv", transactionRows); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// all rows of a query for the user, collected into structs by column name
+func collectUserRows[T any](sql string, userID string) ([]T, error) {
+	rows, err := initializers.DB.Query(context.Background(), sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := pgx.CollectRows(rows, pgx.RowToStructByName[T])
+	// an empty list instead of null in the JSON files
+	if result == nil {
+		result = make([]T, 0)
+	}
+	return result, err
+}
+
+func writeArchiveJSON(zw *zip.Writer, name string, data any) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+func writeArchiveCSV(zw *zip.Writer, name string, records [][]string) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(records); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func timeOrEmpty(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
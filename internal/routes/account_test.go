@@ -0,0 +1,355 @@
+package routes
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/lockout"
+	"github.com/akashsharma99/passbook-app/internal/mailer"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	mailDir := t.TempDir()
+	originalMailer := initializers.Mailer
+	initializers.Mailer = &mailer.LogSender{Dir: mailDir, From: "no-reply@example.com"}
+	defer func() { initializers.Mailer = originalMailer }()
+
+	originalUsernameLimiter, originalIPLimiter := initializers.UsernameLoginLimiter, initializers.IPLoginLimiter
+	initializers.UsernameLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), lockout.Policy{FreeAttempts: 5, LockoutThreshold: 5, LockoutDuration: time.Hour, Window: time.Hour})
+	initializers.IPLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), lockout.Policy{FreeAttempts: 100, LockoutThreshold: 1000, Window: time.Hour})
+	defer func() {
+		initializers.UsernameLoginLimiter, initializers.IPLoginLimiter = originalUsernameLimiter, originalIPLimiter
+	}()
+	t.Setenv("ACCOUNT_DELETION_GRACE_DAYS", "30")
+
+	router := gin.New()
+	router.DELETE("/v1/users/me", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+		c.Set("sessionId", "test-session-id")
+	}, DeleteAccount)
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	now := time.Now().UTC()
+	expectUser := func() {
+		mockDB.ExpectQuery(`^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", string(passwordHash), now, now, &now, nil, nil, int64(0)))
+	}
+	del := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/users/me", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Deletion is scheduled after the grace period", func(t *testing.T) {
+		purgeAfter := &captureArg{}
+		expectUser()
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(`^INSERT INTO passbook_app.account_deletions \(user_id, requested_at, purge_after\) VALUES \(\$1, \$2, \$3\) ON CONFLICT \(user_id\) DO UPDATE .* RETURNING purge_after$`).
+			WithArgs("test-user-id", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"purge_after"}).AddRow(now.Add(30 * 24 * time.Hour)))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventAccountDeletionRequested, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), purgeAfter, pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := del(`{"password":"secret"}`)
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Contains(t, w.Body.String(), `"purge_after"`)
+		assert.Contains(t, purgeAfter.value, now.Add(30*24*time.Hour).Format(time.RFC3339))
+		mails := strings.Join(sentMails(t, mailDir), "\n")
+		assert.Contains(t, mails, "To: jane@example.com")
+		assert.Contains(t, mails, "cancel the deletion")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		expectUser()
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventLoginFailed, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		assert.Equal(t, http.StatusForbidden, del(`{"password":"guess"}`).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Missing password", func(t *testing.T) {
+		expectUser()
+		assert.Equal(t, http.StatusBadRequest, del(`{}`).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("User without a password is emailed a confirmation link", func(t *testing.T) {
+		mockDB.ExpectQuery(`^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", "", now, now, &now, nil, nil, int64(0)))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.account_deletion_confirmations WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.account_deletion_confirmations \(token_hash, user_id, expires_at, created_at\) VALUES \(\$1, \$2, \$3, \$4\)$`).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		// nothing is scheduled until the link is opened
+		w := del("")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), accountDeletionConfirmationSentMessage)
+		mails := sentMails(t, mailDir)
+		assert.Contains(t, mails[len(mails)-1], "/delete-account?token=")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestConfirmAccountDeletion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	mailDir := t.TempDir()
+	originalMailer := initializers.Mailer
+	initializers.Mailer = &mailer.LogSender{Dir: mailDir, From: "no-reply@example.com"}
+	defer func() { initializers.Mailer = originalMailer }()
+	t.Setenv("ACCOUNT_DELETION_GRACE_DAYS", "30")
+
+	router := gin.New()
+	router.POST("/v1/users/me/deletion/confirm", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, ConfirmAccountDeletion)
+	now := time.Now().UTC()
+	expectUser := func() {
+		mockDB.ExpectQuery(`^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", "", now, now, &now, nil, nil, int64(0)))
+	}
+	confirmSQL := `^DELETE FROM passbook_app.account_deletion_confirmations WHERE token_hash=\$1 AND user_id=\$2 AND expires_at > \$3$`
+	confirm := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/users/me/deletion/confirm", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Emailed token schedules the deletion", func(t *testing.T) {
+		expectUser()
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(confirmSQL).
+			WithArgs(utils.HashToken("the-token"), "test-user-id", pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+		mockDB.ExpectQuery(`^INSERT INTO passbook_app.account_deletions`).
+			WithArgs("test-user-id", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"purge_after"}).AddRow(now.Add(30 * 24 * time.Hour)))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventAccountDeletionRequested, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := confirm(`{"token":"the-token"}`)
+
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Contains(t, w.Body.String(), `"purge_after"`)
+		assert.Contains(t, strings.Join(sentMails(t, mailDir), "\n"), "cancel the deletion")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown, expired or someone else's token", func(t *testing.T) {
+		expectUser()
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(confirmSQL).
+			WithArgs(utils.HashToken("other-token"), "test-user-id", pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		mockDB.ExpectRollback()
+
+		assert.Equal(t, http.StatusBadRequest, confirm(`{"token":"other-token"}`).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Missing token", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, confirm(`{}`).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestCancelAccountDeletion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.DELETE("/v1/users/me/deletion", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, CancelAccountDeletion)
+	deleteSQL := `^DELETE FROM passbook_app.account_deletions WHERE user_id=\$1$`
+
+	t.Run("Pending deletion is cancelled", func(t *testing.T) {
+		mockDB.ExpectExec(deleteSQL).WithArgs("test-user-id").WillReturnResult(pgxmock.NewResult("DELETE", 1))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventAccountDeletionCancelled, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/users/me/deletion", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("No pending deletion", func(t *testing.T) {
+		mockDB.ExpectExec(deleteSQL).WithArgs("test-user-id").WillReturnResult(pgxmock.NewResult("DELETE", 0))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/users/me/deletion", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestPurgeDeletedAccounts(t *testing.T) {
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	mockDB.ExpectQuery(`^SELECT user_id FROM passbook_app.account_deletions WHERE purge_after < \$1$`).
+		WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow("test-user-id"))
+	mockDB.ExpectBegin()
+	for _, table := range append(userDataTables, "users") {
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.` + table + ` WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	}
+	mockDB.ExpectCommit()
+	mockDB.ExpectRollback()
+
+	assert.NoError(t, purgeDeletedAccounts(mockDB))
+	assert.NoError(t, mockDB.ExpectationsWereMet())
+}
+
+func TestExportAccountData(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.GET("/v1/users/me/export", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, ExportAccountData)
+	now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	secret := "totp-secret"
+
+	mockDB.ExpectQuery(`^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`).
+		WithArgs("test-user-id").
+		WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", "the-password-hash", now, now, &now, &secret, &now, int64(0)))
+	mockDB.ExpectQuery(`^SELECT purge_after FROM passbook_app.account_deletions WHERE user_id=\$1$`).
+		WithArgs("test-user-id").
+		WillReturnRows(pgxmock.NewRows([]string{"purge_after"}))
+	mockDB.ExpectQuery(`^SELECT .* FROM passbook_app.passbooks WHERE user_id=\$1`).
+		WithArgs("test-user-id").
+		WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "user_id", "bank_name", "account_number", "total_balance", "nickname", "currency", "created_at", "updated_at"}).
+			AddRow("pb-1", "test-user-id", "Test Bank", "1234", types.Money(97950), "Savings", "EUR", now, now))
+	mockDB.ExpectQuery(`^SELECT .* FROM passbook_app.transactions WHERE user_id=\$1`).
+		WithArgs("test-user-id").
+		WillReturnRows(pgxmock.NewRows([]string{"transaction_id", "amount", "transaction_date", "transaction_type", "party_name", "description", "created_at", "updated_at", "tags", "passbook_id", "user_id", "transfer_id", "external_id", "deleted_at"}).
+			AddRow("tr-1", types.Money(2050), now, "DEBIT", "Coffee Shop", "", now, now, "food", "pb-1", "test-user-id", nil, "", nil).
+			AddRow("tr-2", types.Money(1000), now, "DEBIT", "Book Store", "Novel", now, now, "", "pb-1", "test-user-id", nil, "", &now))
+	for _, table := range []string{"import_profiles", "exchange_rates", "sessions", "personal_access_tokens", "user_identities"} {
+		mockDB.ExpectQuery(`^SELECT .* FROM passbook_app.` + table + ` WHERE user_id=\$1`).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"created_at"}))
+	}
+	expectPreferences(mockDB, "test-user-id")
+	mockDB.ExpectQuery(`^SELECT .* FROM passbook_app.security_events WHERE user_id=\$1`).
+		WithArgs("test-user-id").
+		WillReturnRows(pgxmock.NewRows([]string{"created_at"}))
+	mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+		WithArgs("test-user-id", securityEventDataExported, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/users/me/export", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "passbook-account-")
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		assert.NoError(t, err)
+		content, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(content)
+	}
+	assert.Len(t, files, 12)
+	assert.Contains(t, files["preferences.json"], `"currency": "INR"`)
+	assert.Contains(t, files["user.json"], `"has_password": true`)
+	assert.Contains(t, files["user.json"], `"deletion_purge_after": null`)
+	assert.NotContains(t, files["user.json"], "the-password-hash")
+	assert.NotContains(t, files["user.json"], secret)
+	assert.Contains(t, files["passbooks.csv"], "pb-1,Test Bank,1234,Savings,EUR,979.50,")
+	lines := strings.Split(strings.TrimSpace(files["transactions.csv"]), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasSuffix(lines[2], ",2024-04-01T00:00:00Z"), "trashed transaction keeps its deleted_at")
+	assert.Equal(t, "[]\n", files["sessions.json"])
+	assert.NoError(t, mockDB.ExpectationsWereMet())
+}
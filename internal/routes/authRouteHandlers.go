@@ -3,17 +3,24 @@ package routes
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net/mail"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/akashsharma99/passbook-app/internal/initializers"
 	"github.com/akashsharma99/passbook-app/internal/middlewares"
 	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -21,8 +28,30 @@ type UserReq struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// optional name of the device logging in, derived from the user agent when empty
+	DeviceName string `json:"device_name"`
 }
 
+const (
+	accessTokenLifetime  = 15 * time.Minute
+	refreshTokenLifetime = 24 * time.Hour
+	// time to enter the code of the authenticator app after the password
+	mfaTokenLifetime = 5 * time.Minute
+)
+
+var (
+	errSessionRevoked = errors.New("session revoked")
+	// an already rotated refresh token was presented again, either the client or an attacker holds a stolen copy
+	errRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// types of the security events recorded for an account
+const (
+	securityEventRefreshTokenReuse = "refresh_token_reuse"
+	securityEventLoginFailed       = "login_failed"
+	securityEventAccountLocked     = "account_locked"
+)
+
 func setErrorResponse(ctx *gin.Context, erroCode int, message string) {
 	ctx.JSON(erroCode, gin.H{
 		"status":  "error",
@@ -30,6 +59,17 @@ func setErrorResponse(ctx *gin.Context, erroCode int, message string) {
 	})
 }
 
+// error message for a request body that could not be bound, amount and rate validation errors are passed on as is
+func invalidBodyMessage(err error) string {
+	if errors.Is(err, types.ErrInvalidMoney) || errors.Is(err, types.ErrMoneyPrecision) || errors.Is(err, types.ErrMoneyOutOfRange) {
+		return err.Error()
+	}
+	if errors.Is(err, types.ErrInvalidRate) || errors.Is(err, types.ErrRatePrecision) || errors.Is(err, types.ErrRateOutOfRange) {
+		return err.Error()
+	}
+	return "Invalid request body"
+}
+
 // route handler for creating a new user
 func CreateUser(ctx *gin.Context) {
 
@@ -44,6 +84,10 @@ func CreateUser(ctx *gin.Context) {
 		setErrorResponse(ctx, 400, "Please provide all the mandatory fields.")
 		return
 	}
+	if !isValidEmail(user.Email) {
+		setErrorResponse(ctx, 400, "Please provide a valid email address.")
+		return
+	}
 	// encrypt the password before saving it in DB using bcrypt
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -56,12 +100,12 @@ func CreateUser(ctx *gin.Context) {
 	}
 	user.Password = string(hashedPassword)
 	// save the user in DB
-	ctag, err := initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.users (username, email, password_hash,created_at,updated_at) VALUES ($1, $2, $3, $4, $5)",
+	var userID string
+	err = initializers.DB.QueryRow(context.Background(), "INSERT INTO passbook_app.users (username, email, password_hash,created_at,updated_at) VALUES ($1, $2, $3, $4, $5) RETURNING user_id",
 		user.Username,
 		user.Email,
 		user.Password,
-		time.Now().UTC(), time.Now().UTC())
-	log.Println(ctag)
+		time.Now().UTC(), time.Now().UTC()).Scan(&userID)
 	if err != nil {
 		log.Println(err)
 		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
@@ -71,14 +115,19 @@ func CreateUser(ctx *gin.Context) {
 		setErrorResponse(ctx, 500, "Failed to create User. Try again later!")
 		return
 	}
+	// the account is created either way, the user can ask for the verification email again
+	if err := sendVerificationEmail(userID, user.Username, user.Email); err != nil {
+		log.Println("Failed to send verification email to user_id:", userID, err)
+	}
 
 	ctx.JSON(201, gin.H{
 		"status":  "success",
-		"message": "User created successfully",
+		"message": "User created successfully. A verification link has been sent to the email address",
 		"data": map[string]interface{}{
-			"user": map[string]string{
-				"username": user.Username,
-				"email":    user.Email,
+			"user": map[string]interface{}{
+				"username":       user.Username,
+				"email":          user.Email,
+				"email_verified": false,
 			},
 		},
 		"meta": nil,
@@ -93,89 +142,230 @@ func LoginUser(ctx *gin.Context) {
 		setErrorResponse(ctx, 400, "Invalid request")
 		return
 	}
+	// checked before looking up the user, so the response does not tell whether the username exists
+	usernameKey := "user:" + strings.ToLower(userReq.Username)
+	if !checkLoginLimits(ctx, usernameKey) {
+		return
+	}
 	rows, _ := initializers.DB.Query(context.Background(), "SELECT * FROM passbook_app.users WHERE username=$1", userReq.Username)
 	// scan row into user struct
 	user, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[types.User])
 	if err != nil {
+		recordFailedLogin(ctx, usernameKey, "", securityEventLoginFailed)
 		setErrorResponse(ctx, 401, "Invalid username or password")
 		log.Println(err)
 		return
 	}
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(userReq.Password))
 	if err != nil {
+		recordFailedLogin(ctx, usernameKey, user.UserID, securityEventLoginFailed)
 		setErrorResponse(ctx, 401, "Invalid username or password")
 		return
 	}
-	// generate access and refresh tokens
-	access_token, refresh_token, err := generateTokens(user)
+	clearLoginLimits(ctx, usernameKey)
+	finishLogin(ctx, user, userReq.DeviceName)
+}
+
+// respond to the first step of a login, with the tokens or with a challenge for users with two-factor authentication
+func finishLogin(ctx *gin.Context, user types.User, deviceName string) {
+	// with two-factor authentication the password only earns a challenge token to send along with the code
+	if user.TOTPEnabledAt != nil {
+		mfa_token, err := generateMFAToken(user)
+		if err != nil {
+			setErrorResponse(ctx, 500, "Login failed. Try again later!")
+			return
+		}
+		ctx.JSON(200, gin.H{
+			"status":  "success",
+			"message": "Two-factor authentication code required",
+			"data": map[string]interface{}{
+				"mfa_required": true,
+				"mfa_token":    mfa_token,
+			},
+		})
+		return
+	}
+	completeLogin(ctx, user, deviceName)
+}
+
+/*
+Count an attempt of the key of the login and of the client IP up front, so concurrent guesses cannot all pass before
+a failure is counted. Respond with a 429 and return false when either one has to wait after too many failures.
+Counters that cannot be read do not block the login. A successful attempt is taken back with clearLoginLimits.
+*/
+func checkLoginLimits(ctx *gin.Context, key string) bool {
+	allowed, wait, err := initializers.UsernameLoginLimiter.Attempt(key)
+	if err != nil {
+		log.Println("Failed to count login attempt of", key, err)
+		allowed = true
+	}
+	if allowed {
+		ipKey := "ip:" + ctx.ClientIP()
+		allowed, wait, err = initializers.IPLoginLimiter.Attempt(ipKey)
+		if err != nil {
+			log.Println("Failed to count login attempt of", ipKey, err)
+			allowed = true
+		}
+		if !allowed {
+			// the attempt does not happen, so it does not count for the key either
+			if err := initializers.UsernameLoginLimiter.Forgive(key); err != nil {
+				log.Println("Failed to take back login attempt of", key, err)
+			}
+		}
+	}
+	if !allowed {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		setErrorResponse(ctx, 429, "Too many failed login attempts. Please try again later")
+		return false
+	}
+	return true
+}
+
+// take back the attempt counted by checkLoginLimits after a success, the failures of the key start over
+func clearLoginLimits(ctx *gin.Context, key string) {
+	if err := initializers.UsernameLoginLimiter.Reset(key); err != nil {
+		log.Println("Failed to reset failed login counter of", key, err)
+	}
+	if err := initializers.IPLoginLimiter.Forgive("ip:" + ctx.ClientIP()); err != nil {
+		log.Println("Failed to take back login attempt of ip", ctx.ClientIP(), err)
+	}
+}
+
+// record a failed login, already counted by checkLoginLimits, for the user if there is an account
+func recordFailedLogin(ctx *gin.Context, key string, userID string, eventType string) {
+	if userID == "" {
+		log.Println("Failed login for unknown", key, "from", ctx.ClientIP())
+		return
+	}
+	wait, locked, err := initializers.UsernameLoginLimiter.Status(key)
+	if err != nil {
+		log.Println("Failed to read failed login counter of", key, err)
+	}
+	details := "Wrong credentials were entered"
+	if locked {
+		eventType = securityEventAccountLocked
+		details = fmt.Sprintf("Too many failed logins, locked for %s", wait.Round(time.Second))
+	} else if wait > 0 {
+		details += fmt.Sprintf(", next attempt allowed in %s", wait.Round(time.Second))
+	}
+	if err := recordSecurityEvent(initializers.DB, ctx, userID, eventType, "", details); err != nil {
+		log.Println("Failed to record security event of user_id:", userID, err)
+	}
+}
+
+// start a session for the device of a user who passed all login checks and respond with its tokens
+func completeLogin(ctx *gin.Context, user types.User, deviceName string) {
+	// start a session for this device and generate its access and refresh tokens
+	access_token, refresh_token, err := createSession(ctx, user, deviceName)
 	if err != nil {
 		setErrorResponse(ctx, 500, "Login failed. Try again later!")
 		return
 	}
 	// return access token in response body while refresh token in httponly cookie
-	ctx.SetCookie("refresh_token", refresh_token, 3600*24, "/", "", true, true)
+	ctx.SetCookie("refresh_token", refresh_token, int(refreshTokenLifetime.Seconds()), "/", "", true, true)
 	ctx.JSON(200, gin.H{
 		"status":  "success",
 		"message": "User logged in successfully",
 		"data": map[string]interface{}{
 			"access_token": access_token,
-			"user": map[string]string{
-				"username": user.Username,
-				"email":    user.Email,
+			"user": map[string]interface{}{
+				"username":       user.Username,
+				"email":          user.Email,
+				"email_verified": user.EmailVerifiedAt != nil,
 			},
 		},
 	})
 }
-func generateTokens(user types.User) (string, string, error) {
+
+// generate the short lived token proving the password of the user was checked, exchanged with a TOTP or recovery code for the real tokens
+func generateMFAToken(user types.User) (string, error) {
+	time_now := time.Now()
+	claims := types.UserTokenClaims{
+		UserID:  user.UserID,
+		Purpose: types.TokenPurposeMFA,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time_now.Add(mfaTokenLifetime)),
+			IssuedAt:  jwt.NewNumericDate(time_now),
+		},
+	}
+	mfa_token, err := initializers.TokenKeyring.Sign(claims)
+	if err != nil {
+		log.Println("Failed to generate mfa token for user ", user.UserID)
+		return "", err
+	}
+	return mfa_token, nil
+}
+
+// generate the access and refresh tokens of a session of the user
+func generateTokens(user types.User, sessionID string) (string, string, error) {
 	time_now := time.Now()
 	// generate signed access token
 	accessClaims := types.UserTokenClaims{
-		UserID: user.UserID,
+		UserID:    user.UserID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time_now.Add(time.Minute * 15)),
+			ExpiresAt: jwt.NewNumericDate(time_now.Add(accessTokenLifetime)),
 			IssuedAt:  jwt.NewNumericDate(time_now),
 		},
 	}
-	access_token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims).SignedString([]byte(os.Getenv("ACCESS_SECRET")))
+	access_token, err := initializers.TokenKeyring.Sign(accessClaims)
 	if err != nil {
-		log.Println("Failed to generate access token for user ", user.Username)
+		log.Println("Failed to generate access token for user ", user.UserID)
+		return "", "", err
+	}
+	// generate signed refresh token, the random id makes every refresh token unique even when two are issued within a second
+	tokenID, err := utils.GenerateUUID()
+	if err != nil {
+		log.Println("Failed to generate refresh token id for user ", user.UserID)
 		return "", "", err
 	}
-	// generate signed refresh token
 	refreshClaims := types.UserTokenClaims{
-		UserID: user.UserID,
+		UserID:    user.UserID,
+		SessionID: sessionID,
+		Purpose:   types.TokenPurposeRefresh,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time_now.Add(time.Hour * 24)),
+			ID:        tokenID,
+			ExpiresAt: jwt.NewNumericDate(time_now.Add(refreshTokenLifetime)),
 			IssuedAt:  jwt.NewNumericDate(time_now),
 		},
 	}
-	refresh_token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims).SignedString([]byte(os.Getenv("REFRESH_SECRET")))
+	refresh_token, err := initializers.TokenKeyring.Sign(refreshClaims)
 	if err != nil {
-		log.Println("Failed to generate refresh token for user ", user.Username)
+		log.Println("Failed to generate refresh token for user ", user.UserID)
 		return "", "", err
 	}
-	// if token for user_id exists update it else insert token
-	var exists bool
-	dberr := initializers.DB.QueryRow(context.Background(), "SELECT true FROM passbook_app.tokens WHERE user_id=$1", user.UserID).Scan(&exists)
-	if dberr != nil && dberr != pgx.ErrNoRows {
-		log.Println(dberr)
-		log.Println("Failed to check if token exists for user ", user.Username)
-		return "", "", dberr
+	return access_token, refresh_token, nil
+}
+
+/*
+Start a new session of the user for the requesting device and return its access and refresh tokens. Every device
+has its own session so logging in on one device does not log the user out of another one.
+*/
+func createSession(ctx *gin.Context, user types.User, deviceName string) (string, string, error) {
+	sessionID, err := utils.GenerateUUID()
+	if err != nil {
+		log.Println("Failed to generate session_id for user ", user.Username)
+		return "", "", err
 	}
-	if exists {
-		_, dberr = initializers.DB.Exec(context.Background(), "UPDATE passbook_app.tokens SET rtoken=$1, updated_at=$2 WHERE user_id=$3",
-			refresh_token, time_now.UTC(), user.UserID)
-	} else {
-		_, dberr = initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.tokens (user_id, rtoken, created_at, updated_at) VALUES ($1, $2, $3, $4)",
-			user.UserID, refresh_token, time_now.UTC(), time_now.UTC())
+	access_token, refresh_token, err := generateTokens(user, sessionID)
+	if err != nil {
+		return "", "", err
 	}
-
-	if dberr != nil {
-		log.Println("Failed to save refresh token for user ", user.Username)
-		return "", "", dberr
+	userAgent := truncate(ctx.Request.UserAgent(), 512)
+	deviceName = truncate(utils.TrimAndSanitizeStrict(deviceName), 255)
+	if deviceName == "" {
+		deviceName = deviceNameFromUserAgent(userAgent)
+	}
+	time_now := time.Now().UTC()
+	_, err = initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.sessions (session_id, user_id, rtoken_hash, device_name, ip, user_agent, created_at, last_used_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		sessionID, user.UserID, utils.HashToken(refresh_token), deviceName, ctx.ClientIP(), userAgent, time_now, time_now)
+	if err != nil {
+		log.Println("Failed to save session for user ", user.Username, err)
+		return "", "", err
 	}
 	return access_token, refresh_token, nil
 }
+
 func RefreshToken(ctx *gin.Context) {
 	refresh_token, err := ctx.Cookie("refresh_token")
 	if err != nil {
@@ -183,25 +373,42 @@ func RefreshToken(ctx *gin.Context) {
 		setErrorResponse(ctx, 400, "Invalid request")
 		return
 	}
-	claims, err := middlewares.ValidateToken(refresh_token, os.Getenv("REFRESH_SECRET"))
-	if err != nil {
+	claims, err := middlewares.ValidateToken(refresh_token, types.TokenPurposeRefresh, os.Getenv("REFRESH_SECRET"))
+	if err != nil || claims.SessionID == "" {
 		setErrorResponse(ctx, 401, "Invalid Refresh token")
 		return
 	}
-	// check if user exists and token is not revoked
+	// check if user exists
 	user_id := claims.UserID
-	if !isValidUser(user_id) || isRevokedToken(refresh_token, user_id) {
+	if !isValidUser(user_id) {
 		setErrorResponse(ctx, 401, "Invalid Refresh token")
 		return
 	}
-	// generate new access and refresh tokens
-	access_token, refresh_token, err := generateTokens(types.User{UserID: user_id})
+	// generate new access and refresh tokens for the same session
+	access_token, new_refresh_token, err := generateTokens(types.User{UserID: user_id}, claims.SessionID)
 	if err != nil {
 		setErrorResponse(ctx, 500, "Failed to refresh token. Try again later!")
 		return
 	}
+	err = rotateSessionToken(ctx, initializers.DB, claims.SessionID, user_id, refresh_token, new_refresh_token)
+	if errors.Is(err, errRefreshTokenReused) {
+		log.Println("Reuse of a rotated refresh token, revoked session", claims.SessionID, "of user_id:", user_id)
+		clearRefreshTokenCookie(ctx)
+		setErrorResponse(ctx, 401, "Invalid Refresh token")
+		return
+	}
+	if errors.Is(err, errSessionRevoked) {
+		log.Println("The incoming refresh token is a revoked token")
+		setErrorResponse(ctx, 401, "Invalid Refresh token")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to rotate refresh token of session", claims.SessionID, err)
+		setErrorResponse(ctx, 500, "Failed to refresh token. Try again later!")
+		return
+	}
 	// return access token in response body while refresh token in httponly cookie
-	ctx.SetCookie("refresh_token", refresh_token, 3600*24, "/", "", true, true)
+	ctx.SetCookie("refresh_token", new_refresh_token, int(refreshTokenLifetime.Seconds()), "/", "", true, true)
 	ctx.JSON(200, gin.H{
 		"status":  "success",
 		"message": "Token refreshed successfully",
@@ -220,16 +427,172 @@ func isValidUser(user_id string) bool {
 	}
 	return exists
 }
-func isRevokedToken(refresh_token string, user_id string) bool {
-	// if token not present in token table then it is a revoked token and should not be allowed to refresh
-	var exists bool
-	dberr := initializers.DB.QueryRow(context.Background(), "SELECT true FROM passbook_app.tokens WHERE user_id=$1 AND rtoken=$2", user_id, refresh_token).Scan(&exists)
-	if dberr == pgx.ErrNoRows {
-		log.Println("The incoming refresh token is a revoked token")
-		return true
-	} else if dberr != nil {
-		log.Println("Failed to check token is revoked or not", dberr)
-		return true
+
+/*
+Replace the refresh token of a session with a new one and mark the session as used. The session and the tokens it
+rotated away from form a rotation family: only the current refresh token can be rotated, the old one is remembered
+so presenting it again revokes the whole session and records a security event, as only a copy of a token that was
+already used can still be around. Returns errSessionRevoked for unknown tokens and sessions.
+*/
+func rotateSessionToken(ctx *gin.Context, conn initializers.PgxPoolIface, sessionID string, userID string, oldToken string, newToken string) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	oldHash := utils.HashToken(oldToken)
+	var currentHash string
+	err = tx.QueryRow(context.Background(), "SELECT rtoken_hash FROM passbook_app.sessions WHERE session_id=$1 AND user_id=$2 FOR UPDATE", sessionID, userID).Scan(&currentHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+	time_now := time.Now().UTC()
+	if currentHash != oldHash {
+		var rotated bool
+		err = tx.QueryRow(context.Background(), "SELECT true FROM passbook_app.rotated_tokens WHERE token_hash=$1 AND session_id=$2", oldHash, sessionID).Scan(&rotated)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errSessionRevoked
+		}
+		if err != nil {
+			return err
+		}
+		// revoke the family, its rotated tokens are deleted along with the session
+		_, err = tx.Exec(context.Background(), "DELETE FROM passbook_app.sessions WHERE session_id=$1", sessionID)
+		if err != nil {
+			return err
+		}
+		err = recordSecurityEvent(tx, ctx, userID, securityEventRefreshTokenReuse, sessionID, "A rotated refresh token was presented again, the session was revoked")
+		if err != nil {
+			return err
+		}
+		if err = tx.Commit(context.Background()); err != nil {
+			return err
+		}
+		return errRefreshTokenReused
+	}
+	_, err = tx.Exec(context.Background(), "INSERT INTO passbook_app.rotated_tokens (token_hash, session_id, rotated_at) VALUES ($1, $2, $3)", oldHash, sessionID, time_now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.sessions SET rtoken_hash=$1, last_used_at=$2, ip=$3 WHERE session_id=$4",
+		utils.HashToken(newToken), time_now, ctx.ClientIP(), sessionID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// dbExecutor is satisfied by both the connection pool and a transaction
+type dbExecutor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// record a security event of the user along with the client the request came from
+func recordSecurityEvent(conn dbExecutor, ctx *gin.Context, userID string, eventType string, sessionID string, details string) error {
+	var session *string
+	if sessionID != "" {
+		session = &sessionID
+	}
+	_, err := conn.Exec(context.Background(), "INSERT INTO passbook_app.security_events (user_id, event_type, session_id, ip, user_agent, details, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		userID, eventType, session, ctx.ClientIP(), truncate(ctx.Request.UserAgent(), 512), details, time.Now().UTC())
+	return err
+}
+
+// a readable device name like "Firefox on Windows" from a user agent
+func deviceNameFromUserAgent(userAgent string) string {
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	system := ""
+	for _, o := range []struct{ token, name string }{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			system = o.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	case userAgent != "":
+		return truncate(userAgent, 255)
+	}
+	return "Unknown device"
+}
+
+// an email is valid when it is a bare address like jane@example.com, without a display name
+func isValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && len(email) <= 255
+}
+
+// cut s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
 	}
-	return !exists
+	return s[:n]
+}
+
+// expire the refresh token cookie on the client
+func clearRefreshTokenCookie(ctx *gin.Context) {
+	ctx.SetCookie("refresh_token", "", -1, "/", "", true, true)
+}
+
+/*
+Route handler for logging out the client holding the refresh token cookie. The session of the refresh token is
+revoked and the cookie is cleared. Logging out is idempotent, a missing or invalid cookie still succeeds.
+*/
+func LogoutUser(ctx *gin.Context) {
+	refreshToken, err := ctx.Cookie("refresh_token")
+	if err == nil && refreshToken != "" {
+		claims, err := middlewares.ValidateToken(refreshToken, types.TokenPurposeRefresh, os.Getenv("REFRESH_SECRET"))
+		if err == nil && claims.SessionID != "" {
+			_, err = initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.sessions WHERE session_id=$1 AND user_id=$2 AND rtoken_hash=$3", claims.SessionID, claims.UserID, utils.HashToken(refreshToken))
+			if err != nil {
+				log.Println("Failed to revoke session", claims.SessionID, "of user_id:", claims.UserID, err)
+				setErrorResponse(ctx, 500, "Logout failed. Try again later!")
+				return
+			}
+		}
+	}
+	clearRefreshTokenCookie(ctx)
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "User logged out successfully",
+	})
+}
+
+// route handler for revoking every session of the logged in user, e.g. when a refresh token was stolen
+func LogoutUserEverywhere(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	ctag, err := initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.sessions WHERE user_id=$1", loggedInUserID)
+	if err != nil {
+		log.Println("Failed to revoke sessions of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Logout failed. Try again later!")
+		return
+	}
+	log.Println("Revoked", ctag.RowsAffected(), "sessions of user_id:", loggedInUserID)
+	clearRefreshTokenCookie(ctx)
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "User logged out from all devices successfully",
+	})
 }
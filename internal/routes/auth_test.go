@@ -0,0 +1,391 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/lockout"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// signed refresh token of a session of the user as issued by generateTokens
+func testRefreshToken(t *testing.T, userID string, sessionID string) string {
+	now := time.Now()
+	token, err := initializers.TokenKeyring.Sign(types.UserTokenClaims{
+		UserID:    userID,
+		SessionID: sessionID,
+		Purpose:   types.TokenPurposeRefresh,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to sign refresh token: %v", err)
+	}
+	return token
+}
+
+// columns of SELECT * on passbook_app.users
+var userColumns = []string{"user_id", "username", "email", "password_hash", "created_at", "updated_at", "email_verified_at", "totp_secret", "totp_enabled_at", "totp_last_counter"}
+
+// the Set-Cookie header of a response clearing the refresh token cookie
+func isRefreshCookieCleared(w *httptest.ResponseRecorder) bool {
+	cookie := w.Header().Get("Set-Cookie")
+	return strings.HasPrefix(cookie, "refresh_token=;") && strings.Contains(cookie, "Max-Age=0")
+}
+
+func TestLogoutUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	testUserID := "test-user-id"
+	testSessionID := "test-session-id"
+
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	auth := router.Group("/v1/auth")
+	{
+		auth.POST("/logout", LogoutUser)
+		auth.POST("/logout-all", authTestMiddleware(), LogoutUserEverywhere)
+	}
+
+	t.Run("Session of the refresh token is revoked", func(t *testing.T) {
+		refreshToken := testRefreshToken(t, testUserID, testSessionID)
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.sessions WHERE session_id=\$1 AND user_id=\$2 AND rtoken_hash=\$3$`).
+			WithArgs(testSessionID, testUserID, utils.HashToken(refreshToken)).
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/logout", nil)
+		req.AddCookie(&http.Cookie{Name: "refresh_token", Value: refreshToken})
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, isRefreshCookieCleared(w))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Logout without cookie succeeds", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/logout", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, isRefreshCookieCleared(w))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Logout everywhere revokes all sessions", func(t *testing.T) {
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.sessions WHERE user_id=\$1$`).
+			WithArgs(testUserID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/logout-all", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, isRefreshCookieCleared(w))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestLoginUserCreatesSession(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/auth/login", LoginUser)
+
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	now := time.Now().UTC()
+	mockDB.ExpectQuery(`^SELECT \* FROM passbook_app.users WHERE username=\$1$`).
+		WithArgs("jane").
+		WillReturnRows(pgxmock.NewRows(userColumns).
+			AddRow("test-user-id", "jane", "jane@example.com", string(passwordHash), now, now, &now, nil, nil, int64(0)))
+	mockDB.ExpectExec(`^INSERT INTO passbook_app.sessions \(session_id, user_id, rtoken_hash, device_name, ip, user_agent, created_at, last_used_at\)`).
+		WithArgs(pgxmock.AnyArg(), "test-user-id", pgxmock.AnyArg(), "Firefox on Windows", "192.0.2.1", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0", pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/auth/login", strings.NewReader(`{"username":"jane","password":"secret"}`))
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0")
+	req.RemoteAddr = "192.0.2.1:54321"
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Set-Cookie"), "refresh_token=")
+	assert.NoError(t, mockDB.ExpectationsWereMet())
+}
+
+func TestRefreshToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	testUserID := "test-user-id"
+	testSessionID := "test-session-id"
+	router := gin.New()
+	router.GET("/v1/auth/refresh", RefreshToken)
+	userSQL := `^SELECT true FROM passbook_app.users WHERE user_id=\$1$`
+	sessionSQL := `^SELECT rtoken_hash FROM passbook_app.sessions WHERE session_id=\$1 AND user_id=\$2 FOR UPDATE$`
+	rotatedSQL := `^SELECT true FROM passbook_app.rotated_tokens WHERE token_hash=\$1 AND session_id=\$2$`
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/auth/refresh", nil)
+		req.AddCookie(&http.Cookie{Name: "refresh_token", Value: refreshToken})
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Refresh token of the session is rotated", func(t *testing.T) {
+		refreshToken := testRefreshToken(t, testUserID, testSessionID)
+		mockDB.ExpectQuery(userSQL).WithArgs(testUserID).WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(sessionSQL).
+			WithArgs(testSessionID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"rtoken_hash"}).AddRow(utils.HashToken(refreshToken)))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.rotated_tokens \(token_hash, session_id, rotated_at\) VALUES \(\$1, \$2, \$3\)$`).
+			WithArgs(utils.HashToken(refreshToken), testSessionID, pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectExec(`^UPDATE passbook_app.sessions SET rtoken_hash=\$1, last_used_at=\$2, ip=\$3 WHERE session_id=\$4$`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), testSessionID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := refresh(refreshToken)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Set-Cookie"), "refresh_token=")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Reused refresh token revokes the session", func(t *testing.T) {
+		refreshToken := testRefreshToken(t, testUserID, testSessionID)
+		mockDB.ExpectQuery(userSQL).WithArgs(testUserID).WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(sessionSQL).
+			WithArgs(testSessionID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"rtoken_hash"}).AddRow(utils.HashToken("newer-token")))
+		mockDB.ExpectQuery(rotatedSQL).
+			WithArgs(utils.HashToken(refreshToken), testSessionID).
+			WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.sessions WHERE session_id=\$1$`).
+			WithArgs(testSessionID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events \(user_id, event_type, session_id, ip, user_agent, details, created_at\)`).
+			WithArgs(testUserID, "refresh_token_reuse", &testSessionID, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := refresh(refreshToken)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.True(t, isRefreshCookieCleared(w))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown refresh token is rejected", func(t *testing.T) {
+		refreshToken := testRefreshToken(t, testUserID, testSessionID)
+		mockDB.ExpectQuery(userSQL).WithArgs(testUserID).WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(sessionSQL).
+			WithArgs(testSessionID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"rtoken_hash"}).AddRow(utils.HashToken("newer-token")))
+		mockDB.ExpectQuery(rotatedSQL).
+			WithArgs(utils.HashToken(refreshToken), testSessionID).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectRollback()
+
+		w := refresh(refreshToken)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Revoked session is rejected", func(t *testing.T) {
+		refreshToken := testRefreshToken(t, testUserID, testSessionID)
+		mockDB.ExpectQuery(userSQL).WithArgs(testUserID).WillReturnRows(pgxmock.NewRows([]string{"exists"}).AddRow(true))
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(sessionSQL).
+			WithArgs(testSessionID, testUserID).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectRollback()
+
+		w := refresh(refreshToken)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Refresh token without session is rejected", func(t *testing.T) {
+		w := refresh(testRefreshToken(t, testUserID, ""))
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Access token is no refresh token", func(t *testing.T) {
+		accessToken, _, err := generateTokens(types.User{UserID: testUserID}, testSessionID)
+		assert.NoError(t, err)
+
+		w := refresh(accessToken)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestLoginLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	originalUsernameLimiter, originalIPLimiter := initializers.UsernameLoginLimiter, initializers.IPLoginLimiter
+	policy := lockout.Policy{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Hour, LockoutThreshold: 3, LockoutDuration: time.Hour, Window: time.Hour}
+	initializers.UsernameLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), policy)
+	initializers.IPLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), lockout.Policy{FreeAttempts: 100, LockoutThreshold: 1000, Window: time.Hour})
+	defer func() {
+		initializers.UsernameLoginLimiter, initializers.IPLoginLimiter = originalUsernameLimiter, originalIPLimiter
+	}()
+
+	router := gin.New()
+	router.POST("/v1/auth/login", LoginUser)
+	login := func(username string, password string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/login", strings.NewReader(`{"username":"`+username+`","password":"`+password+`"}`))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	now := time.Now().UTC()
+	userSQL := `^SELECT \* FROM passbook_app.users WHERE username=\$1$`
+
+	t.Run("Wrong password is recorded and backs off", func(t *testing.T) {
+		for i, event := range []string{"login_failed", "login_failed"} {
+			mockDB.ExpectQuery(userSQL).
+				WithArgs("jane").
+				WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", string(passwordHash), now, now, nil, nil, nil, int64(0)))
+			mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+				WithArgs("test-user-id", event, (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+			w := login("jane", "wrong")
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code, i)
+			if i == 0 {
+				continue
+			}
+			// the second failure is past the free attempt, so the next one has to wait
+			w = login("Jane", "secret")
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+			assert.Equal(t, "60", w.Header().Get("Retry-After"))
+		}
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown usernames are limited as well", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			mockDB.ExpectQuery(userSQL).WithArgs("ghost").WillReturnRows(pgxmock.NewRows(userColumns))
+			assert.Equal(t, http.StatusUnauthorized, login("ghost", "guess").Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, login("ghost", "guess").Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Lockout is recorded", func(t *testing.T) {
+		// two earlier failures whose backoff is already over
+		for i := 0; i < 2; i++ {
+			initializers.UsernameLoginLimiter.Store.Attempt("user:john", time.Now().Add(-30*time.Minute), policy)
+		}
+		mockDB.ExpectQuery(userSQL).
+			WithArgs("john").
+			WillReturnRows(pgxmock.NewRows(userColumns).AddRow("john-id", "john", "john@example.com", string(passwordHash), now, now, nil, nil, nil, int64(0)))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("john-id", "account_locked", (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), "Too many failed logins, locked for 1h0m0s", pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		assert.Equal(t, http.StatusUnauthorized, login("john", "wrong").Code)
+		assert.Equal(t, http.StatusTooManyRequests, login("john", "secret").Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("PASSBOOK_ENV", "DEV")
+	clientIP := func(router *gin.Engine, remoteAddr string) string {
+		router.GET("/test/ip", func(ctx *gin.Context) { ctx.String(200, ctx.ClientIP()) })
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/test/ip", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	t.Run("Forwarded headers are ignored by default", func(t *testing.T) {
+		t.Setenv("TRUSTED_PROXIES", "")
+		assert.Equal(t, "192.0.2.1", clientIP(NewRouter(), "192.0.2.1:4321"))
+	})
+
+	t.Run("Forwarded headers of a trusted proxy are used", func(t *testing.T) {
+		t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.10")
+		assert.Equal(t, "203.0.113.7", clientIP(NewRouter(), "10.1.2.3:4321"))
+		assert.Equal(t, "192.0.2.1", clientIP(NewRouter(), "192.0.2.1:4321"))
+	})
+}
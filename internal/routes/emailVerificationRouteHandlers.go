@@ -0,0 +1,169 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/mailer"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	emailVerificationTokenLifetime = 24 * time.Hour
+	// minimum time between two verification emails of a user
+	emailVerificationResendInterval = time.Minute
+)
+
+var errInvalidVerificationToken = errors.New("invalid or expired email verification token")
+
+type emailVerificationReq struct {
+	Token string `json:"token"`
+}
+
+/*
+Email a verification link for the current email of the user. A new token replaces the earlier ones of the user and
+is bound to the email it was sent to, so it stops working when the email of the account changes.
+*/
+func sendVerificationEmail(userID string, username string, email string) error {
+	token, err := utils.GenerateSecureToken()
+	if err != nil {
+		return err
+	}
+	time_now := time.Now().UTC()
+	_, err = initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.email_verifications WHERE user_id=$1", userID)
+	if err != nil {
+		return err
+	}
+	_, err = initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.email_verifications (token_hash, user_id, email, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)",
+		utils.HashToken(token), userID, email, time_now.Add(emailVerificationTokenLifetime), time_now)
+	if err != nil {
+		return err
+	}
+	link := strings.TrimRight(os.Getenv("APP_BASE_URL"), "/") + "/verify-email?token=" + url.QueryEscape(token)
+	return initializers.Mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Verify your Passbook email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm that this is your email address by opening the link below within %d hours:\n\n%s\n\n"+
+			"If you did not create a Passbook account you can ignore this email.\n",
+			username, int(emailVerificationTokenLifetime.Hours()), link),
+	})
+}
+
+// route handler for confirming the email of an account with the token of a verification link
+func VerifyEmail(ctx *gin.Context) {
+	var req emailVerificationReq
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		setErrorResponse(ctx, 400, "Please provide the verification token.")
+		return
+	}
+	err := verifyEmail(initializers.DB, req.Token)
+	if errors.Is(err, errInvalidVerificationToken) {
+		setErrorResponse(ctx, 400, "Invalid or expired email verification token")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to verify email", err)
+		setErrorResponse(ctx, 500, "Failed to verify email. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Email verified successfully",
+	})
+}
+
+// use up the verification token and mark the email of its user as verified if it is still the email of the account
+func verifyEmail(conn initializers.PgxPoolIface, token string) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	time_now := time.Now().UTC()
+	var userID, email string
+	err = tx.QueryRow(context.Background(), "DELETE FROM passbook_app.email_verifications WHERE token_hash=$1 AND expires_at > $2 RETURNING user_id, email",
+		utils.HashToken(token), time_now).Scan(&userID, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errInvalidVerificationToken
+	}
+	if err != nil {
+		return err
+	}
+	ctag, err := tx.Exec(context.Background(), "UPDATE passbook_app.users SET email_verified_at=$1, updated_at=$1 WHERE user_id=$2 AND email=$3 AND email_verified_at IS NULL",
+		time_now, userID, email)
+	if err != nil {
+		return err
+	}
+	if ctag.RowsAffected() == 0 {
+		// the email was changed since the link was sent or was already verified
+		var verified bool
+		err = tx.QueryRow(context.Background(), "SELECT email_verified_at IS NOT NULL FROM passbook_app.users WHERE user_id=$1 AND email=$2", userID, email).Scan(&verified)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errInvalidVerificationToken
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+// route handler for sending the verification link of the logged in user again, at most once per resend interval
+func ResendVerificationEmail(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var username, email string
+	var verified bool
+	err := initializers.DB.QueryRow(context.Background(), "SELECT username, email, email_verified_at IS NOT NULL FROM passbook_app.users WHERE user_id=$1", loggedInUserID).
+		Scan(&username, &email, &verified)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			setErrorResponse(ctx, 404, "User not found")
+			return
+		}
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to send verification email. Try again later!")
+		return
+	}
+	if verified {
+		setErrorResponse(ctx, 409, "Email is already verified")
+		return
+	}
+	var lastSentAt time.Time
+	err = initializers.DB.QueryRow(context.Background(), "SELECT created_at FROM passbook_app.email_verifications WHERE user_id=$1 ORDER BY created_at DESC LIMIT 1", loggedInUserID).Scan(&lastSentAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Println("Failed to get last verification email of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to send verification email. Try again later!")
+		return
+	}
+	if wait := emailVerificationResendInterval - time.Since(lastSentAt); err == nil && wait > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		setErrorResponse(ctx, 429, "A verification email was sent recently. Please wait before requesting another one")
+		return
+	}
+	if err := sendVerificationEmail(loggedInUserID, username, email); err != nil {
+		log.Println("Failed to send verification email to user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to send verification email. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Verification email sent",
+	})
+}
+
+// delete the email verification tokens which expired
+func purgeExpiredEmailVerifications(conn initializers.PgxPoolIface) error {
+	_, err := conn.Exec(context.Background(), "DELETE FROM passbook_app.email_verifications WHERE expires_at < $1", time.Now().UTC())
+	return err
+}
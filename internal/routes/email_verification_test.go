@@ -0,0 +1,313 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/mailer"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailVerification(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("APP_BASE_URL", "https://passbook.example.com")
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	mailDir := t.TempDir()
+	originalMailer := initializers.Mailer
+	initializers.Mailer = &mailer.LogSender{Dir: mailDir, From: "no-reply@example.com"}
+	defer func() { initializers.Mailer = originalMailer }()
+
+	testUserID := "test-user-id"
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	auth := router.Group("/v1/auth")
+	{
+		auth.POST("/register", CreateUser)
+		auth.POST("/verify-email", VerifyEmail)
+		auth.POST("/verify-email/resend", authTestMiddleware(), ResendVerificationEmail)
+	}
+	expectVerificationToken := func() {
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.email_verifications WHERE user_id=\$1$`).
+			WithArgs(testUserID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.email_verifications \(token_hash, user_id, email, expires_at, created_at\)`).
+			WithArgs(pgxmock.AnyArg(), testUserID, "jane@example.com", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	}
+
+	t.Run("Registration emails a verification link", func(t *testing.T) {
+		mockDB.ExpectQuery(`^INSERT INTO passbook_app.users \(username, email, password_hash,created_at,updated_at\) VALUES \(\$1, \$2, \$3, \$4, \$5\) RETURNING user_id$`).
+			WithArgs("jane", "jane@example.com", pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow(testUserID))
+		expectVerificationToken()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/register", strings.NewReader(`{"username":"jane","email":"jane@example.com","password":"secret"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Contains(t, w.Body.String(), `"email_verified":false`)
+		mails := sentMails(t, mailDir)
+		assert.Len(t, mails, 1)
+		assert.Contains(t, mails[0], "https://passbook.example.com/verify-email?token=")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid email is rejected", func(t *testing.T) {
+		for _, email := range []string{"not-an-email", "Jane <jane@example.com>"} {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/v1/auth/register", strings.NewReader(`{"username":"jane","email":"`+email+`","password":"secret"}`))
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code, email)
+		}
+	})
+
+	t.Run("Email is verified", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(`^DELETE FROM passbook_app.email_verifications WHERE token_hash=\$1 AND expires_at > \$2 RETURNING user_id, email$`).
+			WithArgs(utils.HashToken("verify-token"), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"user_id", "email"}).AddRow(testUserID, "jane@example.com"))
+		mockDB.ExpectExec(`^UPDATE passbook_app.users SET email_verified_at=\$1, updated_at=\$1 WHERE user_id=\$2 AND email=\$3 AND email_verified_at IS NULL$`).
+			WithArgs(pgxmock.AnyArg(), testUserID, "jane@example.com").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/verify-email", strings.NewReader(`{"token":"verify-token"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Token for a changed email is rejected", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(`^DELETE FROM passbook_app.email_verifications`).
+			WithArgs(utils.HashToken("verify-token"), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"user_id", "email"}).AddRow(testUserID, "old@example.com"))
+		mockDB.ExpectExec(`^UPDATE passbook_app.users SET email_verified_at`).
+			WithArgs(pgxmock.AnyArg(), testUserID, "old@example.com").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+		mockDB.ExpectQuery(`^SELECT email_verified_at IS NOT NULL FROM passbook_app.users WHERE user_id=\$1 AND email=\$2$`).
+			WithArgs(testUserID, "old@example.com").
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/verify-email", strings.NewReader(`{"token":"verify-token"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	userSQL := `^SELECT username, email, email_verified_at IS NOT NULL FROM passbook_app.users WHERE user_id=\$1$`
+	lastSentSQL := `^SELECT created_at FROM passbook_app.email_verifications WHERE user_id=\$1 ORDER BY created_at DESC LIMIT 1$`
+
+	t.Run("Resend is throttled", func(t *testing.T) {
+		mockDB.ExpectQuery(userSQL).
+			WithArgs(testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"username", "email", "verified"}).AddRow("jane", "jane@example.com", false))
+		mockDB.ExpectQuery(lastSentSQL).
+			WithArgs(testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"created_at"}).AddRow(time.Now().Add(-20 * time.Second)))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/verify-email/resend", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "40", w.Header().Get("Retry-After"))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Verification email is resent", func(t *testing.T) {
+		mockDB.ExpectQuery(userSQL).
+			WithArgs(testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"username", "email", "verified"}).AddRow("jane", "jane@example.com", false))
+		mockDB.ExpectQuery(lastSentSQL).
+			WithArgs(testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"created_at"}).AddRow(time.Now().Add(-2 * time.Minute)))
+		expectVerificationToken()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/verify-email/resend", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, sentMails(t, mailDir), 2)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Verified email is not resent", func(t *testing.T) {
+		mockDB.ExpectQuery(userSQL).
+			WithArgs(testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"username", "email", "verified"}).AddRow("jane", "jane@example.com", true))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/verify-email/resend", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.GET("/sensitive", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+		c.Next()
+	}, middlewares.RequireVerifiedEmail(), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	verifiedSQL := `^SELECT email_verified_at IS NOT NULL FROM passbook_app.users WHERE user_id=\$1$`
+	get := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/sensitive", nil)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("Policy disabled", func(t *testing.T) {
+		t.Setenv("REQUIRE_VERIFIED_EMAIL", "")
+		assert.Equal(t, http.StatusNoContent, get())
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unverified email is blocked", func(t *testing.T) {
+		t.Setenv("REQUIRE_VERIFIED_EMAIL", "true")
+		mockDB.ExpectQuery(verifiedSQL).WithArgs("test-user-id").WillReturnRows(pgxmock.NewRows([]string{"verified"}).AddRow(false))
+		assert.Equal(t, http.StatusForbidden, get())
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Verified email passes", func(t *testing.T) {
+		t.Setenv("REQUIRE_VERIFIED_EMAIL", "true")
+		mockDB.ExpectQuery(verifiedSQL).WithArgs("test-user-id").WillReturnRows(pgxmock.NewRows([]string{"verified"}).AddRow(true))
+		assert.Equal(t, http.StatusNoContent, get())
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestVerifiedEmailRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("PASSBOOK_ENV", "DEV")
+	t.Setenv("REQUIRE_VERIFIED_EMAIL", "true")
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := NewRouter()
+	registered := map[string]bool{}
+	for _, route := range router.Routes() {
+		registered[route.Method+" "+route.Path] = true
+	}
+	now := time.Now()
+	accessToken, err := initializers.TokenKeyring.Sign(types.UserTokenClaims{
+		UserID:    "test-user-id",
+		SessionID: "test-session-id",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to sign access token: %v", err)
+	}
+	pathParam := regexp.MustCompile(`:[a-z_]+`)
+
+	for _, route := range verifiedEmailRoutes {
+		t.Run(route, func(t *testing.T) {
+			assert.True(t, registered[route], "no such route")
+			mockDB.ExpectQuery(`^SELECT email_verified_at IS NOT NULL FROM passbook_app.users WHERE user_id=\$1$`).
+				WithArgs("test-user-id").
+				WillReturnRows(pgxmock.NewRows([]string{"verified"}).AddRow(false))
+
+			method, path, _ := strings.Cut(route, " ")
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(method, pathParam.ReplaceAllString(path, "test-id"), nil)
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusForbidden, w.Code)
+			assert.Contains(t, w.Body.String(), "verify your email")
+			assert.NoError(t, mockDB.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("Every route changing money data is listed", func(t *testing.T) {
+		listed := map[string]bool{}
+		for _, route := range verifiedEmailRoutes {
+			listed[route] = true
+		}
+		moneyPaths := []string{"/v1/passbooks", "/v1/transfers", "/v1/exchange-rates", "/v1/import-profiles", "/v1/imports"}
+		for _, route := range router.Routes() {
+			if route.Method == "GET" || !slices.ContainsFunc(moneyPaths, func(p string) bool { return strings.HasPrefix(route.Path, p) }) {
+				continue
+			}
+			assert.True(t, listed[route.Method+" "+route.Path], "%s %s does not require a verified email", route.Method, route.Path)
+		}
+	})
+
+	t.Run("Routes that are not sensitive skip the check", func(t *testing.T) {
+		// the handler itself fails on the empty body before touching the database
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", "/v1/users/me/preferences", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,466 @@
+package routes
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/importers"
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/locale"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// columns of an exchange rates file, the header row names them in any order
+var exchangeRateColumns = []string{"rate_date", "base_currency", "quote_currency", "rate"}
+
+const upsertExchangeRateSQL = "INSERT INTO passbook_app.exchange_rates (rate_id, user_id, base_currency, quote_currency, rate_date, rate, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (user_id, base_currency, quote_currency, rate_date) DO UPDATE SET rate=EXCLUDED.rate, created_at=EXCLUDED.created_at RETURNING rate_id"
+
+type exchangeRateReq struct {
+	BaseCurrency  string     `json:"base_currency"`
+	QuoteCurrency string     `json:"quote_currency"`
+	RateDate      string     `json:"rate_date"`
+	Rate          types.Rate `json:"rate"`
+}
+
+// balance of a passbook as of the date of a totals report, converted into the currency of the report
+type passbookTotal struct {
+	PassbookID       string      `json:"passbook_id"`
+	Nickname         string      `json:"nickname"`
+	Currency         string      `json:"currency"`
+	Balance          types.Money `json:"balance"`
+	ConvertedBalance types.Money `json:"converted_balance"`
+}
+
+// sum of the balances of the passbooks in one currency
+type currencyTotal struct {
+	Currency         string      `json:"currency"`
+	Balance          types.Money `json:"balance"`
+	ConvertedBalance types.Money `json:"converted_balance"`
+	// rate the balances were converted with, null for the currency of the report
+	Rate *types.ExchangeRate `json:"rate"`
+}
+
+type totalsReport struct {
+	AsOf       string          `json:"as_of"`
+	Currency   string          `json:"currency"`
+	Total      types.Money     `json:"total"`
+	Currencies []currencyTotal `json:"currencies"`
+	Passbooks  []passbookTotal `json:"passbooks"`
+}
+
+// check the fields of an exchange rate sent by the user, dates are plain days like 2024-04-01
+func newExchangeRate(base string, quote string, date string, rate types.Rate) (types.ExchangeRate, error) {
+	er := types.ExchangeRate{
+		BaseCurrency:  normalizeCurrency(base),
+		QuoteCurrency: normalizeCurrency(quote),
+		Rate:          rate,
+	}
+	if !locale.IsCurrency(er.BaseCurrency) || !locale.IsCurrency(er.QuoteCurrency) {
+		return er, locale.ErrInvalidCurrency
+	}
+	if er.BaseCurrency == er.QuoteCurrency {
+		return er, errors.New("base and quote currency should be different")
+	}
+	rateDate, err := time.Parse(time.DateOnly, strings.TrimSpace(date))
+	if err != nil {
+		return er, errors.New("invalid rate_date, expected format YYYY-MM-DD")
+	}
+	er.RateDate = rateDate
+	if er.Rate <= 0 {
+		return er, types.ErrInvalidRate
+	}
+	return er, nil
+}
+
+// insert the rate or replace the rate of the same pair and day, sets the id of the stored rate
+func upsertExchangeRate(tx pgx.Tx, userID string, er *types.ExchangeRate) error {
+	rateID, err := utils.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	return tx.QueryRow(context.Background(), upsertExchangeRateSQL,
+		rateID, userID, er.BaseCurrency, er.QuoteCurrency, er.RateDate, er.Rate, er.CreatedAt).Scan(&er.RateID)
+}
+
+// store a batch of rates in one db transaction, either all of them are stored or none
+func upsertExchangeRates(conn initializers.PgxPoolIface, userID string, rates []types.ExchangeRate) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	for i := range rates {
+		if err := upsertExchangeRate(tx, userID, &rates[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+// route handler for loading a single exchange rate, a rate of the same pair and day is replaced
+func CreateExchangeRate(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req exchangeRateReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		setErrorResponse(ctx, 400, invalidBodyMessage(err))
+		return
+	}
+	er, err := newExchangeRate(req.BaseCurrency, req.QuoteCurrency, req.RateDate, req.Rate)
+	if err != nil {
+		setErrorResponse(ctx, 400, err.Error())
+		return
+	}
+	er.CreatedAt = time.Now().UTC()
+	rates := []types.ExchangeRate{er}
+	if err := upsertExchangeRates(initializers.DB, loggedInUserID, rates); err != nil {
+		log.Println("Failed to store exchange rate for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to store exchange rate")
+		return
+	}
+	ctx.JSON(201, gin.H{
+		"status":  "success",
+		"message": "Exchange rate stored successfully",
+		"data": map[string]types.ExchangeRate{
+			"exchange_rate": rates[0],
+		},
+	})
+}
+
+/*
+Route handler for loading exchange rates from a CSV file uploaded as "file". The header row names the columns
+rate_date, base_currency, quote_currency and rate in any order. Nothing is stored when any of the rows is invalid.
+*/
+func ImportExchangeRates(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	fileHeader, err := ctx.FormFile("file")
+	if err != nil {
+		setErrorResponse(ctx, 400, "Please upload the exchange rates as file")
+		return
+	}
+	if fileHeader.Size > maxImportFileSize {
+		setErrorResponse(ctx, 400, "Exchange rates file is too large")
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Println("Failed to open uploaded exchange rates", err)
+		setErrorResponse(ctx, 500, "Failed to import exchange rates")
+		return
+	}
+	defer file.Close()
+	rates, rowErrors, err := parseExchangeRatesCSV(file)
+	if err != nil {
+		setErrorResponse(ctx, 400, "Failed to parse exchange rates: "+err.Error())
+		return
+	}
+	if len(rowErrors) > 0 {
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Exchange rates file has invalid rows, nothing was imported",
+			"data": map[string][]importers.RowError{
+				"errors": rowErrors,
+			},
+		})
+		return
+	}
+	if len(rates) == 0 {
+		setErrorResponse(ctx, 400, "Exchange rates file has no rates")
+		return
+	}
+	if len(rates) > maxImportRows {
+		setErrorResponse(ctx, 400, "Exchange rates file has too many rows")
+		return
+	}
+	if err := upsertExchangeRates(initializers.DB, loggedInUserID, rates); err != nil {
+		log.Println("Failed to import exchange rates for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to import exchange rates")
+		return
+	}
+	log.Println("Imported", len(rates), "exchange rates for user_id:", loggedInUserID)
+	ctx.JSON(201, gin.H{
+		"status":  "success",
+		"message": "Exchange rates imported successfully",
+		"data": map[string]int{
+			"imported": len(rates),
+		},
+	})
+}
+
+// parse an exchange rates file, rows that are invalid are returned as row errors with their line number
+func parseExchangeRatesCSV(r io.Reader) ([]types.ExchangeRate, []importers.RowError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, errors.New("file is empty")
+		}
+		return nil, nil, err
+	}
+	index := make(map[string]int, len(exchangeRateColumns))
+	for i, name := range header {
+		// spreadsheets often save CSV files with a byte order mark
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, column := range exchangeRateColumns {
+		if _, ok := index[column]; !ok {
+			return nil, nil, fmt.Errorf("missing column %s in the header", column)
+		}
+	}
+	createdAt := time.Now().UTC()
+	rates := make([]types.ExchangeRate, 0)
+	rowErrors := make([]importers.RowError, 0)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(column string) string {
+			if i := index[column]; i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		rate, err := types.ParseRate(field("rate"))
+		if err != nil {
+			rowErrors = append(rowErrors, importers.RowError{Line: line, Message: err.Error()})
+			continue
+		}
+		er, err := newExchangeRate(field("base_currency"), field("quote_currency"), field("rate_date"), rate)
+		if err != nil {
+			rowErrors = append(rowErrors, importers.RowError{Line: line, Message: err.Error()})
+			continue
+		}
+		er.CreatedAt = createdAt
+		rates = append(rates, er)
+	}
+	return rates, rowErrors, nil
+}
+
+// route handler for listing the exchange rates of the user, newest first, optionally only of one currency pair
+func GetExchangeRates(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	base := normalizeCurrency(ctx.Query("base_currency"))
+	quote := normalizeCurrency(ctx.Query("quote_currency"))
+	rows, err := initializers.DB.Query(context.Background(), "SELECT rate_id, base_currency, quote_currency, rate_date, rate, created_at FROM passbook_app.exchange_rates WHERE user_id=$1 AND ($2='' OR base_currency=$2) AND ($3='' OR quote_currency=$3) ORDER BY rate_date DESC, base_currency, quote_currency",
+		loggedInUserID, base, quote)
+	if err != nil {
+		log.Println("Failed to get exchange rates for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get exchange rates")
+		return
+	}
+	rates, err := pgx.CollectRows(rows, pgx.RowToStructByName[types.ExchangeRate])
+	if err != nil {
+		log.Println("Failed to get exchange rates for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get exchange rates")
+		return
+	}
+	if rates == nil {
+		rates = make([]types.ExchangeRate, 0)
+	}
+	ctx.JSON(200, gin.H{
+		"status": "success",
+		"data": map[string][]types.ExchangeRate{
+			"exchange_rates": rates,
+		},
+	})
+}
+
+func DeleteExchangeRate(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	rateID := ctx.Param("rate_id")
+	ctag, err := initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.exchange_rates WHERE rate_id::text=$1 AND user_id=$2", rateID, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to delete exchange rate", rateID, "for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to delete exchange rate")
+		return
+	}
+	if ctag.RowsAffected() == 0 {
+		setErrorResponse(ctx, 404, "Exchange rate not found")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Exchange rate deleted successfully",
+	})
+}
+
+/*
+Route handler for the total balance of all passbooks of the user at the end of the "as_of" day (today by default) in
+the time zone of the user, converted into "currency" (the base currency of the user by default). The balance of a
+passbook on a day is its current balance without the transactions dated after that day. Each currency is converted
+with the latest rate on or before the day, the rate of the inverse pair is used when the user only loaded that one.
+*/
+func GetPassbookTotals(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	format, err := userFormat(loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get preferences of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get totals")
+		return
+	}
+	currency := format.Currency
+	if c := ctx.Query("currency"); c != "" {
+		currency = normalizeCurrency(c)
+		if !locale.IsCurrency(currency) {
+			setErrorResponse(ctx, 400, locale.ErrInvalidCurrency.Error())
+			return
+		}
+	}
+	asOf := time.Now().In(format.Location)
+	asOf = time.Date(asOf.Year(), asOf.Month(), asOf.Day(), 0, 0, 0, 0, format.Location)
+	if v := ctx.Query("as_of"); v != "" {
+		asOf, err = time.ParseInLocation(time.DateOnly, v, format.Location)
+		if err != nil {
+			setErrorResponse(ctx, 400, "Invalid as_of, expected format YYYY-MM-DD")
+			return
+		}
+	}
+	rows, err := initializers.DB.Query(context.Background(), "SELECT p.passbook_id, p.nickname, p.currency, p.total_balance - COALESCE(SUM(CASE WHEN t.transaction_type='CREDIT' THEN t.amount ELSE -t.amount END), 0) FROM passbook_app.passbooks p LEFT JOIN passbook_app.transactions t ON t.passbook_id=p.passbook_id AND t.deleted_at IS NULL AND t.transaction_date >= $2 WHERE p.user_id=$1 GROUP BY p.passbook_id ORDER BY p.created_at",
+		loggedInUserID, asOf.AddDate(0, 0, 1))
+	if err != nil {
+		log.Println("Failed to get passbook balances for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get totals")
+		return
+	}
+	passbooks, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (passbookTotal, error) {
+		var p passbookTotal
+		err := row.Scan(&p.PassbookID, &p.Nickname, &p.Currency, &p.Balance)
+		return p, err
+	})
+	if err != nil {
+		log.Println("Failed to get passbook balances for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get totals")
+		return
+	}
+	report := totalsReport{AsOf: asOf.Format(time.DateOnly), Currency: currency, Passbooks: make([]passbookTotal, 0, len(passbooks))}
+	foreign := make([]string, 0)
+	for _, p := range passbooks {
+		// access tokens restricted to some passbooks only add up those
+		if !middlewares.CanAccessPassbook(ctx, p.PassbookID) {
+			continue
+		}
+		if p.Currency != currency && !utils.Contains(foreign, p.Currency) {
+			foreign = append(foreign, p.Currency)
+		}
+		report.Passbooks = append(report.Passbooks, p)
+	}
+	rates, err := latestExchangeRates(loggedInUserID, currency, foreign, asOf)
+	if err != nil {
+		log.Println("Failed to get exchange rates for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get totals")
+		return
+	}
+	missing := make([]string, 0)
+	for _, c := range foreign {
+		if _, ok := rates[c]; !ok {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("No exchange rate to %s on or before %s for %s", currency, report.AsOf, strings.Join(missing, ", ")),
+			"data": map[string][]string{
+				"missing_currencies": missing,
+			},
+		})
+		return
+	}
+	byCurrency := make(map[string]*currencyTotal)
+	for i := range report.Passbooks {
+		p := &report.Passbooks[i]
+		p.ConvertedBalance, err = convertMoney(p.Balance, p.Currency, currency, rates)
+		if err != nil {
+			log.Println("Failed to convert balance of passbook", p.PassbookID, "for user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to get totals")
+			return
+		}
+		total, ok := byCurrency[p.Currency]
+		if !ok {
+			total = &currencyTotal{Currency: p.Currency}
+			if rate, ok := rates[p.Currency]; ok {
+				total.Rate = &rate
+			}
+			byCurrency[p.Currency] = total
+		}
+		total.Balance += p.Balance
+		total.ConvertedBalance += p.ConvertedBalance
+		report.Total += p.ConvertedBalance
+	}
+	report.Currencies = make([]currencyTotal, 0, len(byCurrency))
+	for _, total := range byCurrency {
+		report.Currencies = append(report.Currencies, *total)
+	}
+	sort.Slice(report.Currencies, func(i, j int) bool { return report.Currencies[i].Currency < report.Currencies[j].Currency })
+	ctx.JSON(200, gin.H{
+		"status": "success",
+		"data": map[string]totalsReport{
+			"totals": report,
+		},
+	})
+}
+
+/*
+The latest rates on or before a day between each of the given currencies and the target currency, keyed by the given
+currency. A rate can be stored either way round, when both pairs have a rate the most recent one wins and on the same
+day the one from the given currency to the target currency.
+*/
+func latestExchangeRates(userID string, target string, currencies []string, day time.Time) (map[string]types.ExchangeRate, error) {
+	rates := make(map[string]types.ExchangeRate, len(currencies))
+	if len(currencies) == 0 {
+		return rates, nil
+	}
+	rows, err := initializers.DB.Query(context.Background(), "SELECT DISTINCT ON (base_currency, quote_currency) rate_id, base_currency, quote_currency, rate_date, rate, created_at FROM passbook_app.exchange_rates WHERE user_id=$1 AND rate_date <= $2 AND ((base_currency = ANY($3) AND quote_currency=$4) OR (base_currency=$4 AND quote_currency = ANY($3))) ORDER BY base_currency, quote_currency, rate_date DESC",
+		userID, day.Format(time.DateOnly), currencies, target)
+	if err != nil {
+		return nil, err
+	}
+	found, err := pgx.CollectRows(rows, pgx.RowToStructByName[types.ExchangeRate])
+	if err != nil {
+		return nil, err
+	}
+	for _, rate := range found {
+		currency := rate.BaseCurrency
+		if currency == target {
+			currency = rate.QuoteCurrency
+		}
+		existing, ok := rates[currency]
+		if !ok || rate.RateDate.After(existing.RateDate) || (rate.RateDate.Equal(existing.RateDate) && rate.BaseCurrency == currency) {
+			rates[currency] = rate
+		}
+	}
+	return rates, nil
+}
+
+// convert an amount into the target currency with the rate found for its currency by latestExchangeRates
+func convertMoney(m types.Money, from string, target string, rates map[string]types.ExchangeRate) (types.Money, error) {
+	if from == target {
+		return m, nil
+	}
+	rate, ok := rates[from]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate from %s to %s", from, target)
+	}
+	if rate.BaseCurrency == from {
+		return rate.Rate.Convert(m)
+	}
+	return rate.Rate.ConvertBack(m)
+}
@@ -0,0 +1,270 @@
+package routes
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const upsertRateSQL = `^INSERT INTO passbook_app.exchange_rates \(rate_id, user_id, base_currency, quote_currency, rate_date, rate, created_at\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6, \$7\) ON CONFLICT \(user_id, base_currency, quote_currency, rate_date\) DO UPDATE SET .* RETURNING rate_id$`
+
+func TestCreateExchangeRate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/exchange-rates", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, CreateExchangeRate)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/exchange-rates", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Rate is stored", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(upsertRateSQL).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", "USD", "INR", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), types.Rate(8341250000), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"rate_id"}).AddRow("rate-1"))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := post(`{"base_currency": "usd", "quote_currency": "INR", "rate_date": "2024-04-01", "rate": 83.4125}`)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Contains(t, w.Body.String(), `"rate_id":"rate-1"`)
+		assert.Contains(t, w.Body.String(), `"rate":83.4125`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid rates", func(t *testing.T) {
+		for body, message := range map[string]string{
+			`{"base_currency": "USD", "quote_currency": "USD", "rate_date": "2024-04-01", "rate": 1}`:     "base and quote currency should be different",
+			`{"base_currency": "USD", "quote_currency": "rupee", "rate_date": "2024-04-01", "rate": 1}`:   "invalid currency",
+			`{"base_currency": "USD", "quote_currency": "INR", "rate_date": "01/04/2024", "rate": 1}`:     "invalid rate_date",
+			`{"base_currency": "USD", "quote_currency": "INR", "rate_date": "2024-04-01"}`:                "invalid exchange rate",
+			`{"base_currency": "USD", "quote_currency": "INR", "rate_date": "2024-04-01", "rate": 1e-9}`:  "at most 8 decimal places",
+			`{"base_currency": "USD", "quote_currency": "INR", "rate_date": "2024-04-01", "rate": -83.4}`: "invalid exchange rate",
+		} {
+			w := post(body)
+			assert.Equal(t, http.StatusBadRequest, w.Code, body)
+			assert.Contains(t, w.Body.String(), message, body)
+		}
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestImportExchangeRates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/exchange-rates/import", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, ImportExchangeRates)
+	upload := func(content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "rates.csv")
+		fw.Write([]byte(content))
+		mw.Close()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/exchange-rates/import", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("All rates of the file are stored", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(upsertRateSQL).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", "USD", "INR", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), types.Rate(8341250000), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"rate_id"}).AddRow("rate-1"))
+		mockDB.ExpectQuery(upsertRateSQL).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", "EUR", "INR", time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC), types.Rate(9010000000), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"rate_id"}).AddRow("rate-2"))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := upload("\ufeffBase_Currency,quote_currency,rate_date,rate\nusd,INR,2024-04-01,83.4125\nEUR,INR,2024-04-02,90.10\n")
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Contains(t, w.Body.String(), `"imported":2`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Nothing is stored when a row is invalid", func(t *testing.T) {
+		w := upload("rate_date,base_currency,quote_currency,rate\n2024-04-01,USD,INR,83.4125\n2024-04-31,EUR,INR,90.10\n2024-04-02,EUR,INR,abc\n")
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), `{"line":3,"message":"invalid rate_date, expected format YYYY-MM-DD"}`)
+		assert.Contains(t, w.Body.String(), `{"line":4,"message":"invalid exchange rate, expected a positive number"}`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Missing column", func(t *testing.T) {
+		w := upload("date,base_currency,quote_currency,rate\n2024-04-01,USD,INR,83.4125\n")
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "missing column rate_date")
+	})
+}
+
+func TestGetPassbookTotals(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.GET("/v1/passbooks/totals", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, GetPassbookTotals)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/passbooks/totals"+query, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	balancesSQL := `^SELECT p.passbook_id, p.nickname, p.currency, p.total_balance - COALESCE\(SUM\(.*\), 0\) FROM passbook_app.passbooks p LEFT JOIN passbook_app.transactions t .* AND t.transaction_date >= \$2 WHERE p.user_id=\$1 GROUP BY p.passbook_id ORDER BY p.created_at$`
+	ratesSQL := `^SELECT DISTINCT ON \(base_currency, quote_currency\) rate_id, base_currency, quote_currency, rate_date, rate, created_at FROM passbook_app.exchange_rates WHERE user_id=\$1 AND rate_date <= \$2 AND .* ORDER BY base_currency, quote_currency, rate_date DESC$`
+	expectBalances := func() {
+		mockDB.ExpectQuery(balancesSQL).
+			WithArgs("test-user-id", sameInstant{time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "nickname", "currency", "balance"}).
+				AddRow("pb-inr", "Savings", "INR", types.Money(100000)).
+				AddRow("pb-usd", "Dollars", "USD", types.Money(10000)).
+				AddRow("pb-eur", "Euros", "EUR", types.Money(5000)))
+	}
+	rateColumns := []string{"rate_id", "base_currency", "quote_currency", "rate_date", "rate", "created_at"}
+
+	t.Run("Balances are converted with direct and inverse rates", func(t *testing.T) {
+		expectPreferences(mockDB, "test-user-id")
+		expectBalances()
+		mockDB.ExpectQuery(ratesSQL).
+			WithArgs("test-user-id", "2024-04-30", []string{"USD", "EUR"}, "INR").
+			WillReturnRows(pgxmock.NewRows(rateColumns).
+				AddRow("rate-1", "EUR", "INR", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), "89", time.Now()).
+				AddRow("rate-2", "INR", "EUR", time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC), "0.011", time.Now()).
+				AddRow("rate-3", "USD", "INR", time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC), "83.5", time.Now()).
+				AddRow("rate-4", "INR", "USD", time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC), "0.012", time.Now()))
+
+		w := get("?as_of=2024-04-30")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		body := w.Body.String()
+		// 1000 INR + 100 USD * 83.5 + 50 EUR / 0.011
+		assert.Contains(t, body, `"as_of":"2024-04-30","currency":"INR","total":13895.45`)
+		assert.Contains(t, body, `{"passbook_id":"pb-usd","nickname":"Dollars","currency":"USD","balance":100.00,"converted_balance":8350.00}`)
+		assert.Contains(t, body, `{"currency":"EUR","balance":50.00,"converted_balance":4545.45,"rate":{"rate_id":"rate-2"`)
+		assert.Contains(t, body, `{"currency":"INR","balance":1000.00,"converted_balance":1000.00,"rate":null}`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Missing rates are reported", func(t *testing.T) {
+		expectPreferences(mockDB, "test-user-id")
+		expectBalances()
+		mockDB.ExpectQuery(ratesSQL).
+			WithArgs("test-user-id", "2024-04-30", []string{"USD", "EUR"}, "INR").
+			WillReturnRows(pgxmock.NewRows(rateColumns).
+				AddRow("rate-3", "USD", "INR", time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC), "83.5", time.Now()))
+
+		w := get("?as_of=2024-04-30")
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), `"missing_currencies":["EUR"]`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Totals in the currency of a passbook need no rate for it", func(t *testing.T) {
+		expectPreferences(mockDB, "test-user-id")
+		expectBalances()
+		mockDB.ExpectQuery(ratesSQL).
+			WithArgs("test-user-id", "2024-04-30", []string{"INR", "EUR"}, "USD").
+			WillReturnRows(pgxmock.NewRows(rateColumns).
+				AddRow("rate-4", "INR", "USD", time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC), "0.012", time.Now()).
+				AddRow("rate-5", "EUR", "USD", time.Date(2024, 4, 29, 0, 0, 0, 0, time.UTC), "1.07", time.Now()))
+
+		w := get("?as_of=2024-04-30&currency=usd")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		// 1000 INR * 0.012 + 100 USD + 50 EUR * 1.07
+		assert.Contains(t, w.Body.String(), `"currency":"USD","total":165.50`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid params", func(t *testing.T) {
+		expectPreferences(mockDB, "test-user-id")
+		assert.Equal(t, http.StatusBadRequest, get("?as_of=30-04-2024").Code)
+		expectPreferences(mockDB, "test-user-id")
+		assert.Equal(t, http.StatusBadRequest, get("?currency=dollar").Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestDeleteExchangeRate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.DELETE("/v1/exchange-rates/:rate_id", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, DeleteExchangeRate)
+
+	mockDB.ExpectExec(`^DELETE FROM passbook_app.exchange_rates WHERE rate_id::text=\$1 AND user_id=\$2$`).
+		WithArgs("rate-1", "test-user-id").
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/v1/exchange-rates/rate-1", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NoError(t, mockDB.ExpectationsWereMet())
+}
@@ -0,0 +1,236 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/exporters"
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/locale"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+/*
+Transactions of the user with the nickname of their passbook and the balance of the passbook right after each transaction.
+The running balance is derived backwards from total_balance by subtracting the effect of all later transactions of the
+passbook, so it is computed over the full history before any filter is applied. Callers filter the result with
+transactionFilter.whereClause, when a passbook is given it is the $2 arg of that clause.
+*/
+const exportTransactionsSubquery = `SELECT t.transaction_id, t.amount, t.transaction_date, t.transaction_type, t.party_name, t.description, t.created_at, t.updated_at, t.tags, t.passbook_id, t.user_id, t.transfer_id, t.deleted_at, p.nickname AS passbook_name, p.currency,
+p.total_balance - COALESCE(SUM(CASE WHEN t.transaction_type='CREDIT' THEN t.amount ELSE -t.amount END) OVER (PARTITION BY t.passbook_id ORDER BY t.transaction_date DESC, t.created_at DESC, t.transaction_id DESC ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING), 0) AS running_balance
+FROM passbook_app.transactions t JOIN passbook_app.passbooks p ON p.passbook_id=t.passbook_id WHERE t.user_id=$1 AND t.deleted_at IS NULL`
+
+// query for the transactions matching a where clause of transactionFilter, each row with its passbook name and running balance
+func exportTransactionsQuery(where string, passbookID string, orderBy string) string {
+	subquery := exportTransactionsSubquery
+	if passbookID != "" {
+		subquery += " AND t.passbook_id=$2"
+	}
+	return fmt.Sprintf("SELECT transaction_id, amount, transaction_date, transaction_type, party_name, description, created_at, updated_at, tags, passbook_id, user_id, transfer_id, passbook_name, running_balance, currency FROM (%s) AS transactions WHERE %s ORDER BY %s",
+		subquery, where, orderBy)
+}
+
+func scanExportRow(rows pgx.Rows) (exporters.Row, error) {
+	var row exporters.Row
+	err := rows.Scan(&row.TransactionID, &row.Amount, &row.TransactionDate, &row.TransactionType, &row.PartyName, &row.Description, &row.CreatedAt, &row.UpdatedAt, &row.Tags, &row.PassbookID, &row.UserID, &row.TransferID, &row.PassbookName, &row.RunningBalance, &row.Currency)
+	return row, err
+}
+
+// route handler for exporting the transactions of a passbook
+func ExportPassbookTransactions(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	passbookID := ctx.Param("passbook_id")
+	var pbid string
+	err := initializers.DB.QueryRow(context.Background(), "SELECT passbook_id FROM passbook_app.passbooks WHERE passbook_id=$1 AND user_id=$2", passbookID, loggedInUserID).Scan(&pbid)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			setErrorResponse(ctx, 404, "Passbook not found")
+			return
+		}
+		log.Println("Failed to check passbook for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to export transactions")
+		return
+	}
+	exportTransactions(ctx, loggedInUserID, passbookID)
+}
+
+// route handler for exporting the transactions of all passbooks of the user
+func ExportAllTransactions(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	if middlewares.IsPassbookRestricted(ctx) {
+		setErrorResponse(ctx, 403, "Token is restricted to some passbooks, export them one by one")
+		return
+	}
+	exportTransactions(ctx, loggedInUserID, "")
+}
+
+/*
+Stream the transactions matching the listing filters in the requested format ("csv" by default, "ndjson" or "xlsx").
+Pagination params are ignored since everything matching is exported, and transactions are oldest first unless a
+sort_order is given. Rows are written as they are read from the db so memory use does not grow with the export.
+*/
+func exportTransactions(ctx *gin.Context, userID string, passbookID string) {
+	format := ctx.DefaultQuery("format", "csv")
+	if !exporters.IsFormat(format) {
+		setErrorResponse(ctx, 400, "invalid format, should be one of csv, ndjson or xlsx")
+		return
+	}
+	filter, err := parseTransactionFilter(ctx)
+	if err != nil {
+		setErrorResponse(ctx, 400, err.Error())
+		return
+	}
+	if ctx.Query("sort_order") == "" {
+		filter.SortOrder = "ASC"
+	}
+	localeFormat, err := userFormat(userID)
+	if err != nil {
+		log.Println("Failed to get preferences of user_id:", userID, err)
+		setErrorResponse(ctx, 500, "Failed to export transactions")
+		return
+	}
+	filter.setTimeZone(localeFormat.Location)
+	where, args := filter.whereClause(userID, passbookID)
+	rows, err := initializers.DB.Query(context.Background(), exportTransactionsQuery(where, passbookID, filter.orderByClause()), args...)
+	if err != nil {
+		log.Println("Failed to export transactions for user_id:", userID, "passbook_id:", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to export transactions")
+		return
+	}
+	defer rows.Close()
+	// errors of the query itself only surface when reading the first row, read it before the status is sent
+	hasRow := rows.Next()
+	if !hasRow && rows.Err() != nil {
+		log.Println("Failed to export transactions for user_id:", userID, "passbook_id:", passbookID, rows.Err())
+		setErrorResponse(ctx, 500, "Failed to export transactions")
+		return
+	}
+	filename := "transactions"
+	if passbookID != "" {
+		filename = "passbook-" + passbookID + "-transactions"
+	}
+	filename = fmt.Sprintf("%s-%s.%s", filename, time.Now().UTC().Format("20060102"), exporters.Extension(format))
+	ctx.Header("Content-Type", exporters.ContentType(format))
+	ctx.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	ctx.Status(200)
+	// once the first byte is written the status cannot change anymore, failures are only logged and the download is cut short
+	writer, err := exporters.New(format, ctx.Writer)
+	if err != nil {
+		log.Println("Failed to start export for user_id:", userID, err)
+		return
+	}
+	count := 0
+	for ; hasRow; hasRow = rows.Next() {
+		row, err := scanExportRow(rows)
+		if err != nil {
+			log.Println("Failed to scan exported transaction for user_id:", userID, err)
+			return
+		}
+		row.TransactionDate = localeFormat.In(row.TransactionDate)
+		if err := writer.Write(row); err != nil {
+			log.Println("Failed to write export for user_id:", userID, err)
+			return
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to export transactions for user_id:", userID, "passbook_id:", passbookID, err)
+		return
+	}
+	if err := writer.Close(); err != nil {
+		log.Println("Failed to finish export for user_id:", userID, err)
+		return
+	}
+	log.Println("Exported", count, "transactions as", format, "for user_id:", userID)
+}
+
+/*
+Route handler for the PDF statement of a passbook for a calendar month given as YYYY-MM. The month starts at midnight
+in the time zone of the user and the statement is formatted by the preferences of the user. The opening balance and
+all transactions of the month are read in one repeatable read db transaction so the statement always adds up.
+*/
+func GetPassbookStatement(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	passbookID := ctx.Param("passbook_id")
+	if _, err := time.Parse("2006-01", ctx.Param("month")); err != nil {
+		setErrorResponse(ctx, 400, "Invalid month, expected format YYYY-MM")
+		return
+	}
+	format, err := userFormat(loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get preferences of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to generate statement")
+		return
+	}
+	month, _ := time.ParseInLocation("2006-01", ctx.Param("month"), format.Location)
+	now := time.Now().UTC()
+	if month.After(now) {
+		setErrorResponse(ctx, 400, "Statement month is in the future")
+		return
+	}
+	statement, err := getPassbookStatement(initializers.DB, loggedInUserID, passbookID, month, format)
+	if err != nil {
+		if errors.Is(err, errPassbookNotFound) {
+			setErrorResponse(ctx, 404, "Passbook not found")
+			return
+		}
+		log.Println("Failed to get statement of passbook", passbookID, "for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to generate statement")
+		return
+	}
+	statement.GeneratedAt = now
+	ctx.Header("Content-Type", "application/pdf")
+	ctx.Header("Content-Disposition", `attachment; filename="statement-`+month.Format("2006-01")+`.pdf"`)
+	ctx.Status(200)
+	if err := exporters.WriteStatementPDF(ctx.Writer, statement); err != nil {
+		log.Println("Failed to write statement of passbook", passbookID, "for user_id:", loggedInUserID, err)
+	}
+}
+
+/*
+Read the opening balance and the transactions of a month of a passbook, oldest first with their running balance.
+The statement is formatted with the given format, amounts are shown in the currency of the passbook.
+*/
+func getPassbookStatement(conn initializers.PgxPoolIface, userID string, passbookID string, month time.Time, format locale.Format) (exporters.Statement, error) {
+	statement := exporters.Statement{Month: month, Format: format}
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return statement, err
+	}
+	defer tx.Rollback(context.Background())
+	if _, err := tx.Exec(context.Background(), "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY"); err != nil {
+		return statement, err
+	}
+	// the opening balance is the current balance without the effect of everything from the start of the month on
+	err = tx.QueryRow(context.Background(), "SELECT p.nickname, p.bank_name, p.account_number, p.currency, p.total_balance - COALESCE(SUM(CASE WHEN t.transaction_type='CREDIT' THEN t.amount ELSE -t.amount END), 0) FROM passbook_app.passbooks p LEFT JOIN passbook_app.transactions t ON t.passbook_id=p.passbook_id AND t.deleted_at IS NULL AND t.transaction_date >= $3 WHERE p.passbook_id=$1 AND p.user_id=$2 GROUP BY p.passbook_id",
+		passbookID, userID, month).Scan(&statement.PassbookName, &statement.BankName, &statement.AccountNumber, &statement.Format.Currency, &statement.OpeningBalance)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return statement, errPassbookNotFound
+		}
+		return statement, err
+	}
+	end := month.AddDate(0, 1, 0).Add(-time.Microsecond)
+	filter := transactionFilter{FromDate: &month, ToDate: &end}
+	where, args := filter.whereClause(userID, passbookID)
+	// same order as the running balance so every line follows from the previous one
+	rows, err := tx.Query(context.Background(), exportTransactionsQuery(where, passbookID, "transaction_date ASC, created_at ASC, transaction_id ASC"), args...)
+	if err != nil {
+		return statement, err
+	}
+	defer rows.Close()
+	statement.Rows = make([]exporters.Row, 0)
+	for rows.Next() {
+		row, err := scanExportRow(rows)
+		if err != nil {
+			return statement, err
+		}
+		statement.Rows = append(statement.Rows, row)
+	}
+	return statement, rows.Err()
+}
@@ -0,0 +1,225 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportPassbookTransactions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	testUserID := "test-user-id"
+	testPassbookID := "test-passbook-id"
+
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	v1 := router.Group("/v1")
+	passbooks := v1.Group("/passbooks", authTestMiddleware())
+	{
+		passbooks.GET("/:passbook_id/export", ExportPassbookTransactions)
+	}
+	reqURL := fmt.Sprintf("/v1/passbooks/%s/export", testPassbookID)
+	passbookSQL := `^SELECT passbook_id FROM passbook_app.passbooks WHERE passbook_id=\$1 AND user_id=\$2$`
+	exportSQL := `^SELECT transaction_id, .*, passbook_name, running_balance, currency FROM \(SELECT .* WHERE t.user_id=\$1 AND t.deleted_at IS NULL AND t.passbook_id=\$2\) AS transactions WHERE user_id=\$1 AND deleted_at IS NULL AND passbook_id=\$2 AND transaction_type=\$3 ORDER BY transaction_date ASC, transaction_id ASC$`
+	columns := []string{"transaction_id", "amount", "transaction_date", "transaction_type", "party_name", "description", "created_at", "updated_at", "tags", "passbook_id", "user_id", "transfer_id", "passbook_name", "running_balance", "currency"}
+
+	t.Run("Transactions are streamed as CSV with running balance", func(t *testing.T) {
+		date := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+		mockDB.ExpectQuery(passbookSQL).
+			WithArgs(testPassbookID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id"}).AddRow(testPassbookID))
+		expectPreferences(mockDB, testUserID)
+		mockDB.ExpectQuery(exportSQL).
+			WithArgs(testUserID, testPassbookID, "DEBIT").
+			WillReturnRows(pgxmock.NewRows(columns).
+				AddRow("tr-1", types.Money(2050), date, "DEBIT", "Coffee Shop", "", date, date, "food", testPassbookID, testUserID, nil, "Savings", types.Money(97950), "USD").
+				AddRow("tr-2", types.Money(1000), date.AddDate(0, 0, 1), "DEBIT", "Book Store", "Novel", date, date, "", testPassbookID, testUserID, nil, "Savings", types.Money(96950), "USD"))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL+"?type=debit", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment; filename=\"passbook-test-passbook-id-transactions-")
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		assert.Len(t, lines, 3)
+		assert.True(t, strings.HasSuffix(lines[0], ",running_balance"))
+		// amounts are in the currency of the passbook whatever the base currency of the user
+		assert.Equal(t, "tr-1,2024-04-01T00:00:00Z,test-passbook-id,Savings,DEBIT,20.50,USD,Coffee Shop,,food,,979.50", lines[1])
+		assert.Equal(t, "tr-2,2024-04-02T00:00:00Z,test-passbook-id,Savings,DEBIT,10.00,USD,Book Store,Novel,,,969.50", lines[2])
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		mockDB.ExpectQuery(passbookSQL).
+			WithArgs(testPassbookID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id"}).AddRow(testPassbookID))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL+"?format=pdf", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Passbook not found", func(t *testing.T) {
+		mockDB.ExpectQuery(passbookSQL).
+			WithArgs(testPassbookID, testUserID).
+			WillReturnError(pgx.ErrNoRows)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestGetPassbookStatement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	testUserID := "test-user-id"
+	testPassbookID := "test-passbook-id"
+
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	v1 := router.Group("/v1")
+	passbooks := v1.Group("/passbooks", authTestMiddleware())
+	{
+		passbooks.GET("/:passbook_id/statements/:month", GetPassbookStatement)
+	}
+	month := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	reqURL := fmt.Sprintf("/v1/passbooks/%s/statements/2024-04", testPassbookID)
+	openingSQL := `^SELECT p.nickname, p.bank_name, p.account_number, p.currency, p.total_balance - COALESCE\(SUM\(.*\), 0\) FROM passbook_app.passbooks p LEFT JOIN passbook_app.transactions t .* AND t.transaction_date >= \$3 WHERE p.passbook_id=\$1 AND p.user_id=\$2 GROUP BY p.passbook_id$`
+	rowsSQL := `^SELECT transaction_id, .* FROM \(SELECT .*\) AS transactions WHERE user_id=\$1 AND deleted_at IS NULL AND passbook_id=\$2 AND transaction_date >= \$3 AND transaction_date <= \$4 ORDER BY transaction_date ASC, created_at ASC, transaction_id ASC$`
+	columns := []string{"transaction_id", "amount", "transaction_date", "transaction_type", "party_name", "description", "created_at", "updated_at", "tags", "passbook_id", "user_id", "transfer_id", "passbook_name", "running_balance", "currency"}
+
+	t.Run("Statement is generated", func(t *testing.T) {
+		date := month.AddDate(0, 0, 4)
+		expectPreferences(mockDB, testUserID)
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(`^SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY$`).
+			WillReturnResult(pgxmock.NewResult("SET", 0))
+		mockDB.ExpectQuery(openingSQL).
+			WithArgs(testPassbookID, testUserID, month).
+			WillReturnRows(pgxmock.NewRows([]string{"nickname", "bank_name", "account_number", "currency", "opening"}).
+				AddRow("Savings", "Test Bank", "123512", "INR", types.Money(100000)))
+		mockDB.ExpectQuery(rowsSQL).
+			WithArgs(testUserID, testPassbookID, month, month.AddDate(0, 1, 0).Add(-time.Microsecond)).
+			WillReturnRows(pgxmock.NewRows(columns).
+				AddRow("tr-1", types.Money(2050), date, "DEBIT", "Coffee Shop", "", date, date, "", testPassbookID, testUserID, nil, "Savings", types.Money(97950), "INR"))
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/pdf", w.Header().Get("Content-Type"))
+		assert.Equal(t, `attachment; filename="statement-2024-04.pdf"`, w.Header().Get("Content-Disposition"))
+		body := w.Body.String()
+		assert.True(t, strings.HasPrefix(body, "%PDF-"))
+		assert.Contains(t, body, "(Coffee Shop)")
+		assert.Contains(t, body, "(979.50)")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Month starts at midnight in the time zone of the user", func(t *testing.T) {
+		kolkata, _ := time.LoadLocation("Asia/Kolkata")
+		localMonth := time.Date(2024, 4, 1, 0, 0, 0, 0, kolkata)
+		expectPreferences(mockDB, testUserID, types.Preferences{Currency: "INR", TimeZone: "Asia/Kolkata", Locale: "en-IN", DateFormat: "DD/MM/YYYY"})
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(`^SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY$`).
+			WillReturnResult(pgxmock.NewResult("SET", 0))
+		mockDB.ExpectQuery(openingSQL).
+			WithArgs(testPassbookID, testUserID, sameInstant{localMonth}).
+			WillReturnRows(pgxmock.NewRows([]string{"nickname", "bank_name", "account_number", "currency", "opening"}).
+				AddRow("Savings", "Test Bank", "123512", "USD", types.Money(12345678)))
+		mockDB.ExpectQuery(rowsSQL).
+			WithArgs(testUserID, testPassbookID, sameInstant{localMonth}, sameInstant{localMonth.AddDate(0, 1, 0).Add(-time.Microsecond)}).
+			WillReturnRows(pgxmock.NewRows(columns))
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		body := w.Body.String()
+		assert.Contains(t, body, "(01/04/2024 - 30/04/2024)")
+		assert.Contains(t, body, "(USD 1,23,456.78)")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Passbook not found", func(t *testing.T) {
+		expectPreferences(mockDB, testUserID)
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(`^SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY$`).
+			WillReturnResult(pgxmock.NewResult("SET", 0))
+		mockDB.ExpectQuery(openingSQL).
+			WithArgs(testPassbookID, testUserID, month).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid month", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/v1/passbooks/%s/statements/2024-13", testPassbookID), nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -0,0 +1,483 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log"
+	"mime/multipart"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/importers"
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// uploaded statements larger than this are rejected
+const maxImportFileSize = 5 << 20
+
+// maximum number of statement lines imported in one request
+const maxImportRows = 5000
+
+type importSummary struct {
+	Count          int         `json:"count"`
+	TotalCredit    types.Money `json:"total_credit"`
+	TotalDebit     types.Money `json:"total_debit"`
+	BalanceChange  types.Money `json:"balance_change"`
+	CurrentBalance types.Money `json:"current_balance"`
+	NewBalance     types.Money `json:"new_balance"`
+}
+
+// comparison of the ledger balance reported by a statement with the balance of the passbook after the import
+type importReconciliation struct {
+	StatementBalance types.Money `json:"statement_balance"`
+	BalanceAsOf      time.Time   `json:"balance_as_of"`
+	PassbookBalance  types.Money `json:"passbook_balance"`
+	Difference       types.Money `json:"difference"`
+	Reconciled       bool        `json:"reconciled"`
+}
+
+// result of an import, returned both for a dry run and for a committed import
+type importPreview struct {
+	DryRun         bool                  `json:"dry_run"`
+	Transactions   []types.Transaction   `json:"transactions"`
+	Errors         []importers.RowError  `json:"errors"`
+	Skipped        int                   `json:"skipped"`
+	Summary        importSummary         `json:"summary"`
+	Reconciliation *importReconciliation `json:"reconciliation,omitempty"`
+}
+
+func CreateImportProfile(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var profile types.ImportProfile
+	if err := ctx.ShouldBindJSON(&profile); err != nil {
+		setErrorResponse(ctx, 400, "Invalid request body")
+		return
+	}
+	if err := sanitizeImportProfileRequest(&profile); err != nil {
+		setErrorResponse(ctx, 400, err.Error())
+		return
+	}
+	uid, err := utils.GenerateUUID()
+	if err != nil {
+		log.Println("Failed to generate profile_id for user_id:", loggedInUserID)
+		setErrorResponse(ctx, 500, "Failed to create import profile")
+		return
+	}
+	profile.ProfileID = uid
+	profile.UserID = loggedInUserID
+	profile.CreatedAt = time.Now().UTC()
+	profile.UpdatedAt = profile.CreatedAt
+	_, err = initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.import_profiles (profile_id, user_id, name, delimiter, has_header, skip_rows, date_column, date_format, amount_column, debit_column, credit_column, party_column, description_column, decimal_separator, tags, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)",
+		profile.ProfileID, profile.UserID, profile.Name, profile.Delimiter, profile.HasHeader, profile.SkipRows, profile.DateColumn, profile.DateFormat, profile.AmountColumn, profile.DebitColumn, profile.CreditColumn, profile.PartyColumn, profile.DescriptionColumn, profile.DecimalSeparator, profile.Tags, profile.CreatedAt, profile.UpdatedAt)
+	if err != nil {
+		log.Println(err)
+		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			setErrorResponse(ctx, 409, "Import profile with the same name already exists")
+			return
+		}
+		setErrorResponse(ctx, 500, "Failed to create import profile")
+		return
+	}
+	ctx.JSON(201, gin.H{
+		"status":  "success",
+		"message": "Import profile created successfully",
+		"data": map[string]types.ImportProfile{
+			"profile": profile,
+		},
+	})
+}
+
+func sanitizeImportProfileRequest(p *types.ImportProfile) error {
+	p.Name = utils.TrimAndSanitizeStrict(p.Name)
+	p.Tags = utils.TrimAndSanitizeStrict(p.Tags)
+	// column names are only used to look up the header of the uploaded file so they are kept as is
+	for _, column := range []*string{&p.DateColumn, &p.DateFormat, &p.AmountColumn, &p.DebitColumn, &p.CreditColumn, &p.PartyColumn, &p.DescriptionColumn} {
+		*column = strings.TrimSpace(*column)
+		if len(*column) > 255 {
+			return errors.New("column names should be less than 255 characters")
+		}
+	}
+	return importers.ValidateProfile(p)
+}
+
+func GetImportProfiles(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	rows, _ := initializers.DB.Query(context.Background(), "SELECT profile_id, user_id, name, delimiter, has_header, skip_rows, date_column, date_format, amount_column, debit_column, credit_column, party_column, description_column, decimal_separator, tags, created_at, updated_at FROM passbook_app.import_profiles WHERE user_id=$1 ORDER BY name", loggedInUserID)
+	profiles, err := pgx.CollectRows(rows, pgx.RowToStructByName[types.ImportProfile])
+	if err != nil {
+		log.Println("Failed to get import profiles for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get import profiles")
+		return
+	}
+	if profiles == nil {
+		profiles = make([]types.ImportProfile, 0)
+	}
+	ctx.JSON(200, gin.H{
+		"status": "success",
+		"data": map[string][]types.ImportProfile{
+			"profiles": profiles,
+		},
+	})
+}
+
+func DeleteImportProfile(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	profileID := ctx.Param("profile_id")
+	ctag, err := initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.import_profiles WHERE profile_id=$1 AND user_id=$2", profileID, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to delete import profile", profileID, "for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to delete import profile")
+		return
+	}
+	if ctag.RowsAffected() == 0 {
+		setErrorResponse(ctx, 404, "Import profile not found")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Import profile deleted successfully",
+	})
+}
+
+func getImportProfile(userID string, profileID string) (types.ImportProfile, error) {
+	rows, _ := initializers.DB.Query(context.Background(), "SELECT profile_id, user_id, name, delimiter, has_header, skip_rows, date_column, date_format, amount_column, debit_column, credit_column, party_column, description_column, decimal_separator, tags, created_at, updated_at FROM passbook_app.import_profiles WHERE profile_id=$1 AND user_id=$2", profileID, userID)
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[types.ImportProfile])
+}
+
+/*
+Route handler for importing a CSV bank statement into a passbook using a saved import profile.
+Expects a multipart form with the statement in "file" and the profile in "profile_id". Unless "dry_run" is set to
+false only a preview is returned, otherwise all rows and the resulting balance change are committed in one db transaction.
+*/
+func ImportCSVStatement(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	passbookID := ctx.Param("passbook_id")
+	profile, err := getImportProfile(loggedInUserID, ctx.PostForm("profile_id"))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			setErrorResponse(ctx, 404, "Import profile not found")
+			return
+		}
+		log.Println("Failed to get import profile for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to import statement")
+		return
+	}
+	file, ok := openImportFile(ctx)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	entries, rowErrors, err := importers.ParseCSV(file, profile)
+	if err != nil {
+		setErrorResponse(ctx, 400, "Failed to parse statement: "+err.Error())
+		return
+	}
+	importEntries(ctx, loggedInUserID, passbookID, entries, rowErrors, profile.Tags, nil)
+}
+
+/*
+Route handler for importing an OFX/QFX statement. The passbook is matched by the account number of the statement,
+"passbook_id" can be sent along to pick one when several passbooks share the account number. Transactions whose
+FITID was already imported into the passbook are skipped.
+*/
+func ImportOFXStatement(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	file, ok := openImportFile(ctx)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	statement, err := importers.ParseOFX(file)
+	if err != nil {
+		setErrorResponse(ctx, 400, "Failed to parse statement: "+err.Error())
+		return
+	}
+	importStatement(ctx, loggedInUserID, statement)
+}
+
+/*
+Route handler for importing an ISO 20022 camt.053 statement. The passbook is matched by the IBAN (or other account id)
+of the statement, statements whose balances do not add up are rejected as a whole.
+*/
+func ImportCAMT053Statement(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	file, ok := openImportFile(ctx)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	statement, err := importers.ParseCAMT053(file)
+	if err != nil {
+		setErrorResponse(ctx, 400, "Failed to parse statement: "+err.Error())
+		return
+	}
+	importStatement(ctx, loggedInUserID, statement)
+}
+
+/*
+Route handler for importing a SWIFT MT940 statement. The passbook is matched by the :25: account identification,
+either as a whole or the account number after the bank code (e.g. 10020030/1234567), statements whose balances
+do not add up are rejected as a whole.
+*/
+func ImportMT940Statement(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	file, ok := openImportFile(ctx)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	statement, err := importers.ParseMT940(file)
+	if err != nil {
+		setErrorResponse(ctx, 400, "Failed to parse statement: "+err.Error())
+		return
+	}
+	importStatement(ctx, loggedInUserID, statement)
+}
+
+// import a parsed statement into the passbook of the user matching the account of the statement
+func importStatement(ctx *gin.Context, userID string, statement *importers.Statement) {
+	passbookID, ok := findStatementPassbook(ctx, userID, statement.AccountID)
+	if !ok {
+		return
+	}
+	importEntries(ctx, userID, passbookID, statement.Entries, statement.Errors, utils.TrimAndSanitizeStrict(ctx.PostForm("tags")), statement)
+}
+
+// find the passbook of the user with the account number of a statement, responds with an error and returns false if there is no single match
+func findStatementPassbook(ctx *gin.Context, userID string, accountID string) (string, bool) {
+	passbookID := ctx.PostForm("passbook_id")
+	// account numbers are compared without spaces since IBANs are often stored in their printed form
+	candidates := []string{strings.ReplaceAll(accountID, " ", "")}
+	if i := strings.LastIndex(candidates[0], "/"); i >= 0 && i < len(candidates[0])-1 {
+		candidates = append(candidates, candidates[0][i+1:])
+	}
+	rows, _ := initializers.DB.Query(context.Background(), "SELECT passbook_id FROM passbook_app.passbooks WHERE user_id=$1 AND replace(account_number, ' ', '') = ANY($2) AND ($3='' OR passbook_id::text=$3)", userID, candidates, passbookID)
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		log.Println("Failed to find passbook for statement account of user_id:", userID, err)
+		setErrorResponse(ctx, 500, "Failed to import statement")
+		return "", false
+	}
+	// access tokens restricted to some passbooks cannot import into the others
+	ids = slices.DeleteFunc(ids, func(id string) bool { return !middlewares.CanAccessPassbook(ctx, id) })
+	switch len(ids) {
+	case 0:
+		setErrorResponse(ctx, 404, "No passbook found with account number "+accountID)
+		return "", false
+	case 1:
+		return ids[0], true
+	default:
+		setErrorResponse(ctx, 409, "Several passbooks have account number "+accountID+", please provide passbook_id")
+		return "", false
+	}
+}
+
+// open the uploaded statement of a multipart import request, responds with an error and returns false if there is none
+func openImportFile(ctx *gin.Context) (multipart.File, bool) {
+	fileHeader, err := ctx.FormFile("file")
+	if err != nil {
+		setErrorResponse(ctx, 400, "Please upload the statement as file")
+		return nil, false
+	}
+	if fileHeader.Size > maxImportFileSize {
+		setErrorResponse(ctx, 400, "Statement file is too large")
+		return nil, false
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Println("Failed to open uploaded statement", err)
+		setErrorResponse(ctx, 500, "Failed to import statement")
+		return nil, false
+	}
+	return file, true
+}
+
+/*
+Validate parsed statement entries as regular transactions of the passbook and either respond with a preview (dry run)
+or create all of them through updatePassbookAndCreateTrxs. Nothing is imported when any of the entries is invalid.
+Entries with an external id that was already imported into the passbook (even if trashed or purged since) are skipped, and
+when the statement reports a closing balance it is reconciled with the balance of the passbook after the import.
+Statements in another currency than the passbook are rejected as a whole.
+*/
+func importEntries(ctx *gin.Context, userID string, passbookID string, entries []importers.Entry, rowErrors []importers.RowError, tags string, statement *importers.Statement) {
+	dryRun := ctx.DefaultPostForm("dry_run", "true") != "false"
+	var currentBalance types.Money
+	var currency string
+	err := initializers.DB.QueryRow(context.Background(), "SELECT total_balance, currency FROM passbook_app.passbooks WHERE passbook_id=$1 AND user_id=$2", passbookID, userID).Scan(&currentBalance, &currency)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			setErrorResponse(ctx, 403, "Invalid passbook")
+			return
+		}
+		log.Println("Failed to get passbook", passbookID, "for import", err)
+		setErrorResponse(ctx, 500, "Failed to import statement")
+		return
+	}
+	// CSV statements do not tell their currency, the other formats have to match the passbook
+	if statement != nil && !currencyMatches(statement.Currency, currency) {
+		setErrorResponse(ctx, 400, "Statement currency "+statement.Currency+" does not match the currency "+currency+" of the passbook")
+		return
+	}
+	if len(entries) > maxImportRows {
+		setErrorResponse(ctx, 400, "Statement has too many rows")
+		return
+	}
+	entries, skipped, err := skipImportedEntries(passbookID, entries)
+	if err != nil {
+		log.Println("Failed to check already imported transactions of passbook", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to import statement")
+		return
+	}
+	preview := importPreview{
+		DryRun:       dryRun,
+		Transactions: make([]types.Transaction, 0, len(entries)),
+		Errors:       rowErrors,
+		Skipped:      skipped,
+		Summary:      importSummary{CurrentBalance: currentBalance},
+	}
+	if preview.Errors == nil {
+		preview.Errors = make([]importers.RowError, 0)
+	}
+	timeNow := time.Now().UTC()
+	trs := make([]*types.Transaction, 0, len(entries))
+	for _, entry := range entries {
+		tr := types.Transaction{
+			ExternalID:      entry.ExternalID,
+			Amount:          entry.Amount,
+			TransactionDate: entry.Date,
+			TransactionType: entry.Type,
+			PartyName:       entry.PartyName,
+			Description:     entry.Description,
+			Tags:            tags,
+			CreatedAt:       timeNow,
+			UpdatedAt:       timeNow,
+			PassbookID:      passbookID,
+			UserID:          userID,
+		}
+		if err := sanitizeTransactionRequest(&tr); err != nil {
+			preview.Errors = append(preview.Errors, importers.RowError{Line: entry.Line, Message: err.Error()})
+			continue
+		}
+		if tr.TransactionID, err = utils.GenerateUUID(); err != nil {
+			log.Println("Failed to generate transaction_id for import of user_id:", userID)
+			setErrorResponse(ctx, 500, "Failed to import statement")
+			return
+		}
+		if tr.TransactionType == "CREDIT" {
+			preview.Summary.TotalCredit += tr.Amount
+		} else {
+			preview.Summary.TotalDebit += tr.Amount
+		}
+		preview.Transactions = append(preview.Transactions, tr)
+	}
+	for i := range preview.Transactions {
+		trs = append(trs, &preview.Transactions[i])
+	}
+	preview.Summary.Count = len(preview.Transactions)
+	preview.Summary.BalanceChange = preview.Summary.TotalCredit - preview.Summary.TotalDebit
+	preview.Summary.NewBalance = currentBalance + preview.Summary.BalanceChange
+	preview.reconcile(statement)
+	if dryRun {
+		ctx.JSON(200, gin.H{
+			"status":  "success",
+			"message": "Statement preview generated, submit again with dry_run=false to import",
+			"data": map[string]importPreview{
+				"import": preview,
+			},
+		})
+		return
+	}
+	if len(preview.Errors) > 0 {
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Statement has invalid rows, nothing was imported",
+			"data": map[string]importPreview{
+				"import": preview,
+			},
+		})
+		return
+	}
+	if len(trs) == 0 {
+		setErrorResponse(ctx, 400, "Statement has no new transactions to import")
+		return
+	}
+	newBalance, err := updatePassbookAndCreateTrxs(initializers.DB, passbookID, trs)
+	if err != nil {
+		if errors.Is(err, errInsufficientBalance) {
+			setErrorResponse(ctx, 400, "Insufficient balance")
+			return
+		}
+		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			setErrorResponse(ctx, 409, "Statement is already being imported")
+			return
+		}
+		log.Println("Failed to import statement into passbook", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to import statement")
+		return
+	}
+	// the balance could have changed between the preview and the import
+	preview.Summary.NewBalance = newBalance
+	preview.Summary.CurrentBalance = newBalance - preview.Summary.BalanceChange
+	preview.reconcile(statement)
+	log.Println("Imported", len(trs), "transactions into passbook", passbookID)
+	ctx.JSON(201, gin.H{
+		"status":  "success",
+		"message": "Statement imported successfully",
+		"data": map[string]importPreview{
+			"import": preview,
+		},
+	})
+}
+
+// drop the entries whose external id was already imported into the passbook, purged from trash or appears twice in the statement
+func skipImportedEntries(passbookID string, entries []importers.Entry) ([]importers.Entry, int, error) {
+	externalIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ExternalID != "" {
+			externalIDs = append(externalIDs, entry.ExternalID)
+		}
+	}
+	if len(externalIDs) == 0 {
+		return entries, 0, nil
+	}
+	rows, _ := initializers.DB.Query(context.Background(), "SELECT external_id FROM passbook_app.transactions WHERE passbook_id=$1 AND external_id = ANY($2) UNION SELECT external_id FROM passbook_app.purged_imports WHERE passbook_id=$1 AND external_id = ANY($2)", passbookID, externalIDs)
+	imported, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, 0, err
+	}
+	seen := make(map[string]bool, len(externalIDs))
+	for _, id := range imported {
+		seen[id] = true
+	}
+	remaining := make([]importers.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.ExternalID != "" {
+			if seen[entry.ExternalID] {
+				continue
+			}
+			seen[entry.ExternalID] = true
+		}
+		remaining = append(remaining, entry)
+	}
+	return remaining, len(entries) - len(remaining), nil
+}
+
+// compare the closing balance of the statement with the new balance of the passbook
+func (p *importPreview) reconcile(statement *importers.Statement) {
+	if statement == nil || statement.ClosingBalance == nil {
+		return
+	}
+	p.Reconciliation = &importReconciliation{
+		StatementBalance: *statement.ClosingBalance,
+		BalanceAsOf:      statement.ClosingDate,
+		PassbookBalance:  p.Summary.NewBalance,
+		Difference:       p.Summary.NewBalance - *statement.ClosingBalance,
+	}
+	p.Reconciliation.Reconciled = p.Reconciliation.Difference == 0
+}
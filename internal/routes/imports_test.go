@@ -0,0 +1,411 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// post a multipart import request with the statement as "file", a nil file leaves out the file field
+func postStatement(router *gin.Engine, path string, file []byte, fields map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	if file != nil {
+		fw, _ := mw.CreateFormFile("file", "statement")
+		fw.Write(file)
+	}
+	mw.Close()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	router.ServeHTTP(w, req)
+	return w
+}
+
+type importResponse struct {
+	Message string `json:"message"`
+	Data    struct {
+		Import importPreview `json:"import"`
+	} `json:"data"`
+}
+
+func decodeImport(t *testing.T, w *httptest.ResponseRecorder) importPreview {
+	var response importResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Data.Import
+}
+
+const (
+	importBalanceSQL     = `^SELECT total_balance, currency FROM passbook_app.passbooks WHERE passbook_id=\$1 AND user_id=\$2$`
+	importLockSQL        = `^SELECT total_balance FROM passbook_app.passbooks WHERE passbook_id=\$1 FOR UPDATE$`
+	importedExternalSQL  = `^SELECT external_id FROM passbook_app.transactions WHERE passbook_id=\$1 AND external_id = ANY\(\$2\) UNION SELECT external_id FROM passbook_app.purged_imports WHERE passbook_id=\$1 AND external_id = ANY\(\$2\)$`
+	statementPassbookSQL = `^SELECT passbook_id FROM passbook_app.passbooks WHERE user_id=\$1 AND replace\(account_number, ' ', ''\) = ANY\(\$2\) AND \(\$3='' OR passbook_id::text=\$3\)$`
+)
+
+func TestImportCSVStatement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/passbooks/:passbook_id/imports/csv", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, ImportCSVStatement)
+	upload := func(statement string, fields map[string]string) *httptest.ResponseRecorder {
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		fields["profile_id"] = "profile-1"
+		return postStatement(router, "/v1/passbooks/test-passbook-id/imports/csv", []byte(statement), fields)
+	}
+	profileColumns := []string{"profile_id", "user_id", "name", "delimiter", "has_header", "skip_rows", "date_column", "date_format", "amount_column", "debit_column", "credit_column", "party_column", "description_column", "decimal_separator", "tags", "created_at", "updated_at"}
+	expectProfile := func() {
+		now := time.Now()
+		mockDB.ExpectQuery(`^SELECT profile_id, .* FROM passbook_app.import_profiles WHERE profile_id=\$1 AND user_id=\$2$`).
+			WithArgs("profile-1", "test-user-id").
+			WillReturnRows(pgxmock.NewRows(profileColumns).
+				AddRow("profile-1", "test-user-id", "My Bank", ",", true, 0, "Date", "YYYY-MM-DD", "Amount", "", "", "Payee", "", ".", "bank", now, now))
+	}
+	expectPassbook := func(balance types.Money) {
+		mockDB.ExpectQuery(importBalanceSQL).
+			WithArgs("test-passbook-id", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"total_balance", "currency"}).AddRow(balance, "INR"))
+	}
+	statement := "Date,Amount,Payee\n2024-04-01,1500.00,ACME\n2024-04-02,-20.50,Coffee Shop\n"
+
+	t.Run("Dry run returns a preview without importing", func(t *testing.T) {
+		expectProfile()
+		expectPassbook(10000)
+
+		w := upload(statement, nil)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		preview := decodeImport(t, w)
+		assert.True(t, preview.DryRun)
+		assert.Len(t, preview.Transactions, 2)
+		assert.Equal(t, importSummary{Count: 2, TotalCredit: 150000, TotalDebit: 2050, BalanceChange: 147950, CurrentBalance: 10000, NewBalance: 157950}, preview.Summary)
+		assert.Nil(t, preview.Reconciliation)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("All rows and the balance change are committed together", func(t *testing.T) {
+		expectProfile()
+		expectPassbook(10000)
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(importLockSQL).
+			WithArgs("test-passbook-id").
+			WillReturnRows(pgxmock.NewRows([]string{"total_balance"}).AddRow(types.Money(10000)))
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET total_balance=\$1`).
+			WithArgs(types.Money(157950), pgxmock.AnyArg(), "test-passbook-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		for _, party := range []string{"ACME", "Coffee Shop"} {
+			mockDB.ExpectExec(`^INSERT INTO passbook_app.transactions`).
+				WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), party, "", pgxmock.AnyArg(), pgxmock.AnyArg(), "bank", "test-passbook-id", "test-user-id", pgxmock.AnyArg(), (*string)(nil)).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		}
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := upload(statement, map[string]string{"dry_run": "false"})
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		preview := decodeImport(t, w)
+		assert.False(t, preview.DryRun)
+		assert.Equal(t, types.Money(157950), preview.Summary.NewBalance)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Import driving the balance negative is rejected", func(t *testing.T) {
+		expectProfile()
+		expectPassbook(1000)
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(importLockSQL).
+			WithArgs("test-passbook-id").
+			WillReturnRows(pgxmock.NewRows([]string{"total_balance"}).AddRow(types.Money(1000)))
+		mockDB.ExpectRollback()
+
+		w := upload("Date,Amount,Payee\n2024-04-02,-20.50,Coffee Shop\n", map[string]string{"dry_run": "false"})
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Insufficient balance")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid rows are reported and nothing is imported", func(t *testing.T) {
+		expectProfile()
+		expectPassbook(10000)
+
+		w := upload(statement+"2024-04-03,12O.00,Typo\n", map[string]string{"dry_run": "false"})
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		preview := decodeImport(t, w)
+		assert.Len(t, preview.Errors, 1)
+		assert.Equal(t, 4, preview.Errors[0].Line)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Statements with too many rows are rejected", func(t *testing.T) {
+		expectProfile()
+		expectPassbook(10000)
+		var large strings.Builder
+		large.WriteString("Date,Amount,Payee\n")
+		for i := 0; i <= maxImportRows; i++ {
+			fmt.Fprintf(&large, "2024-04-01,1.00,Row %d\n", i)
+		}
+
+		w := upload(large.String(), nil)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "too many rows")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Missing file or profile", func(t *testing.T) {
+		expectProfile()
+		w := postStatement(router, "/v1/passbooks/test-passbook-id/imports/csv", nil, map[string]string{"profile_id": "profile-1"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		mockDB.ExpectQuery(`^SELECT profile_id, .* FROM passbook_app.import_profiles`).
+			WithArgs("profile-2", "test-user-id").
+			WillReturnRows(pgxmock.NewRows(profileColumns))
+		w = postStatement(router, "/v1/passbooks/test-passbook-id/imports/csv", []byte(statement), map[string]string{"profile_id": "profile-2"})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+const routeOFXStatement = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+  <BANKMSGSRSV1><STMTTRNRS><STMTRS>
+    <CURDEF>USD</CURDEF>
+    <BANKACCTFROM><BANKID>121000248</BANKID><ACCTID>123512</ACCTID></BANKACCTFROM>
+    <BANKTRANLIST>
+      <STMTTRN><TRNTYPE>CREDIT</TRNTYPE><DTPOSTED>20240401</DTPOSTED><TRNAMT>1500.00</TRNAMT><FITID>FIT-1</FITID><NAME>ACME</NAME></STMTTRN>
+      <STMTTRN><TRNTYPE>DEBIT</TRNTYPE><DTPOSTED>20240402</DTPOSTED><TRNAMT>-20.50</TRNAMT><FITID>FIT-2</FITID><NAME>Coffee Shop</NAME></STMTTRN>
+    </BANKTRANLIST>
+    <LEDGERBAL><BALAMT>1579.50</BALAMT><DTASOF>20240405</DTASOF></LEDGERBAL>
+  </STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`
+
+const routeCAMT053Statement = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02">
+  <BkToCstmrStmt>
+    <Stmt>
+      <Id>STMT-2024-04</Id>
+      <Acct><Id><IBAN>DE89370400440532013000</IBAN></Id><Ccy>EUR</Ccy></Acct>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>OPBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">1000.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Dt><Dt>2024-03-31</Dt></Dt>
+      </Bal>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>CLBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">1500.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Dt><Dt>2024-04-05</Dt></Dt>
+      </Bal>
+      <Ntry>
+        <Amt Ccy="EUR">500.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Sts>BOOK</Sts>
+        <BookgDt><Dt>2024-04-01</Dt></BookgDt><AcctSvcrRef>REF-1</AcctSvcrRef>
+        <NtryDtls><TxDtls><RltdPties><Dbtr><Nm>ACME GmbH</Nm></Dbtr></RltdPties></TxDtls></NtryDtls>
+      </Ntry>
+    </Stmt>
+  </BkToCstmrStmt>
+</Document>`
+
+const routeMT940Statement = `{1:F01DEUTDEFFAXXX0000000000}{2:O9400000240406DEUTDEFFAXXX00000000002404060000N}{4:
+:20:STMT240405
+:25:37040044/0532013000
+:28C:00042/001
+:60F:C240331EUR1000,00
+:61:240401C500,00NTRFNONREF//BANKREF1
+:86:/NAME/ACME GmbH/REMI/USTD//Salary/
+:62F:C240405EUR1500,00
+-}`
+
+func TestImportStatements(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	imports := router.Group("/v1/imports", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	})
+	imports.POST("/ofx", ImportOFXStatement)
+	imports.POST("/camt053", ImportCAMT053Statement)
+	imports.POST("/mt940", ImportMT940Statement)
+	expectPassbooks := func(candidates []string, passbookID string, found ...string) {
+		rows := pgxmock.NewRows([]string{"passbook_id"})
+		for _, id := range found {
+			rows.AddRow(id)
+		}
+		mockDB.ExpectQuery(statementPassbookSQL).
+			WithArgs("test-user-id", candidates, passbookID).
+			WillReturnRows(rows)
+	}
+	expectPassbook := func(passbookID string, balance types.Money, currency string) {
+		mockDB.ExpectQuery(importBalanceSQL).
+			WithArgs(passbookID, "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"total_balance", "currency"}).AddRow(balance, currency))
+	}
+
+	t.Run("OFX entries already imported are skipped and the balance is reconciled", func(t *testing.T) {
+		expectPassbooks([]string{"123512"}, "", "pb-usd")
+		// FIT-1 was imported with an earlier statement, the balance already contains it
+		expectPassbook("pb-usd", 160000, "USD")
+		mockDB.ExpectQuery(importedExternalSQL).
+			WithArgs("pb-usd", []string{"FIT-1", "FIT-2"}).
+			WillReturnRows(pgxmock.NewRows([]string{"external_id"}).AddRow("FIT-1"))
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(importLockSQL).
+			WithArgs("pb-usd").
+			WillReturnRows(pgxmock.NewRows([]string{"total_balance"}).AddRow(types.Money(160000)))
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET total_balance=\$1`).
+			WithArgs(types.Money(157950), pgxmock.AnyArg(), "pb-usd").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		fitID := "FIT-2"
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.transactions`).
+			WithArgs(pgxmock.AnyArg(), types.Money(2050), pgxmock.AnyArg(), "DEBIT", "Coffee Shop", "", pgxmock.AnyArg(), pgxmock.AnyArg(), "", "pb-usd", "test-user-id", pgxmock.AnyArg(), &fitID).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := postStatement(router, "/v1/imports/ofx", []byte(routeOFXStatement), map[string]string{"dry_run": "false"})
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		preview := decodeImport(t, w)
+		assert.Equal(t, 1, preview.Skipped)
+		assert.Len(t, preview.Transactions, 1)
+		assert.Equal(t, &importReconciliation{
+			StatementBalance: 157950,
+			BalanceAsOf:      time.Date(2024, 4, 5, 0, 0, 0, 0, time.UTC),
+			PassbookBalance:  157950,
+			Difference:       0,
+			Reconciled:       true,
+		}, preview.Reconciliation)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("OFX entries purged from trash are not imported again", func(t *testing.T) {
+		expectPassbooks([]string{"123512"}, "", "pb-usd")
+		expectPassbook("pb-usd", 157950, "USD")
+		// FIT-2 is still stored, FIT-1 was deleted by the user and purged from trash since
+		mockDB.ExpectQuery(importedExternalSQL).
+			WithArgs("pb-usd", []string{"FIT-1", "FIT-2"}).
+			WillReturnRows(pgxmock.NewRows([]string{"external_id"}).AddRow("FIT-2").AddRow("FIT-1"))
+
+		w := postStatement(router, "/v1/imports/ofx", []byte(routeOFXStatement), nil)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		preview := decodeImport(t, w)
+		assert.Equal(t, 2, preview.Skipped)
+		assert.Empty(t, preview.Transactions)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Statement in another currency than the passbook is rejected", func(t *testing.T) {
+		expectPassbooks([]string{"123512"}, "", "pb-inr")
+		expectPassbook("pb-inr", 160000, "INR")
+
+		w := postStatement(router, "/v1/imports/ofx", []byte(routeOFXStatement), nil)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Statement currency USD does not match the currency INR of the passbook")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("camt.053 preview with a difference to the closing balance", func(t *testing.T) {
+		expectPassbooks([]string{"DE89370400440532013000"}, "", "pb-eur")
+		expectPassbook("pb-eur", 90000, "EUR")
+		mockDB.ExpectQuery(importedExternalSQL).
+			WithArgs("pb-eur", []string{"REF-1"}).
+			WillReturnRows(pgxmock.NewRows([]string{"external_id"}))
+
+		w := postStatement(router, "/v1/imports/camt053", []byte(routeCAMT053Statement), nil)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		preview := decodeImport(t, w)
+		assert.True(t, preview.DryRun)
+		assert.Equal(t, "ACME GmbH", preview.Transactions[0].PartyName)
+		// 900 + 500 in the passbook against 1500 in the statement
+		assert.Equal(t, types.Money(-10000), preview.Reconciliation.Difference)
+		assert.False(t, preview.Reconciliation.Reconciled)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("camt.053 statement without a matching passbook", func(t *testing.T) {
+		expectPassbooks([]string{"DE89370400440532013000"}, "")
+
+		w := postStatement(router, "/v1/imports/camt053", []byte(routeCAMT053Statement), nil)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	mt940Candidates := []string{"37040044/0532013000", "0532013000"}
+
+	t.Run("MT940 account shared by several passbooks needs passbook_id", func(t *testing.T) {
+		expectPassbooks(mt940Candidates, "", "pb-1", "pb-2")
+
+		w := postStatement(router, "/v1/imports/mt940", []byte(routeMT940Statement), nil)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("MT940 preview into the chosen passbook", func(t *testing.T) {
+		expectPassbooks(mt940Candidates, "pb-2", "pb-2")
+		expectPassbook("pb-2", 100000, "EUR")
+		mockDB.ExpectQuery(importedExternalSQL).
+			WithArgs("pb-2", []string{"BANKREF1"}).
+			WillReturnRows(pgxmock.NewRows([]string{"external_id"}))
+
+		w := postStatement(router, "/v1/imports/mt940", []byte(routeMT940Statement), map[string]string{"passbook_id": "pb-2", "tags": "salary"})
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		preview := decodeImport(t, w)
+		assert.Equal(t, "salary", preview.Transactions[0].Tags)
+		assert.True(t, preview.Reconciliation.Reconciled)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unparsable statement or missing file", func(t *testing.T) {
+		w := postStatement(router, "/v1/imports/mt940", []byte("not a statement"), nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = postStatement(router, "/v1/imports/ofx", nil, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
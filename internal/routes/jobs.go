@@ -0,0 +1,49 @@
+package routes
+
+import (
+	"log"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+)
+
+// StartBackgroundJobs runs the periodic maintenance jobs of the app every interval until the process exits
+func StartBackgroundJobs(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for ; true; <-ticker.C {
+			if err := purgeExpiredTrash(initializers.DB); err != nil {
+				log.Println("Failed to purge expired trash", err)
+			}
+			if err := purgeExpiredSessions(initializers.DB); err != nil {
+				log.Println("Failed to purge expired sessions", err)
+			}
+			if err := purgeExpiredPasswordResets(initializers.DB); err != nil {
+				log.Println("Failed to purge expired password reset tokens", err)
+			}
+			if err := purgeExpiredEmailVerifications(initializers.DB); err != nil {
+				log.Println("Failed to purge expired email verification tokens", err)
+			}
+			if err := purgeExpiredOIDCLogins(initializers.DB); err != nil {
+				log.Println("Failed to purge expired oidc logins", err)
+			}
+			if err := purgeExpiredAccountDeletionConfirmations(initializers.DB); err != nil {
+				log.Println("Failed to purge expired account deletion confirmations", err)
+			}
+			if err := purgeDeletedAccounts(initializers.DB); err != nil {
+				log.Println("Failed to purge deleted accounts", err)
+			}
+			// also picks up the keys added by other instances
+			if err := initializers.TokenKeyring.Rotate(); err != nil {
+				log.Println("Failed to rotate token signing keys", err)
+			}
+			if err := initializers.UsernameLoginLimiter.Purge(); err != nil {
+				log.Println("Failed to purge failed login counters", err)
+			}
+			if err := initializers.IPLoginLimiter.Purge(); err != nil {
+				log.Println("Failed to purge failed login counters", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/gin-gonic/gin"
+)
+
+// jwksMaxAge lets verifiers cache the keys, new keys are published a day before they sign so an hour of caching is safe
+const jwksMaxAge = "public, max-age=3600"
+
+// GetJWKS publishes the public keys verifying the tokens of the app as a JSON Web Key Set
+func GetJWKS(ctx *gin.Context) {
+	ctx.Header("Cache-Control", jwksMaxAge)
+	ctx.JSON(200, initializers.TokenKeyring.JWKS())
+}
@@ -0,0 +1,38 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/keyring"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJWKS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	accessToken, _, err := generateTokens(types.User{UserID: "test-user-id"}, "test-session-id")
+	assert.NoError(t, err)
+
+	router := gin.New()
+	router.GET("/.well-known/jwks.json", GetJWKS)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+	var jwks keyring.JWKS
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	assert.Equal(t, initializers.TokenKeyring.JWKS(), jwks)
+	// the published key is the one named by the tokens
+	token, _, err := jwt.NewParser().ParseUnverified(accessToken, &types.UserTokenClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, jwks.Keys[0].Kid, token.Header["kid"])
+	assert.Equal(t, "EdDSA", token.Header["alg"])
+}
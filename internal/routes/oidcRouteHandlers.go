@@ -0,0 +1,505 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/oidc"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// time the user has to log in at the identity provider
+	oidcLoginLifetime = 10 * time.Minute
+	// cookie tying the callback to the browser which started the login, only sent to the oidc routes
+	oidcStateCookie     = "oidc_state"
+	oidcStateCookiePath = "/v1/auth/oidc"
+	// usernames tried for a new user before giving up, the name at the provider first and then with random suffixes
+	oidcUsernameAttempts = 3
+)
+
+const (
+	securityEventIdentityLinked   = "identity_linked"
+	securityEventIdentityUnlinked = "identity_unlinked"
+)
+
+var (
+	errInvalidOIDCLogin = errors.New("invalid or expired oidc login")
+	errOIDCNoEmail      = errors.New("identity provider shared no valid email")
+	errOIDCEmailTaken   = errors.New("email of the identity belongs to another user")
+)
+
+type oidcLoginReq struct {
+	// optional name of the device logging in, derived from the user agent when empty
+	DeviceName string `json:"device_name"`
+}
+
+type oidcCallbackReq struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
+// a login started at the identity provider, read back once by the callback
+type oidcLogin struct {
+	nonce        string
+	codeVerifier string
+	deviceName   string
+	// set when a logged in user links an identity
+	userID    *string
+	expiresAt time.Time
+}
+
+func isOIDCConfigured(ctx *gin.Context) bool {
+	if initializers.OIDCProvider == nil {
+		setErrorResponse(ctx, 404, "OIDC login is not configured")
+		return false
+	}
+	return true
+}
+
+/*
+Route handler for starting a login with the OpenID Connect provider. Responds with the URL of the provider the web app
+sends the browser to, the provider sends it back to the redirect URL with a code and the state which the web app posts
+to the callback.
+*/
+func StartOIDCLogin(ctx *gin.Context) {
+	if !isOIDCConfigured(ctx) {
+		return
+	}
+	var req oidcLoginReq
+	// the body is optional
+	if err := ctx.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		setErrorResponse(ctx, 400, "Invalid request body")
+		return
+	}
+	authorizationURL, err := startOIDCLogin(ctx, nil, req.DeviceName)
+	if err != nil {
+		log.Println("Failed to start oidc login", err)
+		setErrorResponse(ctx, 500, "Failed to start the login. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Continue the login at the identity provider",
+		"data": map[string]string{
+			"authorization_url": authorizationURL,
+		},
+	})
+}
+
+/*
+Remember a new login with a random state, nonce and PKCE verifier and return the authorization URL of the provider.
+The db keeps the hash of the state, the state itself goes to the provider and into a cookie of the browser.
+*/
+func startOIDCLogin(ctx *gin.Context, userID *string, deviceName string) (string, error) {
+	state, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := utils.GenerateSecureToken()
+	if err != nil {
+		return "", err
+	}
+	codeVerifier, err := oidc.NewCodeVerifier()
+	if err != nil {
+		return "", err
+	}
+	// discovers the provider first, so nothing is stored while it cannot be reached
+	authorizationURL, err := initializers.OIDCProvider.AuthCodeURL(context.Background(), state, nonce, oidc.CodeChallenge(codeVerifier))
+	if err != nil {
+		return "", err
+	}
+	time_now := time.Now().UTC()
+	_, err = initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.oidc_login_states (state_hash, nonce, code_verifier, device_name, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		utils.HashToken(state), nonce, codeVerifier, truncate(utils.TrimAndSanitizeStrict(deviceName), 255), userID, time_now.Add(oidcLoginLifetime), time_now)
+	if err != nil {
+		return "", err
+	}
+	ctx.SetCookie(oidcStateCookie, state, int(oidcLoginLifetime.Seconds()), oidcStateCookiePath, "", true, true)
+	return authorizationURL, nil
+}
+
+/*
+Route handler for finishing a login with the OpenID Connect provider. The code is exchanged for the ID token of the
+user, whose identity logs in the user it is linked to. An identity which is not linked yet is linked to the user with
+the same email or signs up a new user. Users with two-factor authentication get an mfa token as with the password.
+*/
+func OIDCCallback(ctx *gin.Context) {
+	if !isOIDCConfigured(ctx) {
+		return
+	}
+	var req oidcCallbackReq
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Code == "" || req.State == "" {
+		setErrorResponse(ctx, 400, "Please provide the code and state sent by the identity provider.")
+		return
+	}
+	login, err := consumeOIDCLogin(ctx, req.State)
+	clearOIDCStateCookie(ctx)
+	if errors.Is(err, errInvalidOIDCLogin) {
+		setErrorResponse(ctx, 400, "Invalid or expired login. Please start the login again")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to get oidc login", err)
+		setErrorResponse(ctx, 500, "Login failed. Try again later!")
+		return
+	}
+	rawIDToken, err := initializers.OIDCProvider.Exchange(context.Background(), req.Code, login.codeVerifier)
+	if err != nil {
+		log.Println("Failed to exchange oidc code", err)
+		if errors.Is(err, oidc.ErrExchangeFailed) {
+			setErrorResponse(ctx, 401, "Login with the identity provider failed")
+			return
+		}
+		setErrorResponse(ctx, 502, "The identity provider cannot be reached. Try again later!")
+		return
+	}
+	claims, err := initializers.OIDCProvider.VerifyIDToken(context.Background(), rawIDToken, login.nonce)
+	if err != nil {
+		log.Println("Failed to verify oidc id token", err)
+		setErrorResponse(ctx, 401, "Login with the identity provider failed")
+		return
+	}
+	if login.userID != nil {
+		linkIdentity(ctx, *login.userID, claims)
+		return
+	}
+	user, err := oidcUser(ctx, claims)
+	if errors.Is(err, errOIDCNoEmail) {
+		setErrorResponse(ctx, 400, "The identity provider did not share a valid email address")
+		return
+	}
+	if errors.Is(err, errOIDCEmailTaken) {
+		setErrorResponse(ctx, 409, "An account with this email already exists. Log in with the password and link the identity in the account settings")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to log in oidc subject", claims.Subject, err)
+		setErrorResponse(ctx, 500, "Login failed. Try again later!")
+		return
+	}
+	finishLogin(ctx, user, login.deviceName)
+}
+
+/*
+Read and delete the login of the state. The state has to come back to the browser which started the login, otherwise
+an attacker could start a login and have it finished in the browser of somebody else.
+*/
+func consumeOIDCLogin(ctx *gin.Context, state string) (oidcLogin, error) {
+	cookie, err := ctx.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		return oidcLogin{}, errInvalidOIDCLogin
+	}
+	var login oidcLogin
+	err = initializers.DB.QueryRow(context.Background(), "DELETE FROM passbook_app.oidc_login_states WHERE state_hash=$1 RETURNING nonce, code_verifier, device_name, user_id, expires_at",
+		utils.HashToken(state)).Scan(&login.nonce, &login.codeVerifier, &login.deviceName, &login.userID, &login.expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return oidcLogin{}, errInvalidOIDCLogin
+	}
+	if err != nil {
+		return oidcLogin{}, err
+	}
+	if !login.expiresAt.After(time.Now()) {
+		return oidcLogin{}, errInvalidOIDCLogin
+	}
+	return login, nil
+}
+
+// expire the state cookie on the client
+func clearOIDCStateCookie(ctx *gin.Context) {
+	ctx.SetCookie(oidcStateCookie, "", -1, oidcStateCookiePath, "", true, true)
+}
+
+/*
+The user an identity logs in. An identity which is not linked yet is linked to the user with the same email only when
+both the provider and the app verified the email, otherwise anybody able to pick an email at the provider could take
+over the account with that email. Without a user with the email a new user signs up.
+*/
+func oidcUser(ctx *gin.Context, claims *oidc.Claims) (types.User, error) {
+	var userID string
+	err := initializers.DB.QueryRow(context.Background(), "UPDATE passbook_app.user_identities SET last_login_at=$1 WHERE issuer=$2 AND subject=$3 RETURNING user_id",
+		time.Now().UTC(), initializers.OIDCProvider.Issuer(), claims.Subject).Scan(&userID)
+	if err == nil {
+		return getUserByID(initializers.DB, userID)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return types.User{}, err
+	}
+	if !isValidEmail(claims.Email) {
+		return types.User{}, errOIDCNoEmail
+	}
+	rows, err := initializers.DB.Query(context.Background(), "SELECT * FROM passbook_app.users WHERE email=$1", claims.Email)
+	if err != nil {
+		return types.User{}, err
+	}
+	user, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[types.User])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return createOIDCUser(ctx, claims)
+	}
+	if err != nil {
+		return types.User{}, err
+	}
+	if !claims.EmailVerified || user.EmailVerifiedAt == nil {
+		return types.User{}, errOIDCEmailTaken
+	}
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		return types.User{}, err
+	}
+	defer tx.Rollback(context.Background())
+	time_now := time.Now().UTC()
+	if _, err := insertIdentity(tx, ctx, user.UserID, claims, &time_now); err != nil {
+		return types.User{}, err
+	}
+	return user, tx.Commit(context.Background())
+}
+
+/*
+Sign up a user with the name and email of the identity. The user has no password, bcrypt never matches the empty hash,
+and can set one with a password reset link. An email the provider did not verify gets a verification link.
+*/
+func createOIDCUser(ctx *gin.Context, claims *oidc.Claims) (types.User, error) {
+	base := oidcUsername(claims)
+	username := base
+	for attempt := 1; ; attempt++ {
+		user, err := insertOIDCUser(ctx, username, claims)
+		if err == nil {
+			if user.EmailVerifiedAt == nil {
+				if err := sendVerificationEmail(user.UserID, user.Username, user.Email); err != nil {
+					log.Println("Failed to send verification email to user_id:", user.UserID, err)
+				}
+			}
+			return user, nil
+		}
+		// the user signed up in the meantime
+		if strings.Contains(err.Error(), "users_email_key") {
+			return types.User{}, errOIDCEmailTaken
+		}
+		if attempt == oidcUsernameAttempts || !strings.Contains(err.Error(), "users_username_key") {
+			return types.User{}, err
+		}
+		suffix, err := utils.GenerateSecureToken()
+		if err != nil {
+			return types.User{}, err
+		}
+		username = base + "-" + strings.ToLower(suffix[:6])
+	}
+}
+
+func insertOIDCUser(ctx *gin.Context, username string, claims *oidc.Claims) (types.User, error) {
+	time_now := time.Now().UTC()
+	user := types.User{
+		Username:  username,
+		Email:     claims.Email,
+		CreatedAt: time_now,
+		UpdatedAt: time_now,
+	}
+	if claims.EmailVerified {
+		user.EmailVerifiedAt = &time_now
+	}
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		return types.User{}, err
+	}
+	defer tx.Rollback(context.Background())
+	err = tx.QueryRow(context.Background(), "INSERT INTO passbook_app.users (username, email, password_hash, created_at, updated_at, email_verified_at) VALUES ($1, $2, '', $3, $4, $5) RETURNING user_id",
+		user.Username, user.Email, user.CreatedAt, user.UpdatedAt, user.EmailVerifiedAt).Scan(&user.UserID)
+	if err != nil {
+		return types.User{}, err
+	}
+	if _, err := insertIdentity(tx, ctx, user.UserID, claims, &time_now); err != nil {
+		return types.User{}, err
+	}
+	return user, tx.Commit(context.Background())
+}
+
+// username of a new user, the name preferred at the provider or else the local part of the email
+func oidcUsername(claims *oidc.Claims) string {
+	username := utils.TrimAndSanitizeStrict(claims.PreferredUsername)
+	if username == "" {
+		localPart, _, _ := strings.Cut(claims.Email, "@")
+		username = utils.TrimAndSanitizeStrict(localPart)
+	}
+	if username == "" {
+		username = "user"
+	}
+	// leaves room for the suffix of a taken username
+	return truncate(username, 240)
+}
+
+// link the identity to the user and record it, lastLoginAt is nil when the identity is linked without logging in
+func insertIdentity(tx pgx.Tx, ctx *gin.Context, userID string, claims *oidc.Claims, lastLoginAt *time.Time) (types.Identity, error) {
+	identity := types.Identity{
+		Issuer:      initializers.OIDCProvider.Issuer(),
+		Subject:     claims.Subject,
+		Email:       truncate(claims.Email, 255),
+		CreatedAt:   time.Now().UTC(),
+		LastLoginAt: lastLoginAt,
+	}
+	err := tx.QueryRow(context.Background(), "INSERT INTO passbook_app.user_identities (user_id, issuer, subject, email, created_at, last_login_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING identity_id",
+		userID, identity.Issuer, identity.Subject, identity.Email, identity.CreatedAt, identity.LastLoginAt).Scan(&identity.IdentityID)
+	if err != nil {
+		return types.Identity{}, err
+	}
+	err = recordSecurityEvent(tx, ctx, userID, securityEventIdentityLinked, "", "Identity "+identity.Email+" at "+identity.Issuer+" was linked")
+	return identity, err
+}
+
+// link the identity of the callback to the user who started linking it, no tokens are issued
+func linkIdentity(ctx *gin.Context, userID string, claims *oidc.Claims) {
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to link identity. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	identity, err := insertIdentity(tx, ctx, userID, claims, nil)
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			setErrorResponse(ctx, 409, "This identity is already linked to an account")
+			return
+		}
+		log.Println("Failed to link identity of user_id:", userID, err)
+		setErrorResponse(ctx, 500, "Failed to link identity. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Identity linked successfully",
+		"data": map[string]types.Identity{
+			"identity": identity,
+		},
+	})
+}
+
+// route handler for linking an identity at the OpenID Connect provider to the logged in user, finished by the callback
+func StartIdentityLink(ctx *gin.Context) {
+	if !isOIDCConfigured(ctx) {
+		return
+	}
+	loggedInUserID := ctx.MustGet("userId").(string)
+	authorizationURL, err := startOIDCLogin(ctx, &loggedInUserID, "")
+	if err != nil {
+		log.Println("Failed to start linking an identity to user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to link identity. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Continue at the identity provider to link the identity",
+		"data": map[string]string{
+			"authorization_url": authorizationURL,
+		},
+	})
+}
+
+// route handler for listing the identities linked to the logged in user
+func GetIdentities(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	rows, err := initializers.DB.Query(context.Background(), "SELECT identity_id, issuer, subject, email, created_at, last_login_at FROM passbook_app.user_identities WHERE user_id=$1 ORDER BY created_at", loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get identities of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get identities")
+		return
+	}
+	defer rows.Close()
+	identities := make([]types.Identity, 0)
+	for rows.Next() {
+		var i types.Identity
+		if err := rows.Scan(&i.IdentityID, &i.Issuer, &i.Subject, &i.Email, &i.CreatedAt, &i.LastLoginAt); err != nil {
+			log.Println("Failed to scan identity of user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to get identities")
+			return
+		}
+		identities = append(identities, i)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to get identities of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get identities")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Identities fetched successfully",
+		"data": map[string][]types.Identity{
+			"identities": identities,
+		},
+	})
+}
+
+// route handler for unlinking an identity of the logged in user, the last identity of a user without a password stays
+func DeleteIdentity(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	identityID := ctx.Param("identity_id")
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to unlink identity. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	// locks the user so two requests cannot unlink the last two identities
+	var passwordHash string
+	err = tx.QueryRow(context.Background(), "SELECT password_hash FROM passbook_app.users WHERE user_id=$1 FOR UPDATE", loggedInUserID).Scan(&passwordHash)
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to unlink identity. Try again later!")
+		return
+	}
+	var issuer, email string
+	err = tx.QueryRow(context.Background(), "DELETE FROM passbook_app.user_identities WHERE identity_id::text=$1 AND user_id=$2 RETURNING issuer, email", identityID, loggedInUserID).Scan(&issuer, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		setErrorResponse(ctx, 404, "Identity not found")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to unlink identity", identityID, "of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to unlink identity. Try again later!")
+		return
+	}
+	if passwordHash == "" {
+		var remaining int
+		err = tx.QueryRow(context.Background(), "SELECT count(*) FROM passbook_app.user_identities WHERE user_id=$1", loggedInUserID).Scan(&remaining)
+		if err != nil {
+			log.Println("Failed to count identities of user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to unlink identity. Try again later!")
+			return
+		}
+		if remaining == 0 {
+			setErrorResponse(ctx, 409, "This identity is the only way to log in. Set a password with a password reset link before unlinking it")
+			return
+		}
+	}
+	err = recordSecurityEvent(tx, ctx, loggedInUserID, securityEventIdentityUnlinked, ctx.GetString("sessionId"), "Identity "+email+" at "+issuer+" was unlinked")
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Println("Failed to unlink identity", identityID, "of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to unlink identity. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Identity unlinked successfully",
+	})
+}
+
+// delete the oidc logins which were never finished
+func purgeExpiredOIDCLogins(conn initializers.PgxPoolIface) error {
+	_, err := conn.Exec(context.Background(), "DELETE FROM passbook_app.oidc_login_states WHERE expires_at < $1", time.Now().UTC())
+	return err
+}
@@ -0,0 +1,329 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/oidc"
+	"github.com/akashsharma99/passbook-app/internal/oidc/oidctest"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	idp := oidctest.NewServer("passbook", "secret")
+	defer idp.Close()
+	originalProvider := initializers.OIDCProvider
+	initializers.OIDCProvider = oidc.NewProvider(oidc.Config{Issuer: idp.Issuer(), ClientID: "passbook", ClientSecret: "secret", RedirectURL: "https://passbook.example.com/oidc/callback"})
+	defer func() { initializers.OIDCProvider = originalProvider }()
+
+	router := gin.New()
+	router.POST("/v1/auth/oidc/login", StartOIDCLogin)
+	router.POST("/v1/auth/oidc/callback", OIDCCallback)
+	router.POST("/v1/users/me/identities", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, StartIdentityLink)
+
+	stateSQL := `^INSERT INTO passbook_app.oidc_login_states \(state_hash, nonce, code_verifier, device_name, user_id, expires_at, created_at\)`
+	consumeSQL := `^DELETE FROM passbook_app.oidc_login_states WHERE state_hash=\$1 RETURNING nonce, code_verifier, device_name, user_id, expires_at$`
+	identitySQL := `^UPDATE passbook_app.user_identities SET last_login_at=\$1 WHERE issuer=\$2 AND subject=\$3 RETURNING user_id$`
+	emailSQL := `^SELECT \* FROM passbook_app.users WHERE email=\$1$`
+	insertUserSQL := `^INSERT INTO passbook_app.users \(username, email, password_hash, created_at, updated_at, email_verified_at\)`
+	insertIdentitySQL := `^INSERT INTO passbook_app.user_identities \(user_id, issuer, subject, email, created_at, last_login_at\)`
+	sessionSQL := `^INSERT INTO passbook_app.sessions`
+	now := time.Now().UTC()
+
+	// a login at the provider as the web app does it, returns the callback request with the state cookie
+	type login struct {
+		code, state, nonce, verifier, stateHash string
+		cookie                                  *http.Cookie
+	}
+	start := func(t *testing.T, path string, body string) login {
+		stateHash, nonce, verifier := &captureArg{}, &captureArg{}, &captureArg{}
+		mockDB.ExpectExec(stateSQL).
+			WithArgs(stateHash, nonce, verifier, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var res struct {
+			Data struct {
+				AuthorizationURL string `json:"authorization_url"`
+			} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		code, state, err := idp.Authorize(res.Data.AuthorizationURL)
+		assert.NoError(t, err)
+		cookies := w.Result().Cookies()
+		assert.Len(t, cookies, 1)
+		assert.Equal(t, "/v1/auth/oidc", cookies[0].Path)
+		assert.True(t, cookies[0].HttpOnly)
+		return login{code: code, state: state, nonce: nonce.value, verifier: verifier.value, stateHash: stateHash.value, cookie: cookies[0]}
+	}
+	callback := func(l login, cookie *http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/oidc/callback", strings.NewReader(`{"code":"`+l.code+`","state":"`+l.state+`"}`))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expectConsume := func(l login, userID *string) {
+		mockDB.ExpectQuery(consumeSQL).
+			WithArgs(l.stateHash).
+			WillReturnRows(pgxmock.NewRows([]string{"nonce", "code_verifier", "device_name", "user_id", "expires_at"}).
+				AddRow(l.nonce, l.verifier, "", userID, now.Add(oidcLoginLifetime)))
+	}
+
+	t.Run("Linked identity logs in its user", func(t *testing.T) {
+		l := start(t, "/v1/auth/oidc/login", `{"device_name":"Work laptop"}`)
+		expectConsume(l, nil)
+		mockDB.ExpectQuery(identitySQL).
+			WithArgs(pgxmock.AnyArg(), idp.Issuer(), "oidctest-subject").
+			WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow("test-user-id"))
+		mockDB.ExpectQuery(`^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", "", now, now, &now, nil, nil, int64(0)))
+		mockDB.ExpectExec(sessionSQL).WithArgs(anyArgs(8)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := callback(l, l.cookie)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"access_token"`)
+		assert.Contains(t, w.Header().Values("Set-Cookie")[1], "refresh_token=")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("State has to come back to the browser which started the login", func(t *testing.T) {
+		l := start(t, "/v1/auth/oidc/login", "")
+
+		assert.Equal(t, http.StatusBadRequest, callback(l, nil).Code)
+		assert.Equal(t, http.StatusBadRequest, callback(l, &http.Cookie{Name: oidcStateCookie, Value: "someone-elses-state"}).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Expired login", func(t *testing.T) {
+		l := start(t, "/v1/auth/oidc/login", "")
+		mockDB.ExpectQuery(consumeSQL).
+			WithArgs(l.stateHash).
+			WillReturnRows(pgxmock.NewRows([]string{"nonce", "code_verifier", "device_name", "user_id", "expires_at"}).
+				AddRow(l.nonce, l.verifier, "", nil, now.Add(-time.Second)))
+
+		assert.Equal(t, http.StatusBadRequest, callback(l, l.cookie).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Nonce of another login is rejected", func(t *testing.T) {
+		l := start(t, "/v1/auth/oidc/login", "")
+		l.nonce = "another-nonce"
+		expectConsume(l, nil)
+
+		assert.Equal(t, http.StatusUnauthorized, callback(l, l.cookie).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("New identity signs up a user", func(t *testing.T) {
+		idp.SetIdentity(oidctest.Identity{Subject: "new-subject", Email: "john@example.com", EmailVerified: true, PreferredUsername: "john"})
+		defer idp.SetIdentity(oidctest.Identity{Subject: "oidctest-subject", Email: "jane@example.com", EmailVerified: true, PreferredUsername: "jane"})
+		l := start(t, "/v1/auth/oidc/login", "")
+		expectConsume(l, nil)
+		mockDB.ExpectQuery(identitySQL).WithArgs(pgxmock.AnyArg(), idp.Issuer(), "new-subject").WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+		mockDB.ExpectQuery(emailSQL).WithArgs("john@example.com").WillReturnRows(pgxmock.NewRows(userColumns))
+		// the username is taken, the second attempt gets a suffix
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(insertUserSQL).
+			WithArgs("john", "john@example.com", pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnError(&duplicateKeyError{"users_username_key"})
+		mockDB.ExpectRollback()
+		username := &captureArg{}
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(insertUserSQL).
+			WithArgs(username, "john@example.com", pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow("new-user-id"))
+		mockDB.ExpectQuery(insertIdentitySQL).
+			WithArgs("new-user-id", idp.Issuer(), "new-subject", "john@example.com", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"identity_id"}).AddRow("new-identity-id"))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("new-user-id", securityEventIdentityLinked, (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+		mockDB.ExpectExec(sessionSQL).WithArgs(anyArgs(8)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := callback(l, l.cookie)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Regexp(t, `^john-[a-z0-9_-]{6}$`, username.value)
+		assert.Contains(t, w.Body.String(), `"email_verified":true`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Email of an account is not linked unless both sides verified it", func(t *testing.T) {
+		idp.SetIdentity(oidctest.Identity{Subject: "new-subject", Email: "jane@example.com", EmailVerified: false})
+		defer idp.SetIdentity(oidctest.Identity{Subject: "oidctest-subject", Email: "jane@example.com", EmailVerified: true, PreferredUsername: "jane"})
+		l := start(t, "/v1/auth/oidc/login", "")
+		expectConsume(l, nil)
+		mockDB.ExpectQuery(identitySQL).WithArgs(pgxmock.AnyArg(), idp.Issuer(), "new-subject").WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+		mockDB.ExpectQuery(emailSQL).
+			WithArgs("jane@example.com").
+			WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", "hash", now, now, &now, nil, nil, int64(0)))
+
+		w := callback(l, l.cookie)
+
+		assert.Equal(t, http.StatusConflict, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Verified email links the identity and asks for the second factor", func(t *testing.T) {
+		idp.SetIdentity(oidctest.Identity{Subject: "new-subject", Email: "jane@example.com", EmailVerified: true})
+		defer idp.SetIdentity(oidctest.Identity{Subject: "oidctest-subject", Email: "jane@example.com", EmailVerified: true, PreferredUsername: "jane"})
+		l := start(t, "/v1/auth/oidc/login", "")
+		expectConsume(l, nil)
+		secret := "JBSWY3DPEHPK3PXP"
+		mockDB.ExpectQuery(identitySQL).WithArgs(pgxmock.AnyArg(), idp.Issuer(), "new-subject").WillReturnRows(pgxmock.NewRows([]string{"user_id"}))
+		mockDB.ExpectQuery(emailSQL).
+			WithArgs("jane@example.com").
+			WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", "hash", now, now, &now, &secret, &now, int64(0)))
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(insertIdentitySQL).
+			WithArgs("test-user-id", idp.Issuer(), "new-subject", "jane@example.com", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"identity_id"}).AddRow("new-identity-id"))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventIdentityLinked, (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := callback(l, l.cookie)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"mfa_required":true`)
+		assert.NotContains(t, strings.Join(w.Header().Values("Set-Cookie"), ";"), "refresh_token=")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Logged in user links an identity", func(t *testing.T) {
+		l := start(t, "/v1/users/me/identities", "")
+		userID := "test-user-id"
+		expectConsume(l, &userID)
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(insertIdentitySQL).
+			WithArgs("test-user-id", idp.Issuer(), "oidctest-subject", "jane@example.com", pgxmock.AnyArg(), (*time.Time)(nil)).
+			WillReturnRows(pgxmock.NewRows([]string{"identity_id"}).AddRow("new-identity-id"))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventIdentityLinked, (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := callback(l, l.cookie)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"identity_id":"new-identity-id"`)
+		assert.NotContains(t, w.Body.String(), "access_token")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Not configured", func(t *testing.T) {
+		initializers.OIDCProvider = nil
+		defer func() {
+			initializers.OIDCProvider = oidc.NewProvider(oidc.Config{Issuer: idp.Issuer(), ClientID: "passbook", ClientSecret: "secret", RedirectURL: "https://passbook.example.com/oidc/callback"})
+		}()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/oidc/login", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestDeleteIdentity(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.DELETE("/v1/users/me/identities/:identity_id", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, DeleteIdentity)
+	passwordSQL := `^SELECT password_hash FROM passbook_app.users WHERE user_id=\$1 FOR UPDATE$`
+	deleteSQL := `^DELETE FROM passbook_app.user_identities WHERE identity_id::text=\$1 AND user_id=\$2 RETURNING issuer, email$`
+	countSQL := `^SELECT count\(\*\) FROM passbook_app.user_identities WHERE user_id=\$1$`
+	unlink := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/users/me/identities/identity-id", nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Last identity of a user without a password stays", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(passwordSQL).WithArgs("test-user-id").WillReturnRows(pgxmock.NewRows([]string{"password_hash"}).AddRow(""))
+		mockDB.ExpectQuery(deleteSQL).WithArgs("identity-id", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"issuer", "email"}).AddRow("https://idp.example.com", "jane@example.com"))
+		mockDB.ExpectQuery(countSQL).WithArgs("test-user-id").WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(0))
+		mockDB.ExpectRollback()
+
+		assert.Equal(t, http.StatusConflict, unlink().Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Identity is unlinked", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(passwordSQL).WithArgs("test-user-id").WillReturnRows(pgxmock.NewRows([]string{"password_hash"}).AddRow("hash"))
+		mockDB.ExpectQuery(deleteSQL).WithArgs("identity-id", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"issuer", "email"}).AddRow("https://idp.example.com", "jane@example.com"))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventIdentityUnlinked, (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		assert.Equal(t, http.StatusOK, unlink().Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown identity", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(passwordSQL).WithArgs("test-user-id").WillReturnRows(pgxmock.NewRows([]string{"password_hash"}).AddRow("hash"))
+		mockDB.ExpectQuery(deleteSQL).WithArgs("identity-id", "test-user-id").WillReturnRows(pgxmock.NewRows([]string{"issuer", "email"}))
+		mockDB.ExpectRollback()
+
+		assert.Equal(t, http.StatusNotFound, unlink().Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+// error of a violated unique constraint as Postgres words it
+type duplicateKeyError struct{ constraint string }
+
+func (e *duplicateKeyError) Error() string {
+	return `ERROR: duplicate key value violates unique constraint "` + e.constraint + `" (SQLSTATE 23505)`
+}
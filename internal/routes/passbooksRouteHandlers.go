@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/locale"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
 	"github.com/akashsharma99/passbook-app/internal/types"
 	"github.com/akashsharma99/passbook-app/internal/utils"
 	"github.com/gin-gonic/gin"
@@ -16,9 +18,13 @@ import (
 func CreatePassbook(ctx *gin.Context) {
 	loggedInUserID := ctx.MustGet("userId").(string)
 	log.Println("Creating Passbook for user_id:", loggedInUserID)
+	if middlewares.IsPassbookRestricted(ctx) {
+		setErrorResponse(ctx, 403, "Token is restricted to existing passbooks")
+		return
+	}
 	var passbook types.Passbook
 	if err := ctx.ShouldBindJSON(&passbook); err != nil {
-		setErrorResponse(ctx, 400, "Invalid request body")
+		setErrorResponse(ctx, 400, invalidBodyMessage(err))
 		return
 	}
 	// input sanitization
@@ -28,6 +34,16 @@ func CreatePassbook(ctx *gin.Context) {
 		setErrorResponse(ctx, 400, err.Error())
 		return
 	}
+	// passbooks without a currency are in the base currency of the user
+	if passbook.Currency == "" {
+		prefs, err := getUserPreferences(loggedInUserID)
+		if err != nil {
+			log.Println("Failed to get preferences of user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to create passbook")
+			return
+		}
+		passbook.Currency = prefs.Currency
+	}
 	// check if the passbook already exists for the user
 	var existingId string
 	err = initializers.DB.QueryRow(context.Background(), "SELECT passbook_id FROM passbook_app.passbooks WHERE user_id=$1 AND bank_name=$2 AND account_number=$3", loggedInUserID, passbook.BankName, passbook.AccountNumber).Scan(&existingId)
@@ -55,11 +71,12 @@ func CreatePassbook(ctx *gin.Context) {
 		AccountNumber: passbook.AccountNumber,
 		TotalBalance:  passbook.TotalBalance,
 		Nickname:      passbook.Nickname,
+		Currency:      passbook.Currency,
 		CreatedAt:     time.Now().UTC(),
 		UpdatedAt:     time.Now().UTC(),
 	}
-	_, err2 := initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.passbooks (passbook_id, user_id, bank_name, account_number, total_balance, nickname, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-		pbook.PassbookID, pbook.UserID, pbook.BankName, pbook.AccountNumber, pbook.TotalBalance, pbook.Nickname, pbook.CreatedAt, pbook.UpdatedAt)
+	_, err2 := initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.passbooks (passbook_id, user_id, bank_name, account_number, total_balance, nickname, currency, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		pbook.PassbookID, pbook.UserID, pbook.BankName, pbook.AccountNumber, pbook.TotalBalance, pbook.Nickname, pbook.Currency, pbook.CreatedAt, pbook.UpdatedAt)
 	if err2 != nil {
 		log.Println(err2)
 		log.Println("Failed to create passbook for user_id:", loggedInUserID)
@@ -88,25 +105,28 @@ func sanitizePassbookRequest(pb *types.Passbook) error {
 	if (*pb).AccountNumber == "" || len((*pb).AccountNumber) > 255 {
 		return errors.New("invalid account number")
 	}
-	// total balance should fit in DECIMAL(11,2)
-	if (*pb).TotalBalance < 0 || (*pb).TotalBalance > 999999999.99 {
+	// total balance should fit in DECIMAL(11,2), over precise amounts are already rejected while binding the request
+	if (*pb).TotalBalance < 0 || (*pb).TotalBalance > types.MaxMoney {
 		return errors.New("invalid total balance")
 	}
-	// truncate total balance to 2 decimal places if more than 2 decimal digits
-	(*pb).TotalBalance = float64(int((*pb).TotalBalance*100)) / 100
 
 	// nickname validations
 	(*pb).Nickname = utils.TrimAndSanitizeStrict((*pb).Nickname)
 	if (*pb).Nickname == "" || len((*pb).Nickname) > 255 {
 		return errors.New("invalid nickname")
 	}
+	// currency is optional, it defaults to the base currency of the user
+	(*pb).Currency = normalizeCurrency((*pb).Currency)
+	if (*pb).Currency != "" && !locale.IsCurrency((*pb).Currency) {
+		return locale.ErrInvalidCurrency
+	}
 	return nil
 }
 
 func GetPassbooks(ctx *gin.Context) {
 	loggedInUserID := ctx.MustGet("userId").(string)
 	log.Println("Getting Passbooks for user_id:", loggedInUserID)
-	rows, err := initializers.DB.Query(context.Background(), "SELECT passbook_id, user_id, bank_name, account_number, total_balance, nickname, created_at, updated_at FROM passbook_app.passbooks WHERE user_id=$1", loggedInUserID)
+	rows, err := initializers.DB.Query(context.Background(), "SELECT passbook_id, user_id, bank_name, account_number, total_balance, nickname, currency, created_at, updated_at FROM passbook_app.passbooks WHERE user_id=$1", loggedInUserID)
 	if err != nil {
 		log.Println("Failed to get passbooks for user_id:", loggedInUserID)
 		setErrorResponse(ctx, 500, "Failed to get passbooks")
@@ -116,12 +136,16 @@ func GetPassbooks(ctx *gin.Context) {
 	passbooks := make([]types.Passbook, 0)
 	for rows.Next() {
 		var p types.Passbook
-		err := rows.Scan(&p.PassbookID, &p.UserID, &p.BankName, &p.AccountNumber, &p.TotalBalance, &p.Nickname, &p.CreatedAt, &p.UpdatedAt)
+		err := rows.Scan(&p.PassbookID, &p.UserID, &p.BankName, &p.AccountNumber, &p.TotalBalance, &p.Nickname, &p.Currency, &p.CreatedAt, &p.UpdatedAt)
 		if err != nil {
 			log.Println("Failed to get passbooks for user_id:", loggedInUserID)
 			setErrorResponse(ctx, 500, "Failed to get passbooks")
 			return
 		}
+		// access tokens restricted to some passbooks only list those
+		if !middlewares.CanAccessPassbook(ctx, p.PassbookID) {
+			continue
+		}
 		passbooks = append(passbooks, p)
 	}
 	log.Println("Passbooks fetched for user_id:", loggedInUserID)
@@ -137,9 +161,9 @@ func GetPassbook(ctx *gin.Context) {
 	loggedInUserID := ctx.MustGet("userId").(string)
 	passbookID := ctx.Param("passbook_id")
 	log.Println("Getting Passbook for user_id:", loggedInUserID, "passbook_id:", passbookID)
-	row := initializers.DB.QueryRow(context.Background(), "SELECT passbook_id, user_id, bank_name, account_number, total_balance, nickname, created_at, updated_at FROM passbook_app.passbooks WHERE user_id=$1 AND passbook_id=$2", loggedInUserID, passbookID)
+	row := initializers.DB.QueryRow(context.Background(), "SELECT passbook_id, user_id, bank_name, account_number, total_balance, nickname, currency, created_at, updated_at FROM passbook_app.passbooks WHERE user_id=$1 AND passbook_id=$2", loggedInUserID, passbookID)
 	var p types.Passbook
-	err := row.Scan(&p.PassbookID, &p.UserID, &p.BankName, &p.AccountNumber, &p.TotalBalance, &p.Nickname, &p.CreatedAt, &p.UpdatedAt)
+	err := row.Scan(&p.PassbookID, &p.UserID, &p.BankName, &p.AccountNumber, &p.TotalBalance, &p.Nickname, &p.Currency, &p.CreatedAt, &p.UpdatedAt)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			log.Println("Passbook not found for user_id:", loggedInUserID, "passbook_id:", passbookID)
@@ -164,7 +188,7 @@ func UpdatePassbook(ctx *gin.Context) {
 	log.Println("Updating Passbook for user_id:", loggedInUserID, "passbook_id:", passbookID)
 	var passbook types.Passbook
 	if err := ctx.ShouldBindJSON(&passbook); err != nil {
-		setErrorResponse(ctx, 400, "Invalid request body")
+		setErrorResponse(ctx, 400, invalidBodyMessage(err))
 		return
 	}
 	// if user tries to update some other users passbook return 400
@@ -185,8 +209,8 @@ func UpdatePassbook(ctx *gin.Context) {
 		return
 	}
 	// check if the passbook exists for the user
-	var existingId string
-	err = initializers.DB.QueryRow(context.Background(), "SELECT passbook_id FROM passbook_app.passbooks WHERE user_id=$1 AND passbook_id=$2", loggedInUserID, passbookID).Scan(&existingId)
+	var existingId, currency string
+	err = initializers.DB.QueryRow(context.Background(), "SELECT passbook_id, currency FROM passbook_app.passbooks WHERE user_id=$1 AND passbook_id=$2", loggedInUserID, passbookID).Scan(&existingId, &currency)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			log.Println("Passbook not found for user_id:", loggedInUserID, "passbook_id:", passbookID)
@@ -197,6 +221,12 @@ func UpdatePassbook(ctx *gin.Context) {
 		setErrorResponse(ctx, 500, "Failed to update passbook")
 		return
 	}
+	// the amounts of existing transactions would silently change their meaning
+	if passbook.Currency != "" && passbook.Currency != currency {
+		setErrorResponse(ctx, 400, "Currency of a passbook cannot be changed")
+		return
+	}
+	passbook.Currency = currency
 	passbook.UpdatedAt = time.Now().UTC()
 	// passbook exists, update the passbook
 	_, err2 := initializers.DB.Exec(context.Background(), "UPDATE passbook_app.passbooks SET bank_name=$1, account_number=$2, total_balance=$3, nickname=$4, updated_at=$5 WHERE user_id=$6 AND passbook_id=$7",
@@ -222,19 +252,78 @@ func DeletePassbook(ctx *gin.Context) {
 	loggedInUserID := ctx.MustGet("userId").(string)
 	passbookID := ctx.Param("passbook_id")
 	log.Println("Reqeust to delete passbook with id : ", passbookID)
-	_, err := initializers.DB.Exec(context.Background(), "DELETE passbook_app.passbooks where user_id=$1 and passbook_id=$2", loggedInUserID, passbookID)
+	deleted, err := deletePassbookAndTrxs(initializers.DB, loggedInUserID, passbookID)
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if errors.Is(err, errPassbookNotFound) {
 			log.Println("Passbook not found for user_id:", loggedInUserID, "passbook_id:", passbookID)
 			setErrorResponse(ctx, 404, "Passbook not found")
 			return
 		}
+		log.Println(err)
 		log.Println("Failed to delete passbook for user_id:", loggedInUserID, "passbook_id:", passbookID)
 		setErrorResponse(ctx, 500, "Failed to delete passbook")
 		return
 	}
+	log.Println("Passbook deleted for user_id:", loggedInUserID, "passbook_id:", passbookID, "deleted rows:", deleted)
 	ctx.JSON(200, gin.H{
 		"status":  "success",
 		"message": "Passbook deleted successfully",
+		"data": map[string]interface{}{
+			"deleted": deleted,
+		},
 	})
 }
+
+/*
+Lock the passbook and delete it along with every row referencing it (including trashed transactions) in a single
+transaction so a passbook is never left half deleted. Returns the number of deleted rows keyed by entity.
+*/
+func deletePassbookAndTrxs(conn initializers.PgxPoolIface, userID string, passbookID string) (map[string]int64, error) {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	var existingId string
+	err = tx.QueryRow(context.Background(), "SELECT passbook_id FROM passbook_app.passbooks WHERE user_id=$1 AND passbook_id=$2 FOR UPDATE", userID, passbookID).Scan(&existingId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errPassbookNotFound
+		}
+		return nil, err
+	}
+	// legs of transfers in other passbooks stay as regular transactions since that money did move
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.transactions SET transfer_id=NULL WHERE passbook_id<>$1 AND transfer_id IN (SELECT transfer_id FROM passbook_app.transactions WHERE passbook_id=$1 AND transfer_id IS NOT NULL)", passbookID)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make(map[string]int64)
+	ctag, err := tx.Exec(context.Background(), "DELETE FROM passbook_app.transactions WHERE passbook_id=$1", passbookID)
+	if err != nil {
+		return nil, err
+	}
+	deleted["transactions"] = ctag.RowsAffected()
+	_, err = tx.Exec(context.Background(), "DELETE FROM passbook_app.purged_imports WHERE passbook_id=$1", passbookID)
+	if err != nil {
+		return nil, err
+	}
+	// access tokens restricted to the passbook lose it, a token left without any passbook is revoked
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.personal_access_tokens SET passbook_ids = array_remove(passbook_ids, $1::uuid) WHERE user_id=$2 AND $1::uuid = ANY(passbook_ids)", passbookID, userID)
+	if err != nil {
+		return nil, err
+	}
+	ctag, err = tx.Exec(context.Background(), "DELETE FROM passbook_app.personal_access_tokens WHERE user_id=$1 AND passbook_ids = '{}'", userID)
+	if err != nil {
+		return nil, err
+	}
+	deleted["access_tokens"] = ctag.RowsAffected()
+	ctag, err = tx.Exec(context.Background(), "DELETE FROM passbook_app.passbooks WHERE user_id=$1 AND passbook_id=$2", userID, passbookID)
+	if err != nil {
+		return nil, err
+	}
+	if ctag.RowsAffected() == 0 {
+		return nil, errPassbookNotFound
+	}
+	deleted["passbooks"] = ctag.RowsAffected()
+	return deleted, tx.Commit(context.Background())
+}
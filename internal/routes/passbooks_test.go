@@ -0,0 +1,223 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeletePassbook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	testUserID := "test-user-id"
+	testPassbookID := "test-passbook-id"
+
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	v1 := router.Group("/v1")
+	passbooks := v1.Group("/passbooks", authTestMiddleware())
+	{
+		passbooks.DELETE("/:passbook_id", DeletePassbook)
+	}
+	reqURL := fmt.Sprintf("/v1/passbooks/%s", testPassbookID)
+	lockSQL := `^SELECT passbook_id FROM passbook_app.passbooks WHERE user_id=\$1 AND passbook_id=\$2 FOR UPDATE$`
+
+	t.Run("Passbook and its transactions are deleted and detached from access tokens", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs(testUserID, testPassbookID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id"}).AddRow(testPassbookID))
+		mockDB.ExpectExec(`^UPDATE passbook_app.transactions SET transfer_id=NULL WHERE passbook_id<>\$1`).
+			WithArgs(testPassbookID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.transactions WHERE passbook_id=\$1$`).
+			WithArgs(testPassbookID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 3))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.purged_imports WHERE passbook_id=\$1$`).
+			WithArgs(testPassbookID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		mockDB.ExpectExec(`^UPDATE passbook_app.personal_access_tokens SET passbook_ids = array_remove\(passbook_ids, \$1::uuid\) WHERE user_id=\$2 AND \$1::uuid = ANY\(passbook_ids\)$`).
+			WithArgs(testPassbookID, testUserID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 2))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.personal_access_tokens WHERE user_id=\$1 AND passbook_ids = '\{\}'$`).
+			WithArgs(testUserID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.passbooks WHERE user_id=\$1 AND passbook_id=\$2$`).
+			WithArgs(testUserID, testPassbookID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", reqURL, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var responseBody map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+		deleted := responseBody["data"].(map[string]interface{})["deleted"].(map[string]interface{})
+		assert.Equal(t, float64(3), deleted["transactions"])
+		assert.Equal(t, float64(1), deleted["passbooks"])
+		assert.Equal(t, float64(1), deleted["access_tokens"])
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	t.Run("Passbook not found", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs(testUserID, testPassbookID).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", reqURL, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+}
+
+func TestCreatePassbook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/passbooks", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, CreatePassbook)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/passbooks", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	existsSQL := `^SELECT passbook_id FROM passbook_app.passbooks WHERE user_id=\$1 AND bank_name=\$2 AND account_number=\$3$`
+	insertSQL := `^INSERT INTO passbook_app.passbooks \(passbook_id, user_id, bank_name, account_number, total_balance, nickname, currency, created_at, updated_at\)`
+
+	t.Run("Passbook is in the base currency of the user by default", func(t *testing.T) {
+		expectPreferences(mockDB, "test-user-id", types.Preferences{Currency: "EUR", TimeZone: "UTC", Locale: "de-DE", DateFormat: "DD.MM.YYYY"})
+		mockDB.ExpectQuery(existsSQL).
+			WithArgs("test-user-id", "Test Bank", "1234").
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectExec(insertSQL).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", "Test Bank", "1234", types.Money(10000), "Savings", "EUR", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := post(`{"bank_name": "Test Bank", "account_number": "1234", "total_balance": 100, "nickname": "Savings"}`)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Contains(t, w.Body.String(), `"currency":"EUR"`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Given currency", func(t *testing.T) {
+		mockDB.ExpectQuery(existsSQL).
+			WithArgs("test-user-id", "Test Bank", "5678").
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectExec(insertSQL).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", "Test Bank", "5678", types.Money(10000), "Dollars", "USD", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := post(`{"bank_name": "Test Bank", "account_number": "5678", "total_balance": 100, "nickname": "Dollars", "currency": "usd"}`)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid currency", func(t *testing.T) {
+		w := post(`{"bank_name": "Test Bank", "account_number": "5678", "total_balance": 100, "nickname": "Dollars", "currency": "dollar"}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid currency")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestUpdatePassbookCurrency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.PATCH("/v1/passbooks/:passbook_id", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, UpdatePassbook)
+	patch := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", "/v1/passbooks/test-passbook-id", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	existsSQL := `^SELECT passbook_id, currency FROM passbook_app.passbooks WHERE user_id=\$1 AND passbook_id=\$2$`
+
+	t.Run("Currency is kept when left out", func(t *testing.T) {
+		mockDB.ExpectQuery(existsSQL).
+			WithArgs("test-user-id", "test-passbook-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "currency"}).AddRow("test-passbook-id", "USD"))
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET bank_name=\$1`).
+			WithArgs("Test Bank", "1234", types.Money(10000), "Savings", pgxmock.AnyArg(), "test-user-id", "test-passbook-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+		w := patch(`{"user_id": "test-user-id", "bank_name": "Test Bank", "account_number": "1234", "total_balance": 100, "nickname": "Savings"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"currency":"USD"`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Currency cannot be changed", func(t *testing.T) {
+		mockDB.ExpectQuery(existsSQL).
+			WithArgs("test-user-id", "test-passbook-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "currency"}).AddRow("test-passbook-id", "USD"))
+
+		w := patch(`{"user_id": "test-user-id", "bank_name": "Test Bank", "account_number": "1234", "total_balance": 100, "nickname": "Savings", "currency": "EUR"}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Currency of a passbook cannot be changed")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
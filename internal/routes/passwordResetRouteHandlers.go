@@ -0,0 +1,197 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/mailer"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetTokenLifetime = time.Hour
+	// minimum time between two password reset emails of a user
+	passwordResetResendInterval = time.Minute
+)
+
+const securityEventPasswordReset = "password_reset"
+
+var errInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// same response whether an account has the email or not, so the endpoint cannot be used to find registered emails
+const passwordResetRequestedMessage = "If an account with this email exists, a password reset link has been sent to it"
+
+type passwordResetReq struct {
+	Email string `json:"email"`
+}
+
+type passwordResetConfirmReq struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+/*
+Route handler for requesting a password reset link. A new single use token replaces any earlier unused one of the
+user and is emailed as a link to the web app, only the hash of the token is stored. At most one link is sent per
+minute. A link that is not sent, because one was sent recently or the email could not be delivered, gets the same
+response so the endpoint does not tell whether an account has the email.
+*/
+func RequestPasswordReset(ctx *gin.Context) {
+	var req passwordResetReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		setErrorResponse(ctx, 400, "Invalid request body")
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if email == "" {
+		setErrorResponse(ctx, 400, "Please provide the email of the account.")
+		return
+	}
+	var userID, username string
+	err := initializers.DB.QueryRow(context.Background(), "SELECT user_id, username FROM passbook_app.users WHERE email=$1", email).Scan(&userID, &username)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Println("Failed to find user for password reset", err)
+		setErrorResponse(ctx, 500, "Failed to request password reset. Try again later!")
+		return
+	}
+	if err == nil {
+		sent, err := sendPasswordResetLink(userID, username, email)
+		if err != nil {
+			log.Println("Failed to send password reset link to user_id:", userID, err)
+		} else if !sent {
+			log.Println("Password reset link was sent recently to user_id:", userID)
+		}
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": passwordResetRequestedMessage,
+	})
+}
+
+// email a password reset link to the user, returns false without sending one when a link was sent in the last minute
+func sendPasswordResetLink(userID string, username string, email string) (bool, error) {
+	var lastSentAt time.Time
+	err := initializers.DB.QueryRow(context.Background(), "SELECT created_at FROM passbook_app.password_resets WHERE user_id=$1 ORDER BY created_at DESC LIMIT 1", userID).Scan(&lastSentAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, err
+	}
+	if err == nil && time.Since(lastSentAt) < passwordResetResendInterval {
+		return false, nil
+	}
+	token, err := utils.GenerateSecureToken()
+	if err != nil {
+		return false, err
+	}
+	time_now := time.Now().UTC()
+	_, err = initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.password_resets WHERE user_id=$1", userID)
+	if err != nil {
+		return false, err
+	}
+	_, err = initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.password_resets (token_hash, user_id, expires_at, created_at) VALUES ($1, $2, $3, $4)",
+		utils.HashToken(token), userID, time_now.Add(passwordResetTokenLifetime), time_now)
+	if err != nil {
+		return false, err
+	}
+	link := strings.TrimRight(os.Getenv("APP_BASE_URL"), "/") + "/reset-password?token=" + url.QueryEscape(token)
+	return true, initializers.Mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Reset your Passbook password",
+		Body: fmt.Sprintf("Hi %s,\n\nWe received a request to reset the password of your Passbook account. "+
+			"Open the link below within %d minutes to choose a new password:\n\n%s\n\n"+
+			"If you did not request a password reset you can ignore this email, your password stays the same.\n",
+			username, int(passwordResetTokenLifetime.Minutes()), link),
+	})
+}
+
+/*
+Route handler for setting a new password with the token of a password reset link. The token can be used only once
+and every session of the user is revoked, so devices logged in with the old password have to log in again.
+*/
+func ConfirmPasswordReset(ctx *gin.Context) {
+	var req passwordResetConfirmReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		setErrorResponse(ctx, 400, "Invalid request body")
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		setErrorResponse(ctx, 400, "Please provide the reset token and the new password.")
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			setErrorResponse(ctx, 400, "Password too long. Please provide a password with less than 72 characters")
+			return
+		}
+		setErrorResponse(ctx, 500, "Failed to reset password. Try again later!")
+		return
+	}
+	err = resetPassword(ctx, initializers.DB, req.Token, string(hashedPassword))
+	if errors.Is(err, errInvalidResetToken) {
+		setErrorResponse(ctx, 400, "Invalid or expired password reset token")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to reset password", err)
+		setErrorResponse(ctx, 500, "Failed to reset password. Try again later!")
+		return
+	}
+	clearRefreshTokenCookie(ctx)
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Password reset successfully. Please log in with the new password",
+	})
+}
+
+// use up the reset token, set the new password hash of its user and revoke all sessions and personal access tokens of the user
+func resetPassword(ctx *gin.Context, conn initializers.PgxPoolIface, token string, passwordHash string) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	time_now := time.Now().UTC()
+	var userID string
+	err = tx.QueryRow(context.Background(), "UPDATE passbook_app.password_resets SET used_at=$1 WHERE token_hash=$2 AND used_at IS NULL AND expires_at > $1 RETURNING user_id",
+		time_now, utils.HashToken(token)).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.users SET password_hash=$1, updated_at=$2 WHERE user_id=$3", passwordHash, time_now, userID)
+	if err != nil {
+		return err
+	}
+	ctag, err := tx.Exec(context.Background(), "DELETE FROM passbook_app.sessions WHERE user_id=$1", userID)
+	if err != nil {
+		return err
+	}
+	// whoever reset the password of a taken over account must not keep access through a token created by the attacker
+	tokensTag, err := tx.Exec(context.Background(), "DELETE FROM passbook_app.personal_access_tokens WHERE user_id=$1", userID)
+	if err != nil {
+		return err
+	}
+	err = recordSecurityEvent(tx, ctx, userID, securityEventPasswordReset, "", fmt.Sprintf("The password was reset with an emailed link, %d sessions and %d access tokens were revoked", ctag.RowsAffected(), tokensTag.RowsAffected()))
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// delete the password reset tokens which are used up or expired
+func purgeExpiredPasswordResets(conn initializers.PgxPoolIface) error {
+	_, err := conn.Exec(context.Background(), "DELETE FROM passbook_app.password_resets WHERE expires_at < $1 OR used_at IS NOT NULL", time.Now().UTC())
+	return err
+}
@@ -0,0 +1,248 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/mailer"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// the emails written by a LogSender into dir
+func sentMails(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatalf("Failed to list mails: %v", err)
+	}
+	mails := make([]string, 0, len(files))
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("Failed to read mail: %v", err)
+		}
+		mails = append(mails, string(content))
+	}
+	return mails
+}
+
+// pgxmock argument matching any string and keeping the value for later checks
+type captureArg struct{ value string }
+
+func (c *captureArg) Match(v any) bool {
+	s, ok := v.(string)
+	c.value = s
+	return ok
+}
+
+// mail sender whose server is down
+type failingSender struct{}
+
+func (failingSender) Send(mailer.Message) error {
+	return errors.New("connection refused")
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("APP_BASE_URL", "https://passbook.example.com/")
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	mailDir := t.TempDir()
+	originalMailer := initializers.Mailer
+	initializers.Mailer = &mailer.LogSender{Dir: mailDir, From: "no-reply@example.com"}
+	defer func() { initializers.Mailer = originalMailer }()
+
+	router := gin.New()
+	router.POST("/v1/auth/password-reset", RequestPasswordReset)
+	userSQL := `^SELECT user_id, username FROM passbook_app.users WHERE email=\$1$`
+	lastSentSQL := `^SELECT created_at FROM passbook_app.password_resets WHERE user_id=\$1 ORDER BY created_at DESC LIMIT 1$`
+	expectUser := func() {
+		mockDB.ExpectQuery(userSQL).
+			WithArgs("jane@example.com").
+			WillReturnRows(pgxmock.NewRows([]string{"user_id", "username"}).AddRow("test-user-id", "jane"))
+	}
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/password-reset", strings.NewReader(`{"email":" jane@example.com "}`))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Reset link is emailed", func(t *testing.T) {
+		tokenHash := &captureArg{}
+		expectUser()
+		mockDB.ExpectQuery(lastSentSQL).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"created_at"}).AddRow(time.Now().Add(-2 * time.Minute)))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.password_resets WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.password_resets \(token_hash, user_id, expires_at, created_at\)`).
+			WithArgs(tokenHash, "test-user-id", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := request()
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+		mails := sentMails(t, mailDir)
+		assert.Len(t, mails, 1)
+		assert.Contains(t, mails[0], "To: jane@example.com")
+		link := regexp.MustCompile(`https://passbook\.example\.com/reset-password\?token=(\S+)`).FindStringSubmatch(mails[0])
+		if assert.Len(t, link, 2) {
+			token, err := url.QueryUnescape(link[1])
+			assert.NoError(t, err)
+			// only the hash of the emailed token is stored
+			assert.Equal(t, utils.HashToken(token), tokenHash.value)
+		}
+	})
+
+	t.Run("Unknown email gets the same response", func(t *testing.T) {
+		mockDB.ExpectQuery(userSQL).
+			WithArgs("nobody@example.com").
+			WillReturnError(pgx.ErrNoRows)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/password-reset", strings.NewReader(`{"email":"nobody@example.com"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), passwordResetRequestedMessage)
+		assert.Len(t, sentMails(t, mailDir), 1)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("No second link within a minute", func(t *testing.T) {
+		expectUser()
+		mockDB.ExpectQuery(lastSentSQL).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"created_at"}).AddRow(time.Now().Add(-10 * time.Second)))
+
+		w := request()
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), passwordResetRequestedMessage)
+		assert.Len(t, sentMails(t, mailDir), 1)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Failure to send the email gets the same response", func(t *testing.T) {
+		initializers.Mailer = failingSender{}
+		defer func() { initializers.Mailer = &mailer.LogSender{Dir: mailDir, From: "no-reply@example.com"} }()
+		expectUser()
+		mockDB.ExpectQuery(lastSentSQL).
+			WithArgs("test-user-id").
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.password_resets WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.password_resets`).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := request()
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), passwordResetRequestedMessage)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Missing email", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/password-reset", strings.NewReader(`{}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestConfirmPasswordReset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/auth/password-reset/confirm", ConfirmPasswordReset)
+	useTokenSQL := `^UPDATE passbook_app.password_resets SET used_at=\$1 WHERE token_hash=\$2 AND used_at IS NULL AND expires_at > \$1 RETURNING user_id$`
+
+	t.Run("Password is reset and sessions and access tokens are revoked", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(useTokenSQL).
+			WithArgs(pgxmock.AnyArg(), utils.HashToken("reset-token")).
+			WillReturnRows(pgxmock.NewRows([]string{"user_id"}).AddRow("test-user-id"))
+		mockDB.ExpectExec(`^UPDATE passbook_app.users SET password_hash=\$1, updated_at=\$2 WHERE user_id=\$3$`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), "test-user-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.sessions WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnResult(pgxmock.NewResult("DELETE", 2))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.personal_access_tokens WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", "password_reset", (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), "The password was reset with an emailed link, 2 sessions and 1 access tokens were revoked", pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/password-reset/confirm", strings.NewReader(`{"token":"reset-token","password":"new-secret"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, isRefreshCookieCleared(w))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Used or expired token is rejected", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(useTokenSQL).
+			WithArgs(pgxmock.AnyArg(), utils.HashToken("reset-token")).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/password-reset/confirm", strings.NewReader(`{"token":"reset-token","password":"new-secret"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Missing password", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/auth/password-reset/confirm", strings.NewReader(`{"token":"reset-token"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
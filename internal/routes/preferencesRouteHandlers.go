@@ -0,0 +1,118 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/locale"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+type updatePreferencesReq struct {
+	Currency   *string `json:"currency"`
+	TimeZone   *string `json:"time_zone"`
+	Locale     *string `json:"locale"`
+	DateFormat *string `json:"date_format"`
+}
+
+// preferences of the user, the defaults when the user never changed them
+func getUserPreferences(userID string) (types.Preferences, error) {
+	rows, err := initializers.DB.Query(context.Background(), "SELECT currency, time_zone, locale, date_format FROM passbook_app.user_preferences WHERE user_id=$1", userID)
+	if err != nil {
+		return types.Preferences{}, err
+	}
+	prefs, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[types.Preferences])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return locale.Default, nil
+	}
+	return prefs, err
+}
+
+// format applying the preferences of the user to listings, statements and exports
+func userFormat(userID string) (locale.Format, error) {
+	prefs, err := getUserPreferences(userID)
+	if err != nil {
+		return locale.Format{}, err
+	}
+	format, err := locale.New(prefs)
+	if err != nil {
+		// stored preferences were valid when they were saved, a time zone can still be dropped from the tz database
+		log.Println("Invalid preferences of user_id:", userID, err)
+		return locale.New(locale.Default)
+	}
+	return format, nil
+}
+
+// route handler for getting the preferences of the logged in user
+func GetPreferences(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	prefs, err := getUserPreferences(loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get preferences of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get preferences")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Preferences fetched successfully",
+		"data": map[string]types.Preferences{
+			"preferences": prefs,
+		},
+	})
+}
+
+// route handler for changing the preferences of the logged in user, fields left out keep their current value
+func UpdatePreferences(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req updatePreferencesReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		setErrorResponse(ctx, 400, "Invalid request body")
+		return
+	}
+	if req.Currency == nil && req.TimeZone == nil && req.Locale == nil && req.DateFormat == nil {
+		setErrorResponse(ctx, 400, "Please provide currency, time_zone, locale or date_format to update.")
+		return
+	}
+	prefs, err := getUserPreferences(loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get preferences of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to update preferences")
+		return
+	}
+	if req.Currency != nil {
+		prefs.Currency = strings.ToUpper(strings.TrimSpace(*req.Currency))
+	}
+	if req.TimeZone != nil {
+		prefs.TimeZone = strings.TrimSpace(*req.TimeZone)
+	}
+	if req.Locale != nil {
+		prefs.Locale = strings.TrimSpace(*req.Locale)
+	}
+	if req.DateFormat != nil {
+		prefs.DateFormat = strings.TrimSpace(*req.DateFormat)
+	}
+	if _, err := locale.New(prefs); err != nil {
+		setErrorResponse(ctx, 400, err.Error())
+		return
+	}
+	_, err = initializers.DB.Exec(context.Background(), "INSERT INTO passbook_app.user_preferences (user_id, currency, time_zone, locale, date_format, updated_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (user_id) DO UPDATE SET currency=EXCLUDED.currency, time_zone=EXCLUDED.time_zone, locale=EXCLUDED.locale, date_format=EXCLUDED.date_format, updated_at=EXCLUDED.updated_at",
+		loggedInUserID, prefs.Currency, prefs.TimeZone, prefs.Locale, prefs.DateFormat, time.Now().UTC())
+	if err != nil {
+		log.Println("Failed to update preferences of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to update preferences")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Preferences updated successfully",
+		"data": map[string]types.Preferences{
+			"preferences": prefs,
+		},
+	})
+}
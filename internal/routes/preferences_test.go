@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// expect the lookup of the preferences of a user, who never set any unless they are given
+func expectPreferences(mockDB pgxmock.PgxPoolIface, userID string, prefs ...types.Preferences) {
+	rows := pgxmock.NewRows([]string{"currency", "time_zone", "locale", "date_format"})
+	for _, p := range prefs {
+		rows.AddRow(p.Currency, p.TimeZone, p.Locale, p.DateFormat)
+	}
+	mockDB.ExpectQuery(`^SELECT currency, time_zone, locale, date_format FROM passbook_app.user_preferences WHERE user_id=\$1$`).
+		WithArgs(userID).
+		WillReturnRows(rows)
+}
+
+// matches a time arg at the same instant, whatever its time zone
+type sameInstant struct{ t time.Time }
+
+func (s sameInstant) Match(v any) bool {
+	t, ok := v.(time.Time)
+	return ok && t.Equal(s.t)
+}
+
+func TestGetPreferences(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.GET("/v1/users/me/preferences", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, GetPreferences)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/users/me/preferences", nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Defaults of a user without preferences", func(t *testing.T) {
+		expectPreferences(mockDB, "test-user-id")
+
+		w := get()
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"preferences":{"currency":"INR","time_zone":"UTC","locale":"en-US","date_format":"DD MMM YYYY"}`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Stored preferences", func(t *testing.T) {
+		expectPreferences(mockDB, "test-user-id", types.Preferences{Currency: "EUR", TimeZone: "Europe/Berlin", Locale: "de-DE", DateFormat: "DD.MM.YYYY"})
+
+		w := get()
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"time_zone":"Europe/Berlin"`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestUpdatePreferences(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.PATCH("/v1/users/me/preferences", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, UpdatePreferences)
+	patch := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", "/v1/users/me/preferences", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Given fields are changed", func(t *testing.T) {
+		expectPreferences(mockDB, "test-user-id")
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.user_preferences \(user_id, currency, time_zone, locale, date_format, updated_at\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\) ON CONFLICT \(user_id\) DO UPDATE SET .*$`).
+			WithArgs("test-user-id", "INR", "Asia/Kolkata", "en-IN", "DD MMM YYYY", pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := patch(`{"time_zone":"Asia/Kolkata","locale":"en-IN"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"time_zone":"Asia/Kolkata"`)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid values", func(t *testing.T) {
+		for body, message := range map[string]string{
+			`{"currency":"rupees"}`:         "invalid currency",
+			`{"time_zone":"Asia/Atlantis"}`: "unknown time zone",
+			`{"locale":"tlh"}`:              "unsupported locale",
+			`{"date_format":"YYYYMMDD"}`:    "unsupported date format",
+		} {
+			expectPreferences(mockDB, "test-user-id")
+			w := patch(body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), message)
+		}
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("No field given", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, patch(`{}`).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
@@ -1,12 +1,61 @@
 package routes
 
 import (
+	"log"
 	"os"
+	"strings"
 
 	"github.com/akashsharma99/passbook-app/internal/middlewares"
 	"github.com/gin-gonic/gin"
 )
 
+// sensitive routes, by method and full path, which need a verified email while REQUIRE_VERIFIED_EMAIL=true
+var verifiedEmailRoutes = []string{
+	"POST /v1/users/me/tokens",
+	"POST /v1/users/me/password",
+	"DELETE /v1/users/me",
+	"GET /v1/users/me/export",
+	"POST /v1/passbooks",
+	"PATCH /v1/passbooks/:passbook_id",
+	"DELETE /v1/passbooks/:passbook_id",
+	"POST /v1/passbooks/:passbook_id/imports/csv",
+	"GET /v1/passbooks/:passbook_id/export",
+	"GET /v1/passbooks/:passbook_id/statements/:month",
+	"POST /v1/passbooks/:passbook_id/transactions",
+	"PATCH /v1/passbooks/:passbook_id/transactions/:transaction_id",
+	"DELETE /v1/passbooks/:passbook_id/transactions/:transaction_id",
+	"POST /v1/passbooks/:passbook_id/transactions/:transaction_id/restore",
+	"POST /v1/exchange-rates",
+	"POST /v1/exchange-rates/import",
+	"DELETE /v1/exchange-rates/:rate_id",
+	"POST /v1/import-profiles",
+	"DELETE /v1/import-profiles/:profile_id",
+	"POST /v1/imports/ofx",
+	"POST /v1/imports/camt053",
+	"POST /v1/imports/mt940",
+	"GET /v1/transactions/export",
+	"POST /v1/transfers",
+}
+
+/*
+The client IP limits failed logins and is stored with sessions and security events, so the X-Forwarded-For and
+X-Real-IP headers are only trusted from the proxies in TRUSTED_PROXIES, a comma separated list of IP addresses and CIDR
+ranges. Without it the address of the connection is used. TRUSTED_PLATFORM names the header a platform in front of the
+app puts the client IP in, like CF-Connecting-IP on Cloudflare.
+*/
+func configureTrustedProxies(router *gin.Engine) {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		log.Fatal("TRUSTED_PROXIES must be a comma separated list of IP addresses or CIDR ranges ", err)
+	}
+	router.TrustedPlatform = os.Getenv("TRUSTED_PLATFORM")
+}
+
 // TODO: Refer to this guide for adding input validations https://blog.logrocket.com/gin-binding-in-go-a-tutorial-with-examples/
 // create a router using gin and return it
 func NewRouter() *gin.Engine {
@@ -15,6 +64,10 @@ func NewRouter() *gin.Engine {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	router := gin.Default()
+	configureTrustedProxies(router)
+	router.Use(middlewares.VerifiedEmailRoutes(verifiedEmailRoutes...))
+	// public keys of the tokens for other services verifying them
+	router.GET("/.well-known/jwks.json", GetJWKS)
 	// add routes for v1 of api
 	v1 := router.Group("/v1")
 	{
@@ -28,32 +81,100 @@ func NewRouter() *gin.Engine {
 		auth := v1.Group("/auth")
 		{
 			auth.POST("/login", LoginUser)
+			auth.POST("/login/mfa", LoginWithMFA)
 			auth.POST("/register", CreateUser)
 			auth.GET("/refresh", RefreshToken)
+			auth.POST("/logout", LogoutUser)
+			auth.POST("/logout-all", middlewares.AuthUser(), LogoutUserEverywhere)
+			auth.POST("/password-reset", RequestPasswordReset)
+			auth.POST("/password-reset/confirm", ConfirmPasswordReset)
+			auth.POST("/verify-email", VerifyEmail)
+			auth.POST("/verify-email/resend", middlewares.AuthUser(), ResendVerificationEmail)
+			auth.POST("/oidc/login", StartOIDCLogin)
+			auth.POST("/oidc/callback", OIDCCallback)
 		}
 		// users routes
 		users := v1.Group("/users")
 		{
 			users.GET("/me", middlewares.AuthUser(), GetUser)
-			// users.PATCH("/me", UpdateUser)
+			users.GET("/me/sessions", middlewares.AuthUser(), GetSessions)                         // gets the active sessions of a user
+			users.DELETE("/me/sessions/:session_id", middlewares.AuthUser(), DeleteSession)        // revokes a session by id
+			users.POST("/me/totp", middlewares.AuthUser(), EnrollTOTP)                             // starts the enrollment of an authenticator app
+			users.POST("/me/totp/confirm", middlewares.AuthUser(), ConfirmTOTP)                    // enables two-factor authentication
+			users.DELETE("/me/totp", middlewares.AuthUser(), DisableTOTP)                          // disables two-factor authentication
+			users.POST("/me/totp/recovery-codes", middlewares.AuthUser(), RegenerateRecoveryCodes) // replaces the recovery codes
+			users.POST("/me/tokens", middlewares.AuthUser(), CreateAccessToken)                    // creates a personal access token
+			users.GET("/me/tokens", middlewares.AuthUser(), GetAccessTokens)                       // gets the personal access tokens of a user
+			users.DELETE("/me/tokens/:token_id", middlewares.AuthUser(), DeleteAccessToken)        // revokes a personal access token
+			users.POST("/me/identities", middlewares.AuthUser(), StartIdentityLink)                // starts linking an identity at the OpenID Connect provider
+			users.GET("/me/identities", middlewares.AuthUser(), GetIdentities)                     // gets the identities linked to a user
+			users.DELETE("/me/identities/:identity_id", middlewares.AuthUser(), DeleteIdentity)    // unlinks an identity
+			users.PATCH("/me", middlewares.AuthUser(), UpdateUser)                                 // updates the username and email of a user
+			users.POST("/me/password", middlewares.AuthUser(), ChangePassword)                     // changes the password and revokes the other sessions
+			users.DELETE("/me", middlewares.AuthUser(), DeleteAccount)                             // schedules the deletion of the account after the grace period
+			users.POST("/me/deletion/confirm", middlewares.AuthUser(), ConfirmAccountDeletion)     // confirms the deletion of an account without a password with an emailed link
+			users.DELETE("/me/deletion", middlewares.AuthUser(), CancelAccountDeletion)            // cancels the pending deletion of the account
+			users.GET("/me/export", middlewares.AuthUser(), ExportAccountData)                     // downloads everything stored about the user as a zip archive
+			users.GET("/me/preferences", middlewares.AuthUser(), GetPreferences)                   // gets the currency, time zone, locale and date format of a user
+			users.PATCH("/me/preferences", middlewares.AuthUser(), UpdatePreferences)              // changes the preferences of a user
 		}
 		// passbooks routes
 		passbooks := v1.Group("/passbooks")
 		{
-			passbooks.POST("", middlewares.AuthUser(), CreatePassbook)                // creates a new passbook
-			passbooks.GET("", middlewares.AuthUser(), GetPassbooks)                   // gets all passbooks for a user
-			passbooks.GET("/:passbook_id", middlewares.AuthUser(), GetPassbook)       // gets a passbook by id
-			passbooks.PATCH("/:passbook_id", middlewares.AuthUser(), UpdatePassbook)  // updates a passbook by id
-			passbooks.DELETE("/:passbook_id", middlewares.AuthUser(), DeletePassbook) // deletes a passbook by id
+			passbooks.POST("", middlewares.AuthUser(middlewares.ScopePassbooksWrite), CreatePassbook)                                  // creates a new passbook
+			passbooks.GET("", middlewares.AuthUser(middlewares.ScopePassbooksRead), GetPassbooks)                                      // gets all passbooks for a user
+			passbooks.GET("/totals", middlewares.AuthUser(middlewares.ScopePassbooksRead), GetPassbookTotals)                          // total balance of all passbooks as of a date converted into one currency
+			passbooks.GET("/:passbook_id", middlewares.AuthUser(middlewares.ScopePassbooksRead), GetPassbook)                          // gets a passbook by id
+			passbooks.PATCH("/:passbook_id", middlewares.AuthUser(middlewares.ScopePassbooksWrite), UpdatePassbook)                    // updates a passbook by id
+			passbooks.DELETE("/:passbook_id", middlewares.AuthUser(middlewares.ScopePassbooksWrite), DeletePassbook)                   // deletes a passbook by id
+			passbooks.POST("/:passbook_id/imports/csv", middlewares.AuthUser(middlewares.ScopeImportsWrite), ImportCSVStatement)       // imports a CSV bank statement into a passbook
+			passbooks.GET("/:passbook_id/export", middlewares.AuthUser(middlewares.ScopeExportsRead), ExportPassbookTransactions)      // exports the transactions of a passbook
+			passbooks.GET("/:passbook_id/statements/:month", middlewares.AuthUser(middlewares.ScopeExportsRead), GetPassbookStatement) // monthly PDF statement of a passbook
 
 			transactions := passbooks.Group("/:passbook_id/transactions")
 			{
-				// 	transactions.GET("", GetTransactions)                      // gets all transactions for a passbook
-				transactions.POST("", middlewares.AuthUser(), CreateTransaction)             // creates a new transaction for a passbook
-				transactions.GET("/:transaction_id", middlewares.AuthUser(), GetTransaction) // gets a transaction by id
-				// 	transactions.PATCH("/:transaction_id", UpdateTransaction)  // updates a transaction by id
+				transactions.GET("", middlewares.AuthUser(middlewares.ScopeTransactionsRead), GetTransactions)                              // gets all transactions for a passbook
+				transactions.POST("", middlewares.AuthUser(middlewares.ScopeTransactionsWrite), CreateTransaction)                          // creates a new transaction for a passbook
+				transactions.GET("/:transaction_id", middlewares.AuthUser(middlewares.ScopeTransactionsRead), GetTransaction)               // gets a transaction by id
+				transactions.PATCH("/:transaction_id", middlewares.AuthUser(middlewares.ScopeTransactionsWrite), UpdateTransaction)         // updates a transaction by id
+				transactions.DELETE("/:transaction_id", middlewares.AuthUser(middlewares.ScopeTransactionsWrite), DeleteTransaction)        // moves a transaction to trash
+				transactions.GET("/trash", middlewares.AuthUser(middlewares.ScopeTransactionsRead), GetTrashedTransactions)                 // gets the trashed transactions of a passbook
+				transactions.POST("/:transaction_id/restore", middlewares.AuthUser(middlewares.ScopeTransactionsWrite), RestoreTransaction) // restores a transaction from trash
 			}
 		}
+		// exchange rates routes, the rates of a user convert between the currencies of their passbooks
+		exchangeRates := v1.Group("/exchange-rates")
+		{
+			exchangeRates.POST("", middlewares.AuthUser(middlewares.ScopePassbooksWrite), CreateExchangeRate)            // stores the rate of a currency pair on a day
+			exchangeRates.POST("/import", middlewares.AuthUser(middlewares.ScopePassbooksWrite), ImportExchangeRates)    // stores the rates of a CSV file
+			exchangeRates.GET("", middlewares.AuthUser(middlewares.ScopePassbooksRead), GetExchangeRates)                // gets the exchange rates of a user
+			exchangeRates.DELETE("/:rate_id", middlewares.AuthUser(middlewares.ScopePassbooksWrite), DeleteExchangeRate) // deletes an exchange rate by id
+		}
+		// import profiles routes
+		importProfiles := v1.Group("/import-profiles")
+		{
+			importProfiles.POST("", middlewares.AuthUser(middlewares.ScopeImportsWrite), CreateImportProfile)               // creates a CSV column mapping profile
+			importProfiles.GET("", middlewares.AuthUser(middlewares.ScopeImportsWrite), GetImportProfiles)                  // gets all import profiles of a user
+			importProfiles.DELETE("/:profile_id", middlewares.AuthUser(middlewares.ScopeImportsWrite), DeleteImportProfile) // deletes an import profile by id
+		}
+		// statement imports that find the passbook by the account number of the statement
+		imports := v1.Group("/imports")
+		{
+			imports.POST("/ofx", middlewares.AuthUser(middlewares.ScopeImportsWrite), ImportOFXStatement)         // imports an OFX/QFX statement
+			imports.POST("/camt053", middlewares.AuthUser(middlewares.ScopeImportsWrite), ImportCAMT053Statement) // imports an ISO 20022 camt.053 statement
+			imports.POST("/mt940", middlewares.AuthUser(middlewares.ScopeImportsWrite), ImportMT940Statement)     // imports a SWIFT MT940 statement
+		}
+		// transactions across all passbooks of a user
+		transactions := v1.Group("/transactions")
+		{
+			transactions.GET("/export", middlewares.AuthUser(middlewares.ScopeExportsRead), ExportAllTransactions) // exports the transactions of all passbooks
+		}
+		// transfers routes
+		transfers := v1.Group("/transfers")
+		{
+			transfers.POST("", middlewares.AuthUser(middlewares.ScopeTransactionsWrite), CreateTransfer)         // moves money between two passbooks of a user
+			transfers.GET("/:transfer_id", middlewares.AuthUser(middlewares.ScopeTransactionsRead), GetTransfer) // gets both legs of a transfer
+		}
 	}
 
 	return router
@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+)
+
+// route handler for listing the active sessions of the logged in user, the session of the request is marked as current
+func GetSessions(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	currentSessionID := ctx.GetString("sessionId")
+	// sessions not refreshed within the refresh token lifetime cannot be used anymore
+	rows, err := initializers.DB.Query(context.Background(), "SELECT session_id, device_name, ip, user_agent, created_at, last_used_at FROM passbook_app.sessions WHERE user_id=$1 AND last_used_at > $2 ORDER BY last_used_at DESC",
+		loggedInUserID, time.Now().UTC().Add(-refreshTokenLifetime))
+	if err != nil {
+		log.Println("Failed to get sessions of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get sessions")
+		return
+	}
+	defer rows.Close()
+	sessions := make([]types.Session, 0)
+	for rows.Next() {
+		var s types.Session
+		if err := rows.Scan(&s.SessionID, &s.DeviceName, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			log.Println("Failed to scan session of user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to get sessions")
+			return
+		}
+		s.Current = s.SessionID == currentSessionID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to get sessions of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get sessions")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Sessions fetched successfully",
+		"data": map[string][]types.Session{
+			"sessions": sessions,
+		},
+	})
+}
+
+/*
+Route handler for revoking a single session of the logged in user. The refresh token of the session stops working
+right away, access tokens already issued for it stay valid until they expire.
+*/
+func DeleteSession(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	sessionID := ctx.Param("session_id")
+	ctag, err := initializers.DB.Exec(context.Background(), "DELETE FROM passbook_app.sessions WHERE session_id=$1 AND user_id=$2", sessionID, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to revoke session", sessionID, "of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to revoke session")
+		return
+	}
+	if ctag.RowsAffected() == 0 {
+		setErrorResponse(ctx, 404, "Session not found")
+		return
+	}
+	if sessionID == ctx.GetString("sessionId") {
+		clearRefreshTokenCookie(ctx)
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Session revoked successfully",
+	})
+}
+
+// delete the sessions whose refresh token has expired and the rotated refresh tokens which can no longer be presented
+func purgeExpiredSessions(conn initializers.PgxPoolIface) error {
+	expiredBefore := time.Now().UTC().Add(-refreshTokenLifetime)
+	ctag, err := conn.Exec(context.Background(), "DELETE FROM passbook_app.sessions WHERE last_used_at < $1", expiredBefore)
+	if err != nil {
+		return err
+	}
+	if ctag.RowsAffected() > 0 {
+		log.Println("Purged", ctag.RowsAffected(), "expired sessions")
+	}
+	_, err = conn.Exec(context.Background(), "DELETE FROM passbook_app.rotated_tokens WHERE rotated_at < $1", expiredBefore)
+	return err
+}
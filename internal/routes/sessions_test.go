@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	testUserID := "test-user-id"
+	currentSessionID := "current-session-id"
+
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Set("sessionId", currentSessionID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	users := router.Group("/v1/users", authTestMiddleware())
+	{
+		users.GET("/me/sessions", GetSessions)
+		users.DELETE("/me/sessions/:session_id", DeleteSession)
+	}
+
+	t.Run("Active sessions are listed", func(t *testing.T) {
+		now := time.Now().UTC()
+		mockDB.ExpectQuery(`^SELECT session_id, device_name, ip, user_agent, created_at, last_used_at FROM passbook_app.sessions WHERE user_id=\$1 AND last_used_at > \$2 ORDER BY last_used_at DESC$`).
+			WithArgs(testUserID, pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"session_id", "device_name", "ip", "user_agent", "created_at", "last_used_at"}).
+				AddRow(currentSessionID, "Firefox on Windows", "192.0.2.1", "Mozilla/5.0", now, now).
+				AddRow("phone-session-id", "Safari on iPhone", "192.0.2.2", "Mozilla/5.0", now, now.Add(-time.Hour)))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/users/me/sessions", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Data struct {
+				Sessions []map[string]any `json:"sessions"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response.Data.Sessions, 2)
+		assert.Equal(t, true, response.Data.Sessions[0]["current"])
+		assert.Equal(t, false, response.Data.Sessions[1]["current"])
+		assert.Equal(t, "Safari on iPhone", response.Data.Sessions[1]["device_name"])
+		assert.NotContains(t, response.Data.Sessions[0], "rtoken")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Session is revoked", func(t *testing.T) {
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.sessions WHERE session_id=\$1 AND user_id=\$2$`).
+			WithArgs("phone-session-id", testUserID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/users/me/sessions/phone-session-id", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown session", func(t *testing.T) {
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.sessions WHERE session_id=\$1 AND user_id=\$2$`).
+			WithArgs("other-session-id", testUserID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/users/me/sessions/other-session-id", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,413 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/akashsharma99/passbook-app/internal/totp"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const recoveryCodeCount = 10
+
+const (
+	securityEventTOTPEnabled      = "totp_enabled"
+	securityEventTOTPDisabled     = "totp_disabled"
+	securityEventMFAFailed        = "mfa_failed"
+	securityEventRecoveryCodeUsed = "recovery_code_used"
+)
+
+// second factor sent along with a request, either a code of the authenticator app or a recovery code
+type secondFactorReq struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type mfaLoginReq struct {
+	MFAToken string `json:"mfa_token"`
+	secondFactorReq
+	DeviceName string `json:"device_name"`
+}
+
+type disableTOTPReq struct {
+	Password string `json:"password"`
+	secondFactorReq
+}
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "Passbook"
+}
+
+/*
+Route handler for starting the TOTP enrollment of the logged in user. A new secret is stored and returned along with
+the otpauth URI for the QR code, two-factor authentication is only enabled once a code of it is confirmed.
+*/
+func EnrollTOTP(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var username string
+	var enabled bool
+	err := initializers.DB.QueryRow(context.Background(), "SELECT username, totp_enabled_at IS NOT NULL FROM passbook_app.users WHERE user_id=$1", loggedInUserID).Scan(&username, &enabled)
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to start two-factor enrollment. Try again later!")
+		return
+	}
+	if enabled {
+		setErrorResponse(ctx, 409, "Two-factor authentication is already enabled")
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Println("Failed to generate totp secret", err)
+		setErrorResponse(ctx, 500, "Failed to start two-factor enrollment. Try again later!")
+		return
+	}
+	_, err = initializers.DB.Exec(context.Background(), "UPDATE passbook_app.users SET totp_secret=$1, updated_at=$2 WHERE user_id=$3 AND totp_enabled_at IS NULL", secret, time.Now().UTC(), loggedInUserID)
+	if err != nil {
+		log.Println("Failed to save totp secret of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to start two-factor enrollment. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Scan the QR code of the otpauth URI with an authenticator app and confirm a code to enable two-factor authentication",
+		"data": map[string]string{
+			"secret":      secret,
+			"otpauth_uri": totp.URI(totpIssuer(), username, secret),
+		},
+	})
+}
+
+// route handler for enabling two-factor authentication with a code of the enrolled secret, returns the recovery codes once
+func ConfirmTOTP(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req secondFactorReq
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		setErrorResponse(ctx, 400, "Please provide a code of the authenticator app.")
+		return
+	}
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to enable two-factor authentication. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	var secret *string
+	var enabled bool
+	err = tx.QueryRow(context.Background(), "SELECT totp_secret, totp_enabled_at IS NOT NULL FROM passbook_app.users WHERE user_id=$1 FOR UPDATE", loggedInUserID).Scan(&secret, &enabled)
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to enable two-factor authentication. Try again later!")
+		return
+	}
+	if enabled {
+		setErrorResponse(ctx, 409, "Two-factor authentication is already enabled")
+		return
+	}
+	if secret == nil {
+		setErrorResponse(ctx, 400, "Start the two-factor enrollment first")
+		return
+	}
+	counter, ok := totp.Validate(*secret, req.Code, time.Now())
+	if !ok {
+		setErrorResponse(ctx, 400, "Invalid code")
+		return
+	}
+	time_now := time.Now().UTC()
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.users SET totp_enabled_at=$1, totp_last_counter=$2, updated_at=$1 WHERE user_id=$3", time_now, counter, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to enable totp of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to enable two-factor authentication. Try again later!")
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, loggedInUserID)
+	if err == nil {
+		err = recordSecurityEvent(tx, ctx, loggedInUserID, securityEventTOTPEnabled, ctx.GetString("sessionId"), "Two-factor authentication was enabled")
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Println("Failed to enable totp of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to enable two-factor authentication. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Two-factor authentication enabled. Store the recovery codes in a safe place, they are shown only once",
+		"data": map[string][]string{
+			"recovery_codes": codes,
+		},
+	})
+}
+
+/*
+Route handler for turning two-factor authentication off. Needs the password and a code of the authenticator app or a
+recovery code, so a stolen access token alone cannot remove the second factor. Users without a password, who log in
+with an OpenID Connect provider, only need the code.
+*/
+func DisableTOTP(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req disableTOTPReq
+	if err := ctx.ShouldBindJSON(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		setErrorResponse(ctx, 400, "Please provide the password and a code of the authenticator app or a recovery code.")
+		return
+	}
+	user, err := getUserByID(initializers.DB, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to disable two-factor authentication. Try again later!")
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		setErrorResponse(ctx, 409, "Two-factor authentication is not enabled")
+		return
+	}
+	if user.PasswordHash != "" && req.Password == "" {
+		setErrorResponse(ctx, 400, "Please provide the password and a code of the authenticator app or a recovery code.")
+		return
+	}
+	// guesses share the counter of the codes of the login
+	mfaKey := "mfa:" + loggedInUserID
+	if !checkLoginLimits(ctx, mfaKey) {
+		return
+	}
+	if user.PasswordHash != "" && bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		recordFailedLogin(ctx, mfaKey, loggedInUserID, securityEventMFAFailed)
+		setErrorResponse(ctx, 403, "Invalid password or code")
+		return
+	}
+	ok, err := verifySecondFactor(ctx, initializers.DB, user, req.secondFactorReq)
+	if err != nil {
+		log.Println("Failed to check second factor of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to disable two-factor authentication. Try again later!")
+		return
+	}
+	if !ok {
+		recordFailedLogin(ctx, mfaKey, loggedInUserID, securityEventMFAFailed)
+		setErrorResponse(ctx, 403, "Invalid password or code")
+		return
+	}
+	clearLoginLimits(ctx, mfaKey)
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to disable two-factor authentication. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.users SET totp_secret=NULL, totp_enabled_at=NULL, totp_last_counter=0, updated_at=$1 WHERE user_id=$2", time.Now().UTC(), loggedInUserID)
+	if err == nil {
+		_, err = tx.Exec(context.Background(), "DELETE FROM passbook_app.recovery_codes WHERE user_id=$1", loggedInUserID)
+	}
+	if err == nil {
+		err = recordSecurityEvent(tx, ctx, loggedInUserID, securityEventTOTPDisabled, ctx.GetString("sessionId"), "Two-factor authentication was disabled")
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Println("Failed to disable totp of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to disable two-factor authentication. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// route handler for replacing all recovery codes of the logged in user, needs a code of the authenticator app
+func RegenerateRecoveryCodes(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req secondFactorReq
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		setErrorResponse(ctx, 400, "Please provide a code of the authenticator app.")
+		return
+	}
+	user, err := getUserByID(initializers.DB, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to generate recovery codes. Try again later!")
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		setErrorResponse(ctx, 409, "Two-factor authentication is not enabled")
+		return
+	}
+	mfaKey := "mfa:" + loggedInUserID
+	if !checkLoginLimits(ctx, mfaKey) {
+		return
+	}
+	ok, err := verifySecondFactor(ctx, initializers.DB, user, secondFactorReq{Code: req.Code})
+	if err != nil {
+		log.Println("Failed to check second factor of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to generate recovery codes. Try again later!")
+		return
+	}
+	if !ok {
+		recordFailedLogin(ctx, mfaKey, loggedInUserID, securityEventMFAFailed)
+		setErrorResponse(ctx, 403, "Invalid code")
+		return
+	}
+	clearLoginLimits(ctx, mfaKey)
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to generate recovery codes. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	codes, err := replaceRecoveryCodes(tx, loggedInUserID)
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Println("Failed to replace recovery codes of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to generate recovery codes. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Recovery codes generated, the earlier codes no longer work",
+		"data": map[string][]string{
+			"recovery_codes": codes,
+		},
+	})
+}
+
+// route handler for the second step of the login, exchanges the MFA token and a second factor for the session tokens
+func LoginWithMFA(ctx *gin.Context) {
+	var req mfaLoginReq
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		setErrorResponse(ctx, 400, "Please provide the mfa token and a code of the authenticator app or a recovery code.")
+		return
+	}
+	claims, err := middlewares.ValidateToken(req.MFAToken, types.TokenPurposeMFA, "")
+	if err != nil {
+		setErrorResponse(ctx, 401, "Invalid or expired mfa token. Please log in again")
+		return
+	}
+	user, err := getUserByID(initializers.DB, claims.UserID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		setErrorResponse(ctx, 401, "Invalid or expired mfa token. Please log in again")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to get user_id:", claims.UserID, err)
+		setErrorResponse(ctx, 500, "Login failed. Try again later!")
+		return
+	}
+	if user.TOTPEnabledAt == nil {
+		// two-factor authentication was turned off in the meantime, the password has to be checked again
+		setErrorResponse(ctx, 401, "Invalid or expired mfa token. Please log in again")
+		return
+	}
+	// codes are guessed against their own counter, a new mfa token does not give new attempts
+	mfaKey := "mfa:" + user.UserID
+	if !checkLoginLimits(ctx, mfaKey) {
+		return
+	}
+	ok, err := verifySecondFactor(ctx, initializers.DB, user, req.secondFactorReq)
+	if err != nil {
+		log.Println("Failed to check second factor of user_id:", user.UserID, err)
+		setErrorResponse(ctx, 500, "Login failed. Try again later!")
+		return
+	}
+	if !ok {
+		recordFailedLogin(ctx, mfaKey, user.UserID, securityEventMFAFailed)
+		setErrorResponse(ctx, 401, "Invalid two-factor code")
+		return
+	}
+	clearLoginLimits(ctx, mfaKey)
+	completeLogin(ctx, user, req.DeviceName)
+}
+
+func getUserByID(conn initializers.PgxPoolIface, userID string) (types.User, error) {
+	rows, err := conn.Query(context.Background(), "SELECT * FROM passbook_app.users WHERE user_id=$1", userID)
+	if err != nil {
+		return types.User{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[types.User])
+}
+
+/*
+Check a code of the authenticator app or a recovery code of the user and use it up. A TOTP code is accepted only if it
+belongs to a later period than the last accepted one and a recovery code works only once, so a code seen by someone
+looking over the shoulder cannot be replayed.
+*/
+func verifySecondFactor(ctx *gin.Context, conn dbExecutor, user types.User, req secondFactorReq) (bool, error) {
+	if req.Code != "" {
+		if user.TOTPSecret == nil {
+			return false, nil
+		}
+		counter, ok := totp.Validate(*user.TOTPSecret, req.Code, time.Now())
+		if !ok || counter <= user.TOTPLastCounter {
+			return false, nil
+		}
+		ctag, err := conn.Exec(context.Background(), "UPDATE passbook_app.users SET totp_last_counter=$1 WHERE user_id=$2 AND totp_last_counter < $1", counter, user.UserID)
+		if err != nil {
+			return false, err
+		}
+		return ctag.RowsAffected() == 1, nil
+	}
+	code := normalizeRecoveryCode(req.RecoveryCode)
+	if code == "" {
+		return false, nil
+	}
+	ctag, err := conn.Exec(context.Background(), "UPDATE passbook_app.recovery_codes SET used_at=$1 WHERE user_id=$2 AND code_hash=$3 AND used_at IS NULL",
+		time.Now().UTC(), user.UserID, utils.HashToken(code))
+	if err != nil {
+		return false, err
+	}
+	if ctag.RowsAffected() == 0 {
+		return false, nil
+	}
+	err = recordSecurityEvent(conn, ctx, user.UserID, securityEventRecoveryCodeUsed, "", "A recovery code was used instead of the authenticator app")
+	return err == nil, err
+}
+
+// recovery codes are shown as xxxxx-xxxxx but accepted in any case and with or without separators
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// delete the recovery codes of the user and store the hashes of new ones, the plain codes are returned to show them once
+func replaceRecoveryCodes(tx pgx.Tx, userID string) ([]string, error) {
+	_, err := tx.Exec(context.Background(), "DELETE FROM passbook_app.recovery_codes WHERE user_id=$1", userID)
+	if err != nil {
+		return nil, err
+	}
+	time_now := time.Now().UTC()
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))
+		_, err = tx.Exec(context.Background(), "INSERT INTO passbook_app.recovery_codes (code_hash, user_id, created_at) VALUES ($1, $2, $3)", utils.HashToken(code), userID, time_now)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
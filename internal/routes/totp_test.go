@@ -0,0 +1,369 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/lockout"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/akashsharma99/passbook-app/internal/totp"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func anyArgs(n int) []any {
+	args := make([]any, n)
+	for i := range args {
+		args[i] = pgxmock.AnyArg()
+	}
+	return args
+}
+
+func TestTwoStepLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/auth/login", LoginUser)
+	router.POST("/v1/auth/login/mfa", LoginWithMFA)
+	router.GET("/v1/users/me", middlewares.AuthUser(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	secret, _ := totp.GenerateSecret()
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	now := time.Now().UTC()
+	lastCounter := totp.Counter(now) - 5
+	userRow := func() *pgxmock.Rows {
+		return pgxmock.NewRows(userColumns).
+			AddRow("test-user-id", "jane", "jane@example.com", string(passwordHash), now, now, &now, &secret, &now, lastCounter)
+	}
+	post := func(path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	var mfaToken string
+
+	t.Run("Password only earns an mfa token", func(t *testing.T) {
+		mockDB.ExpectQuery(`^SELECT \* FROM passbook_app.users WHERE username=\$1$`).WithArgs("jane").WillReturnRows(userRow())
+
+		w := post("/v1/auth/login", `{"username":"jane","password":"secret"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Set-Cookie"))
+		var response struct {
+			Data map[string]any `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, true, response.Data["mfa_required"])
+		assert.NotContains(t, response.Data, "access_token")
+		mfaToken, _ = response.Data["mfa_token"].(string)
+		assert.NotEmpty(t, mfaToken)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Mfa token is no access token", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/users/me", nil)
+		req.Header.Set("Authorization", "Bearer "+mfaToken)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	userByIDSQL := `^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`
+	counterSQL := `^UPDATE passbook_app.users SET totp_last_counter=\$1 WHERE user_id=\$2 AND totp_last_counter < \$1$`
+	sessionSQL := `^INSERT INTO passbook_app.sessions`
+
+	t.Run("Code of the authenticator app completes the login", func(t *testing.T) {
+		code, _ := totp.Code(secret, time.Now())
+		mockDB.ExpectQuery(userByIDSQL).WithArgs("test-user-id").WillReturnRows(userRow())
+		mockDB.ExpectExec(counterSQL).
+			WithArgs(pgxmock.AnyArg(), "test-user-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(sessionSQL).WithArgs(anyArgs(8)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := post("/v1/auth/login/mfa", `{"mfa_token":"`+mfaToken+`","code":"`+code+`"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "access_token")
+		assert.Contains(t, w.Header().Get("Set-Cookie"), "refresh_token=")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Code of an already used period is rejected", func(t *testing.T) {
+		code, _ := totp.Code(secret, time.Now())
+		mockDB.ExpectQuery(userByIDSQL).WithArgs("test-user-id").WillReturnRows(userRow())
+		// another request used the code in the meantime
+		mockDB.ExpectExec(counterSQL).
+			WithArgs(pgxmock.AnyArg(), "test-user-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", "mfa_failed", (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := post("/v1/auth/login/mfa", `{"mfa_token":"`+mfaToken+`","code":"`+code+`"}`)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Recovery code completes the login", func(t *testing.T) {
+		mockDB.ExpectQuery(userByIDSQL).WithArgs("test-user-id").WillReturnRows(userRow())
+		mockDB.ExpectExec(`^UPDATE passbook_app.recovery_codes SET used_at=\$1 WHERE user_id=\$2 AND code_hash=\$3 AND used_at IS NULL$`).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", utils.HashToken("abcdefghij")).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", "recovery_code_used", (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectExec(sessionSQL).WithArgs(anyArgs(8)...).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		w := post("/v1/auth/login/mfa", `{"mfa_token":"`+mfaToken+`","recovery_code":"ABCDE-FGHIJ"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Access token cannot be used as mfa token", func(t *testing.T) {
+		accessToken, _, err := generateTokens(types.User{UserID: "test-user-id"}, "test-session-id")
+		assert.NoError(t, err)
+
+		w := post("/v1/auth/login/mfa", `{"mfa_token":"`+accessToken+`","code":"123456"}`)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	testUserID := "test-user-id"
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	users := router.Group("/v1/users", authTestMiddleware())
+	{
+		users.POST("/me/totp", EnrollTOTP)
+		users.POST("/me/totp/confirm", ConfirmTOTP)
+	}
+	secret := &captureArg{}
+
+	t.Run("Enrollment returns the secret and otpauth URI", func(t *testing.T) {
+		mockDB.ExpectQuery(`^SELECT username, totp_enabled_at IS NOT NULL FROM passbook_app.users WHERE user_id=\$1$`).
+			WithArgs(testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"username", "enabled"}).AddRow("jane", false))
+		mockDB.ExpectExec(`^UPDATE passbook_app.users SET totp_secret=\$1, updated_at=\$2 WHERE user_id=\$3 AND totp_enabled_at IS NULL$`).
+			WithArgs(secret, pgxmock.AnyArg(), testUserID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/users/me/totp", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"secret":"`+secret.value+`"`)
+		assert.Contains(t, w.Body.String(), "otpauth://totp/Passbook:jane?")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Confirming a code enables TOTP and returns recovery codes", func(t *testing.T) {
+		code, _ := totp.Code(secret.value, time.Now())
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(`^SELECT totp_secret, totp_enabled_at IS NOT NULL FROM passbook_app.users WHERE user_id=\$1 FOR UPDATE$`).
+			WithArgs(testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"totp_secret", "enabled"}).AddRow(&secret.value, false))
+		mockDB.ExpectExec(`^UPDATE passbook_app.users SET totp_enabled_at=\$1, totp_last_counter=\$2, updated_at=\$1 WHERE user_id=\$3$`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), testUserID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.recovery_codes WHERE user_id=\$1$`).
+			WithArgs(testUserID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		for i := 0; i < recoveryCodeCount; i++ {
+			mockDB.ExpectExec(`^INSERT INTO passbook_app.recovery_codes \(code_hash, user_id, created_at\)`).
+				WithArgs(pgxmock.AnyArg(), testUserID, pgxmock.AnyArg()).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		}
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs(testUserID, "totp_enabled", pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/users/me/totp/confirm", strings.NewReader(`{"code":"`+code+`"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Data struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Len(t, response.Data.RecoveryCodes, recoveryCodeCount)
+		assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, response.Data.RecoveryCodes[0])
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Wrong code does not enable TOTP", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(`^SELECT totp_secret, totp_enabled_at IS NOT NULL FROM passbook_app.users`).
+			WithArgs(testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"totp_secret", "enabled"}).AddRow(&secret.value, false))
+		mockDB.ExpectRollback()
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/users/me/totp/confirm", strings.NewReader(`{"code":"abcdef"}`))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestDisableTOTP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	originalUsernameLimiter, originalIPLimiter := initializers.UsernameLoginLimiter, initializers.IPLoginLimiter
+	initializers.UsernameLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), lockout.Policy{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Hour, LockoutThreshold: 5, LockoutDuration: time.Hour, Window: time.Hour})
+	initializers.IPLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), lockout.Policy{FreeAttempts: 100, LockoutThreshold: 1000, Window: time.Hour})
+	defer func() {
+		initializers.UsernameLoginLimiter, initializers.IPLoginLimiter = originalUsernameLimiter, originalIPLimiter
+	}()
+
+	testUserID := "test-user-id"
+	router := gin.New()
+	users := router.Group("/v1/users", func(c *gin.Context) { c.Set("userId", testUserID) })
+	{
+		users.DELETE("/me/totp", DisableTOTP)
+		users.POST("/me/totp/recovery-codes", RegenerateRecoveryCodes)
+	}
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	disable := func(body string) *httptest.ResponseRecorder {
+		return send("DELETE", "/v1/users/me/totp", body)
+	}
+	secret, _ := totp.GenerateSecret()
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	now := time.Now().UTC()
+	userRow := func(passwordHash string) *pgxmock.Rows {
+		return pgxmock.NewRows(userColumns).
+			AddRow(testUserID, "jane", "jane@example.com", passwordHash, now, now, &now, &secret, &now, totp.Counter(now)-5)
+	}
+	userByIDSQL := `^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`
+	expectDisabled := func() {
+		mockDB.ExpectExec(`^UPDATE passbook_app.users SET totp_last_counter=\$1`).
+			WithArgs(pgxmock.AnyArg(), testUserID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(`^UPDATE passbook_app.users SET totp_secret=NULL`).
+			WithArgs(pgxmock.AnyArg(), testUserID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.recovery_codes WHERE user_id=\$1$`).
+			WithArgs(testUserID).
+			WillReturnResult(pgxmock.NewResult("DELETE", 10))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs(testUserID, "totp_disabled", pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+	}
+
+	t.Run("Password and code disable TOTP", func(t *testing.T) {
+		code, _ := totp.Code(secret, time.Now())
+		mockDB.ExpectQuery(userByIDSQL).WithArgs(testUserID).WillReturnRows(userRow(string(passwordHash)))
+		expectDisabled()
+
+		w := disable(`{"password":"secret","code":"` + code + `"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Users with a password have to send it", func(t *testing.T) {
+		code, _ := totp.Code(secret, time.Now())
+		mockDB.ExpectQuery(userByIDSQL).WithArgs(testUserID).WillReturnRows(userRow(string(passwordHash)))
+
+		w := disable(`{"code":"` + code + `"}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Users without a password only need the code", func(t *testing.T) {
+		code, _ := totp.Code(secret, time.Now())
+		mockDB.ExpectQuery(userByIDSQL).WithArgs(testUserID).WillReturnRows(userRow(""))
+		expectDisabled()
+
+		w := disable(`{"code":"` + code + `"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Wrong codes are recorded and limited", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			mockDB.ExpectQuery(userByIDSQL).WithArgs(testUserID).WillReturnRows(userRow(string(passwordHash)))
+			mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+				WithArgs(testUserID, "mfa_failed", (*string)(nil), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+			w := disable(`{"password":"secret","code":"abc123"}`)
+			assert.Equal(t, http.StatusForbidden, w.Code, i)
+		}
+		// the second failure is past the free attempt, regenerating the recovery codes shares the counter
+		mockDB.ExpectQuery(userByIDSQL).WithArgs(testUserID).WillReturnRows(userRow(string(passwordHash)))
+		w := send("POST", "/v1/users/me/totp/recovery-codes", `{"code":"abc123"}`)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "60", w.Header().Get("Retry-After"))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
@@ -3,10 +3,18 @@ package routes
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
 	"github.com/akashsharma99/passbook-app/internal/types"
 	"github.com/akashsharma99/passbook-app/internal/utils"
 	"github.com/gin-gonic/gin"
@@ -15,14 +23,33 @@ import (
 	// database/sql import removed as sql.ErrNoRows is replaced by pgx.ErrNoRows
 )
 
+var (
+	errInsufficientBalance = errors.New("insufficient balance")
+	errTransactionNotFound = errors.New("transaction not found")
+	errPassbookNotFound    = errors.New("passbook not found")
+	// transfer legs can only change amount, date and details, moving them or flipping their type would break the pair
+	errTransferLegImmutable = errors.New("passbook and transaction type of a transfer cannot be changed")
+	// amounts are never converted, a transaction is always in the currency of its passbook
+	errCurrencyMismatch = errors.New("currency does not match the currency of the passbook")
+	// the passbook belongs to the user but the access token of the request is restricted to other passbooks
+	errPassbookNotAccessible = errors.New("passbook not accessible")
+)
+
+// body of the create and update transaction requests, currency is optional and only checked against the passbook
+type transactionReq struct {
+	types.Transaction
+	Currency string `json:"currency"`
+}
+
 func CreateTransaction(ctx *gin.Context) {
 	loggedInUserID := ctx.MustGet("userId").(string)
 	passbookID := ctx.Param("passbook_id")
-	var transaction types.Transaction
-	if err := ctx.ShouldBindJSON(&transaction); err != nil {
-		setErrorResponse(ctx, 400, "Invalid request body")
+	var req transactionReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		setErrorResponse(ctx, 400, invalidBodyMessage(err))
 		return
 	}
+	transaction := req.Transaction
 	// input sanitization
 	err := sanitizeTransactionRequest(&transaction)
 	if err != nil {
@@ -30,12 +57,16 @@ func CreateTransaction(ctx *gin.Context) {
 		return
 	}
 	// return 403 if user_id in token does not match user_id in passbook or if passbook does not exist
-	var pbid string
-	err = initializers.DB.QueryRow(context.Background(), "SELECT passbook_id FROM passbook_app.passbooks WHERE passbook_id=$1 AND user_id=$2", passbookID, loggedInUserID).Scan(&pbid)
+	var currency string
+	err = initializers.DB.QueryRow(context.Background(), "SELECT currency FROM passbook_app.passbooks WHERE passbook_id=$1 AND user_id=$2", passbookID, loggedInUserID).Scan(&currency)
 	if err != nil {
 		setErrorResponse(ctx, 403, "Invalid passbook")
 		return
 	}
+	if !currencyMatches(req.Currency, currency) {
+		setErrorResponse(ctx, 400, "Currency "+normalizeCurrency(req.Currency)+" does not match the currency "+currency+" of the passbook")
+		return
+	}
 	// create a new transaction
 	uid, uiderr := utils.GenerateUUID()
 	if uiderr != nil {
@@ -61,7 +92,7 @@ func CreateTransaction(ctx *gin.Context) {
 	err = updatePassbookAndCreateTrx(initializers.DB, &tr)
 	if err != nil {
 		// if the new balance is less than 0, return an error
-		if err.Error() == "insufficient balance" {
+		if errors.Is(err, errInsufficientBalance) {
 			setErrorResponse(ctx, 400, "Insufficient balance")
 			return
 		}
@@ -84,43 +115,504 @@ Update the passbook's updated_at field and also disallow the transaction if the
 Create the transaction and commit the transaction.
 */
 func updatePassbookAndCreateTrx(conn initializers.PgxPoolIface, tr *types.Transaction) error {
+	_, err := updatePassbookAndCreateTrxs(conn, tr.PassbookID, []*types.Transaction{tr})
+	return err
+}
+
+/*
+Same as updatePassbookAndCreateTrx for a batch of transactions of one passbook, either all of them are created or none.
+The balance is checked once all transactions are applied since statements are not always ordered by date.
+Returns the new total balance of the passbook.
+*/
+func updatePassbookAndCreateTrxs(conn initializers.PgxPoolIface, passbookID string, trs []*types.Transaction) (types.Money, error) {
 	tx, err := conn.Begin(context.Background())
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer tx.Rollback(context.Background())
 	// get the passbook details
 	var passbook types.Passbook
-	err = tx.QueryRow(context.Background(), "SELECT total_balance FROM passbook_app.passbooks WHERE passbook_id=$1 FOR UPDATE", tr.PassbookID).Scan(&passbook.TotalBalance)
+	err = tx.QueryRow(context.Background(), "SELECT total_balance FROM passbook_app.passbooks WHERE passbook_id=$1 FOR UPDATE", passbookID).Scan(&passbook.TotalBalance)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	// update the total balance of the passbook depending on the transaction type
-	if tr.TransactionType == "CREDIT" {
-		passbook.TotalBalance += tr.Amount
-	} else {
-		passbook.TotalBalance -= tr.Amount
+	for _, tr := range trs {
+		passbook.TotalBalance += transactionEffect(tr.TransactionType, tr.Amount)
+		passbook.UpdatedAt = tr.UpdatedAt
 	}
 	// if the new balance is less than 0, return an error
 	if passbook.TotalBalance < 0 {
-		return errors.New("insufficient balance")
+		return 0, errInsufficientBalance
 	}
 	// update the passbook's updated_at and total_balance field
-	passbook.UpdatedAt = tr.UpdatedAt
-	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.passbooks SET total_balance=$1, updated_at=$2 WHERE passbook_id=$3", passbook.TotalBalance, passbook.UpdatedAt, tr.PassbookID)
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.passbooks SET total_balance=$1, updated_at=$2 WHERE passbook_id=$3", passbook.TotalBalance, passbook.UpdatedAt, passbookID)
+	if err != nil {
+		return 0, err
+	}
+	// create the transactions
+	for _, tr := range trs {
+		err = insertTrx(tx, tr)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// commit the transaction
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	return passbook.TotalBalance, nil
+}
+
+// insert a transaction row, the caller is responsible for updating the balance of the passbook in the same db transaction
+func insertTrx(tx pgx.Tx, tr *types.Transaction) error {
+	// external_id is only set for imported transactions, store NULL otherwise so the unique index ignores them
+	var externalID *string
+	if tr.ExternalID != "" {
+		externalID = &tr.ExternalID
+	}
+	_, err := tx.Exec(context.Background(), "INSERT INTO passbook_app.transactions (transaction_id, amount, transaction_date, transaction_type, party_name, description, created_at, updated_at, tags, passbook_id, user_id, transfer_id, external_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)",
+		tr.TransactionID, tr.Amount, tr.TransactionDate, tr.TransactionType, tr.PartyName, tr.Description, tr.CreatedAt, tr.UpdatedAt, tr.Tags, tr.PassbookID, tr.UserID, tr.TransferID, externalID)
+	return err
+}
+
+func UpdateTransaction(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	passbookID := ctx.Param("passbook_id")
+	transactionID := ctx.Param("transaction_id")
+	var req transactionReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		setErrorResponse(ctx, 400, invalidBodyMessage(err))
+		return
+	}
+	transaction := req.Transaction
+	// input sanitization
+	err := sanitizeTransactionRequest(&transaction)
+	if err != nil {
+		setErrorResponse(ctx, 400, err.Error())
+		return
+	}
+	// passbook_id in the body is optional, when it differs from the path the transaction is moved to that passbook
+	transaction.PassbookID = utils.TrimAndSanitizeStrict(transaction.PassbookID)
+	if transaction.PassbookID == "" {
+		transaction.PassbookID = passbookID
+	}
+	canAccess := passbookAccess(ctx)
+	if !canAccess(transaction.PassbookID) {
+		setErrorResponse(ctx, 403, "Token is not allowed to access this passbook")
+		return
+	}
+	transaction.TransactionID = transactionID
+	transaction.UserID = loggedInUserID
+	transaction.UpdatedAt = time.Now().UTC()
+	err = updatePassbooksAndUpdateTrx(initializers.DB, passbookID, &transaction, normalizeCurrency(req.Currency), canAccess)
+	if err != nil {
+		switch {
+		case errors.Is(err, errTransactionNotFound):
+			setErrorResponse(ctx, 404, "Transaction not found or not authorized")
+		case errors.Is(err, errPassbookNotFound):
+			setErrorResponse(ctx, 403, "Invalid passbook")
+		case errors.Is(err, errPassbookNotAccessible):
+			setErrorResponse(ctx, 403, "Token is not allowed to access the passbook of the other leg of the transfer")
+		case errors.Is(err, errInsufficientBalance):
+			setErrorResponse(ctx, 400, "Insufficient balance")
+		case errors.Is(err, errTransferLegImmutable):
+			setErrorResponse(ctx, 400, "Passbook and transaction type of a transfer cannot be changed")
+		case errors.Is(err, errCurrencyMismatch):
+			setErrorResponse(ctx, 400, "Currency of the transaction does not match the currency of the passbook")
+		default:
+			log.Printf("Error updating transaction %s for passbook %s: %v", transactionID, passbookID, err)
+			setErrorResponse(ctx, 500, "Failed to update transaction")
+		}
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Transaction updated successfully",
+		"data": map[string]interface{}{
+			"transaction": transaction,
+		},
+	})
+}
+
+/*
+Lock the current and the target passbook, reverse the effect of the old transaction on the current passbook and
+apply the effect of the updated transaction on the target passbook. Both passbooks are locked before the transaction
+row and always in the same order so concurrent updates cannot deadlock. Disallow the update if any of the new
+balances is less than 0.
+When the transaction is a leg of a transfer the passbook of the other leg is locked as well and the amount and
+transaction date are copied over to the other leg so both legs stay consistent.
+The transaction can only move to a passbook of the same currency, currency is the one the client sent, if any.
+canAccess tells whether the access token of the request may use the passbook of the other leg.
+*/
+func updatePassbooksAndUpdateTrx(conn initializers.PgxPoolIface, currentPassbookID string, tr *types.Transaction, currency string, canAccess func(passbookID string) bool) error {
+	tx, err := conn.Begin(context.Background())
 	if err != nil {
 		return err
 	}
-	// create the transaction
-	_, err = tx.Exec(context.Background(), "INSERT INTO passbook_app.transactions (transaction_id, amount, transaction_date, transaction_type, party_name, description, created_at, updated_at, tags, passbook_id, user_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)", tr.TransactionID, tr.Amount, tr.TransactionDate, tr.TransactionType, tr.PartyName, tr.Description, tr.CreatedAt, tr.UpdatedAt, tr.Tags, tr.PassbookID, tr.UserID)
+	defer tx.Rollback(context.Background())
+	otherLeg, err := findTransferCounterpart(tx, tr.UserID, tr.TransactionID)
 	if err != nil {
 		return err
 	}
-	// commit the transaction
-	err = tx.Commit(context.Background())
+	if otherLeg.PassbookID != "" && !canAccess(otherLeg.PassbookID) {
+		return errPassbookNotAccessible
+	}
+	balances, err := lockPassbooks(tx, tr.UserID, currentPassbookID, tr.PassbookID, otherLeg.PassbookID)
+	if err != nil {
+		return err
+	}
+	if _, ok := balances[currentPassbookID]; !ok {
+		return errTransactionNotFound
+	}
+	if _, ok := balances[tr.PassbookID]; !ok {
+		return errPassbookNotFound
+	}
+	if tr.PassbookID != currentPassbookID || currency != "" {
+		currencies, err := passbookCurrencies(tx, currentPassbookID, tr.PassbookID)
+		if err != nil {
+			return err
+		}
+		if currencies[tr.PassbookID] != currencies[currentPassbookID] || !currencyMatches(currency, currencies[tr.PassbookID]) {
+			return errCurrencyMismatch
+		}
+	}
+	// get the existing transaction
+	var old types.Transaction
+	err = tx.QueryRow(context.Background(), "SELECT amount, transaction_type, created_at, transfer_id FROM passbook_app.transactions WHERE transaction_id=$1 AND passbook_id=$2 AND user_id=$3 AND deleted_at IS NULL FOR UPDATE",
+		tr.TransactionID, currentPassbookID, tr.UserID).Scan(&old.Amount, &old.TransactionType, &old.CreatedAt, &old.TransferID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errTransactionNotFound
+		}
+		return err
+	}
+	tr.CreatedAt = old.CreatedAt
+	tr.TransferID = old.TransferID
+	// reverse the old transaction and apply the updated one
+	balances[currentPassbookID] -= transactionEffect(old.TransactionType, old.Amount)
+	balances[tr.PassbookID] += transactionEffect(tr.TransactionType, tr.Amount)
+	if old.TransferID != nil {
+		if tr.PassbookID != currentPassbookID || tr.TransactionType != old.TransactionType {
+			return errTransferLegImmutable
+		}
+		// the other leg was looked up before taking the locks, make sure it is still the same
+		if _, ok := balances[otherLeg.PassbookID]; !ok || otherLeg.TransferID != *old.TransferID {
+			return errTransactionNotFound
+		}
+		var otherType string
+		err = tx.QueryRow(context.Background(), "SELECT transaction_type FROM passbook_app.transactions WHERE transaction_id=$1 AND transfer_id=$2 FOR UPDATE", otherLeg.TransactionID, otherLeg.TransferID).Scan(&otherType)
+		if err != nil {
+			return err
+		}
+		balances[otherLeg.PassbookID] += transactionEffect(otherType, tr.Amount) - transactionEffect(otherType, old.Amount)
+		_, err = tx.Exec(context.Background(), "UPDATE passbook_app.transactions SET amount=$1, transaction_date=$2, updated_at=$3 WHERE transaction_id=$4",
+			tr.Amount, tr.TransactionDate, tr.UpdatedAt, otherLeg.TransactionID)
+		if err != nil {
+			return err
+		}
+	}
+	// in passbook_id order like the locks, which keeps the statements of a db transaction predictable
+	for _, id := range slices.Sorted(maps.Keys(balances)) {
+		balance := balances[id]
+		if balance < 0 {
+			return errInsufficientBalance
+		}
+		_, err = tx.Exec(context.Background(), "UPDATE passbook_app.passbooks SET total_balance=$1, updated_at=$2 WHERE passbook_id=$3", balance, tr.UpdatedAt, id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.transactions SET amount=$1, transaction_date=$2, transaction_type=$3, party_name=$4, description=$5, tags=$6, passbook_id=$7, updated_at=$8 WHERE transaction_id=$9",
+		tr.Amount, tr.TransactionDate, tr.TransactionType, tr.PartyName, tr.Description, tr.Tags, tr.PassbookID, tr.UpdatedAt, tr.TransactionID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// the access token restriction of the request as a check that can be run inside db transactions
+func passbookAccess(ctx *gin.Context) func(passbookID string) bool {
+	return func(passbookID string) bool {
+		return middlewares.CanAccessPassbook(ctx, passbookID)
+	}
+}
+
+// lock the given passbooks of the user ordered by passbook_id and return their balances, passbooks not owned by the user are left out
+func lockPassbooks(tx pgx.Tx, userID string, passbookIDs ...string) (map[string]types.Money, error) {
+	ids := make([]string, 0, len(passbookIDs))
+	for _, id := range passbookIDs {
+		if id != "" && !utils.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	passbookIDs = ids
+	rows, err := tx.Query(context.Background(), "SELECT passbook_id, total_balance FROM passbook_app.passbooks WHERE passbook_id = ANY($1) AND user_id=$2 ORDER BY passbook_id FOR UPDATE", passbookIDs, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	balances := make(map[string]types.Money, len(passbookIDs))
+	for rows.Next() {
+		var id string
+		var balance types.Money
+		if err := rows.Scan(&id, &balance); err != nil {
+			return nil, err
+		}
+		balances[id] = balance
+	}
+	return balances, rows.Err()
+}
+
+// currencies of the given passbooks keyed by passbook_id
+func passbookCurrencies(tx pgx.Tx, passbookIDs ...string) (map[string]string, error) {
+	rows, err := tx.Query(context.Background(), "SELECT passbook_id, currency FROM passbook_app.passbooks WHERE passbook_id = ANY($1)", passbookIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	currencies := make(map[string]string, len(passbookIDs))
+	for rows.Next() {
+		var id, currency string
+		if err := rows.Scan(&id, &currency); err != nil {
+			return nil, err
+		}
+		currencies[id] = currency
+	}
+	return currencies, rows.Err()
+}
+
+// currency codes are case insensitive in requests and statements
+func normalizeCurrency(currency string) string {
+	return strings.ToUpper(strings.TrimSpace(currency))
+}
+
+// whether an amount in the given currency, empty when unknown, can be booked on a passbook in passbookCurrency
+func currencyMatches(currency string, passbookCurrency string) bool {
+	currency = normalizeCurrency(currency)
+	return currency == "" || currency == passbookCurrency
+}
+
+// the signed effect a transaction has on the balance of its passbook
+func transactionEffect(transactionType string, amount types.Money) types.Money {
+	if transactionType == "CREDIT" {
+		return amount
+	}
+	return -amount
+}
+
+func DeleteTransaction(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	passbookID := ctx.Param("passbook_id")
+	transactionID := ctx.Param("transaction_id")
+	deletedAt, err := setTrxDeletedAndUpdatePassbook(initializers.DB, loggedInUserID, passbookID, transactionID, true, passbookAccess(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, errTransactionNotFound):
+			setErrorResponse(ctx, 404, "Transaction not found or not authorized")
+		case errors.Is(err, errInsufficientBalance):
+			setErrorResponse(ctx, 400, "Insufficient balance")
+		case errors.Is(err, errPassbookNotAccessible):
+			setErrorResponse(ctx, 403, "Token is not allowed to access the passbook of the other leg of the transfer")
+		default:
+			log.Printf("Error deleting transaction %s for passbook %s: %v", transactionID, passbookID, err)
+			setErrorResponse(ctx, 500, "Failed to delete transaction")
+		}
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Transaction moved to trash",
+		"data": map[string]interface{}{
+			"transaction_id": transactionID,
+			"deleted_at":     deletedAt,
+			"purge_at":       deletedAt.Add(trashRetention()),
+		},
+	})
+}
+
+func RestoreTransaction(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	passbookID := ctx.Param("passbook_id")
+	transactionID := ctx.Param("transaction_id")
+	_, err := setTrxDeletedAndUpdatePassbook(initializers.DB, loggedInUserID, passbookID, transactionID, false, passbookAccess(ctx))
+	if err != nil {
+		switch {
+		case errors.Is(err, errTransactionNotFound):
+			setErrorResponse(ctx, 404, "Transaction not found in trash")
+		case errors.Is(err, errInsufficientBalance):
+			setErrorResponse(ctx, 400, "Insufficient balance")
+		case errors.Is(err, errPassbookNotAccessible):
+			setErrorResponse(ctx, 403, "Token is not allowed to access the passbook of the other leg of the transfer")
+		default:
+			log.Printf("Error restoring transaction %s for passbook %s: %v", transactionID, passbookID, err)
+			setErrorResponse(ctx, 500, "Failed to restore transaction")
+		}
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Transaction restored successfully",
+		"data": map[string]interface{}{
+			"transaction_id": transactionID,
+		},
+	})
+}
+
+/*
+Move a transaction to trash or restore it from trash. The passbook is locked first, then the effect of the
+transaction on total_balance is reversed when trashing and re-applied when restoring. Disallow the change if the
+new balance is less than 0. Only transactions trashed within the retention window can be restored.
+Both legs of a transfer are always trashed and restored together.
+canAccess tells whether the access token of the request may use the passbook of the other leg.
+Returns the time at which the transaction was trashed.
+*/
+func setTrxDeletedAndUpdatePassbook(conn initializers.PgxPoolIface, userID string, passbookID string, transactionID string, deleted bool, canAccess func(passbookID string) bool) (time.Time, error) {
+	timeNow := time.Now().UTC()
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return timeNow, err
+	}
+	defer tx.Rollback(context.Background())
+	otherLeg, err := findTransferCounterpart(tx, userID, transactionID)
+	if err != nil {
+		return timeNow, err
+	}
+	if otherLeg.PassbookID != "" && !canAccess(otherLeg.PassbookID) {
+		return timeNow, errPassbookNotAccessible
+	}
+	balances, err := lockPassbooks(tx, userID, passbookID, otherLeg.PassbookID)
+	if err != nil {
+		return timeNow, err
+	}
+	if _, ok := balances[passbookID]; !ok {
+		return timeNow, errTransactionNotFound
+	}
+	transactionIDs := []string{transactionID}
+	passbookIDs := []string{passbookID}
+	if otherLeg.TransactionID != "" {
+		transactionIDs = append(transactionIDs, otherLeg.TransactionID)
+		passbookIDs = append(passbookIDs, otherLeg.PassbookID)
+	}
+	var deletedAt *time.Time
+	for i, id := range transactionIDs {
+		var tr types.Transaction
+		if deleted {
+			err = tx.QueryRow(context.Background(), "SELECT amount, transaction_type FROM passbook_app.transactions WHERE transaction_id=$1 AND passbook_id=$2 AND user_id=$3 AND deleted_at IS NULL FOR UPDATE",
+				id, passbookIDs[i], userID).Scan(&tr.Amount, &tr.TransactionType)
+		} else {
+			err = tx.QueryRow(context.Background(), "SELECT amount, transaction_type FROM passbook_app.transactions WHERE transaction_id=$1 AND passbook_id=$2 AND user_id=$3 AND deleted_at >= $4 FOR UPDATE",
+				id, passbookIDs[i], userID, timeNow.Add(-trashRetention())).Scan(&tr.Amount, &tr.TransactionType)
+		}
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return timeNow, errTransactionNotFound
+			}
+			return timeNow, err
+		}
+		if deleted {
+			balances[passbookIDs[i]] -= transactionEffect(tr.TransactionType, tr.Amount)
+			deletedAt = &timeNow
+		} else {
+			balances[passbookIDs[i]] += transactionEffect(tr.TransactionType, tr.Amount)
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(balances)) {
+		balance := balances[id]
+		if balance < 0 {
+			return timeNow, errInsufficientBalance
+		}
+		_, err = tx.Exec(context.Background(), "UPDATE passbook_app.passbooks SET total_balance=$1, updated_at=$2 WHERE passbook_id=$3", balance, timeNow, id)
+		if err != nil {
+			return timeNow, err
+		}
+	}
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.transactions SET deleted_at=$1 WHERE transaction_id = ANY($2)", deletedAt, transactionIDs)
+	if err != nil {
+		return timeNow, err
+	}
+	return timeNow, tx.Commit(context.Background())
+}
+
+// GetTrashedTransactions lists the transactions of a passbook that are in trash and can still be restored
+func GetTrashedTransactions(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	passbookID := ctx.Param("passbook_id")
+	retention := trashRetention()
+	rows, err := initializers.DB.Query(context.Background(), "SELECT transaction_id, amount, transaction_date, transaction_type, party_name, description, created_at, updated_at, tags, passbook_id, user_id, transfer_id, deleted_at FROM passbook_app.transactions WHERE user_id=$1 AND passbook_id=$2 AND deleted_at >= $3 ORDER BY deleted_at DESC",
+		loggedInUserID, passbookID, time.Now().UTC().Add(-retention))
+	if err != nil {
+		log.Println("Failed to get trashed transactions for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to get trashed transactions")
+		return
+	}
+	defer rows.Close()
+	transactions := make([]types.Transaction, 0)
+	for rows.Next() {
+		var t types.Transaction
+		err := rows.Scan(&t.TransactionID, &t.Amount, &t.TransactionDate, &t.TransactionType, &t.PartyName, &t.Description, &t.CreatedAt, &t.UpdatedAt, &t.Tags, &t.PassbookID, &t.UserID, &t.TransferID, &t.DeletedAt)
+		if err != nil {
+			log.Println("Failed to scan trashed transaction for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+			setErrorResponse(ctx, 500, "Failed to get trashed transactions")
+			return
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to get trashed transactions for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to get trashed transactions")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status": "success",
+		"data": map[string][]types.Transaction{
+			"transactions": transactions,
+		},
+		"meta": map[string]int{
+			"retention_days": int(retention.Hours() / 24),
+		},
+	})
+}
+
+// how long trashed transactions are kept before being purged, configured in days with TRASH_RETENTION_DAYS
+func trashRetention() time.Duration {
+	days := 30
+	if v := os.Getenv("TRASH_RETENTION_DAYS"); v != "" {
+		if d, err := strconv.Atoi(v); err == nil && d > 0 {
+			days = d
+		} else {
+			log.Println("Invalid TRASH_RETENTION_DAYS, using default of", days, "days")
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+/*
+permanently remove the transactions that have been in trash for longer than the retention window. The external ids of
+purged imported transactions are kept in purged_imports so re-importing the statement does not restore them.
+*/
+func purgeExpiredTrash(conn initializers.PgxPoolIface) error {
+	timeNow := time.Now().UTC()
+	purgeBefore := timeNow.Add(-trashRetention())
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	_, err = tx.Exec(context.Background(), "INSERT INTO passbook_app.purged_imports (passbook_id, user_id, external_id, purged_at) SELECT passbook_id, user_id, external_id, $2 FROM passbook_app.transactions WHERE deleted_at < $1 AND external_id IS NOT NULL ON CONFLICT DO NOTHING",
+		purgeBefore, timeNow)
 	if err != nil {
 		return err
 	}
+	ctag, err := tx.Exec(context.Background(), "DELETE FROM passbook_app.transactions WHERE deleted_at < $1", purgeBefore)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(context.Background()); err != nil {
+		return err
+	}
+	log.Println("Purged", ctag.RowsAffected(), "expired transactions from trash")
 	return nil
 }
 
@@ -135,9 +627,9 @@ func GetTransaction(ctx *gin.Context) {
 		SELECT 
 			transaction_id, amount, transaction_date, transaction_type, 
 			party_name, description, created_at, updated_at, tags, 
-			passbook_id, user_id 
+			passbook_id, user_id, transfer_id 
 		FROM passbook_app.transactions 
-		WHERE transaction_id=$1 AND passbook_id=$2 AND user_id=$3
+		WHERE transaction_id=$1 AND passbook_id=$2 AND user_id=$3 AND deleted_at IS NULL
 	`
 
 	err := initializers.DB.QueryRow(
@@ -158,6 +650,7 @@ func GetTransaction(ctx *gin.Context) {
 		&transaction.Tags,
 		&transaction.PassbookID,
 		&transaction.UserID,
+		&transaction.TransferID,
 	)
 
 	if err != nil {
@@ -185,12 +678,10 @@ func sanitizeTransactionRequest(tr *types.Transaction) error {
 	if (*tr).TransactionType == "" || !utils.Contains(types.ValidTransactionTypes, (*tr).TransactionType) {
 		return errors.New("invalid transaction type")
 	}
-	// amount should fit in DECIMAL(11,2)
-	if (*tr).Amount <= 0 || (*tr).Amount > 999999999.99 {
+	// amount should fit in DECIMAL(11,2), over precise amounts are already rejected while binding the request
+	if (*tr).Amount <= 0 || (*tr).Amount > types.MaxMoney {
 		return errors.New("invalid amount")
 	}
-	// truncate total balance to 2 decimal places if more than 2 decimal digits
-	(*tr).Amount = float64(int((*tr).Amount*100)) / 100
 
 	// party name max 255 characters
 	(*tr).PartyName = utils.TrimAndSanitizeStrict((*tr).PartyName)
@@ -211,3 +702,286 @@ func sanitizeTransactionRequest(tr *types.Transaction) error {
 
 	return nil
 }
+
+// columns a client is allowed to sort the transaction listing by
+var transactionSortColumns = map[string]string{
+	"transaction_date": "transaction_date",
+	"amount":           "amount",
+	"party_name":       "party_name",
+	"created_at":       "created_at",
+}
+
+// transactionFilter holds the query params accepted by the transaction listing endpoint
+type transactionFilter struct {
+	PartyName       string
+	Tags            []string
+	TransactionType string
+	FromDate        *time.Time
+	ToDate          *time.Time
+	MinAmount       *types.Money
+	MaxAmount       *types.Money
+	SortBy          string
+	SortOrder       string
+	Page            int
+	Limit           int
+	// plain dates without a time, they are days in the time zone of the user
+	fromDateOnly bool
+	toDateOnly   bool
+}
+
+/*
+Parse and validate the filter, sort and pagination query params of a transaction listing request.
+Dates can either be RFC3339 timestamps or plain YYYY-MM-DD dates, a plain to_date includes the whole day.
+*/
+func parseTransactionFilter(ctx *gin.Context) (transactionFilter, error) {
+	filter := transactionFilter{
+		SortBy:    "transaction_date",
+		SortOrder: "DESC",
+		Page:      1,
+		Limit:     10,
+	}
+	filter.PartyName = utils.TrimAndSanitizeStrict(ctx.Query("party_name"))
+	if len(filter.PartyName) > 255 {
+		return filter, errors.New("invalid party name")
+	}
+	if tags := utils.TrimAndSanitizeStrict(ctx.Query("tags")); tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				filter.Tags = append(filter.Tags, tag)
+			}
+		}
+	}
+	// README documents the short form "type" so accept both
+	trType := ctx.Query("transaction_type")
+	if trType == "" {
+		trType = ctx.Query("type")
+	}
+	if trType != "" {
+		filter.TransactionType = strings.ToUpper(utils.TrimAndSanitizeStrict(trType))
+		if !utils.Contains(types.ValidTransactionTypes, filter.TransactionType) {
+			return filter, errors.New("invalid transaction type")
+		}
+	}
+	if v := ctx.Query("from_date"); v != "" {
+		fromDate, dateOnly, err := parseDateParam(v)
+		if err != nil {
+			return filter, errors.New("invalid from_date")
+		}
+		filter.FromDate = &fromDate
+		filter.fromDateOnly = dateOnly
+	}
+	if v := ctx.Query("to_date"); v != "" {
+		toDate, dateOnly, err := parseDateParam(v)
+		if err != nil {
+			return filter, errors.New("invalid to_date")
+		}
+		if dateOnly {
+			toDate = toDate.AddDate(0, 0, 1).Add(-time.Microsecond)
+		}
+		filter.ToDate = &toDate
+		filter.toDateOnly = dateOnly
+	}
+	if filter.FromDate != nil && filter.ToDate != nil && filter.FromDate.After(*filter.ToDate) {
+		return filter, errors.New("from_date should not be after to_date")
+	}
+	if v := ctx.Query("min_amount"); v != "" {
+		minAmount, err := types.ParseMoney(v)
+		if err != nil || minAmount < 0 {
+			return filter, errors.New("invalid min_amount")
+		}
+		filter.MinAmount = &minAmount
+	}
+	if v := ctx.Query("max_amount"); v != "" {
+		maxAmount, err := types.ParseMoney(v)
+		if err != nil || maxAmount < 0 {
+			return filter, errors.New("invalid max_amount")
+		}
+		filter.MaxAmount = &maxAmount
+	}
+	if filter.MinAmount != nil && filter.MaxAmount != nil && *filter.MinAmount > *filter.MaxAmount {
+		return filter, errors.New("min_amount should not be greater than max_amount")
+	}
+	if v := ctx.Query("sort_by"); v != "" {
+		if _, ok := transactionSortColumns[v]; !ok {
+			return filter, errors.New("invalid sort_by")
+		}
+		filter.SortBy = v
+	}
+	if v := ctx.Query("sort_order"); v != "" {
+		filter.SortOrder = strings.ToUpper(v)
+		if filter.SortOrder != "ASC" && filter.SortOrder != "DESC" {
+			return filter, errors.New("invalid sort_order")
+		}
+	}
+	if v := ctx.Query("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return filter, errors.New("invalid page")
+		}
+		filter.Page = page
+	}
+	if v := ctx.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 100 {
+			return filter, errors.New("invalid limit, should be between 1 and 100")
+		}
+		filter.Limit = limit
+	}
+	// the offset is bound as an int4 so it has to fit in 32 bits
+	if filter.Page-1 > math.MaxInt32/filter.Limit {
+		return filter, errors.New("invalid page, too large")
+	}
+	return filter, nil
+}
+
+// parseDateParam accepts a RFC3339 timestamp or a YYYY-MM-DD date and reports which one it was
+func parseDateParam(v string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), false, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+/*
+Move the plain from_date and to_date of the filter into the time zone of the user, so a day starts at midnight there.
+Plain dates are parsed as UTC and keep their clock time, timestamps with an offset are left as they are.
+*/
+func (f *transactionFilter) setTimeZone(loc *time.Location) {
+	inZone := func(t time.Time) *time.Time {
+		local := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+		return &local
+	}
+	if f.FromDate != nil && f.fromDateOnly {
+		f.FromDate = inZone(*f.FromDate)
+	}
+	if f.ToDate != nil && f.toDateOnly {
+		f.ToDate = inZone(*f.ToDate)
+	}
+}
+
+// build the WHERE clause and its positional args for the given filter, args start at $1 with user_id
+func (f transactionFilter) whereClause(userID string, passbookID string) (string, []any) {
+	conditions := []string{"user_id=$1", "deleted_at IS NULL"}
+	args := []any{userID}
+	addCondition := func(format string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if passbookID != "" {
+		addCondition("passbook_id=$%d", passbookID)
+	}
+	if f.PartyName != "" {
+		addCondition("party_name ILIKE $%d", "%"+escapeLikePattern(f.PartyName)+"%")
+	}
+	if len(f.Tags) > 0 {
+		// tags are stored as a comma separated list, match transactions having any of the requested tags
+		addCondition("regexp_split_to_array(COALESCE(tags, ''), '\\s*,\\s*') && $%d::text[]", f.Tags)
+	}
+	if f.TransactionType != "" {
+		addCondition("transaction_type=$%d", f.TransactionType)
+	}
+	if f.FromDate != nil {
+		addCondition("transaction_date >= $%d", *f.FromDate)
+	}
+	if f.ToDate != nil {
+		addCondition("transaction_date <= $%d", *f.ToDate)
+	}
+	if f.MinAmount != nil {
+		addCondition("amount >= $%d", *f.MinAmount)
+	}
+	if f.MaxAmount != nil {
+		addCondition("amount <= $%d", *f.MaxAmount)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// ORDER BY clause for the filter, transaction_id is the tie breaker so pages are stable
+func (f transactionFilter) orderByClause() string {
+	return fmt.Sprintf("%s %s, transaction_id %s", transactionSortColumns[f.SortBy], f.SortOrder, f.SortOrder)
+}
+
+// escape the LIKE wildcards so user input is matched literally
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func GetTransactions(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	passbookID := ctx.Param("passbook_id")
+	filter, err := parseTransactionFilter(ctx)
+	if err != nil {
+		setErrorResponse(ctx, 400, err.Error())
+		return
+	}
+	// return 404 if the passbook does not exist or is not owned by the user
+	var pbid string
+	err = initializers.DB.QueryRow(context.Background(), "SELECT passbook_id FROM passbook_app.passbooks WHERE passbook_id=$1 AND user_id=$2", passbookID, loggedInUserID).Scan(&pbid)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			setErrorResponse(ctx, 404, "Passbook not found")
+			return
+		}
+		log.Println("Failed to check passbook for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to get transactions")
+		return
+	}
+	format, err := userFormat(loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get preferences of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get transactions")
+		return
+	}
+	filter.setTimeZone(format.Location)
+	where, args := filter.whereClause(loggedInUserID, passbookID)
+	var totalCount int
+	err = initializers.DB.QueryRow(context.Background(), "SELECT COUNT(*) FROM passbook_app.transactions WHERE "+where, args...).Scan(&totalCount)
+	if err != nil {
+		log.Println("Failed to count transactions for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to get transactions")
+		return
+	}
+	args = append(args, filter.Limit, (filter.Page-1)*filter.Limit)
+	query := fmt.Sprintf("SELECT transaction_id, amount, transaction_date, transaction_type, party_name, description, created_at, updated_at, tags, passbook_id, user_id, transfer_id FROM passbook_app.transactions WHERE %s ORDER BY %s LIMIT $%d OFFSET $%d",
+		where, filter.orderByClause(), len(args)-1, len(args))
+	rows, err := initializers.DB.Query(context.Background(), query, args...)
+	if err != nil {
+		log.Println("Failed to get transactions for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to get transactions")
+		return
+	}
+	defer rows.Close()
+	transactions := make([]types.Transaction, 0, filter.Limit)
+	for rows.Next() {
+		var t types.Transaction
+		err := rows.Scan(&t.TransactionID, &t.Amount, &t.TransactionDate, &t.TransactionType, &t.PartyName, &t.Description, &t.CreatedAt, &t.UpdatedAt, &t.Tags, &t.PassbookID, &t.UserID, &t.TransferID)
+		if err != nil {
+			log.Println("Failed to scan transaction for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+			setErrorResponse(ctx, 500, "Failed to get transactions")
+			return
+		}
+		t.TransactionDate = format.In(t.TransactionDate)
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to get transactions for user_id:", loggedInUserID, "passbook_id:", passbookID, err)
+		setErrorResponse(ctx, 500, "Failed to get transactions")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Transactions fetched successfully",
+		"data": map[string][]types.Transaction{
+			"transactions": transactions,
+		},
+		"meta": map[string]int{
+			"total_pages": int(math.Ceil(float64(totalCount) / float64(filter.Limit))),
+			"total_count": totalCount,
+			"page":        filter.Page,
+			"limit":       filter.Limit,
+		},
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,7 +33,7 @@ func TestGetTransaction(t *testing.T) {
 
 	// Expected SQL query from GetTransaction handler (normalized)
 	// Using pgxmock.QueryMatcherRegexp for more robust matching.
-	expectedSQL := `^SELECT transaction_id, amount, transaction_date, transaction_type, party_name, description, created_at, updated_at, tags, passbook_id, user_id FROM passbook_app.transactions WHERE transaction_id=\$1 AND passbook_id=\$2 AND user_id=\$3$`
+	expectedSQL := `^SELECT transaction_id, amount, transaction_date, transaction_type, party_name, description, created_at, updated_at, tags, passbook_id, user_id, transfer_id FROM passbook_app.transactions WHERE transaction_id=\$1 AND passbook_id=\$2 AND user_id=\$3 AND deleted_at IS NULL$`
 
 	testUserID := "test-user-id"
 	testPassbookID := "test-passbook-id"
@@ -62,7 +63,7 @@ func TestGetTransaction(t *testing.T) {
 		sampleTime := time.Now().UTC().Truncate(time.Microsecond)
 		expectedTransaction := types.Transaction{
 			TransactionID:   testTransactionID,
-			Amount:          100.50,
+			Amount:          types.Money(10050),
 			TransactionDate: sampleTime,
 			TransactionType: "CREDIT",
 			PartyName:       "Test Party",
@@ -77,7 +78,7 @@ func TestGetTransaction(t *testing.T) {
 		rows := pgxmock.NewRows([]string{
 			"transaction_id", "amount", "transaction_date", "transaction_type",
 			"party_name", "description", "created_at", "updated_at", "tags",
-			"passbook_id", "user_id",
+			"passbook_id", "user_id", "transfer_id",
 		}).AddRow(
 			expectedTransaction.TransactionID,
 			expectedTransaction.Amount,
@@ -90,6 +91,7 @@ func TestGetTransaction(t *testing.T) {
 			expectedTransaction.Tags,
 			expectedTransaction.PassbookID,
 			expectedTransaction.UserID,
+			nil,
 		)
 
 		mockDB.ExpectQuery(expectedSQL).
@@ -117,7 +119,7 @@ func TestGetTransaction(t *testing.T) {
 		assert.True(t, ok, "transaction field is not a map")
 
 		assert.Equal(t, expectedTransaction.TransactionID, transactionData["transaction_id"])
-		assert.Equal(t, expectedTransaction.Amount, transactionData["amount"])
+		assert.Equal(t, 100.50, transactionData["amount"])
 		assert.Equal(t, expectedTransaction.TransactionType, transactionData["transaction_type"])
 		assert.Equal(t, expectedTransaction.PartyName, transactionData["party_name"])
 		// Time needs special handling for comparison due to potential time zone/format issues in JSON
@@ -173,3 +175,503 @@ func TestGetTransaction(t *testing.T) {
 		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
 	})
 }
+
+func TestGetTransactions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	passbookSQL := `^SELECT passbook_id FROM passbook_app.passbooks WHERE passbook_id=\$1 AND user_id=\$2$`
+
+	testUserID := "test-user-id"
+	testPassbookID := "test-passbook-id"
+
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	v1 := router.Group("/v1")
+	passbooks := v1.Group("/passbooks", authTestMiddleware())
+	{
+		transactions := passbooks.Group("/:passbook_id/transactions")
+		{
+			transactions.GET("", GetTransactions)
+		}
+	}
+	reqURL := fmt.Sprintf("/v1/passbooks/%s/transactions", testPassbookID)
+
+	t.Run("Filtered and paginated fetch", func(t *testing.T) {
+		sampleTime := time.Now().UTC().Truncate(time.Microsecond)
+		mockDB.ExpectQuery(passbookSQL).
+			WithArgs(testPassbookID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id"}).AddRow(testPassbookID))
+		expectPreferences(mockDB, testUserID)
+		mockDB.ExpectQuery(`^SELECT COUNT\(\*\) FROM passbook_app.transactions WHERE user_id=\$1 AND deleted_at IS NULL AND passbook_id=\$2 AND party_name ILIKE \$3 AND .* && \$4::text\[\] AND transaction_type=\$5$`).
+			WithArgs(testUserID, testPassbookID, "%Gupta%", []string{"fun", "food"}, "CREDIT").
+			WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(11))
+		mockDB.ExpectQuery(`^SELECT transaction_id, .* FROM passbook_app.transactions WHERE .* ORDER BY amount ASC, transaction_id ASC LIMIT \$6 OFFSET \$7$`).
+			WithArgs(testUserID, testPassbookID, "%Gupta%", []string{"fun", "food"}, "CREDIT", 5, 5).
+			WillReturnRows(pgxmock.NewRows([]string{
+				"transaction_id", "amount", "transaction_date", "transaction_type",
+				"party_name", "description", "created_at", "updated_at", "tags",
+				"passbook_id", "user_id", "transfer_id",
+			}).AddRow("trx-1", 10.25, sampleTime, "CREDIT", "Aditya Gupta", "ice cream", sampleTime, sampleTime, "fun", testPassbookID, testUserID, nil))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL+"?party_name=Gupta&tags=fun,food&type=credit&sort_by=amount&sort_order=asc&page=2&limit=5", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var responseBody map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+		meta, ok := responseBody["meta"].(map[string]interface{})
+		assert.True(t, ok, "meta field is not a map")
+		assert.Equal(t, float64(3), meta["total_pages"])
+		assert.Equal(t, float64(2), meta["page"])
+		assert.Equal(t, float64(5), meta["limit"])
+		data := responseBody["data"].(map[string]interface{})
+		assert.Len(t, data["transactions"], 1)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	t.Run("Plain dates are days in the time zone of the user", func(t *testing.T) {
+		kolkata, _ := time.LoadLocation("Asia/Kolkata")
+		from := time.Date(2024, 4, 1, 0, 0, 0, 0, kolkata)
+		to := time.Date(2024, 5, 1, 0, 0, 0, 0, kolkata).Add(-time.Microsecond)
+		sampleTime := time.Date(2024, 3, 31, 20, 0, 0, 0, time.UTC)
+		mockDB.ExpectQuery(passbookSQL).
+			WithArgs(testPassbookID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id"}).AddRow(testPassbookID))
+		expectPreferences(mockDB, testUserID, types.Preferences{Currency: "INR", TimeZone: "Asia/Kolkata", Locale: "en-IN", DateFormat: "DD/MM/YYYY"})
+		mockDB.ExpectQuery(`^SELECT COUNT\(\*\) FROM passbook_app.transactions WHERE user_id=\$1 AND deleted_at IS NULL AND passbook_id=\$2 AND transaction_date >= \$3 AND transaction_date <= \$4$`).
+			WithArgs(testUserID, testPassbookID, sameInstant{from}, sameInstant{to}).
+			WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(1))
+		mockDB.ExpectQuery(`^SELECT transaction_id, .* FROM passbook_app.transactions WHERE .* LIMIT \$5 OFFSET \$6$`).
+			WithArgs(testUserID, testPassbookID, sameInstant{from}, sameInstant{to}, 10, 0).
+			WillReturnRows(pgxmock.NewRows([]string{
+				"transaction_id", "amount", "transaction_date", "transaction_type",
+				"party_name", "description", "created_at", "updated_at", "tags",
+				"passbook_id", "user_id", "transfer_id",
+			}).AddRow("trx-1", 10.25, sampleTime, "CREDIT", "Aditya Gupta", "ice cream", sampleTime, sampleTime, "fun", testPassbookID, testUserID, nil))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL+"?from_date=2024-04-01&to_date=2024-04-30", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		// the date is shown in the time zone of the user
+		assert.Contains(t, w.Body.String(), `"transaction_date":"2024-04-01T01:30:00+05:30"`)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	t.Run("Invalid filter", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL+"?sort_by=password", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	t.Run("Page too large", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL+"?page=9223372036854775807&limit=100", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	t.Run("Passbook not found", func(t *testing.T) {
+		mockDB.ExpectQuery(passbookSQL).
+			WithArgs(testPassbookID, testUserID).
+			WillReturnError(pgx.ErrNoRows)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", reqURL, nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+}
+
+func TestUpdateTransaction(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	testUserID := "test-user-id"
+	testPassbookID := "test-passbook-id"
+	testTransactionID := "test-transaction-id"
+
+	authTestMiddleware := func() gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Set("userId", testUserID)
+			c.Next()
+		}
+	}
+
+	router := gin.New()
+	v1 := router.Group("/v1")
+	passbooks := v1.Group("/passbooks", authTestMiddleware())
+	{
+		transactions := passbooks.Group("/:passbook_id/transactions")
+		{
+			transactions.PATCH("/:transaction_id", UpdateTransaction)
+		}
+	}
+	reqURL := fmt.Sprintf("/v1/passbooks/%s/transactions/%s", testPassbookID, testTransactionID)
+	lockSQL := `^SELECT passbook_id, total_balance FROM passbook_app.passbooks WHERE passbook_id = ANY\(\$1\) AND user_id=\$2 ORDER BY passbook_id FOR UPDATE$`
+	counterpartSQL := `^SELECT o.transfer_id, o.transaction_id, o.passbook_id FROM passbook_app.transactions t JOIN`
+	oldTrxSQL := `^SELECT amount, transaction_type, created_at, transfer_id FROM passbook_app.transactions WHERE transaction_id=\$1 AND passbook_id=\$2 AND user_id=\$3 AND deleted_at IS NULL FOR UPDATE$`
+
+	t.Run("Flipping CREDIT to DEBIT re-computes the balance", func(t *testing.T) {
+		createdAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Microsecond)
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(counterpartSQL).
+			WithArgs(testTransactionID, testUserID).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{testPassbookID}, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).AddRow(testPassbookID, 100.0))
+		mockDB.ExpectQuery(oldTrxSQL).
+			WithArgs(testTransactionID, testPassbookID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"amount", "transaction_type", "created_at", "transfer_id"}).AddRow(30.0, "CREDIT", createdAt, nil))
+		// 100 - 30 (reversed credit) - 20 (new debit)
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET total_balance=\$1`).
+			WithArgs(types.Money(5000), pgxmock.AnyArg(), testPassbookID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^UPDATE passbook_app.transactions SET`).
+			WithArgs(types.Money(2000), pgxmock.AnyArg(), "DEBIT", "Test Party", "", "", testPassbookID, pgxmock.AnyArg(), testTransactionID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		body := `{"amount": 20, "transaction_date": "2024-01-01T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Test Party"}`
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", reqURL, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	t.Run("Update driving the balance negative is rejected", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(counterpartSQL).
+			WithArgs(testTransactionID, testUserID).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{testPassbookID}, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).AddRow(testPassbookID, 100.0))
+		mockDB.ExpectQuery(oldTrxSQL).
+			WithArgs(testTransactionID, testPassbookID, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"amount", "transaction_type", "created_at", "transfer_id"}).AddRow(30.0, "DEBIT", time.Now().UTC(), nil))
+		mockDB.ExpectRollback()
+
+		body := `{"amount": 200, "transaction_date": "2024-01-01T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Test Party"}`
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", reqURL, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	t.Run("Moving to a passbook not owned by the user", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(counterpartSQL).
+			WithArgs(testTransactionID, testUserID).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{testPassbookID, "other-passbook-id"}, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).AddRow(testPassbookID, 100.0))
+		mockDB.ExpectRollback()
+
+		body := `{"amount": 20, "transaction_date": "2024-01-01T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Test Party", "passbook_id": "other-passbook-id"}`
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", reqURL, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	currenciesSQL := `^SELECT passbook_id, currency FROM passbook_app.passbooks WHERE passbook_id = ANY\(\$1\)$`
+
+	t.Run("Moving to a passbook in another currency is rejected", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(counterpartSQL).
+			WithArgs(testTransactionID, testUserID).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{testPassbookID, "usd-passbook-id"}, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).AddRow(testPassbookID, 100.0).AddRow("usd-passbook-id", 100.0))
+		mockDB.ExpectQuery(currenciesSQL).
+			WithArgs([]string{testPassbookID, "usd-passbook-id"}).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "currency"}).AddRow(testPassbookID, "INR").AddRow("usd-passbook-id", "USD"))
+		mockDB.ExpectRollback()
+
+		body := `{"amount": 20, "transaction_date": "2024-01-01T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Test Party", "passbook_id": "usd-passbook-id"}`
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", reqURL, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "does not match the currency of the passbook")
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+
+	t.Run("Currency of the request has to match the passbook", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(counterpartSQL).
+			WithArgs(testTransactionID, testUserID).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{testPassbookID}, testUserID).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).AddRow(testPassbookID, 100.0))
+		mockDB.ExpectQuery(currenciesSQL).
+			WithArgs([]string{testPassbookID, testPassbookID}).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "currency"}).AddRow(testPassbookID, "INR"))
+		mockDB.ExpectRollback()
+
+		body := `{"amount": 20, "transaction_date": "2024-01-01T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Test Party", "currency": "eur"}`
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", reqURL, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet(), "pgxmock expectations not met")
+	})
+}
+
+func TestCreateTransaction(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/passbooks/:passbook_id/transactions", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, CreateTransaction)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/passbooks/test-passbook-id/transactions", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	passbookSQL := `^SELECT currency FROM passbook_app.passbooks WHERE passbook_id=\$1 AND user_id=\$2$`
+
+	t.Run("Transaction in the currency of the passbook", func(t *testing.T) {
+		mockDB.ExpectQuery(passbookSQL).
+			WithArgs("test-passbook-id", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"currency"}).AddRow("USD"))
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(`^SELECT total_balance FROM passbook_app.passbooks WHERE passbook_id=\$1 FOR UPDATE$`).
+			WithArgs("test-passbook-id").
+			WillReturnRows(pgxmock.NewRows([]string{"total_balance"}).AddRow(types.Money(10000)))
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET total_balance=\$1`).
+			WithArgs(types.Money(8000), pgxmock.AnyArg(), "test-passbook-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.transactions`).
+			WithArgs(anyArgs(13)...).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := post(`{"amount": 20, "currency": "usd", "transaction_date": "2024-01-01T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Test Party"}`)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Transaction in another currency is rejected", func(t *testing.T) {
+		mockDB.ExpectQuery(passbookSQL).
+			WithArgs("test-passbook-id", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"currency"}).AddRow("INR"))
+
+		w := post(`{"amount": 20, "currency": "EUR", "transaction_date": "2024-01-01T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Test Party"}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Currency EUR does not match the currency INR of the passbook")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+// matches a time argument that is the given duration before now, allowing for the runtime of the test
+type timeAgo struct{ d time.Duration }
+
+func (a timeAgo) Match(v any) bool {
+	t, ok := v.(time.Time)
+	diff := time.Now().Add(-a.d).Sub(t)
+	return ok && diff >= 0 && diff < time.Minute
+}
+
+func TestTrash(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("TRASH_RETENTION_DAYS", "7")
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	transactions := router.Group("/v1/passbooks/:passbook_id/transactions", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	})
+	transactions.DELETE("/:transaction_id", DeleteTransaction)
+	transactions.POST("/:transaction_id/restore", RestoreTransaction)
+	transactions.GET("/trash", GetTrashedTransactions)
+	send := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/v1/passbooks/test-passbook-id/transactions"+path, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	retention := 7 * 24 * time.Hour
+	counterpartSQL := `^SELECT o.transfer_id, o.transaction_id, o.passbook_id FROM passbook_app.transactions t JOIN`
+	lockSQL := `^SELECT passbook_id, total_balance FROM passbook_app.passbooks WHERE passbook_id = ANY\(\$1\) AND user_id=\$2 ORDER BY passbook_id FOR UPDATE$`
+	activeSQL := `^SELECT amount, transaction_type FROM passbook_app.transactions WHERE transaction_id=\$1 AND passbook_id=\$2 AND user_id=\$3 AND deleted_at IS NULL FOR UPDATE$`
+	trashedSQL := `^SELECT amount, transaction_type FROM passbook_app.transactions WHERE transaction_id=\$1 AND passbook_id=\$2 AND user_id=\$3 AND deleted_at >= \$4 FOR UPDATE$`
+	expectLocked := func(balance types.Money) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(counterpartSQL).
+			WithArgs("test-transaction-id", "test-user-id").
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{"test-passbook-id"}, "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).AddRow("test-passbook-id", balance))
+	}
+
+	t.Run("Delete reverses the transaction on the balance", func(t *testing.T) {
+		expectLocked(10000)
+		mockDB.ExpectQuery(activeSQL).
+			WithArgs("test-transaction-id", "test-passbook-id", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"amount", "transaction_type"}).AddRow(types.Money(3000), "CREDIT"))
+		// 100 - 30 of the trashed credit
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET total_balance=\$1, updated_at=\$2 WHERE passbook_id=\$3$`).
+			WithArgs(types.Money(7000), pgxmock.AnyArg(), "test-passbook-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^UPDATE passbook_app.transactions SET deleted_at=\$1 WHERE transaction_id = ANY\(\$2\)$`).
+			WithArgs(pgxmock.AnyArg(), []string{"test-transaction-id"}).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := send("DELETE", "/test-transaction-id")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var responseBody struct {
+			Data struct {
+				DeletedAt time.Time `json:"deleted_at"`
+				PurgeAt   time.Time `json:"purge_at"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+		assert.Equal(t, retention, responseBody.Data.PurgeAt.Sub(responseBody.Data.DeletedAt))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Restore driving the balance negative is rejected", func(t *testing.T) {
+		expectLocked(1000)
+		mockDB.ExpectQuery(trashedSQL).
+			WithArgs("test-transaction-id", "test-passbook-id", "test-user-id", timeAgo{retention}).
+			WillReturnRows(pgxmock.NewRows([]string{"amount", "transaction_type"}).AddRow(types.Money(3000), "DEBIT"))
+		mockDB.ExpectRollback()
+
+		w := send("POST", "/test-transaction-id/restore")
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Insufficient balance")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Restoring a transaction that is not in trash", func(t *testing.T) {
+		expectLocked(1000)
+		mockDB.ExpectQuery(trashedSQL).
+			WithArgs("test-transaction-id", "test-passbook-id", "test-user-id", timeAgo{retention}).
+			WillReturnError(pgx.ErrNoRows)
+		mockDB.ExpectRollback()
+
+		w := send("POST", "/test-transaction-id/restore")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Contains(t, w.Body.String(), "Transaction not found in trash")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Trash lists the transactions inside the retention window", func(t *testing.T) {
+		deletedAt := time.Now().UTC().Add(-time.Hour)
+		mockDB.ExpectQuery(`^SELECT transaction_id, .* FROM passbook_app.transactions WHERE user_id=\$1 AND passbook_id=\$2 AND deleted_at >= \$3 ORDER BY deleted_at DESC$`).
+			WithArgs("test-user-id", "test-passbook-id", timeAgo{retention}).
+			WillReturnRows(pgxmock.NewRows([]string{"transaction_id", "amount", "transaction_date", "transaction_type", "party_name", "description", "created_at", "updated_at", "tags", "passbook_id", "user_id", "transfer_id", "deleted_at"}).
+				AddRow("test-transaction-id", types.Money(3000), deletedAt, "CREDIT", "Party", "", deletedAt, deletedAt, "", "test-passbook-id", "test-user-id", nil, &deletedAt))
+
+		w := send("GET", "/trash")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var responseBody struct {
+			Data struct {
+				Transactions []types.Transaction `json:"transactions"`
+			} `json:"data"`
+			Meta struct {
+				RetentionDays int `json:"retention_days"`
+			} `json:"meta"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+		assert.Len(t, responseBody.Data.Transactions, 1)
+		assert.Equal(t, 7, responseBody.Meta.RetentionDays)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Purge removes transactions trashed before the retention window", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		// imported transactions leave their external id behind so the next import skips them
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.purged_imports \(passbook_id, user_id, external_id, purged_at\) SELECT passbook_id, user_id, external_id, \$2 FROM passbook_app.transactions WHERE deleted_at < \$1 AND external_id IS NOT NULL ON CONFLICT DO NOTHING$`).
+			WithArgs(timeAgo{retention}, timeAgo{0}).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.transactions WHERE deleted_at < \$1$`).
+			WithArgs(timeAgo{retention}).
+			WillReturnResult(pgxmock.NewResult("DELETE", 2))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		assert.NoError(t, purgeExpiredTrash(mockDB))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
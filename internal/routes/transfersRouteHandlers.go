@@ -0,0 +1,249 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/middlewares"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/akashsharma99/passbook-app/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+type TransferReq struct {
+	FromPassbookID  string      `json:"from_passbook_id"`
+	ToPassbookID    string      `json:"to_passbook_id"`
+	Amount          types.Money `json:"amount"`
+	TransactionDate time.Time   `json:"transaction_date"`
+	Description     string      `json:"description"`
+	Tags            string      `json:"tags"`
+}
+
+// one leg of a transfer as seen from the other leg
+type transferLeg struct {
+	TransferID    string
+	TransactionID string
+	PassbookID    string
+}
+
+// route handler for moving money between two passbooks of the logged in user
+func CreateTransfer(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var transfer TransferReq
+	if err := ctx.ShouldBindJSON(&transfer); err != nil {
+		setErrorResponse(ctx, 400, invalidBodyMessage(err))
+		return
+	}
+	transfer.FromPassbookID = utils.TrimAndSanitizeStrict(transfer.FromPassbookID)
+	transfer.ToPassbookID = utils.TrimAndSanitizeStrict(transfer.ToPassbookID)
+	if transfer.FromPassbookID == "" || transfer.ToPassbookID == "" {
+		setErrorResponse(ctx, 400, "Please provide from_passbook_id and to_passbook_id")
+		return
+	}
+	if transfer.FromPassbookID == transfer.ToPassbookID {
+		setErrorResponse(ctx, 400, "Cannot transfer to the same passbook")
+		return
+	}
+	if !middlewares.CanAccessPassbook(ctx, transfer.FromPassbookID) || !middlewares.CanAccessPassbook(ctx, transfer.ToPassbookID) {
+		setErrorResponse(ctx, 403, "Token is not allowed to access this passbook")
+		return
+	}
+	transferID, err := utils.GenerateUUID()
+	if err != nil {
+		log.Println("Failed to generate transfer_id for user_id:", loggedInUserID)
+		setErrorResponse(ctx, 500, "Failed to create transfer")
+		return
+	}
+	timeNow := time.Now().UTC()
+	// both legs are validated with the same rules as a regular transaction, party names are filled in later
+	debit := types.Transaction{
+		Amount:          transfer.Amount,
+		TransactionDate: transfer.TransactionDate,
+		TransactionType: "DEBIT",
+		PartyName:       "transfer",
+		Description:     transfer.Description,
+		Tags:            transfer.Tags,
+		CreatedAt:       timeNow,
+		UpdatedAt:       timeNow,
+		PassbookID:      transfer.FromPassbookID,
+		UserID:          loggedInUserID,
+		TransferID:      &transferID,
+	}
+	if err := sanitizeTransactionRequest(&debit); err != nil {
+		setErrorResponse(ctx, 400, err.Error())
+		return
+	}
+	credit := debit
+	credit.TransactionType = "CREDIT"
+	credit.PassbookID = transfer.ToPassbookID
+	for _, tr := range []*types.Transaction{&debit, &credit} {
+		if tr.TransactionID, err = utils.GenerateUUID(); err != nil {
+			log.Println("Failed to generate transaction_id for user_id:", loggedInUserID)
+			setErrorResponse(ctx, 500, "Failed to create transfer")
+			return
+		}
+	}
+	err = updatePassbooksAndCreateTransfer(initializers.DB, &debit, &credit)
+	if err != nil {
+		switch {
+		case errors.Is(err, errPassbookNotFound):
+			setErrorResponse(ctx, 403, "Invalid passbook")
+		case errors.Is(err, errInsufficientBalance):
+			setErrorResponse(ctx, 400, "Insufficient balance")
+		case errors.Is(err, errCurrencyMismatch):
+			setErrorResponse(ctx, 400, "Cannot transfer between passbooks of different currencies")
+		default:
+			log.Println("Failed to create transfer for user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to create transfer")
+		}
+		return
+	}
+	log.Println("Transfer", transferID, "created for user_id:", loggedInUserID)
+	ctx.JSON(201, gin.H{
+		"status":  "success",
+		"message": "Transfer created successfully",
+		"data": map[string]interface{}{
+			"transfer": map[string]interface{}{
+				"transfer_id": transferID,
+				"debit":       debit,
+				"credit":      credit,
+			},
+		},
+	})
+}
+
+/*
+Lock both passbooks in passbook_id order so two opposite transfers running at the same time cannot deadlock,
+debit the source and credit the destination passbook and create both legs sharing the same transfer_id in one db transaction.
+The party name of each leg is the nickname of the passbook on the other side. Both passbooks have to be in the same
+currency since the amount is not converted.
+*/
+func updatePassbooksAndCreateTransfer(conn initializers.PgxPoolIface, debit *types.Transaction, credit *types.Transaction) error {
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	balances, err := lockPassbooks(tx, debit.UserID, debit.PassbookID, credit.PassbookID)
+	if err != nil {
+		return err
+	}
+	if len(balances) != 2 {
+		return errPassbookNotFound
+	}
+	balances[debit.PassbookID] -= debit.Amount
+	balances[credit.PassbookID] += credit.Amount
+	if balances[debit.PassbookID] < 0 {
+		return errInsufficientBalance
+	}
+	nicknames := make(map[string]string, 2)
+	currencies := make(map[string]string, 2)
+	rows, err := tx.Query(context.Background(), "SELECT passbook_id, nickname, currency FROM passbook_app.passbooks WHERE passbook_id = ANY($1)", []string{debit.PassbookID, credit.PassbookID})
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id, nickname, currency string
+		if err := rows.Scan(&id, &nickname, &currency); err != nil {
+			rows.Close()
+			return err
+		}
+		nicknames[id] = nickname
+		currencies[id] = currency
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if currencies[debit.PassbookID] != currencies[credit.PassbookID] {
+		return errCurrencyMismatch
+	}
+	debit.PartyName = nicknames[credit.PassbookID]
+	credit.PartyName = nicknames[debit.PassbookID]
+	for _, id := range slices.Sorted(maps.Keys(balances)) {
+		balance := balances[id]
+		_, err = tx.Exec(context.Background(), "UPDATE passbook_app.passbooks SET total_balance=$1, updated_at=$2 WHERE passbook_id=$3", balance, debit.UpdatedAt, id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, tr := range []*types.Transaction{debit, credit} {
+		if err := insertTrx(tx, tr); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+/*
+Find the other leg of the transfer the given transaction is part of without taking any locks, so the caller can lock
+the passbooks of both legs in a deterministic order before locking the transaction rows.
+Returns an empty leg if the transaction is not part of a transfer.
+*/
+func findTransferCounterpart(tx pgx.Tx, userID string, transactionID string) (transferLeg, error) {
+	var leg transferLeg
+	err := tx.QueryRow(context.Background(), "SELECT o.transfer_id, o.transaction_id, o.passbook_id FROM passbook_app.transactions t JOIN passbook_app.transactions o ON o.transfer_id=t.transfer_id AND o.transaction_id<>t.transaction_id WHERE t.transaction_id=$1 AND t.user_id=$2",
+		transactionID, userID).Scan(&leg.TransferID, &leg.TransactionID, &leg.PassbookID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return leg, err
+	}
+	return leg, nil
+}
+
+func GetTransfer(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	transferID := ctx.Param("transfer_id")
+	rows, err := initializers.DB.Query(context.Background(), "SELECT transaction_id, amount, transaction_date, transaction_type, party_name, description, created_at, updated_at, tags, passbook_id, user_id, transfer_id FROM passbook_app.transactions WHERE transfer_id=$1 AND user_id=$2 AND deleted_at IS NULL",
+		transferID, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get transfer", transferID, "for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get transfer")
+		return
+	}
+	defer rows.Close()
+	legs := make(map[string]types.Transaction, 2)
+	for rows.Next() {
+		var t types.Transaction
+		err := rows.Scan(&t.TransactionID, &t.Amount, &t.TransactionDate, &t.TransactionType, &t.PartyName, &t.Description, &t.CreatedAt, &t.UpdatedAt, &t.Tags, &t.PassbookID, &t.UserID, &t.TransferID)
+		if err != nil {
+			log.Println("Failed to scan transfer", transferID, "for user_id:", loggedInUserID, err)
+			setErrorResponse(ctx, 500, "Failed to get transfer")
+			return
+		}
+		// a transfer touching a passbook the access token is not restricted to is not shown at all
+		if !middlewares.CanAccessPassbook(ctx, t.PassbookID) {
+			setErrorResponse(ctx, 404, "Transfer not found")
+			return
+		}
+		if t.TransactionType == "DEBIT" {
+			legs["debit"] = t
+		} else {
+			legs["credit"] = t
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println("Failed to get transfer", transferID, "for user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to get transfer")
+		return
+	}
+	if len(legs) == 0 {
+		setErrorResponse(ctx, 404, "Transfer not found")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status": "success",
+		"data": map[string]interface{}{
+			"transfer": map[string]interface{}{
+				"transfer_id": transferID,
+				"debit":       legs["debit"],
+				"credit":      legs["credit"],
+			},
+		},
+	})
+}
@@ -0,0 +1,296 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/types"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateTransfer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	router.POST("/v1/transfers", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	}, CreateTransfer)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/transfers", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	lockSQL := `^SELECT passbook_id, total_balance FROM passbook_app.passbooks WHERE passbook_id = ANY\(\$1\) AND user_id=\$2 ORDER BY passbook_id FOR UPDATE$`
+	nicknamesSQL := `^SELECT passbook_id, nickname, currency FROM passbook_app.passbooks WHERE passbook_id = ANY\(\$1\)$`
+	// from pb-b to pb-a, so the passbooks are locked in the opposite order of the request
+	body := `{"from_passbook_id": "pb-b", "to_passbook_id": "pb-a", "amount": 25, "transaction_date": "2024-04-02T10:00:00Z", "description": "savings"}`
+
+	t.Run("Passbooks are locked in passbook_id order and both legs are created", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{"pb-b", "pb-a"}, "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).
+				AddRow("pb-a", types.Money(10000)).
+				AddRow("pb-b", types.Money(5000)))
+		mockDB.ExpectQuery(nicknamesSQL).
+			WithArgs([]string{"pb-b", "pb-a"}).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "nickname", "currency"}).
+				AddRow("pb-a", "Savings", "INR").
+				AddRow("pb-b", "Salary", "INR"))
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET total_balance=\$1`).
+			WithArgs(types.Money(12500), pgxmock.AnyArg(), "pb-a").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET total_balance=\$1`).
+			WithArgs(types.Money(2500), pgxmock.AnyArg(), "pb-b").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		for _, leg := range []struct{ passbookID, transactionType, partyName string }{
+			{"pb-b", "DEBIT", "Savings"},
+			{"pb-a", "CREDIT", "Salary"},
+		} {
+			mockDB.ExpectExec(`^INSERT INTO passbook_app.transactions`).
+				WithArgs(pgxmock.AnyArg(), types.Money(2500), pgxmock.AnyArg(), leg.transactionType, leg.partyName, "savings", pgxmock.AnyArg(), pgxmock.AnyArg(), "", leg.passbookID, "test-user-id", pgxmock.AnyArg(), (*string)(nil)).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		}
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := post(body)
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var responseBody struct {
+			Data struct {
+				Transfer struct {
+					TransferID string            `json:"transfer_id"`
+					Debit      types.Transaction `json:"debit"`
+					Credit     types.Transaction `json:"credit"`
+				} `json:"transfer"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+		transfer := responseBody.Data.Transfer
+		assert.Equal(t, transfer.TransferID, *transfer.Debit.TransferID)
+		assert.Equal(t, transfer.TransferID, *transfer.Credit.TransferID)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Insufficient balance in the source passbook", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{"pb-b", "pb-a"}, "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).
+				AddRow("pb-a", types.Money(10000)).
+				AddRow("pb-b", types.Money(1000)))
+		mockDB.ExpectRollback()
+
+		w := post(body)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Insufficient balance")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Transfer to the same passbook is rejected", func(t *testing.T) {
+		w := post(`{"from_passbook_id": "pb-a", "to_passbook_id": "pb-a", "amount": 25, "transaction_date": "2024-04-02T10:00:00Z"}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Cannot transfer to the same passbook")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Passbook of another user is rejected", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{"pb-b", "pb-a"}, "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).
+				AddRow("pb-b", types.Money(5000)))
+		mockDB.ExpectRollback()
+
+		w := post(body)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Passbooks of different currencies are rejected", func(t *testing.T) {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(lockSQL).
+			WithArgs([]string{"pb-b", "pb-a"}, "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).
+				AddRow("pb-a", types.Money(10000)).
+				AddRow("pb-b", types.Money(5000)))
+		mockDB.ExpectQuery(nicknamesSQL).
+			WithArgs([]string{"pb-b", "pb-a"}).
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "nickname", "currency"}).
+				AddRow("pb-a", "Savings", "USD").
+				AddRow("pb-b", "Salary", "INR"))
+		mockDB.ExpectRollback()
+
+		w := post(body)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "different currencies")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestTransferLegs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	router := gin.New()
+	authenticated := router.Group("/v1", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+	})
+	authenticated.PATCH("/passbooks/:passbook_id/transactions/:transaction_id", UpdateTransaction)
+	authenticated.DELETE("/passbooks/:passbook_id/transactions/:transaction_id", DeleteTransaction)
+	authenticated.GET("/transfers/:transfer_id", GetTransfer)
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	// a transfer of 25 from pb-b (debit leg trx-debit) to pb-a (credit leg trx-credit)
+	expectLegsLocked := func() {
+		mockDB.ExpectBegin()
+		mockDB.ExpectQuery(`^SELECT o.transfer_id, o.transaction_id, o.passbook_id FROM passbook_app.transactions t JOIN`).
+			WithArgs("trx-debit", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"transfer_id", "transaction_id", "passbook_id"}).AddRow("transfer-1", "trx-credit", "pb-a"))
+		mockDB.ExpectQuery(`^SELECT passbook_id, total_balance FROM passbook_app.passbooks WHERE passbook_id = ANY\(\$1\) AND user_id=\$2 ORDER BY passbook_id FOR UPDATE$`).
+			WithArgs([]string{"pb-b", "pb-a"}, "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"passbook_id", "total_balance"}).
+				AddRow("pb-a", types.Money(12500)).
+				AddRow("pb-b", types.Money(2500)))
+	}
+	expectBalance := func(passbookID string, balance types.Money) {
+		mockDB.ExpectExec(`^UPDATE passbook_app.passbooks SET total_balance=\$1`).
+			WithArgs(balance, pgxmock.AnyArg(), passbookID).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	}
+	transferID := "transfer-1"
+
+	t.Run("Updating one leg updates the other leg and both balances", func(t *testing.T) {
+		expectLegsLocked()
+		mockDB.ExpectQuery(`^SELECT amount, transaction_type, created_at, transfer_id FROM passbook_app.transactions WHERE transaction_id=\$1`).
+			WithArgs("trx-debit", "pb-b", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"amount", "transaction_type", "created_at", "transfer_id"}).AddRow(types.Money(2500), "DEBIT", time.Now().UTC(), &transferID))
+		mockDB.ExpectQuery(`^SELECT transaction_type FROM passbook_app.transactions WHERE transaction_id=\$1 AND transfer_id=\$2 FOR UPDATE$`).
+			WithArgs("trx-credit", "transfer-1").
+			WillReturnRows(pgxmock.NewRows([]string{"transaction_type"}).AddRow("CREDIT"))
+		mockDB.ExpectExec(`^UPDATE passbook_app.transactions SET amount=\$1, transaction_date=\$2, updated_at=\$3 WHERE transaction_id=\$4$`).
+			WithArgs(types.Money(3000), pgxmock.AnyArg(), pgxmock.AnyArg(), "trx-credit").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		// 125 - 25 + 30 on the credit side, 25 + 25 - 30 on the debit side
+		expectBalance("pb-a", 13000)
+		expectBalance("pb-b", 2000)
+		mockDB.ExpectExec(`^UPDATE passbook_app.transactions SET amount=\$1, transaction_date=\$2, transaction_type=\$3`).
+			WithArgs(types.Money(3000), pgxmock.AnyArg(), "DEBIT", "Savings", "", "", "pb-b", pgxmock.AnyArg(), "trx-debit").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := send("PATCH", "/v1/passbooks/pb-b/transactions/trx-debit", `{"amount": 30, "transaction_date": "2024-04-02T10:00:00Z", "transaction_type": "DEBIT", "party_name": "Savings"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Transaction type of a leg cannot be changed", func(t *testing.T) {
+		expectLegsLocked()
+		mockDB.ExpectQuery(`^SELECT amount, transaction_type, created_at, transfer_id FROM passbook_app.transactions WHERE transaction_id=\$1`).
+			WithArgs("trx-debit", "pb-b", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"amount", "transaction_type", "created_at", "transfer_id"}).AddRow(types.Money(2500), "DEBIT", time.Now().UTC(), &transferID))
+		mockDB.ExpectRollback()
+
+		w := send("PATCH", "/v1/passbooks/pb-b/transactions/trx-debit", `{"amount": 25, "transaction_date": "2024-04-02T10:00:00Z", "transaction_type": "CREDIT", "party_name": "Savings"}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Deleting one leg trashes both legs", func(t *testing.T) {
+		expectLegsLocked()
+		activeSQL := `^SELECT amount, transaction_type FROM passbook_app.transactions WHERE transaction_id=\$1 AND passbook_id=\$2 AND user_id=\$3 AND deleted_at IS NULL FOR UPDATE$`
+		mockDB.ExpectQuery(activeSQL).
+			WithArgs("trx-debit", "pb-b", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"amount", "transaction_type"}).AddRow(types.Money(2500), "DEBIT"))
+		mockDB.ExpectQuery(activeSQL).
+			WithArgs("trx-credit", "pb-a", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"amount", "transaction_type"}).AddRow(types.Money(2500), "CREDIT"))
+		expectBalance("pb-a", 10000)
+		expectBalance("pb-b", 5000)
+		mockDB.ExpectExec(`^UPDATE passbook_app.transactions SET deleted_at=\$1 WHERE transaction_id = ANY\(\$2\)$`).
+			WithArgs(pgxmock.AnyArg(), []string{"trx-debit", "trx-credit"}).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := send("DELETE", "/v1/passbooks/pb-b/transactions/trx-debit", "")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Get transfer returns both legs", func(t *testing.T) {
+		now := time.Now().UTC()
+		mockDB.ExpectQuery(`^SELECT transaction_id, .* FROM passbook_app.transactions WHERE transfer_id=\$1 AND user_id=\$2 AND deleted_at IS NULL$`).
+			WithArgs("transfer-1", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"transaction_id", "amount", "transaction_date", "transaction_type", "party_name", "description", "created_at", "updated_at", "tags", "passbook_id", "user_id", "transfer_id"}).
+				AddRow("trx-debit", types.Money(2500), now, "DEBIT", "Savings", "", now, now, "", "pb-b", "test-user-id", &transferID).
+				AddRow("trx-credit", types.Money(2500), now, "CREDIT", "Salary", "", now, now, "", "pb-a", "test-user-id", &transferID))
+
+		w := send("GET", "/v1/transfers/transfer-1", "")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var responseBody struct {
+			Data struct {
+				Transfer struct {
+					Debit  types.Transaction `json:"debit"`
+					Credit types.Transaction `json:"credit"`
+				} `json:"transfer"`
+			} `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+		assert.Equal(t, "pb-b", responseBody.Data.Transfer.Debit.PassbookID)
+		assert.Equal(t, "pb-a", responseBody.Data.Transfer.Credit.PassbookID)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Unknown transfer is not found", func(t *testing.T) {
+		mockDB.ExpectQuery(`^SELECT transaction_id, .* FROM passbook_app.transactions WHERE transfer_id=\$1`).
+			WithArgs("transfer-2", "test-user-id").
+			WillReturnRows(pgxmock.NewRows([]string{"transaction_id", "amount", "transaction_date", "transaction_type", "party_name", "description", "created_at", "updated_at", "tags", "passbook_id", "user_id", "transfer_id"}))
+
+		w := send("GET", "/v1/transfers/transfer-2", "")
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
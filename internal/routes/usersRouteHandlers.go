@@ -2,14 +2,36 @@ package routes
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/mailer"
 	"github.com/akashsharma99/passbook-app/internal/types"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	securityEventEmailChanged    = "email_changed"
+	securityEventPasswordChanged = "password_changed"
+)
+
+// fields of the user to change, left out fields stay as they are
+type updateUserReq struct {
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+}
+
+type changePasswordReq struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
 func GetUser(ctx *gin.Context) {
 	// take the user id from the auth middleware
 	userID := ctx.MustGet("userId").(string)
@@ -30,11 +52,188 @@ func GetUser(ctx *gin.Context) {
 	ctx.JSON(200, gin.H{
 		"status": "success",
 		"data": map[string]interface{}{
-			"user": map[string]string{
-				"username": user.Username,
-				"email":    user.Email,
-			},
+			"user": userProfile(user),
 		},
 		"meta": nil,
 	})
 }
+
+func userProfile(user types.User) map[string]interface{} {
+	return map[string]interface{}{
+		"username":       user.Username,
+		"email":          user.Email,
+		"email_verified": user.EmailVerifiedAt != nil,
+		"totp_enabled":   user.TOTPEnabledAt != nil,
+	}
+}
+
+/*
+Route handler for changing the username and email of the logged in user. A new email has to be verified again, a
+verification link is sent to it and the old address is told about the change.
+*/
+func UpdateUser(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req updateUserReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		setErrorResponse(ctx, 400, "Invalid request body")
+		return
+	}
+	if req.Username == nil && req.Email == nil {
+		setErrorResponse(ctx, 400, "Please provide a username or email to update")
+		return
+	}
+	user, err := getUserByID(initializers.DB, loggedInUserID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		setErrorResponse(ctx, 404, "User not found")
+		return
+	}
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to update user. Try again later!")
+		return
+	}
+	oldEmail := user.Email
+	if req.Username != nil {
+		user.Username = strings.TrimSpace(*req.Username)
+		if user.Username == "" || len(user.Username) > 255 {
+			setErrorResponse(ctx, 400, "Please provide a username of at most 255 characters")
+			return
+		}
+	}
+	if req.Email != nil {
+		user.Email = strings.TrimSpace(*req.Email)
+		if !isValidEmail(user.Email) {
+			setErrorResponse(ctx, 400, "Please provide a valid email address.")
+			return
+		}
+	}
+	emailChanged := user.Email != oldEmail
+	if emailChanged {
+		user.EmailVerifiedAt = nil
+	}
+	user.UpdatedAt = time.Now().UTC()
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to update user. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.users SET username=$1, email=$2, email_verified_at=$3, updated_at=$4 WHERE user_id=$5",
+		user.Username, user.Email, user.EmailVerifiedAt, user.UpdatedAt, loggedInUserID)
+	if err == nil && emailChanged {
+		err = recordSecurityEvent(tx, ctx, loggedInUserID, securityEventEmailChanged, ctx.GetString("sessionId"), "The email was changed from "+oldEmail+" to "+user.Email)
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Println("Failed to update user_id:", loggedInUserID, err)
+		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			setErrorResponse(ctx, 409, "Username or Email already exists. Please provide a unique username and email.")
+			return
+		}
+		setErrorResponse(ctx, 500, "Failed to update user. Try again later!")
+		return
+	}
+	message := "User updated successfully"
+	if emailChanged {
+		message = "User updated successfully. A verification link has been sent to the new email address"
+		// the change is saved either way, the user can ask for the verification email again
+		if err := sendVerificationEmail(loggedInUserID, user.Username, user.Email); err != nil {
+			log.Println("Failed to send verification email to user_id:", loggedInUserID, err)
+		}
+		if err := sendEmailChangedNotice(user.Username, oldEmail, user.Email); err != nil {
+			log.Println("Failed to notify old email of user_id:", loggedInUserID, err)
+		}
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": message,
+		"data": map[string]interface{}{
+			"user": userProfile(user),
+		},
+	})
+}
+
+// tell the old address of a user that the email changed, so the owner notices when somebody else changed it
+func sendEmailChangedNotice(username string, oldEmail string, newEmail string) error {
+	return initializers.Mailer.Send(mailer.Message{
+		To:      oldEmail,
+		Subject: "Your Passbook email address was changed",
+		Body: fmt.Sprintf("Hi %s,\n\nThe email address of your Passbook account was changed to %s. Emails about the account are no longer sent to this address.\n\n"+
+			"If you did not make this change, please reset your password and contact support right away.\n",
+			username, newEmail),
+	})
+}
+
+/*
+Route handler for changing the password of the logged in user, which needs the current password. Every other session
+of the user is revoked so a device logged in with the old password has to log in again, the current one stays.
+*/
+func ChangePassword(ctx *gin.Context) {
+	loggedInUserID := ctx.MustGet("userId").(string)
+	var req changePasswordReq
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		setErrorResponse(ctx, 400, "Please provide the current and the new password.")
+		return
+	}
+	// guesses of the current password with a stolen access token count against their own counter
+	passwordKey := "password:" + loggedInUserID
+	if !checkLoginLimits(ctx, passwordKey) {
+		return
+	}
+	user, err := getUserByID(initializers.DB, loggedInUserID)
+	if err != nil {
+		log.Println("Failed to get user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to change password. Try again later!")
+		return
+	}
+	// users who signed up with an identity provider have no password yet and set one with a reset link
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)) != nil {
+		recordFailedLogin(ctx, passwordKey, loggedInUserID, securityEventLoginFailed)
+		setErrorResponse(ctx, 403, "Invalid current password")
+		return
+	}
+	clearLoginLimits(ctx, passwordKey)
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			setErrorResponse(ctx, 400, "Password too long. Please provide a password with less than 72 characters")
+			return
+		}
+		log.Println("Failed to hash password of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to change password. Try again later!")
+		return
+	}
+	sessionID := ctx.GetString("sessionId")
+	tx, err := initializers.DB.Begin(context.Background())
+	if err != nil {
+		log.Println("Failed to begin transaction", err)
+		setErrorResponse(ctx, 500, "Failed to change password. Try again later!")
+		return
+	}
+	defer tx.Rollback(context.Background())
+	_, err = tx.Exec(context.Background(), "UPDATE passbook_app.users SET password_hash=$1, updated_at=$2 WHERE user_id=$3", string(passwordHash), time.Now().UTC(), loggedInUserID)
+	if err != nil {
+		log.Println("Failed to change password of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to change password. Try again later!")
+		return
+	}
+	ctag, err := tx.Exec(context.Background(), "DELETE FROM passbook_app.sessions WHERE user_id=$1 AND session_id::text <> $2", loggedInUserID, sessionID)
+	if err == nil {
+		err = recordSecurityEvent(tx, ctx, loggedInUserID, securityEventPasswordChanged, sessionID, fmt.Sprintf("The password was changed, %d other sessions were revoked", ctag.RowsAffected()))
+	}
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		log.Println("Failed to change password of user_id:", loggedInUserID, err)
+		setErrorResponse(ctx, 500, "Failed to change password. Try again later!")
+		return
+	}
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Password changed successfully. Other devices have to log in again",
+	})
+}
@@ -0,0 +1,200 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akashsharma99/passbook-app/internal/initializers"
+	"github.com/akashsharma99/passbook-app/internal/lockout"
+	"github.com/akashsharma99/passbook-app/internal/mailer"
+	"github.com/gin-gonic/gin"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestUpdateUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	mailDir := t.TempDir()
+	originalMailer := initializers.Mailer
+	initializers.Mailer = &mailer.LogSender{Dir: mailDir, From: "no-reply@example.com"}
+	defer func() { initializers.Mailer = originalMailer }()
+
+	router := gin.New()
+	router.PATCH("/v1/users/me", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+		c.Set("sessionId", "test-session-id")
+	}, UpdateUser)
+	userSQL := `^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`
+	updateSQL := `^UPDATE passbook_app.users SET username=\$1, email=\$2, email_verified_at=\$3, updated_at=\$4 WHERE user_id=\$5$`
+	now := time.Now().UTC()
+	userRow := func() *pgxmock.Rows {
+		return pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", "hash", now, now, &now, nil, nil, int64(0))
+	}
+	patch := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", "/v1/users/me", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Username is changed", func(t *testing.T) {
+		mockDB.ExpectQuery(userSQL).WithArgs("test-user-id").WillReturnRows(userRow())
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(updateSQL).
+			WithArgs("janedoe", "jane@example.com", &now, pgxmock.AnyArg(), "test-user-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := patch(`{"username":" janedoe "}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"email_verified":true`)
+		assert.Empty(t, sentMails(t, mailDir))
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("New email has to be verified again", func(t *testing.T) {
+		mockDB.ExpectQuery(userSQL).WithArgs("test-user-id").WillReturnRows(userRow())
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(updateSQL).
+			WithArgs("jane", "jane.doe@example.com", (*time.Time)(nil), pgxmock.AnyArg(), "test-user-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventEmailChanged, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.email_verifications WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnResult(pgxmock.NewResult("DELETE", 0))
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.email_verifications`).
+			WithArgs(pgxmock.AnyArg(), "test-user-id", "jane.doe@example.com", pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectRollback()
+
+		w := patch(`{"email":"jane.doe@example.com"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"email_verified":false`)
+		mails := strings.Join(sentMails(t, mailDir), "\n")
+		assert.Contains(t, mails, "To: jane.doe@example.com")
+		assert.Contains(t, mails, "To: jane@example.com")
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Taken username", func(t *testing.T) {
+		mockDB.ExpectQuery(userSQL).WithArgs("test-user-id").WillReturnRows(userRow())
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(updateSQL).
+			WithArgs("john", "jane@example.com", &now, pgxmock.AnyArg(), "test-user-id").
+			WillReturnError(&duplicateKeyError{"users_username_key"})
+		mockDB.ExpectRollback()
+
+		assert.Equal(t, http.StatusConflict, patch(`{"username":"john"}`).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Invalid fields", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, patch(`{}`).Code)
+		for _, body := range []string{`{"username":"  "}`, `{"email":"Jane <jane@example.com>"}`} {
+			mockDB.ExpectQuery(userSQL).WithArgs("test-user-id").WillReturnRows(userRow())
+			assert.Equal(t, http.StatusBadRequest, patch(body).Code)
+		}
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
+
+func TestChangePassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockDB, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatalf("Failed to create mock pool: %v", err)
+	}
+	defer mockDB.Close()
+
+	originalDB := initializers.DB
+	initializers.DB = mockDB
+	defer func() { initializers.DB = originalDB }()
+
+	originalUsernameLimiter, originalIPLimiter := initializers.UsernameLoginLimiter, initializers.IPLoginLimiter
+	initializers.UsernameLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), lockout.Policy{FreeAttempts: 5, LockoutThreshold: 5, LockoutDuration: time.Hour, Window: time.Hour})
+	initializers.IPLoginLimiter = lockout.NewLimiter(lockout.NewMemoryStore(), lockout.Policy{FreeAttempts: 100, LockoutThreshold: 1000, Window: time.Hour})
+	defer func() {
+		initializers.UsernameLoginLimiter, initializers.IPLoginLimiter = originalUsernameLimiter, originalIPLimiter
+	}()
+
+	router := gin.New()
+	router.POST("/v1/users/me/password", func(c *gin.Context) {
+		c.Set("userId", "test-user-id")
+		c.Set("sessionId", "test-session-id")
+	}, ChangePassword)
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("old-secret"), bcrypt.MinCost)
+	now := time.Now().UTC()
+	expectUser := func() {
+		mockDB.ExpectQuery(`^SELECT \* FROM passbook_app.users WHERE user_id=\$1$`).
+			WithArgs("test-user-id").
+			WillReturnRows(pgxmock.NewRows(userColumns).AddRow("test-user-id", "jane", "jane@example.com", string(passwordHash), now, now, &now, nil, nil, int64(0)))
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/users/me/password", strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Password is changed and other sessions are revoked", func(t *testing.T) {
+		newHash := &captureArg{}
+		expectUser()
+		mockDB.ExpectBegin()
+		mockDB.ExpectExec(`^UPDATE passbook_app.users SET password_hash=\$1, updated_at=\$2 WHERE user_id=\$3$`).
+			WithArgs(newHash, pgxmock.AnyArg(), "test-user-id").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mockDB.ExpectExec(`^DELETE FROM passbook_app.sessions WHERE user_id=\$1 AND session_id::text <> \$2$`).
+			WithArgs("test-user-id", "test-session-id").
+			WillReturnResult(pgxmock.NewResult("DELETE", 2))
+		details := &captureArg{}
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventPasswordChanged, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), details, pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mockDB.ExpectCommit()
+		mockDB.ExpectRollback()
+
+		w := post(`{"current_password":"old-secret","new_password":"new-secret"}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(newHash.value), []byte("new-secret")))
+		assert.Equal(t, "The password was changed, 2 other sessions were revoked", details.value)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Wrong current password", func(t *testing.T) {
+		expectUser()
+		mockDB.ExpectExec(`^INSERT INTO passbook_app.security_events`).
+			WithArgs("test-user-id", securityEventLoginFailed, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+		assert.Equal(t, http.StatusForbidden, post(`{"current_password":"guess","new_password":"new-secret"}`).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+
+	t.Run("Missing fields", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, post(`{"current_password":"old-secret"}`).Code)
+		assert.NoError(t, mockDB.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,63 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the SHA1 test vectors of RFC 6238 appendix B, cut to 6 digits
+func TestCodeRFC6238(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		got, err := Code(secret, time.Unix(unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.NoError(t, err)
+	assert.Len(t, secret, 32)
+	now := time.Unix(1700000000, 0)
+
+	current, _ := Code(secret, now)
+	counter, ok := Validate(secret, current, now)
+	assert.True(t, ok)
+	assert.Equal(t, Counter(now), counter)
+
+	// one period of drift is accepted
+	previous, _ := Code(secret, now.Add(-Period))
+	counter, ok = Validate(secret, previous[:3]+" "+previous[3:], now)
+	assert.True(t, ok)
+	assert.Equal(t, Counter(now)-1, counter)
+
+	old, _ := Code(secret, now.Add(-3*Period))
+	_, ok = Validate(secret, old, now)
+	assert.False(t, ok)
+
+	_, ok = Validate(secret, "12345", now)
+	assert.False(t, ok)
+	_, ok = Validate("not base32!", current, now)
+	assert.False(t, ok)
+	// secrets are accepted in lower case and with spaces as typed from an app
+	_, ok = Validate(strings.ToLower(secret[:4]+" "+secret[4:]), current, now)
+	assert.True(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Passbook", "jane doe", "JBSWY3DPEHPK3PXP")
+	assert.Equal(t, "otpauth://totp/Passbook:jane%20doe?algorithm=SHA1&digits=6&issuer=Passbook&period=30&secret=JBSWY3DPEHPK3PXP", uri)
+}
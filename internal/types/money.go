@@ -0,0 +1,182 @@
+package types
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+/*
+Money is an exact amount stored as integer minor units (1/100th of the currency unit) so that it maps one to one on
+the DECIMAL(11,2) columns of the database.
+
+Rounding rules:
+  - amounts coming from clients (JSON, query params, imported files) are never rounded, an amount with more than 2
+    non zero decimal places is rejected with ErrMoneyPrecision.
+  - amounts derived by the app (e.g. currency conversions) are rounded half to even ("bankers rounding") with RoundMoney.
+*/
+type Money int64
+
+// MaxMoney is the largest amount that fits in a DECIMAL(11,2) column
+const MaxMoney Money = 99999999999
+
+var (
+	ErrInvalidMoney    = errors.New("invalid amount")
+	ErrMoneyPrecision  = errors.New("amount can have at most 2 decimal places")
+	ErrMoneyOutOfRange = errors.New("amount out of range")
+)
+
+var moneyPattern = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?$`)
+
+var minorUnitsPerUnit = big.NewRat(100, 1)
+
+// ParseMoney parses a decimal string like "1024.45" into Money without any loss of precision
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if !moneyPattern.MatchString(s) {
+		return 0, ErrInvalidMoney
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, ErrInvalidMoney
+	}
+	r.Mul(r, minorUnitsPerUnit)
+	if !r.IsInt() {
+		return 0, ErrMoneyPrecision
+	}
+	if !r.Num().IsInt64() || r.Num().Int64() > int64(MaxMoney) || r.Num().Int64() < -int64(MaxMoney) {
+		return 0, ErrMoneyOutOfRange
+	}
+	return Money(r.Num().Int64()), nil
+}
+
+// RoundMoney rounds an arbitrary precision amount (in currency units) half to even to the nearest minor unit
+func RoundMoney(r *big.Rat) (Money, error) {
+	scaled := new(big.Rat).Mul(r, minorUnitsPerUnit)
+	quo, rem := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	// compare twice the remainder with the denominator to find out which side of the half way mark we are
+	half := new(big.Int).Abs(rem)
+	half.Lsh(half, 1)
+	if cmp := half.Cmp(scaled.Denom()); cmp > 0 || (cmp == 0 && quo.Bit(0) == 1) {
+		if rem.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	if !quo.IsInt64() || quo.Int64() > int64(MaxMoney) || quo.Int64() < -int64(MaxMoney) {
+		return 0, ErrMoneyOutOfRange
+	}
+	return Money(quo.Int64()), nil
+}
+
+// Rat returns the amount in currency units as an exact rational number
+func (m Money) Rat() *big.Rat {
+	return big.NewRat(int64(m), 100)
+}
+
+// String formats the amount with exactly 2 decimal places, e.g. "-1024.05"
+func (m Money) String() string {
+	sign := ""
+	units := int64(m)
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, units/100, units%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts both JSON numbers and numeric strings, the literal is parsed as is and never through float64
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// ScanNumeric implements pgtype.NumericScanner so pgx can scan DECIMAL columns directly into Money
+func (m *Money) ScanNumeric(n pgtype.Numeric) error {
+	if !n.Valid {
+		return errors.New("cannot scan NULL into Money")
+	}
+	if n.NaN || n.InfinityModifier != pgtype.Finite {
+		return ErrInvalidMoney
+	}
+	parsed, err := RoundMoney(numericRat(n))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// exact value of a finite numeric
+func numericRat(n pgtype.Numeric) *big.Rat {
+	r := new(big.Rat).SetInt(n.Int)
+	if n.Exp > 0 {
+		r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n.Exp)), nil)))
+	} else if n.Exp < 0 {
+		r.Quo(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-n.Exp)), nil)))
+	}
+	return r
+}
+
+// NumericValue implements pgtype.NumericValuer so Money can be used as a query argument for DECIMAL columns
+func (m Money) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(m)), Exp: -2, Valid: true}, nil
+}
+
+// Scan implements sql.Scanner for drivers and mocks handing over plain go values
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case Money:
+		*m = v
+	case int64:
+		*m = Money(v * 100)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return ErrInvalidMoney
+		}
+		parsed, err := RoundMoney(new(big.Rat).SetFloat64(v))
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	case string:
+		parsed, err := ParseMoney(v)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	case []byte:
+		return m.Scan(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	return nil
+}
+
+// Value implements driver.Valuer
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
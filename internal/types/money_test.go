@@ -0,0 +1,92 @@
+package types
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	valid := map[string]Money{
+		"0.29":          29,
+		"1024.45":       102445,
+		"1024.4":        102440,
+		"-5":            -500,
+		".5":            50,
+		"0.290":         29,
+		"1e2":           10000,
+		"999999999.99":  MaxMoney,
+		"+12.00":        1200,
+		" 7.07 ":        707,
+		"-999999999.99": -MaxMoney,
+	}
+	for input, expected := range valid {
+		m, err := ParseMoney(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, m, input)
+	}
+	invalid := map[string]error{
+		"0.299":         ErrMoneyPrecision,
+		"1.001":         ErrMoneyPrecision,
+		"1000000000.00": ErrMoneyOutOfRange,
+		"abc":           ErrInvalidMoney,
+		"1/3":           ErrInvalidMoney,
+		"0x10":          ErrInvalidMoney,
+		"":              ErrInvalidMoney,
+	}
+	for input, expected := range invalid {
+		_, err := ParseMoney(input)
+		assert.ErrorIs(t, err, expected, input)
+	}
+}
+
+func TestRoundMoneyHalfToEven(t *testing.T) {
+	cases := map[string]Money{
+		"0.125":  12,
+		"0.135":  14,
+		"-0.125": -12,
+		"-0.135": -14,
+		"0.1251": 13,
+		"2.675":  268,
+	}
+	for input, expected := range cases {
+		r, _ := new(big.Rat).SetString(input)
+		m, err := RoundMoney(r)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, m, input)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var tr Transaction
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": 0.29}`), &tr))
+	assert.Equal(t, Money(29), tr.Amount)
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": "150.5"}`), &tr))
+	assert.Equal(t, Money(15050), tr.Amount)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"amount": 10.999}`), &tr), ErrMoneyPrecision)
+
+	out, err := json.Marshal(Passbook{TotalBalance: -105})
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `"total_balance":-1.05`)
+}
+
+func TestMoneyScan(t *testing.T) {
+	var m Money
+	assert.NoError(t, m.ScanNumeric(pgtype.Numeric{Int: big.NewInt(102445), Exp: -2, Valid: true}))
+	assert.Equal(t, Money(102445), m)
+	assert.NoError(t, m.ScanNumeric(pgtype.Numeric{Int: big.NewInt(3), Exp: 1, Valid: true}))
+	assert.Equal(t, Money(3000), m)
+	assert.Error(t, m.ScanNumeric(pgtype.Numeric{}))
+	assert.NoError(t, m.Scan(0.29))
+	assert.Equal(t, Money(29), m)
+	assert.NoError(t, m.Scan("12.34"))
+	assert.Equal(t, Money(1234), m)
+
+	n, err := Money(-1205).NumericValue()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1205), n.Int.Int64())
+	assert.Equal(t, int32(-2), n.Exp)
+}
@@ -0,0 +1,148 @@
+package types
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+/*
+Rate is an exchange rate, the units of a quote currency for one unit of a base currency. It is stored as an integer
+number of 1/10^8th so that it maps one to one on the NUMERIC(18,8) columns of the database. Like Money, rates coming
+from clients are never rounded, amounts converted with a rate are rounded half to even with RoundMoney.
+*/
+type Rate int64
+
+// MaxRate is the largest rate that fits in a NUMERIC(18,8) column
+const MaxRate Rate = 999999999999999999
+
+var (
+	ErrInvalidRate    = errors.New("invalid exchange rate, expected a positive number")
+	ErrRatePrecision  = errors.New("exchange rate can have at most 8 decimal places")
+	ErrRateOutOfRange = errors.New("exchange rate out of range")
+)
+
+const rateUnitsPerUnit = 100000000
+
+// ParseRate parses a decimal string like "83.4125" into a Rate without any loss of precision
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(s)
+	if !moneyPattern.MatchString(s) {
+		return 0, ErrInvalidRate
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, ErrInvalidRate
+	}
+	return rateFromRat(r)
+}
+
+// exact rate of a positive rational number
+func rateFromRat(r *big.Rat) (Rate, error) {
+	if r.Sign() <= 0 {
+		return 0, ErrInvalidRate
+	}
+	scaled := new(big.Rat).Mul(r, big.NewRat(rateUnitsPerUnit, 1))
+	if !scaled.IsInt() {
+		return 0, ErrRatePrecision
+	}
+	if !scaled.Num().IsInt64() || scaled.Num().Int64() > int64(MaxRate) {
+		return 0, ErrRateOutOfRange
+	}
+	return Rate(scaled.Num().Int64()), nil
+}
+
+// Rat returns the rate as an exact rational number
+func (r Rate) Rat() *big.Rat {
+	return big.NewRat(int64(r), rateUnitsPerUnit)
+}
+
+// Convert converts an amount of the base currency into the quote currency
+func (r Rate) Convert(m Money) (Money, error) {
+	return RoundMoney(new(big.Rat).Mul(m.Rat(), r.Rat()))
+}
+
+// ConvertBack converts an amount of the quote currency into the base currency
+func (r Rate) ConvertBack(m Money) (Money, error) {
+	if r <= 0 {
+		return 0, ErrInvalidRate
+	}
+	return RoundMoney(new(big.Rat).Quo(m.Rat(), r.Rat()))
+}
+
+// String formats the rate without trailing zeros, e.g. "83.4125"
+func (r Rate) String() string {
+	s := fmt.Sprintf("%d.%08d", int64(r)/rateUnitsPerUnit, int64(r)%rateUnitsPerUnit)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalJSON accepts both JSON numbers and numeric strings, the literal is parsed as is and never through float64
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	parsed, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// ScanNumeric implements pgtype.NumericScanner so pgx can scan NUMERIC columns directly into a Rate
+func (r *Rate) ScanNumeric(n pgtype.Numeric) error {
+	if !n.Valid {
+		return errors.New("cannot scan NULL into Rate")
+	}
+	if n.NaN || n.InfinityModifier != pgtype.Finite {
+		return ErrInvalidRate
+	}
+	parsed, err := rateFromRat(numericRat(n))
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+// NumericValue implements pgtype.NumericValuer so a Rate can be used as a query argument for NUMERIC columns
+func (r Rate) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(r)), Exp: -8, Valid: true}, nil
+}
+
+// Scan implements sql.Scanner for drivers and mocks handing over plain go values
+func (r *Rate) Scan(src any) error {
+	switch v := src.(type) {
+	case Rate:
+		*r = v
+	case string:
+		parsed, err := ParseRate(v)
+		if err != nil {
+			return err
+		}
+		*r = parsed
+	case []byte:
+		return r.Scan(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into Rate", src)
+	}
+	return nil
+}
+
+// Value implements driver.Valuer
+func (r Rate) Value() (driver.Value, error) {
+	return r.String(), nil
+}
@@ -0,0 +1,86 @@
+package types
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRate(t *testing.T) {
+	valid := map[string]Rate{
+		"83.4125":             8341250000,
+		"0.01200000":          1200000,
+		"1":                   100000000,
+		"0.00000001":          1,
+		"9999999999.99999999": MaxRate,
+		" 1e-2 ":              1000000,
+	}
+	for input, expected := range valid {
+		r, err := ParseRate(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, r, input)
+	}
+	invalid := map[string]error{
+		"0":                  ErrInvalidRate,
+		"-1.5":               ErrInvalidRate,
+		"abc":                ErrInvalidRate,
+		"":                   ErrInvalidRate,
+		"0.000000001":        ErrRatePrecision,
+		"10000000000":        ErrRateOutOfRange,
+		"1/3":                ErrInvalidRate,
+		"0.0120000000000001": ErrRatePrecision,
+	}
+	for input, expected := range invalid {
+		_, err := ParseRate(input)
+		assert.ErrorIs(t, err, expected, input)
+	}
+}
+
+func TestRateString(t *testing.T) {
+	assert.Equal(t, "83.4125", Rate(8341250000).String())
+	assert.Equal(t, "1", Rate(100000000).String())
+	assert.Equal(t, "0.00000001", Rate(1).String())
+}
+
+func TestRateConvert(t *testing.T) {
+	rate, err := ParseRate("83.4125")
+	assert.NoError(t, err)
+	// 12.34 USD is 1029.310250 INR
+	inr, err := rate.Convert(1234)
+	assert.NoError(t, err)
+	assert.Equal(t, Money(102931), inr)
+	// 1000 INR is 11.98861... USD
+	usd, err := rate.ConvertBack(100000)
+	assert.NoError(t, err)
+	assert.Equal(t, Money(1199), usd)
+	_, err = Rate(0).ConvertBack(100)
+	assert.ErrorIs(t, err, ErrInvalidRate)
+}
+
+func TestRateJSONAndScan(t *testing.T) {
+	var body struct {
+		Rate Rate `json:"rate"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"rate": 0.0108}`), &body))
+	assert.Equal(t, Rate(1080000), body.Rate)
+	assert.NoError(t, json.Unmarshal([]byte(`{"rate": "92.5"}`), &body))
+	assert.Equal(t, Rate(9250000000), body.Rate)
+	assert.ErrorIs(t, json.Unmarshal([]byte(`{"rate": -1}`), &body), ErrInvalidRate)
+	out, err := json.Marshal(body)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"rate":92.5}`, string(out))
+
+	var r Rate
+	assert.NoError(t, r.ScanNumeric(pgtype.Numeric{Int: big.NewInt(834125), Exp: -4, Valid: true}))
+	assert.Equal(t, Rate(8341250000), r)
+	assert.Error(t, r.ScanNumeric(pgtype.Numeric{}))
+	assert.NoError(t, r.Scan("1.25"))
+	assert.Equal(t, Rate(125000000), r)
+	n, err := Rate(125000000).NumericValue()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(125000000), n.Int.Int64())
+	assert.Equal(t, int32(-8), n.Exp)
+}
@@ -6,8 +6,18 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+const (
+	// purpose of a token that only allows to finish the login with the second factor
+	TokenPurposeMFA = "mfa"
+	// purpose of a token that only allows to get new tokens of its session
+	TokenPurposeRefresh = "refresh"
+)
+
 type UserTokenClaims struct {
-	UserID string `json:"userId"`
+	UserID    string `json:"userId"`
+	SessionID string `json:"sid,omitempty"`
+	// set for tokens which are not access tokens, the auth middleware rejects them
+	Purpose string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 type User struct {
@@ -17,29 +27,126 @@ type User struct {
 	PasswordHash string    `json:"password_hash"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
+	// nil until the user opens the verification link sent to the email
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	// secret of the authenticator app, set during enrollment and only in use once TOTPEnabledAt is set
+	TOTPSecret    *string    `json:"-"`
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at"`
+	// counter of the last accepted code, codes of the same or an earlier period are rejected
+	TOTPLastCounter int64 `json:"-"`
+}
+
+// Session is a login of a user on a device, the refresh token of the session is never exposed
+type Session struct {
+	SessionID  string    `json:"session_id"`
+	DeviceName string    `json:"device_name"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current" db:"-"`
+}
+
+// security relevant event of an account like a failed login, with the client it came from
+type SecurityEvent struct {
+	EventID   string    `json:"event_id"`
+	EventType string    `json:"event_type"`
+	SessionID *string   `json:"session_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Details   string    `json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// personal access token of a user for scripts, the token itself is only returned once when it is created
+type AccessToken struct {
+	TokenID string `json:"token_id"`
+	Name    string `json:"name"`
+	// start of the token so users can tell their tokens apart
+	TokenPrefix string   `json:"token_prefix"`
+	Scopes      []string `json:"scopes"`
+	// passbooks the token is restricted to, null for all passbooks
+	PassbookIDs []string   `json:"passbook_ids"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// account of a user at an OpenID Connect provider the user can log in with
+type Identity struct {
+	IdentityID string `json:"identity_id"`
+	Issuer     string `json:"issuer"`
+	Subject    string `json:"subject"`
+	// email the provider shared when the identity was linked
+	Email       string     `json:"email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// how amounts and dates are formatted for a user, the supported values are listed by the locale package
+type Preferences struct {
+	Currency   string `json:"currency"`
+	TimeZone   string `json:"time_zone"`
+	Locale     string `json:"locale"`
+	DateFormat string `json:"date_format"`
 }
 type Passbook struct {
 	PassbookID    string    `json:"passbook_id"`
 	UserID        string    `json:"user_id"`
 	BankName      string    `json:"bank_name"`
 	AccountNumber string    `json:"account_number"`
-	TotalBalance  float64   `json:"total_balance"`
+	TotalBalance  Money     `json:"total_balance"`
 	Nickname      string    `json:"nickname"`
+	Currency      string    `json:"currency"`
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
 }
 type Transaction struct {
-	TransactionID   string    `json:"transaction_id"`
-	Amount          float64   `json:"amount"`
-	TransactionDate time.Time `json:"transaction_date"`
-	TransactionType string    `json:"transaction_type"`
-	PartyName       string    `json:"party_name"`
-	Description     string    `json:"description"`
-	CreatedAt       time.Time `json:"created_at"`
-	UpdatedAt       time.Time `json:"updated_at"`
-	Tags            string    `json:"tags"`
-	PassbookID      string    `json:"passbook_id"`
-	UserID          string    `json:"user_id"`
+	TransactionID   string     `json:"transaction_id"`
+	Amount          Money      `json:"amount"`
+	TransactionDate time.Time  `json:"transaction_date"`
+	TransactionType string     `json:"transaction_type"`
+	PartyName       string     `json:"party_name"`
+	Description     string     `json:"description"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	Tags            string     `json:"tags"`
+	PassbookID      string     `json:"passbook_id"`
+	UserID          string     `json:"user_id"`
+	TransferID      *string    `json:"transfer_id,omitempty"`
+	ExternalID      string     `json:"external_id,omitempty"`
+	DeletedAt       *time.Time `json:"deleted_at,omitempty"`
+}
+
+// ExchangeRate is the number of units of the quote currency for one unit of the base currency, from its date on
+type ExchangeRate struct {
+	RateID        string    `json:"rate_id"`
+	BaseCurrency  string    `json:"base_currency"`
+	QuoteCurrency string    `json:"quote_currency"`
+	RateDate      time.Time `json:"rate_date"`
+	Rate          Rate      `json:"rate"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ImportProfile maps the columns of a bank's CSV statement to transaction fields
+type ImportProfile struct {
+	ProfileID         string    `json:"profile_id"`
+	UserID            string    `json:"user_id"`
+	Name              string    `json:"name"`
+	Delimiter         string    `json:"delimiter"`
+	HasHeader         bool      `json:"has_header"`
+	SkipRows          int       `json:"skip_rows"`
+	DateColumn        string    `json:"date_column"`
+	DateFormat        string    `json:"date_format"`
+	AmountColumn      string    `json:"amount_column"`
+	DebitColumn       string    `json:"debit_column"`
+	CreditColumn      string    `json:"credit_column"`
+	PartyColumn       string    `json:"party_column"`
+	DescriptionColumn string    `json:"description_column"`
+	DecimalSeparator  string    `json:"decimal_separator"`
+	Tags              string    `json:"tags"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
 }
 
 var ValidTransactionTypes = []string{"CREDIT", "DEBIT"}
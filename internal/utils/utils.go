@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"strings"
 
 	"github.com/google/uuid"
@@ -30,3 +34,18 @@ func GenerateUUID() (string, error) {
 	}
 	return uid.String(), nil
 }
+
+// HashToken returns the hex encoded SHA-256 hash of a token, tokens are stored hashed so a leaked table cannot be replayed
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateSecureToken returns a random url safe token with 256 bits of entropy for links sent by email
+func GenerateSecureToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}